@@ -0,0 +1,119 @@
+package apigateproxy
+
+import (
+	"net"
+	"net/http"
+
+	"apigate-proxy/handlers"
+	"apigate-proxy/models"
+	"apigate-proxy/service"
+)
+
+// KeyFunc extracts a key, such as an email or user ID, from a request. An
+// empty result means the request has none.
+type KeyFunc func(r *http.Request) string
+
+// RemoteIP is the address of the directly connected peer, without its port.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Header extracts the value of a request header, e.g. one set by an
+// authenticating gateway.
+func Header(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Cookie extracts the value of a cookie.
+func Cookie(name string) KeyFunc {
+	return func(r *http.Request) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// Context extracts a string stored in the request context under key, e.g.
+// the user ID an authentication middleware running earlier has stored.
+func Context(key any) KeyFunc {
+	return func(r *http.Request) string {
+		v, _ := r.Context().Value(key).(string)
+		return v
+	}
+}
+
+// MiddlewareOptions configures Middleware. The zero value decides requests
+// as the ENFORCE_BACKEND_URL listener does, by source address, User-Agent
+// and fingerprints, answers blocked ones with 403 and queues no logs.
+type MiddlewareOptions struct {
+	IP           KeyFunc      // Source address (default RemoteIP)
+	Identity     KeyFunc      // Email or user ID (default the ENFORCE_IDENTITY_HEADER header)
+	IdentityType string       // "email" or "user_id" (default auto-detected)
+	Blocked      http.Handler // Answers blocked requests (default 403 Forbidden)
+	// Queues a log record of every request with its response code, as
+	// POST /api/log would (nil = no logs)
+	Logger *service.LoggerService
+	// Requests passed on without a decision, e.g. health checks (nil = none)
+	Skip func(r *http.Request) bool
+}
+
+// Middleware wraps an application's handler so every request is decided by
+// svc before it is served. Allowed requests reach the handler with the
+// X-Apigate-* decision headers set (see DECISION_HEADERS); blocked requests
+// never do. When the upstream cannot be reached FAIL_MODE applies, and with
+// FAIL_MODE=unknown requests are passed on with X-Apigate-Decision: unknown
+// for the handler to judge.
+//
+//	r := mux.NewRouter()
+//	...
+//	mw := apigateproxy.Middleware(p.Decisions, apigateproxy.MiddlewareOptions{
+//		Identity: apigateproxy.Header("X-User-Email"),
+//		Logger:   p.Logger,
+//	})
+//	http.ListenAndServe(":3000", mw(r))
+func Middleware(svc *service.ProxyService, opts MiddlewareOptions) func(http.Handler) http.Handler {
+	ip := opts.IP
+	if ip == nil {
+		ip = RemoteIP
+	}
+	return func(next http.Handler) http.Handler {
+		e := handlers.NewEnforcer(svc, next)
+		e.Blocked = opts.Blocked
+		e.Logger = opts.Logger
+		e.Request = func(r *http.Request) models.AllowRequest {
+			req := e.AllowRequest(r)
+			req.IPAddress = ip(r)
+			if opts.Identity != nil {
+				req.Email = opts.Identity(r)
+			}
+			if opts.IdentityType != "" {
+				req.IdentityType = opts.IdentityType
+			}
+			return req
+		}
+		if opts.Skip == nil {
+			return e
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if opts.Skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			e.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Middleware is the package Middleware over p's default services; set
+// opts.Logger to p.Logger to queue logs.
+func (p *Proxy) Middleware(opts MiddlewareOptions) func(http.Handler) http.Handler {
+	return Middleware(p.Decisions, opts)
+}
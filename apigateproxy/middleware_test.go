@@ -0,0 +1,162 @@
+package apigateproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/handlers"
+	"apigate-proxy/internal/upstreamtest"
+	"apigate-proxy/models"
+	"apigate-proxy/service"
+)
+
+type userKey struct{}
+
+func TestKeyFuncs(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "[2001:db8::1]:40000"
+	r.Header.Set("X-User", "alice@example.com")
+	r.AddCookie(&http.Cookie{Name: "uid", Value: "u-42"})
+	r = r.WithContext(context.WithValue(r.Context(), userKey{}, "u-7"))
+
+	cases := []struct {
+		name string
+		key  KeyFunc
+		want string
+	}{
+		{"RemoteIP", RemoteIP, "2001:db8::1"},
+		{"Header", Header("X-User"), "alice@example.com"},
+		{"missing header", Header("X-Other"), ""},
+		{"Cookie", Cookie("uid"), "u-42"},
+		{"missing cookie", Cookie("session"), ""},
+		{"Context", Context(userKey{}), "u-7"},
+		{"missing context value", Context("user"), ""},
+	}
+	for _, c := range cases {
+		if got := c.key(r); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	// A peer address without a port is used as is
+	r.RemoteAddr = "203.0.113.7"
+	if got := RemoteIP(r); got != "203.0.113.7" {
+		t.Errorf("RemoteIP without a port: got %q", got)
+	}
+	// Context values that are not strings are no key
+	r = r.WithContext(context.WithValue(r.Context(), userKey{}, 42))
+	if got := Context(userKey{})(r); got != "" {
+		t.Errorf("Context with a non-string value: got %q", got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var blocked map[string]bool
+	upstream := upstreamtest.New(t, func(key string) models.BatchAllowResponseItem {
+		return models.BatchAllowResponseItem{Key: key, Allow: !blocked[key]}
+	})
+	svc := service.NewProxyService(&config.Config{
+		UpstreamBaseURL: upstream.URL,
+		WarmupAction:    service.WarmupLive,
+	}, nil, nil)
+	badUser, _ := svc.IdentityKey("mallory@example.com", "")
+	blocked = map[string]bool{"6.6.6.6": true, "7.7.7.7": true, badUser: true}
+
+	var reached bool
+	var decision string
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		decision = r.Header.Get(handlers.HeaderDecision)
+	})
+	mw := Middleware(svc, MiddlewareOptions{
+		Identity: Cookie("user"),
+		Skip:     func(r *http.Request) bool { return r.URL.Path == "/healthz" },
+	})(app)
+	serve := func(h http.Handler, path, peer, user string, headers map[string]string) int {
+		reached, decision = false, ""
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = peer + ":40000"
+		if user != "" {
+			r.AddCookie(&http.Cookie{Name: "user", Value: user})
+		}
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if code := serve(mw, "/orders", "1.1.1.1", "alice@example.com", nil); code != http.StatusOK || !reached || decision != "allow" {
+		t.Errorf("Expected an allowed request served with its decision, got %d, reached %v, decision %q", code, reached, decision)
+	}
+	if code := serve(mw, "/orders", "6.6.6.6", "", nil); code != http.StatusForbidden || reached {
+		t.Errorf("Expected a blocked address refused, got %d, reached %v", code, reached)
+	}
+	if code := serve(mw, "/orders", "1.1.1.1", "mallory@example.com", nil); code != http.StatusForbidden || reached {
+		t.Errorf("Expected a blocked identity from the cookie refused, got %d, reached %v", code, reached)
+	}
+	if code := serve(mw, "/healthz", "6.6.6.6", "", nil); code != http.StatusOK || !reached {
+		t.Errorf("Expected skipped requests served undecided, got %d", code)
+	}
+	if !upstream.Asked(badUser) {
+		t.Errorf("Expected the identity checked as %q", badUser)
+	}
+
+	// The address can come from elsewhere, and blocked requests can get
+	// another answer
+	custom := Middleware(svc, MiddlewareOptions{
+		IP: Header("X-Client-IP"),
+		Blocked: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}),
+	})(app)
+	if code := serve(custom, "/orders", "1.1.1.1", "", map[string]string{"X-Client-IP": "7.7.7.7"}); code != http.StatusTeapot || reached {
+		t.Errorf("Expected the header's address decided and Blocked used, got %d", code)
+	}
+	if code := serve(custom, "/orders", "6.6.6.6", "", map[string]string{"X-Client-IP": "1.1.1.1"}); code != http.StatusOK || !reached {
+		t.Errorf("Expected the peer address ignored, got %d", code)
+	}
+}
+
+func TestMiddleware_FailMode(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll, func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	})
+
+	for _, c := range []struct {
+		failMode string
+		code     int
+		decision string
+	}{
+		{service.FailOpen, http.StatusOK, "allow"},
+		{service.FailClosed, http.StatusForbidden, ""},
+		// Passed on for the application to judge
+		{service.FailUnknown, http.StatusOK, "unknown"},
+	} {
+		p := New(&config.Config{
+			UpstreamBaseURL: upstream.URL,
+			WarmupAction:    service.WarmupLive,
+			FailMode:        c.failMode,
+		})
+		var reached bool
+		var decision string
+		h := p.Middleware(MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reached = true
+			decision = r.Header.Get(handlers.HeaderDecision)
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		r.RemoteAddr = "1.1.1.1:40000"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != c.code || reached != (c.code == http.StatusOK) || decision != c.decision {
+			t.Errorf("FAIL_MODE=%s: got %d, reached %v with decision %q; want %d with %q",
+				c.failMode, rec.Code, reached, decision, c.code, c.decision)
+		}
+		p.Stop(context.Background())
+	}
+}
@@ -0,0 +1,148 @@
+// Package apigateproxy embeds the proxy in another Go program. New builds the
+// decision cache, log buffer and per-tenant services described by a Config,
+// and the HTTP API the proxy binary serves over them; the program chooses
+// how to listen, or calls the services in-process without HTTP:
+//
+//	cfg := config.LoadConfig() // or a Config built in code
+//	p := apigateproxy.New(cfg)
+//	p.Start()
+//	defer p.Stop(context.Background())
+//
+//	mux.Handle("/apigate/", http.StripPrefix("/apigate", p.Handler()))
+//	resp, err := p.Decisions.Check(ctx, models.AllowRequest{IPAddress: ip})
+package apigateproxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+
+	"apigate-proxy/config"
+	"apigate-proxy/handlers"
+	apigatev1 "apigate-proxy/proto/apigate/v1"
+	"apigate-proxy/service"
+	"apigate-proxy/storage"
+)
+
+// Proxy is a configured proxy: its services and the APIs over them.
+type Proxy struct {
+	Config    *config.Config
+	Decisions *service.ProxyService  // Default tenant's decisions
+	Logger    *service.LoggerService // Default tenant's log buffer
+	Tenants   *service.Tenants       // Routes requests to TENANTS_FILE tenants
+	// Admin actions taken through Handler (ADMIN_AUDIT_FILE)
+	AdminAudit *service.AdminAudit
+
+	store    storage.Storage       // STORAGE_BACKEND of every service
+	limiter  *handlers.RateLimiter // Shared by the HTTP and gRPC APIs
+	reporter *service.Reporter     // REPORT_INTERVAL usage reports
+	handler  http.Handler
+}
+
+// New builds the services described by cfg and the HTTP API over them.
+// Nothing runs in the background until Start.
+func New(cfg *config.Config) *Proxy {
+	store := service.OpenStorage(cfg)
+	svc := service.NewProxyService(cfg, nil, store)
+	logger := service.NewLoggerService(cfg, svc.UpstreamClient(), store)
+	logger.EnrichFrom(svc)
+	p := &Proxy{
+		Config:     cfg,
+		Decisions:  svc,
+		Logger:     logger,
+		Tenants:    service.NewTenants(cfg, svc, logger),
+		AdminAudit: service.NewAdminAudit(cfg, logger),
+		store:      store,
+		limiter:    handlers.NewRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst),
+		reporter:   service.NewReporter(cfg, svc),
+	}
+	p.handler = p.router()
+	return p
+}
+
+// Start starts the background work of every service: window prefetches, log
+// delivery and usage reports.
+func (p *Proxy) Start() {
+	p.Decisions.Start()
+	p.reporter.Start()
+	p.Logger.Start()
+	p.Tenants.Start()
+}
+
+// Stop ends the background work, waiting for prefetches in flight until ctx
+// is done (see ProxyService.Stop) and for log sends and reports in flight,
+// flushes the log buffers and closes the storage backend and the admin audit
+// file. Stop the listeners serving Handler first.
+func (p *Proxy) Stop(ctx context.Context) error {
+	err := p.Decisions.Stop(ctx)
+	p.reporter.Stop()
+	p.Logger.Stop()
+	if terr := p.Tenants.Stop(ctx); terr != nil && err == nil {
+		err = terr
+	}
+	if aerr := p.AdminAudit.Close(); aerr != nil && err == nil {
+		err = aerr
+	}
+	service.CloseStorage(p.store)
+	return err
+}
+
+// Handler returns the HTTP API: every route under /v1 and its legacy alias,
+// /readyz and /openapi.json.
+func (p *Proxy) Handler() http.Handler {
+	return p.handler
+}
+
+// GRPCServer returns a gRPC server offering apigate.v1.DecisionService,
+// authenticated and rate limited like the HTTP API.
+func (p *Proxy) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.UnaryInterceptor(handlers.GRPCInterceptor(p.Config.ClientAPIKeys, p.limiter)))
+	s := grpc.NewServer(opts...)
+	apigatev1.RegisterDecisionServiceServer(s, handlers.NewGRPCServer(p.Decisions, p.Logger))
+	return s
+}
+
+func (p *Proxy) router() http.Handler {
+	cfg := p.Config
+	proxyHandler := handlers.NewProxyHandler(p.Decisions, p.Tenants)
+	proxyHandler.AdminAudit = p.AdminAudit
+	loggerHandler := handlers.NewLoggerHandler(p.Logger, p.Tenants)
+
+	r := mux.NewRouter()
+	// Every API route is served under /v1 and at its legacy unversioned path
+	route := func(path string, h http.Handler, method string) {
+		r.Handle(handlers.V1Path(path), h).Methods(method)
+		r.Handle(path, h).Methods(method)
+	}
+	requireKey := handlers.APIKeyAuth(p.Tenants.ClientAPIKeys(cfg))
+	limit := p.limiter.Middleware
+	isolate := handlers.NewBulkhead(cfg, p.Tenants).Middleware
+	ipGuard := handlers.NewIPGuard(cfg)
+	guard := ipGuard.Middleware
+	route("/api/allow", guard(requireKey(limit(isolate(http.HandlerFunc(proxyHandler.AllowDecisionHandler))))), "POST")
+	route("/api/encrypt-email", guard(limit(http.HandlerFunc(proxyHandler.EncryptEmailHandler))), "GET")
+	route("/api/encrypt-email", guard(limit(http.HandlerFunc(proxyHandler.EncryptEmailHandler))), "POST")
+	route("/api/encrypt-email/batch", guard(limit(http.HandlerFunc(proxyHandler.EncryptEmailBatchHandler))), "POST")
+	route("/api/jobs/{id}", guard(requireKey(limit(http.HandlerFunc(proxyHandler.JobHandler)))), "GET")
+	requireAdmin := handlers.AdminKeyAuth(cfg.AdminAPIKeys)
+	route("/api/decrypt-email", requireAdmin(http.HandlerFunc(proxyHandler.DecryptEmailHandler)), "POST")
+	route("/api/debug/decisions/{id}", requireAdmin(http.HandlerFunc(proxyHandler.DebugDecisionHandler)), "GET")
+	route("/admin/rules/validate", requireAdmin(http.HandlerFunc(proxyHandler.ValidateRulesHandler)), "POST")
+	route("/admin/state", requireAdmin(http.HandlerFunc(proxyHandler.StateHandler)), "GET")
+	route("/admin/invalidate", requireAdmin(http.HandlerFunc(proxyHandler.InvalidateHandler)), "POST")
+	route("/admin/audit", requireAdmin(http.HandlerFunc(proxyHandler.AdminAuditHandler)), "GET")
+	r.HandleFunc("/readyz", proxyHandler.ReadyHandler).Methods("GET")
+	r.Handle("/openapi.json", handlers.OpenAPIHandler(cfg)).Methods("GET")
+	route("/api/stats", requireKey(http.HandlerFunc(proxyHandler.StatsHandler)), "GET")
+	route("/api/upstream/status", requireKey(http.HandlerFunc(proxyHandler.UpstreamStatusHandler)), "GET")
+	route("/api/audit/decisions", requireAdmin(http.HandlerFunc(proxyHandler.AuditHandler)), "GET")
+	route("/api/events", requireKey(http.HandlerFunc(proxyHandler.EventsHandler)), "GET")
+	route("/api/log/stats", requireKey(http.HandlerFunc(loggerHandler.StatsHandler)), "GET")
+	route("/api/log/dlq", requireAdmin(http.HandlerFunc(loggerHandler.DeadLettersHandler)), "GET")
+	route("/api/log/dlq/redrive", requireAdmin(http.HandlerFunc(loggerHandler.RedriveHandler)), "POST")
+	route("/api/log", guard(requireKey(limit(isolate(http.HandlerFunc(loggerHandler.LogRequestHandler))))), "POST")
+	route("/api/ip-guard/stats", requireKey(http.HandlerFunc(ipGuard.StatsHandler)), "GET")
+	return r
+}
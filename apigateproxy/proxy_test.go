@@ -0,0 +1,71 @@
+package apigateproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"apigate-proxy/config"
+)
+
+// serve sends a request with the API key key (none if empty) to p's HTTP API.
+func serve(p *Proxy, method, path, key string) int {
+	r := httptest.NewRequest(method, path, nil)
+	if key != "" {
+		r.Header.Set("X-API-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	p.Handler().ServeHTTP(rec, r)
+	return rec.Code
+}
+
+func TestProxy_AdminRoutes(t *testing.T) {
+	p := New(&config.Config{
+		UpstreamBaseURL: "http://127.0.0.1:0",
+		LogDLQDir:       t.TempDir(),
+		AuditStoreSize:  10,
+		AdminAPIKeys:    []string{"admin-secret"},
+	})
+	t.Cleanup(func() { p.Stop(context.Background()) })
+
+	// Without CLIENT_API_KEYS client routes are open, admin ones are not
+	for _, c := range []struct{ method, path string }{
+		{http.MethodGet, "/api/log/dlq"},
+		{http.MethodPost, "/api/log/dlq/redrive"},
+		{http.MethodGet, "/v1/log/dlq"},
+		{http.MethodGet, "/api/audit/decisions"},
+	} {
+		if code := serve(p, c.method, c.path, ""); code != http.StatusUnauthorized {
+			t.Errorf("%s %s without a key: got %d, want 401", c.method, c.path, code)
+		}
+		if code := serve(p, c.method, c.path, "admin-secret"); code != http.StatusOK {
+			t.Errorf("%s %s with an admin key: got %d, want 200", c.method, c.path, code)
+		}
+	}
+}
+
+func TestProxy_JobRoute(t *testing.T) {
+	p := New(&config.Config{
+		UpstreamBaseURL: "http://127.0.0.1:0",
+		ClientAPIKeys:   []string{"client-secret"},
+	})
+	t.Cleanup(func() { p.Stop(context.Background()) })
+	job, err := p.Decisions.SubmitEncryptJob([]string{"alice@example.com", "bob@example.com"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Job results identify users: reading them takes a client key
+	for _, path := range []string{"/api/jobs/" + job.ID, "/v1/jobs/" + job.ID} {
+		if code := serve(p, http.MethodGet, path, ""); code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a key: got %d, want 401", path, code)
+		}
+		if code := serve(p, http.MethodGet, path, "client-secret"); code != http.StatusOK {
+			t.Errorf("GET %s with a client key: got %d, want 200", path, code)
+		}
+	}
+	if code := serve(p, http.MethodGet, "/api/jobs/missing", "client-secret"); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown job not found, got %d", code)
+	}
+}
@@ -0,0 +1,7 @@
+"""gRPC client stubs for the APIGate proxy, generated by `make clients`."""
+import os
+import sys
+
+# The generated modules import each other as top-level `apigate.v1`, so make
+# them resolvable from inside this package.
+sys.path.insert(0, os.path.dirname(__file__))
@@ -0,0 +1,2 @@
+// Generated by `make clients` from proto/apigate/v1.
+export * from "./gen/apigate/v1/apigate";
@@ -1,29 +1,266 @@
 package config
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+
+	"apigate-proxy/utils"
 )
 
 type Config struct {
 	ServerPort             string
-	UpstreamBaseURL        string
+	GRPCPort               string   // Optional gRPC listener (empty = disabled)
+	UpstreamBaseURL        string   // First configured upstream, kept for logging
+	UpstreamBaseURLs       []string // All upstreams, in failover order
+	UpstreamHealthPath     string
+	UpstreamProtocol       string // "http" (default) or "grpc"
+	UpstreamGRPCAddr       string // gRPC target, e.g. "api.apigate.in:443"
+	UpstreamGRPCInsecure   bool   // Plaintext gRPC (for local/sidecar upstreams)
+	UpstreamHealthInterval int    // Seconds
+	UpstreamMaxIdlePerHost int    // Idle keep-alive connections kept per upstream host
+	UpstreamIdleTimeoutSec int    // How long idle upstream connections are kept
+	UpstreamDialTimeoutSec int    // TCP connect timeout
+	UpstreamTLSTimeoutSec  int    // TLS handshake timeout
+	UpstreamHTTP2          bool   // Negotiate HTTP/2 with TLS upstreams
 	WindowSeconds          int
-	LogFlushInterval       int // Seconds
+	WindowSecondsByType    map[string]int // Per key type refresh windows, e.g. {"ip": 300, "email": 30}
+	MaxWindowKeys          int            // Cap on unique keys tracked for prefetch per window (0 = unlimited)
+	PrefetchWorkers        int            // Goroutines decoding large prefetch responses (0 = NumCPU)
+	PrefetchChunkSize      int            // Keys per upstream prefetch request (0 = one request)
+	PrefetchChunkDelayMs   int            // Pause between prefetch chunks to rate-limit the upstream
+	PrefetchConcurrency    int            // Prefetch chunks in flight at once (default 1)
+	PrefetchDelta          bool           // Refresh cached keys from the upstream's change feed
+	UpstreamStreaming      bool           // Ask the upstream for NDJSON batch responses
+	DecisionMemoTTLMs      int            // Memoize exact-duplicate AllowRequests for this long (0 = off)
+	IdempotencyTTLSeconds  int            // How long Idempotency-Key decisions are replayed (0 = off)
+	TupleCacheTTLMs        int            // Cache combined decisions per full key tuple (0 = off)
+	LiveCheckBudgetMs      int            // Answer provisionally when a live check takes longer (0 = wait)
+	UpstreamDailyKeyBudget int            // Keys sent upstream per UTC day before alerting (0 = unlimited)
+	BudgetAlertPercent     int            // Share of the budget that raises the first alert (default 80)
+	BudgetDegradeFactor    int            // Stretch windows by this factor past the alert threshold (0 = off)
+	CallbackAllowedHosts   []string       // Hosts that may receive deferred decision callbacks
+	CallbackSecret         string         // HMAC-SHA256 key signing callback bodies
+	WarmStart              bool           // Load an upstream decision snapshot at boot instead of allowing everything
+	WarmStartLimit         int            // Max snapshot decisions to load (0 = all)
+	ReadyWhenWarm          bool           // Keep /readyz failing until the cache is warm
+	ReadyWhenUpstream      bool           // Fail /readyz while every upstream fails its health check
+	WarmupSeconds          int            // Warmup length (0 = until the first window swap)
+	WarmupAction           string         // Answer during warmup: "allow" (default), "block" or "live" (no warmup)
+	WarmupPersist          bool           // Persist decisions at each swap and load them at boot to skip warmup
+	ShutdownDrainSeconds   int            // Fail /readyz this long before shutting down
+	CacheControlAllow      string         // Cache-Control sent with allow decisions (empty = none)
+	CacheControlBlock      string         // Cache-Control sent with block decisions, e.g. "public, max-age=5"
+	DecisionHeaders        bool           // Return X-Apigate-* decision/tracing headers for backends
+	ShadowMode             bool           // Evaluate and record decisions but never block (would_block instead)
+	AuditStoreSize         int            // Recent decisions kept for audit queries (0 = disabled)
+	AuditMaxResults        int            // Cap on records returned per audit query
+	DebugStoreTTLSeconds   int            // Retention of sampled decision debug records (0 = disabled)
+	DebugSampleRate        float64        // Fraction of allow decisions sampled into the debug store (blocks always are)
+	EncryptAsyncThreshold  int            // Encrypt batches larger than this run as async jobs
+	EncryptJobWorkers      int            // Workers processing async encrypt jobs
+	EncryptJobTTLSeconds   int            // How long finished encrypt jobs can be fetched
+	ReadReplica            bool           // Never call the upstream; serve decisions from published snapshots only
+	ReplicaSnapshot        string         // Snapshot file path or http(s) URL for read replicas
+	ReplicaUnknownAction   string         // "allow" (default) or "block" for keys missing from the snapshot
+	CacheStalePolicy       string         // "drop" (default) or "retain" the cache when a window has no prefetch
+	FailMode               string         // Answer when a live check fails: "open" (default), "closed" or "unknown"
+	FailSwitchBelow        float64        // Upstream availability (0-1) below which FailSwitchTo applies (0 = never)
+	FailSwitchTo           string         // Fail mode used while availability is low
+	FailSwitchSeconds      int            // How long a switched fail mode lasts
+	FailSwitchWindowSecs   int            // Sliding window over which availability is measured
+	BreakerFailures        int            // Consecutive upstream failures that open the circuit breaker (0 = no breaker)
+	BreakerOpenSeconds     int            // How long an open breaker refuses upstream calls before a trial call
+	CacheMaxStaleSeconds   int            // Oldest prefetch a retained cache may date from (0 = no limit)
+	CacheAllowTTLSeconds   int            // Lifetime of cached allow decisions (0 = until the window swaps)
+	CacheBlockTTLSeconds   int            // Lifetime of cached block decisions (0 = until the window swaps)
+	LogFlushInterval       int            // Seconds
 	LogBatchSize           int
+	LogMaxBuffer           int                // Max records buffered or in flight (0 = unbounded)
+	LogOverflowPolicy      string             // "drop-oldest" (default), "drop-newest" or "block"
+	LogBlockTimeoutMs      int                // How long "block" waits for space before dropping
+	LogSpillDir            string             // Write-ahead spool for undeliverable/overflowing logs (empty = disabled)
+	LogDLQDir              string             // Dead-letter queue for batches that exhausted their retries (empty = disabled)
+	LogMaxAttempts         int                // Spool replay attempts before a segment is dead-lettered
+	LogSinks               []string           // "upstream" (default) and/or "kafka"
+	LogAggregateEventTypes []string           // Event types rolled up per flush interval ("*" = all; empty = off)
+	LogRawEventTypes       []string           // Event types always sent raw, even when matched by "*"
+	LogSampleRates         map[string]float64 // Share of successful records kept, by HTTP method or "*" (empty = all)
+	KafkaBrokers           []string
+	KafkaTopic             string
+	KafkaBatchSize         int
+	KafkaBatchTimeoutMs    int
+	SyslogAddr             string // host:port of an RFC 5424 syslog server
+	SyslogNetwork          string // "udp" (default), "tcp" or "tls"
+	SyslogAppName          string
+
+	// Redaction of personal data in log records before they are buffered
+	LogRedact        map[string]string // Field ("ip_address", "username", "user_agent", "email") -> "hash", "mask" or "drop"
+	LogRedactRegions []string          // Country or continent codes of the records redacted (empty = all)
+	LogRedactKey     string            // HMAC key of hashed fields (empty = subkey of EmailEncryptionKey, with EmailKeyID)
+
+	// Per-source-IP protection of /api/allow, /api/log and /api/encrypt-email
+	IPLimitRPS      float64 // Requests per second per source IP (0 = unlimited)
+	IPLimitBurst    int
+	IPBanStrikes    int // Rejections within IPBanWindowSecs that ban the source (0 = never ban)
+	IPBanWindowSecs int
+	IPBanSeconds    int // Cooldown before a banned source is served again
+
+	// Load balancers and proxies whose X-Forwarded-For, X-Real-IP and
+	// Forwarded headers name the client when a body has no ip_address
+	TrustedProxies []netip.Prefix
+	// Use the connection's source address when a body has no ip_address and no
+	// trusted proxy names the client
+	ClientIPFromRemoteAddr bool
+
+	// Tarpit: blocked requests are answered after a random delay between
+	// TarpitMinMs and TarpitMaxMs, to slow bots down (0 = off)
+	TarpitMinMs   int
+	TarpitMaxMs   int
+	TarpitMaxHeld int // Requests delayed at once; further blocks are answered at once
+
+	// Local velocity limits: requests per key counted on this instance, over
+	// a sliding window, independent of upstream decisions (empty = off)
+	QuotaRules   []QuotaRule
+	QuotaAction  string // "block" (default) or "flag" keys over a limit
+	QuotaMaxKeys int    // Keys counted per rule; further keys are not limited
+
+	// Sharing live-check decisions with peer instances (empty GossipBind = disabled)
+	GossipBind   string   // UDP listen address, e.g. ":7946"
+	GossipPeers  []string // host:port of the other instances
+	GossipSecret string   // Shared HMAC key; messages without a valid MAC are dropped
+
+	// Prefetching on one elected instance per STORAGE_BACKEND
+	LeaderElection  bool
+	LeaderLeaseSecs int // Lease length (0 = two windows)
+
+	// Upstream call timeouts, by kind of call
+	LiveCheckTimeoutMs  int // A cache miss's batch lookup
+	PrefetchTimeoutSecs int // Each prefetch chunk, warm start and change-feed read
+	LogFlushTimeoutSecs int // Each log batch delivered upstream
+
+	// Keys read from vault:// or awssm:// references (nil = set in plain text)
+	UpstreamAPIKeySecret *Secret
+	EmailKeySecret       *Secret
+	EmailSecondarySecret *Secret
+	SecretRefreshSecs    int // How often they are read again (0 = only at boot)
+
+	// Inline enforcement: reverse-proxy traffic to a backend, refusing blocked requests (empty EnforceBackendURL = disabled)
+	EnforceBackendURL     string // e.g. http://app:3000
+	EnforcePort           string // Listener for the proxied traffic (default 8090)
+	EnforceIdentityHeader string // Request header carrying the email or user ID, e.g. X-User-Email
+
+	// Audit trail of admin actions (GET /admin/audit)
+	AdminAuditFile     string // Append-only JSON lines file (empty = recent actions in memory only)
+	AdminAuditUpstream bool   // Also send actions upstream as log records
+
+	// Profiling and runtime metrics listener, e.g. "127.0.0.1:6060" (empty = disabled)
+	DebugAddr string
+
+	// The proxy's own log output
+	LogLevel  string // "debug", "info" (default), "warn" or "error"
+	LogFormat string // "text" (default) or "json"
+
+	// Redis channel the upstream publishes decision changes on (empty = POST /admin/invalidate only)
+	InvalidationChannel string
+
+	// Combining per-key decisions when keys disagree
+	DecisionCombine string             // "any_block" (default), "precedence" or "weighted"
+	KeyPrecedence   []string           // Key types from strongest to weakest, for "precedence"
+	KeyWeights      map[string]float64 // Weight per key type (default 1), for "weighted"
+
+	// Object storage archive sink (S3 or GCS interoperability API)
+	ArchiveEndpoint        string // e.g. https://s3.us-east-1.amazonaws.com or https://storage.googleapis.com
+	ArchiveBucket          string
+	ArchiveRegion          string
+	ArchivePrefix          string
+	ArchivePartition       string // "hour" (default), "date" or "none"
+	ArchiveAccessKey       string
+	ArchiveSecretKey       string
 	UpstreamAPIKey         string
+	ClientAPIKeys          []string          // Keys accepted on the proxy's own endpoints (empty = open)
+	AdminAPIKeys           []string          // Keys accepted on admin endpoints (empty = admin endpoints disabled)
+	ResponseProfiles       map[string]string // Client API key -> response profile: "full", "decision" or "minimal"
+	DefaultResponseProfile string            // Profile of callers without one in ResponseProfiles (default "full")
+	RateLimitRPS           float64           // Per-client requests per second (0 = unlimited)
+	RateLimitBurst         int
+	TenantMaxInFlight      int // Concurrent /api/allow and /api/log requests per tenant (0 = unlimited)
 	EmailEncryptionKey     string
+	EmailSecondaryKey      string // Previous key, also looked up during rotation
+	EmailKeyID             string // Short ID of EmailEncryptionKey; set = HKDF subkeys and "<id>$" prefixes
+	EmailSecondaryKeyID    string // Short ID of EmailSecondaryKey (empty = it made unprefixed values)
 	EmailEncryptionEnabled bool
-	EmailEncryptionFormat  string
+	EmailEncryptionFormat  string // Hash encoding (utils.HashFormat*): "hex" (default), "base64url" or "numeric"
+	EmailEncryptionLength  int    // Hash length in characters (0 = 32 hex, 22 base64url or the 16-byte integer)
+	EmailEncryptionAlgo    string // Keyed hash (utils.Hash*); empty = legacy unprefixed HMAC-SHA256
+	EmailEncryptionMode    string // "hash" (default, one-way) or "reversible" (AES-GCM)
+	ClientCertHeader       string // Header carrying the client cert fingerprint from an mTLS terminator
+	JA3Header              string // Header carrying the JA3 hash from an upstream TLS terminator
+	TLSCertFile            string
+	TLSKeyFile             string
+	TLSClientCAFile        string // CA bundle for verifying client certificates
+	TLSClientAuth          string // "none", "request", "verify-if-given" or "require"
+	HTTPPort               string // Plain HTTP listener alongside TLS (empty = none)
+	HTTPMode               string // "redirect" (default) or "reject" plain HTTP requests
+	GeoIPDBPath            string // MaxMind GeoLite2/GeoIP2 Country or City database
+	ASNDBPath              string // MaxMind GeoLite2/GeoIP2 ASN database
+
+	// Persistence backend shared by stateful features
+	StorageBackend       string // "memory" (default), "file", "bbolt" or "redis"
+	StoragePath          string // Data file for the file backend
+	StorageRedisAddr     string // host:port
+	StorageRedisPassword string
+	StorageRedisDB       int
+	StorageRedisPrefix   string // Key prefix, default "apigate:"
+
+	// Scheduled usage reports
+	ReportInterval     string // "daily", "weekly" or a duration (empty = disabled)
+	ReportFormat       string // "json" or "html"
+	ReportTopN         int
+	ReportWebhookURL   string
+	ReportSMTPAddr     string // host:port
+	ReportSMTPUsername string
+	ReportSMTPPassword string
+	ReportSMTPFrom     string
+	ReportSMTPTo       []string
+
+	// Static local rules as "type:value" entries (e.g. "ip:10.0.0.1", "email:a@b.com")
+	RulesAllow []string
+	RulesDeny  []string
+	RulesFile  string
+
+	// Multi-tenant operation (TENANTS_FILE); empty = single tenant
+	Tenants      map[string]Tenant
+	TenantHeader string // Header carrying the tenant ID, default X-Tenant-ID
+}
+
+// QuotaRule limits the requests of each key of one type, e.g. 100 per minute
+// per IP address.
+type QuotaRule struct {
+	KeyType string // "ip", "email" or "user_id"
+	Limit   int
+	Window  time.Duration
+}
+
+// RulesFileContent is the JSON layout of RULES_FILE.
+type RulesFileContent struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
 }
 
 func LoadConfig() *Config {
 	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using defaults/environment variables")
+	envErr := godotenv.Load()
+	logLevel, logFormat := configureLogging()
+	if envErr != nil {
+		configLog().Info("no .env file found, using defaults and environment variables")
 	}
 
 	// Defaults
@@ -32,7 +269,48 @@ func LoadConfig() *Config {
 	windowSecs := 20
 	logFlush := 10 // Default flush every 10s
 	logBatch := 50 // Default batch size 50
-	apiKey := ""
+	logMaxBuffer := 0
+	logOverflow := "drop-oldest"
+	logBlockTimeout := 100
+	kafkaBatchSize := 100
+	kafkaBatchTimeout := 10
+	syslogNetwork := "udp"
+	syslogAppName := "apigate-proxy"
+	archiveRegion := "us-east-1"
+	archivePartition := "hour"
+	prefetchWorkers := 0
+	prefetchChunkSize := 0
+	prefetchChunkDelay := 0
+	prefetchChunkConcurrency := 1
+	memoTTL := 0
+	warmStartLimit := 0
+	drainSecs := 0
+	rateLimitRPS := 0.0
+	rateLimitBurst := 0
+	tenantMaxInFlight := 0
+	ipLimitRPS := 0.0
+	ipLimitBurst := 0
+	ipBanStrikes := 0
+	ipBanWindow := 60
+	ipBanSeconds := 300
+	leaderLease := 0
+	liveCheckTimeout := 1000
+	prefetchTimeout := 30
+	logFlushTimeout := 10
+	auditStoreSize := 0
+	auditMaxResults := 1000
+	debugStoreTTL := 0
+	cacheMaxStale := 0
+	cacheAllowTTL := 0
+	cacheBlockTTL := 0
+	warmupSeconds := 0
+	debugSampleRate := 0.01
+	encryptAsyncThreshold := 1000
+	encryptJobWorkers := 4
+	encryptJobTTL := 3600
+	reportTopN := 10
+	healthPath := "/health"
+	healthInterval := 10
 
 	if p := os.Getenv("PORT"); p != "" {
 		port = p
@@ -40,39 +318,461 @@ func LoadConfig() *Config {
 	if u := os.Getenv("UPSTREAM_BASE_URL"); u != "" {
 		upstreamURL = u
 	}
-	if w := os.Getenv("WINDOW_SECONDS"); w != "" {
-		if val, err := strconv.Atoi(w); err == nil {
-			windowSecs = val
+	var upstreamURLs []string
+	for _, u := range splitList(upstreamURL) {
+		upstreamURLs = append(upstreamURLs, strings.TrimRight(u, "/"))
+	}
+	if len(upstreamURLs) == 0 {
+		upstreamURLs = []string{"http://localhost:8000"}
+	}
+	if h := os.Getenv("UPSTREAM_HEALTH_PATH"); h != "" {
+		healthPath = h
+	}
+	envInt("UPSTREAM_HEALTH_INTERVAL", &healthInterval)
+	envInt("WINDOW_SECONDS", &windowSecs)
+	envInt("PREFETCH_WORKERS", &prefetchWorkers)
+	envInt("PREFETCH_CHUNK_SIZE", &prefetchChunkSize)
+	envInt("PREFETCH_CHUNK_DELAY_MS", &prefetchChunkDelay)
+	envIntAtLeast("PREFETCH_CHUNK_CONCURRENCY", &prefetchChunkConcurrency, 1)
+	envInt("WARM_START_LIMIT", &warmStartLimit)
+	envInt("SHUTDOWN_DRAIN_SECONDS", &drainSecs)
+	envInt("DECISION_MEMO_TTL_MS", &memoTTL)
+	envFloat("RATE_LIMIT_RPS", &rateLimitRPS)
+	envInt("RATE_LIMIT_BURST", &rateLimitBurst)
+	envIntAtLeast("REPORT_TOP_N", &reportTopN, 0)
+	envInt("LOG_FLUSH_INTERVAL", &logFlush)
+	envInt("LOG_BATCH_SIZE", &logBatch)
+	envInt("LOG_MAX_BUFFER", &logMaxBuffer)
+	if p := os.Getenv("LOG_OVERFLOW_POLICY"); p != "" {
+		logOverflow = strings.ToLower(p)
+	}
+	envInt("LOG_BLOCK_TIMEOUT_MS", &logBlockTimeout)
+	logMaxAttempts := 30
+	envInt("LOG_MAX_ATTEMPTS", &logMaxAttempts)
+	envInt("KAFKA_BATCH_SIZE", &kafkaBatchSize)
+	envInt("KAFKA_BATCH_TIMEOUT_MS", &kafkaBatchTimeout)
+	envInt("TENANT_MAX_IN_FLIGHT", &tenantMaxInFlight)
+	envFloat("IP_LIMIT_RPS", &ipLimitRPS)
+	envInt("IP_LIMIT_BURST", &ipLimitBurst)
+	envInt("IP_BAN_STRIKES", &ipBanStrikes)
+	envIntAtLeast("IP_BAN_WINDOW_SECONDS", &ipBanWindow, 1)
+	envIntAtLeast("IP_BAN_SECONDS", &ipBanSeconds, 1)
+	envIntAtLeast("LEADER_LEASE_SECONDS", &leaderLease, 1)
+	envInt("AUDIT_STORE_SIZE", &auditStoreSize)
+	envInt("AUDIT_MAX_RESULTS", &auditMaxResults)
+	envInt("CACHE_MAX_STALE_SECONDS", &cacheMaxStale)
+	envIntAtLeast("CACHE_ALLOW_TTL_SECONDS", &cacheAllowTTL, 0)
+	envIntAtLeast("CACHE_BLOCK_TTL_SECONDS", &cacheBlockTTL, 0)
+	if w := os.Getenv("WARMUP_SECONDS"); w != "" {
+		if val, err := strconv.Atoi(w); err == nil && val >= 0 {
+			warmupSeconds = val
+		} else {
+			configLog().Warn("ignoring WARMUP_SECONDS: expected a non-negative number of seconds", "value", w)
+		}
+	}
+	warmupAction := strings.ToLower(os.Getenv("WARMUP_ACTION"))
+	switch warmupAction {
+	case "":
+		warmupAction = "allow"
+	case "allow", "block", "live":
+	default:
+		configLog().Warn("ignoring WARMUP_ACTION: expected allow, block or live", "value", warmupAction)
+		warmupAction = "allow"
+	}
+	envInt("DEBUG_STORE_TTL_SECONDS", &debugStoreTTL)
+	envIntAtLeast("ENCRYPT_ASYNC_THRESHOLD", &encryptAsyncThreshold, 0)
+	envIntAtLeast("ENCRYPT_JOB_WORKERS", &encryptJobWorkers, 1)
+	envIntAtLeast("ENCRYPT_JOB_TTL_SECONDS", &encryptJobTTL, 1)
+	if r := os.Getenv("DEBUG_SAMPLE_RATE"); r != "" {
+		if val, err := strconv.ParseFloat(r, 64); err == nil && val >= 0 && val <= 1 {
+			debugSampleRate = val
+		} else {
+			configLog().Warn("ignoring DEBUG_SAMPLE_RATE: expected 0-1", "value", r)
+		}
+	}
+	if n := os.Getenv("SYSLOG_NETWORK"); n != "" {
+		syslogNetwork = strings.ToLower(n)
+	}
+	if a := os.Getenv("SYSLOG_APP_NAME"); a != "" {
+		syslogAppName = a
+	}
+	if r := os.Getenv("LOG_ARCHIVE_REGION"); r != "" {
+		archiveRegion = r
+	}
+	if p := os.Getenv("LOG_ARCHIVE_PARTITION"); p != "" {
+		archivePartition = strings.ToLower(p)
+	}
+	archiveEndpoint := os.Getenv("LOG_ARCHIVE_ENDPOINT")
+	if archiveEndpoint == "" {
+		archiveEndpoint = "https://s3." + archiveRegion + ".amazonaws.com"
+	}
+	maxWindowKeys := 0
+	envInt("MAX_KEYS_PER_WINDOW", &maxWindowKeys)
+	tlsClientAuth := strings.ToLower(os.Getenv("TLS_CLIENT_AUTH"))
+	if tlsClientAuth == "" {
+		tlsClientAuth = "none"
+		if os.Getenv("TLS_CLIENT_CA_FILE") != "" {
+			tlsClientAuth = "require"
+		}
+	}
+	enforceBackend := os.Getenv("ENFORCE_BACKEND_URL")
+	if enforceBackend != "" {
+		if u, err := url.Parse(enforceBackend); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			configLog().Warn("ignoring ENFORCE_BACKEND_URL: expected an http(s) URL", "value", enforceBackend)
+			enforceBackend = ""
+		}
+	}
+	enforcePort := os.Getenv("ENFORCE_PORT")
+	if enforcePort == "" {
+		enforcePort = "8090"
+	}
+	logRedactRegions := splitList(strings.ToUpper(os.Getenv("LOG_REDACT_REGIONS")))
+	if len(logRedactRegions) > 0 && os.Getenv("GEOIP_DB_PATH") == "" {
+		configLog().Warn("LOG_REDACT_REGIONS needs GEOIP_DB_PATH; redacting every record")
+		logRedactRegions = nil
+	}
+	httpMode := strings.ToLower(os.Getenv("HTTP_MODE"))
+	if httpMode == "" {
+		httpMode = "redirect"
+	}
+	tupleTTL := 0
+	envInt("TUPLE_CACHE_TTL_MS", &tupleTTL)
+	idempotencyTTL := 300
+	envInt("IDEMPOTENCY_TTL_SECONDS", &idempotencyTTL)
+	liveCheckBudget := 0
+	envInt("LIVE_CHECK_BUDGET_MS", &liveCheckBudget)
+	tarpitMin := 0
+	envIntAtLeast("TARPIT_MIN_MS", &tarpitMin, 0)
+	tarpitMax := tarpitMin
+	if t := os.Getenv("TARPIT_MAX_MS"); t != "" {
+		if val, err := strconv.Atoi(t); err == nil && val >= tarpitMin {
+			tarpitMax = val
+		} else {
+			configLog().Warn("ignoring TARPIT_MAX_MS: must be a number of milliseconds no less than TARPIT_MIN_MS", "value", t)
+		}
+	}
+	tarpitMaxHeld := 1000
+	envIntAtLeast("TARPIT_MAX_HELD", &tarpitMaxHeld, 1)
+	quotaAction := strings.ToLower(os.Getenv("QUOTA_ACTION"))
+	if quotaAction != "flag" {
+		if quotaAction != "" && quotaAction != "block" {
+			configLog().Warn("ignoring QUOTA_ACTION: expected block or flag", "value", quotaAction)
+		}
+		quotaAction = "block"
+	}
+	quotaMaxKeys := 100000
+	envIntAtLeast("QUOTA_MAX_KEYS", &quotaMaxKeys, 1)
+	maxIdlePerHost := 64
+	envInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", &maxIdlePerHost)
+	idleTimeout := 90
+	envInt("UPSTREAM_IDLE_CONN_TIMEOUT", &idleTimeout)
+	dialTimeout := 5
+	envInt("UPSTREAM_DIAL_TIMEOUT", &dialTimeout)
+	tlsTimeout := 10
+	envInt("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", &tlsTimeout)
+	envInt("LIVE_CHECK_TIMEOUT_MS", &liveCheckTimeout)
+	envInt("PREFETCH_TIMEOUT_SECONDS", &prefetchTimeout)
+	envInt("LOG_FLUSH_TIMEOUT_SECONDS", &logFlushTimeout)
+	emailAlgo := strings.ToLower(os.Getenv("EMAIL_ENCRYPTION_ALGO"))
+	if emailAlgo != "" && !utils.IsHashAlgorithm(emailAlgo) {
+		configLog().Warn("ignoring EMAIL_ENCRYPTION_ALGO: expected hmac-sha256, hmac-sha512-256, blake2b or siphash", "value", emailAlgo)
+		emailAlgo = ""
+	}
+	emailFormat := utils.HashFormatHex
+	if f := strings.ToLower(os.Getenv("EMAIL_ENCRYPTION_FORMAT")); f != "" {
+		if utils.IsHashFormat(f) {
+			emailFormat = f
+		} else {
+			configLog().Warn("ignoring EMAIL_ENCRYPTION_FORMAT: expected hex, base64url or numeric", "value", f)
 		}
 	}
-	if l := os.Getenv("LOG_FLUSH_INTERVAL"); l != "" {
-		if val, err := strconv.Atoi(l); err == nil {
-			logFlush = val
+	emailLength := 0
+	envIntAtLeast("EMAIL_ENCRYPTION_LENGTH", &emailLength, 0)
+	dailyKeyBudget := 0
+	envInt("UPSTREAM_DAILY_KEY_BUDGET", &dailyKeyBudget)
+	budgetAlertPercent := 80
+	if p := os.Getenv("BUDGET_ALERT_PERCENT"); p != "" {
+		if val, err := strconv.Atoi(p); err == nil && val > 0 && val <= 100 {
+			budgetAlertPercent = val
+		} else {
+			configLog().Warn("ignoring BUDGET_ALERT_PERCENT: expected 1-100", "value", p)
 		}
 	}
-	if b := os.Getenv("LOG_BATCH_SIZE"); b != "" {
-		if val, err := strconv.Atoi(b); err == nil {
-			logBatch = val
+	budgetDegradeFactor := 0
+	envInt("BUDGET_DEGRADE_WINDOW_FACTOR", &budgetDegradeFactor)
+	emailMode := strings.ToLower(os.Getenv("EMAIL_ENCRYPTION_MODE"))
+	switch emailMode {
+	case "":
+		emailMode = "hash"
+	case "hash", "reversible":
+	default:
+		configLog().Warn("ignoring EMAIL_ENCRYPTION_MODE: expected hash or reversible", "value", emailMode)
+		emailMode = "hash"
+	}
+	failMode := strings.ToLower(os.Getenv("FAIL_MODE"))
+	switch failMode {
+	case "":
+		failMode = "open"
+	case "open", "closed", "unknown":
+	default:
+		configLog().Warn("ignoring FAIL_MODE: expected open, closed or unknown", "value", failMode)
+		failMode = "open"
+	}
+	failSwitchBelow := 0.0
+	if b := os.Getenv("FAIL_SWITCH_BELOW"); b != "" {
+		if val, err := strconv.ParseFloat(b, 64); err == nil && val >= 0 && val <= 1 {
+			failSwitchBelow = val
+		} else {
+			configLog().Warn("ignoring FAIL_SWITCH_BELOW: expected 0-1", "value", b)
+		}
+	}
+	// By default the switch flips between failing open and closed
+	failSwitchTo := "closed"
+	if failMode != "open" {
+		failSwitchTo = "open"
+	}
+	switch to := strings.ToLower(os.Getenv("FAIL_SWITCH_TO")); to {
+	case "":
+	case "open", "closed", "unknown":
+		failSwitchTo = to
+	default:
+		configLog().Warn("ignoring FAIL_SWITCH_TO: expected open, closed or unknown", "value", to)
+	}
+	failSwitchSecs := 300
+	envIntAtLeast("FAIL_SWITCH_SECONDS", &failSwitchSecs, 1)
+	failSwitchWindow := 60
+	envIntAtLeast("FAIL_SWITCH_WINDOW_SECONDS", &failSwitchWindow, 1)
+	breakerFailures := 0
+	envIntAtLeast("CIRCUIT_BREAKER_FAILURES", &breakerFailures, 0)
+	breakerOpenSecs := 30
+	envIntAtLeast("CIRCUIT_BREAKER_OPEN_SECONDS", &breakerOpenSecs, 1)
+	decisionCombine := strings.ToLower(os.Getenv("DECISION_COMBINE"))
+	switch decisionCombine {
+	case "":
+		decisionCombine = "any_block"
+	case "any_block", "precedence", "weighted":
+	default:
+		configLog().Warn("ignoring DECISION_COMBINE: expected any_block, precedence or weighted", "value", decisionCombine)
+		decisionCombine = "any_block"
+	}
+	var keyPrecedence []string
+	for _, keyType := range splitList(os.Getenv("KEY_PRECEDENCE")) {
+		keyPrecedence = append(keyPrecedence, strings.ToLower(keyType))
+	}
+	defaultProfile := strings.ToLower(os.Getenv("RESPONSE_PROFILE_DEFAULT"))
+	if defaultProfile == "" {
+		defaultProfile = "full"
+	} else if !validResponseProfile(defaultProfile) {
+		configLog().Warn("ignoring RESPONSE_PROFILE_DEFAULT: expected full, decision or minimal", "value", defaultProfile)
+		defaultProfile = "full"
+	}
+	storageRedisDB := 0
+	envInt("STORAGE_REDIS_DB", &storageRedisDB)
+	storageRedisPrefix := "apigate:"
+	if p, ok := os.LookupEnv("STORAGE_REDIS_PREFIX"); ok {
+		storageRedisPrefix = p
+	}
+	apiKey, apiKeySecret := secretEnv("UPSTREAM_API_KEY")
+	emailKey, emailKeySecret := secretEnv("EMAIL_ENCRYPTION_KEY")
+	emailSecondaryKey, emailSecondarySecret := secretEnv("EMAIL_ENCRYPTION_KEY_SECONDARY")
+	emailKeyID := parseKeyID("EMAIL_ENCRYPTION_KEY_ID")
+	emailSecondaryKeyID := parseKeyID("EMAIL_ENCRYPTION_KEY_SECONDARY_ID")
+	// Keys are used as given, so they must fit the algorithm; the
+	// subkeys used with a key ID always do
+	for _, k := range []struct{ env, key, id string }{
+		{"EMAIL_ENCRYPTION_KEY", emailKey, emailKeyID},
+		{"EMAIL_ENCRYPTION_KEY_SECONDARY", emailSecondaryKey, emailSecondaryKeyID},
+	} {
+		if emailAlgo == "" || k.key == "" || k.id != "" {
+			continue
+		}
+		if err := utils.CheckHashKey(emailAlgo, []byte(k.key)); err != nil {
+			configLog().Warn("ignoring EMAIL_ENCRYPTION_ALGO: key does not fit it; use a fitting key or set a key ID", "env", k.env, "error", err)
+			emailAlgo = ""
+		}
+	}
+	logRedactKey := os.Getenv("LOG_REDACT_KEY")
+	// Without LOG_REDACT_KEY, hashed fields use a subkey of the identity key
+	logRedact := parseLogRedact(os.Getenv("LOG_REDACT"), logRedactKey != "" || (emailKeyID != "" && emailKey != ""))
+	secretRefresh := 300
+	envIntAtLeast("SECRET_REFRESH_SECONDS", &secretRefresh, 0)
+
+	rulesAllow := splitList(os.Getenv("RULES_ALLOW"))
+	rulesDeny := splitList(os.Getenv("RULES_DENY"))
+	rulesFile := os.Getenv("RULES_FILE")
+	if rulesFile != "" {
+		content, err := LoadRulesFile(rulesFile)
+		if err != nil {
+			configLog().Error("failed to load rules file", "path", rulesFile, "error", err)
+		} else {
+			rulesAllow = append(rulesAllow, content.Allow...)
+			rulesDeny = append(rulesDeny, content.Deny...)
+		}
+	}
+
+	var tenants map[string]Tenant
+	if tenantsFile := os.Getenv("TENANTS_FILE"); tenantsFile != "" {
+		var err error
+		if tenants, err = LoadTenantsFile(tenantsFile); err != nil {
+			configLog().Error("failed to load tenants file", "path", tenantsFile, "error", err)
 		}
 	}
-	if k := os.Getenv("UPSTREAM_API_KEY"); k != "" {
-		apiKey = k
+	tenantHeader := os.Getenv("TENANT_HEADER")
+	if tenantHeader == "" {
+		tenantHeader = "X-Tenant-ID"
 	}
-	if e := os.Getenv("EMAIL_ENCRYPTION_KEY"); e != "" {
-		// Use as-is
-		// It's fine to store raw string here.
-		// Load even if empty to allow opt-out when not configured.
-		_ = e
+
+	upstreamProtocol := strings.ToLower(os.Getenv("UPSTREAM_PROTOCOL"))
+	if upstreamProtocol == "" {
+		upstreamProtocol = "http"
 	}
 
 	return &Config{
-		ServerPort:         port,
-		UpstreamBaseURL:    upstreamURL,
-		WindowSeconds:      windowSecs,
-		LogFlushInterval:   logFlush,
-		LogBatchSize:       logBatch,
-		UpstreamAPIKey:     apiKey,
-		EmailEncryptionKey: os.Getenv("EMAIL_ENCRYPTION_KEY"),
+		ServerPort:             port,
+		GRPCPort:               os.Getenv("GRPC_PORT"),
+		UpstreamBaseURL:        upstreamURLs[0],
+		UpstreamBaseURLs:       upstreamURLs,
+		UpstreamHealthPath:     healthPath,
+		UpstreamProtocol:       upstreamProtocol,
+		UpstreamGRPCAddr:       os.Getenv("UPSTREAM_GRPC_ADDR"),
+		UpstreamGRPCInsecure:   os.Getenv("UPSTREAM_GRPC_INSECURE") == "true",
+		UpstreamHealthInterval: healthInterval,
+		UpstreamMaxIdlePerHost: maxIdlePerHost,
+		UpstreamIdleTimeoutSec: idleTimeout,
+		UpstreamDialTimeoutSec: dialTimeout,
+		UpstreamTLSTimeoutSec:  tlsTimeout,
+		UpstreamHTTP2:          os.Getenv("UPSTREAM_HTTP2") != "false",
+		WindowSeconds:          windowSecs,
+		WindowSecondsByType:    parseTypeWindows(os.Getenv("WINDOW_SECONDS_BY_TYPE")),
+		MaxWindowKeys:          maxWindowKeys,
+		PrefetchWorkers:        prefetchWorkers,
+		PrefetchChunkSize:      prefetchChunkSize,
+		PrefetchChunkDelayMs:   prefetchChunkDelay,
+		PrefetchConcurrency:    prefetchChunkConcurrency,
+		PrefetchDelta:          os.Getenv("PREFETCH_DELTA") == "true",
+		DecisionMemoTTLMs:      memoTTL,
+		IdempotencyTTLSeconds:  idempotencyTTL,
+		TupleCacheTTLMs:        tupleTTL,
+		LiveCheckBudgetMs:      liveCheckBudget,
+		UpstreamDailyKeyBudget: dailyKeyBudget,
+		BudgetAlertPercent:     budgetAlertPercent,
+		BudgetDegradeFactor:    budgetDegradeFactor,
+		CallbackAllowedHosts:   splitList(os.Getenv("CALLBACK_ALLOWED_HOSTS")),
+		CallbackSecret:         os.Getenv("CALLBACK_SIGNING_SECRET"),
+		WarmStart:              os.Getenv("WARM_START") == "true",
+		WarmStartLimit:         warmStartLimit,
+		ReadyWhenWarm:          os.Getenv("WARM_START_BLOCK_READINESS") == "true",
+		ReadyWhenUpstream:      os.Getenv("UPSTREAM_HEALTH_BLOCK_READINESS") == "true",
+		WarmupSeconds:          warmupSeconds,
+		WarmupAction:           warmupAction,
+		WarmupPersist:          os.Getenv("WARMUP_PERSIST") == "true",
+		ShutdownDrainSeconds:   drainSecs,
+		CacheControlAllow:      os.Getenv("CACHE_CONTROL_ALLOW"),
+		CacheControlBlock:      os.Getenv("CACHE_CONTROL_BLOCK"),
+		DecisionHeaders:        os.Getenv("DECISION_HEADERS") == "true",
+		ShadowMode:             os.Getenv("SHADOW_MODE") == "true",
+		IPLimitRPS:             ipLimitRPS,
+		IPLimitBurst:           ipLimitBurst,
+		IPBanStrikes:           ipBanStrikes,
+		IPBanWindowSecs:        ipBanWindow,
+		IPBanSeconds:           ipBanSeconds,
+		TrustedProxies:         parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")),
+		ClientIPFromRemoteAddr: os.Getenv("CLIENT_IP_FROM_REMOTE_ADDR") == "true",
+		TarpitMinMs:            tarpitMin,
+		TarpitMaxMs:            tarpitMax,
+		TarpitMaxHeld:          tarpitMaxHeld,
+		QuotaRules:             parseQuotaRules(os.Getenv("QUOTA_RULES")),
+		QuotaAction:            quotaAction,
+		QuotaMaxKeys:           quotaMaxKeys,
+		GossipBind:             os.Getenv("GOSSIP_BIND"),
+		GossipPeers:            splitList(os.Getenv("GOSSIP_PEERS")),
+		GossipSecret:           os.Getenv("GOSSIP_SECRET"),
+		LeaderElection:         os.Getenv("LEADER_ELECTION") == "true",
+		LeaderLeaseSecs:        leaderLease,
+		InvalidationChannel:    os.Getenv("INVALIDATION_CHANNEL"),
+		LiveCheckTimeoutMs:     liveCheckTimeout,
+		PrefetchTimeoutSecs:    prefetchTimeout,
+		LogFlushTimeoutSecs:    logFlushTimeout,
+		UpstreamAPIKeySecret:   apiKeySecret,
+		EmailKeySecret:         emailKeySecret,
+		EmailSecondarySecret:   emailSecondarySecret,
+		SecretRefreshSecs:      secretRefresh,
+		EnforceBackendURL:      enforceBackend,
+		EnforcePort:            enforcePort,
+		EnforceIdentityHeader:  os.Getenv("ENFORCE_IDENTITY_HEADER"),
+		AdminAuditFile:         os.Getenv("ADMIN_AUDIT_FILE"),
+		AdminAuditUpstream:     os.Getenv("ADMIN_AUDIT_UPSTREAM") == "true",
+		DebugAddr:              os.Getenv("DEBUG_ADDR"),
+		LogLevel:               logLevel,
+		LogFormat:              logFormat,
+		DecisionCombine:        decisionCombine,
+		KeyPrecedence:          keyPrecedence,
+		KeyWeights:             parseKeyWeights(os.Getenv("KEY_WEIGHTS")),
+		AuditStoreSize:         auditStoreSize,
+		AuditMaxResults:        auditMaxResults,
+		DebugStoreTTLSeconds:   debugStoreTTL,
+		DebugSampleRate:        debugSampleRate,
+		EncryptAsyncThreshold:  encryptAsyncThreshold,
+		EncryptJobWorkers:      encryptJobWorkers,
+		EncryptJobTTLSeconds:   encryptJobTTL,
+		ReadReplica:            os.Getenv("READ_REPLICA") == "true",
+		ReplicaSnapshot:        os.Getenv("REPLICA_SNAPSHOT"),
+		ReplicaUnknownAction:   strings.ToLower(os.Getenv("REPLICA_UNKNOWN_ACTION")),
+		CacheStalePolicy:       strings.ToLower(os.Getenv("CACHE_STALE_POLICY")),
+		CacheMaxStaleSeconds:   cacheMaxStale,
+		CacheAllowTTLSeconds:   cacheAllowTTL,
+		CacheBlockTTLSeconds:   cacheBlockTTL,
+		FailMode:               failMode,
+		FailSwitchBelow:        failSwitchBelow,
+		FailSwitchTo:           failSwitchTo,
+		FailSwitchSeconds:      failSwitchSecs,
+		FailSwitchWindowSecs:   failSwitchWindow,
+		BreakerFailures:        breakerFailures,
+		BreakerOpenSeconds:     breakerOpenSecs,
+		UpstreamStreaming:      os.Getenv("UPSTREAM_STREAMING") == "true",
+		LogFlushInterval:       logFlush,
+		LogBatchSize:           logBatch,
+		LogMaxBuffer:           logMaxBuffer,
+		LogOverflowPolicy:      logOverflow,
+		LogBlockTimeoutMs:      logBlockTimeout,
+		LogSpillDir:            os.Getenv("LOG_SPILL_DIR"),
+		LogDLQDir:              os.Getenv("LOG_DLQ_DIR"),
+		LogMaxAttempts:         logMaxAttempts,
+		LogSinks:               splitList(os.Getenv("LOG_SINKS")),
+		LogAggregateEventTypes: splitList(os.Getenv("LOG_AGGREGATE_EVENT_TYPES")),
+		LogRawEventTypes:       splitList(os.Getenv("LOG_RAW_EVENT_TYPES")),
+		LogSampleRates:         parseSampleRates(os.Getenv("LOG_SAMPLE_RATES")),
+		LogRedact:              logRedact,
+		LogRedactRegions:       logRedactRegions,
+		LogRedactKey:           logRedactKey,
+		KafkaBrokers:           splitList(os.Getenv("KAFKA_BROKERS")),
+		KafkaTopic:             os.Getenv("KAFKA_TOPIC"),
+		KafkaBatchSize:         kafkaBatchSize,
+		KafkaBatchTimeoutMs:    kafkaBatchTimeout,
+		SyslogAddr:             os.Getenv("SYSLOG_ADDR"),
+		SyslogNetwork:          syslogNetwork,
+		SyslogAppName:          syslogAppName,
+		ArchiveEndpoint:        archiveEndpoint,
+		ArchiveBucket:          os.Getenv("LOG_ARCHIVE_BUCKET"),
+		ArchiveRegion:          archiveRegion,
+		ArchivePrefix:          os.Getenv("LOG_ARCHIVE_PREFIX"),
+		ArchivePartition:       archivePartition,
+		ArchiveAccessKey:       firstEnv("LOG_ARCHIVE_ACCESS_KEY", "AWS_ACCESS_KEY_ID"),
+		ArchiveSecretKey:       firstEnv("LOG_ARCHIVE_SECRET_KEY", "AWS_SECRET_ACCESS_KEY"),
+		UpstreamAPIKey:         apiKey,
+		ClientAPIKeys:          splitList(os.Getenv("CLIENT_API_KEYS")),
+		AdminAPIKeys:           splitList(os.Getenv("ADMIN_API_KEYS")),
+		ResponseProfiles:       parseResponseProfiles(os.Getenv("RESPONSE_PROFILES")),
+		DefaultResponseProfile: defaultProfile,
+		RateLimitRPS:           rateLimitRPS,
+		RateLimitBurst:         rateLimitBurst,
+		TenantMaxInFlight:      tenantMaxInFlight,
+		EmailEncryptionKey:     emailKey,
+		EmailSecondaryKey:      emailSecondaryKey,
+		EmailKeyID:             emailKeyID,
+		EmailSecondaryKeyID:    emailSecondaryKeyID,
+		EmailEncryptionFormat:  emailFormat,
+		EmailEncryptionLength:  emailLength,
 		EmailEncryptionEnabled: func() bool {
 			val := os.Getenv("EMAIL_ENCRYPTION_ENABLED")
 			if val == "true" {
@@ -80,11 +780,285 @@ func LoadConfig() *Config {
 			}
 			return false
 		}(),
-		EmailEncryptionFormat: func() string {
-			if f := os.Getenv("EMAIL_ENCRYPTION_FORMAT"); f != "" {
-				return f
+		ClientCertHeader: func() string {
+			if h := os.Getenv("CLIENT_CERT_HEADER"); h != "" {
+				return h
+			}
+			return "X-Client-Cert-Fingerprint"
+		}(),
+		JA3Header: func() string {
+			if h := os.Getenv("JA3_HEADER"); h != "" {
+				return h
 			}
-			return "hex"
+			return "X-JA3-Fingerprint"
 		}(),
+		TLSCertFile:          os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:           os.Getenv("TLS_KEY_FILE"),
+		TLSClientCAFile:      os.Getenv("TLS_CLIENT_CA_FILE"),
+		TLSClientAuth:        tlsClientAuth,
+		HTTPPort:             os.Getenv("HTTP_PORT"),
+		HTTPMode:             httpMode,
+		GeoIPDBPath:          os.Getenv("GEOIP_DB_PATH"),
+		ASNDBPath:            os.Getenv("ASN_DB_PATH"),
+		ReportInterval:       os.Getenv("REPORT_INTERVAL"),
+		ReportFormat:         os.Getenv("REPORT_FORMAT"),
+		ReportTopN:           reportTopN,
+		ReportWebhookURL:     os.Getenv("REPORT_WEBHOOK_URL"),
+		ReportSMTPAddr:       os.Getenv("REPORT_SMTP_ADDR"),
+		ReportSMTPUsername:   os.Getenv("REPORT_SMTP_USERNAME"),
+		ReportSMTPPassword:   os.Getenv("REPORT_SMTP_PASSWORD"),
+		ReportSMTPFrom:       os.Getenv("REPORT_SMTP_FROM"),
+		ReportSMTPTo:         splitList(os.Getenv("REPORT_SMTP_TO")),
+		RulesAllow:           rulesAllow,
+		RulesDeny:            rulesDeny,
+		RulesFile:            rulesFile,
+		Tenants:              tenants,
+		TenantHeader:         tenantHeader,
+		EmailEncryptionAlgo:  emailAlgo,
+		EmailEncryptionMode:  emailMode,
+		StorageBackend:       strings.ToLower(os.Getenv("STORAGE_BACKEND")),
+		StoragePath:          os.Getenv("STORAGE_PATH"),
+		StorageRedisAddr:     os.Getenv("STORAGE_REDIS_ADDR"),
+		StorageRedisPassword: os.Getenv("STORAGE_REDIS_PASSWORD"),
+		StorageRedisDB:       storageRedisDB,
+		StorageRedisPrefix:   storageRedisPrefix,
+	}
+}
+
+// firstEnv returns the first non-empty environment variable among names.
+func firstEnv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// splitList parses a comma-separated env value, dropping blank entries.
+func splitList(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// envInt sets *v to the number in env var name, if set, ignoring anything
+// else with a warning.
+func envInt(name string, v *int) {
+	if s := os.Getenv(name); s != "" {
+		if val, err := strconv.Atoi(s); err == nil {
+			*v = val
+		} else {
+			configLog().Warn("ignoring "+name+": expected a number", "value", s)
+		}
+	}
+}
+
+// envIntAtLeast is envInt for settings that must be at least min.
+func envIntAtLeast(name string, v *int, min int) {
+	if s := os.Getenv(name); s != "" {
+		if val, err := strconv.Atoi(s); err == nil && val >= min {
+			*v = val
+		} else {
+			configLog().Warn(fmt.Sprintf("ignoring %s: expected a number of at least %d", name, min), "value", s)
+		}
+	}
+}
+
+// envFloat sets *v to the decimal number in env var name, if set, ignoring
+// anything else with a warning.
+func envFloat(name string, v *float64) {
+	if s := os.Getenv(name); s != "" {
+		if val, err := strconv.ParseFloat(s, 64); err == nil {
+			*v = val
+		} else {
+			configLog().Warn("ignoring "+name+": expected a number", "value", s)
+		}
+	}
+}
+
+// parseTypeWindows parses "type=window" pairs such as "ip=5m,email=30". Windows
+// are seconds or Go durations; malformed or too-short entries are logged and
+// skipped so one typo does not take the rest of the configuration with it.
+func parseTypeWindows(v string) map[string]int {
+	out := make(map[string]int)
+	for _, entry := range splitList(v) {
+		keyType, window, ok := strings.Cut(entry, "=")
+		keyType = strings.ToLower(strings.TrimSpace(keyType))
+		window = strings.TrimSpace(window)
+		if !ok || keyType == "" {
+			configLog().Warn("ignoring WINDOW_SECONDS_BY_TYPE entry: expected type=window", "entry", entry)
+			continue
+		}
+		secs, err := strconv.Atoi(window)
+		if err != nil {
+			d, derr := time.ParseDuration(window)
+			if derr != nil {
+				configLog().Warn("ignoring WINDOW_SECONDS_BY_TYPE entry: invalid window", "entry", entry)
+				continue
+			}
+			secs = int(d / time.Second)
+		}
+		if secs < 5 {
+			configLog().Warn("ignoring WINDOW_SECONDS_BY_TYPE entry: window must be at least 5s", "entry", entry)
+			continue
+		}
+		out[keyType] = secs
+	}
+	return out
+}
+
+// parseTrustedProxies parses CIDR ranges and single addresses, e.g.
+// "10.0.0.0/8,192.0.2.10".
+func parseTrustedProxies(v string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, entry := range splitList(v) {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			configLog().Warn("ignoring TRUSTED_PROXIES entry: expected an IP address or CIDR range", "entry", entry)
+			continue
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out
+}
+
+// parseKeyID reads the key ID in env var name, ignoring invalid ones.
+func parseKeyID(name string) string {
+	id := strings.TrimSpace(os.Getenv(name))
+	if id != "" && !ValidKeyID(id) {
+		configLog().Warn("ignoring "+name+": expected up to 16 letters, digits, '_' or '-'", "value", id)
+		return ""
+	}
+	return id
+}
+
+// parseQuotaRules parses "type=limit/window" entries, the window in seconds
+// or as a duration, e.g. "ip=100/60,email=20/1m,ip=2000/1h".
+func parseQuotaRules(v string) []QuotaRule {
+	var out []QuotaRule
+	for _, entry := range splitList(v) {
+		keyType, limitWindow, ok := strings.Cut(entry, "=")
+		keyType = strings.ToLower(strings.TrimSpace(keyType))
+		limit, window, ok2 := strings.Cut(strings.TrimSpace(limitWindow), "/")
+		n, err := strconv.Atoi(limit)
+		d, derr := time.ParseDuration(window)
+		if secs, err := strconv.Atoi(window); err == nil {
+			d, derr = time.Duration(secs)*time.Second, nil
+		}
+		switch keyType {
+		case "ip", "email", "user_id":
+		default:
+			ok = false
+		}
+		if !ok || !ok2 || err != nil || n <= 0 || derr != nil || d < time.Second {
+			configLog().Warn("ignoring QUOTA_RULES entry: expected type=limit/window for ip, email or user_id, with a window of at least 1s", "entry", entry)
+			continue
+		}
+		out = append(out, QuotaRule{KeyType: keyType, Limit: n, Window: d})
+	}
+	return out
+}
+
+// parseKeyWeights parses "type=weight" pairs, e.g. "email=3,ip=2,user_agent=1".
+func parseKeyWeights(v string) map[string]float64 {
+	out := make(map[string]float64)
+	for _, entry := range splitList(v) {
+		keyType, weight, ok := strings.Cut(entry, "=")
+		keyType = strings.ToLower(strings.TrimSpace(keyType))
+		w, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		if !ok || keyType == "" || err != nil || w < 0 {
+			configLog().Warn("ignoring KEY_WEIGHTS entry: expected type=weight", "entry", entry)
+			continue
+		}
+		out[keyType] = w
+	}
+	return out
+}
+
+// parseSampleRates parses "method=rate" pairs, e.g. "GET=0.1,*=0.5". Rates are
+// fractions between 0 and 1; "*" applies to methods without their own.
+func parseSampleRates(v string) map[string]float64 {
+	out := make(map[string]float64)
+	for _, entry := range splitList(v) {
+		method, rate, ok := strings.Cut(entry, "=")
+		method = strings.ToUpper(strings.TrimSpace(method))
+		r, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+		if !ok || method == "" || err != nil || r < 0 || r > 1 {
+			configLog().Warn("ignoring LOG_SAMPLE_RATES entry: expected method=rate with a rate between 0 and 1", "entry", entry)
+			continue
+		}
+		out[method] = r
+	}
+	return out
+}
+
+// parseLogRedact parses "field=action" pairs, e.g. "ip_address=mask,username=hash".
+// Without an HMAC key, fields to hash are dropped instead: unkeyed hashes of
+// IP addresses are reversed by trying them all.
+func parseLogRedact(v string, hasKey bool) map[string]string {
+	out := make(map[string]string)
+	for _, entry := range splitList(v) {
+		field, action, ok := strings.Cut(entry, "=")
+		field = strings.ToLower(strings.TrimSpace(field))
+		action = strings.ToLower(strings.TrimSpace(action))
+		switch field {
+		case "ip_address", "username", "user_agent", "email":
+		default:
+			ok = false
+		}
+		if !ok || (action != "hash" && action != "mask" && action != "drop") {
+			configLog().Warn("ignoring LOG_REDACT entry: expected field=hash|mask|drop for ip_address, username, user_agent or email", "entry", entry)
+			continue
+		}
+		if action == "hash" && !hasKey {
+			configLog().Warn("LOG_REDACT hash needs LOG_REDACT_KEY or EMAIL_ENCRYPTION_KEY_ID; dropping the field instead", "field", field)
+			action = "drop"
+		}
+		out[field] = action
+	}
+	return out
+}
+
+// parseResponseProfiles parses "key=profile" pairs binding client API keys to
+// response profiles. Malformed entries are logged (without the key) and skipped.
+func parseResponseProfiles(v string) map[string]string {
+	out := make(map[string]string)
+	for i, entry := range splitList(v) {
+		key, profile, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		profile = strings.ToLower(strings.TrimSpace(profile))
+		if !ok || key == "" || !validResponseProfile(profile) {
+			configLog().Warn("ignoring RESPONSE_PROFILES entry: expected key=full|decision|minimal", "entry", i+1)
+			continue
+		}
+		out[key] = profile
+	}
+	return out
+}
+
+func validResponseProfile(p string) bool {
+	return p == "full" || p == "decision" || p == "minimal"
+}
+
+// LoadRulesFile reads a JSON rules file.
+func LoadRulesFile(path string) (*RulesFileContent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var content RulesFileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
 	}
+	return &content, nil
 }
@@ -0,0 +1,40 @@
+package config
+
+import "testing"
+
+func TestLoadConfig_Problems(t *testing.T) {
+	t.Chdir(t.TempDir())
+	unsetenv(t, "WINDOW_SECONDS", "RATE_LIMIT_RPS")
+
+	before := Problems()
+	cfg := LoadConfig()
+	if n := Problems() - before; n != 0 {
+		t.Fatalf("Expected the defaults valid, got %d problem(s)", n)
+	}
+	defaultTimeout := cfg.LiveCheckTimeoutMs
+
+	// Numbers that do not parse or are out of range are ignored, and counted
+	// for -validate
+	for _, c := range []struct{ env, value string }{
+		{"LIVE_CHECK_TIMEOUT_MS", "abc"},
+		{"ENCRYPT_JOB_WORKERS", "0"},
+		{"RATE_LIMIT_RPS", "fast"},
+	} {
+		t.Run(c.env, func(t *testing.T) {
+			t.Setenv(c.env, c.value)
+			before := Problems()
+			cfg := LoadConfig()
+			if n := Problems() - before; n != 1 {
+				t.Errorf("Expected %s=%s reported once, got %d problem(s)", c.env, c.value, n)
+			}
+			if cfg.LiveCheckTimeoutMs != defaultTimeout || cfg.EncryptJobWorkers != 4 || cfg.RateLimitRPS != 0 {
+				t.Errorf("Expected %s=%s ignored, got %d, %d, %v", c.env, c.value, cfg.LiveCheckTimeoutMs, cfg.EncryptJobWorkers, cfg.RateLimitRPS)
+			}
+		})
+	}
+
+	t.Setenv("WINDOW_SECONDS", "45")
+	if cfg := LoadConfig(); cfg.WindowSeconds != 45 {
+		t.Errorf("Expected WINDOW_SECONDS=45 used, got %d", cfg.WindowSeconds)
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// envVars are the environment variables LoadConfig reads, each of which has a
+// command-line flag. Keep in step with LoadConfig.
+var envVars = []string{
+	"ADMIN_API_KEYS", "ADMIN_AUDIT_FILE", "ADMIN_AUDIT_UPSTREAM", "ASN_DB_PATH", "AUDIT_MAX_RESULTS",
+	"AUDIT_STORE_SIZE", "AWS_ACCESS_KEY_ID", "AWS_DEFAULT_REGION", "AWS_REGION",
+	"AWS_SECRETS_MANAGER_ENDPOINT", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	"BUDGET_ALERT_PERCENT", "BUDGET_DEGRADE_WINDOW_FACTOR", "CACHE_ALLOW_TTL_SECONDS",
+	"CACHE_BLOCK_TTL_SECONDS", "CACHE_CONTROL_ALLOW", "CACHE_CONTROL_BLOCK",
+	"CACHE_MAX_STALE_SECONDS", "CACHE_STALE_POLICY", "CALLBACK_ALLOWED_HOSTS",
+	"CALLBACK_SIGNING_SECRET", "CIRCUIT_BREAKER_FAILURES", "CIRCUIT_BREAKER_OPEN_SECONDS",
+	"CLIENT_API_KEYS", "CLIENT_CERT_HEADER", "CLIENT_IP_FROM_REMOTE_ADDR", "DEBUG_ADDR",
+	"DEBUG_SAMPLE_RATE", "DEBUG_STORE_TTL_SECONDS", "DECISION_COMBINE", "DECISION_HEADERS",
+	"DECISION_MEMO_TTL_MS", "EMAIL_ENCRYPTION_ALGO", "EMAIL_ENCRYPTION_ENABLED",
+	"EMAIL_ENCRYPTION_FORMAT", "EMAIL_ENCRYPTION_KEY", "EMAIL_ENCRYPTION_KEY_ID",
+	"EMAIL_ENCRYPTION_KEY_SECONDARY", "EMAIL_ENCRYPTION_KEY_SECONDARY_ID", "EMAIL_ENCRYPTION_LENGTH",
+	"EMAIL_ENCRYPTION_MODE", "ENCRYPT_ASYNC_THRESHOLD", "ENCRYPT_JOB_TTL_SECONDS",
+	"ENCRYPT_JOB_WORKERS", "ENFORCE_BACKEND_URL", "ENFORCE_IDENTITY_HEADER", "ENFORCE_PORT",
+	"FAIL_MODE", "FAIL_SWITCH_BELOW", "FAIL_SWITCH_SECONDS", "FAIL_SWITCH_TO",
+	"FAIL_SWITCH_WINDOW_SECONDS", "GEOIP_DB_PATH", "GOSSIP_BIND", "GOSSIP_PEERS", "GOSSIP_SECRET",
+	"GRPC_PORT", "HTTP_MODE", "HTTP_PORT", "IDEMPOTENCY_TTL_SECONDS", "INVALIDATION_CHANNEL",
+	"IP_BAN_SECONDS", "IP_BAN_STRIKES", "IP_BAN_WINDOW_SECONDS", "IP_LIMIT_BURST", "IP_LIMIT_RPS",
+	"JA3_HEADER", "KAFKA_BATCH_SIZE", "KAFKA_BATCH_TIMEOUT_MS", "KAFKA_BROKERS", "KAFKA_TOPIC",
+	"KEY_PRECEDENCE", "KEY_WEIGHTS", "LEADER_ELECTION", "LEADER_LEASE_SECONDS",
+	"LIVE_CHECK_BUDGET_MS", "LIVE_CHECK_TIMEOUT_MS", "LOG_AGGREGATE_EVENT_TYPES",
+	"LOG_ARCHIVE_ACCESS_KEY", "LOG_ARCHIVE_BUCKET", "LOG_ARCHIVE_ENDPOINT", "LOG_ARCHIVE_PARTITION",
+	"LOG_ARCHIVE_PREFIX", "LOG_ARCHIVE_REGION", "LOG_ARCHIVE_SECRET_KEY", "LOG_BATCH_SIZE",
+	"LOG_BLOCK_TIMEOUT_MS", "LOG_DLQ_DIR", "LOG_FLUSH_INTERVAL", "LOG_FLUSH_TIMEOUT_SECONDS",
+	"LOG_FORMAT", "LOG_LEVEL", "LOG_MAX_ATTEMPTS", "LOG_MAX_BUFFER", "LOG_OVERFLOW_POLICY",
+	"LOG_RAW_EVENT_TYPES", "LOG_REDACT", "LOG_REDACT_KEY", "LOG_REDACT_REGIONS", "LOG_SAMPLE_RATES",
+	"LOG_SINKS", "LOG_SPILL_DIR", "MAX_KEYS_PER_WINDOW", "PORT", "PREFETCH_CHUNK_CONCURRENCY",
+	"PREFETCH_CHUNK_DELAY_MS", "PREFETCH_CHUNK_SIZE", "PREFETCH_DELTA", "PREFETCH_TIMEOUT_SECONDS",
+	"PREFETCH_WORKERS", "QUOTA_ACTION", "QUOTA_MAX_KEYS", "QUOTA_RULES", "RATE_LIMIT_BURST",
+	"RATE_LIMIT_RPS", "READ_REPLICA", "REPLICA_SNAPSHOT", "REPLICA_UNKNOWN_ACTION", "REPORT_FORMAT",
+	"REPORT_INTERVAL", "REPORT_SMTP_ADDR", "REPORT_SMTP_FROM", "REPORT_SMTP_PASSWORD",
+	"REPORT_SMTP_TO", "REPORT_SMTP_USERNAME", "REPORT_TOP_N", "REPORT_WEBHOOK_URL",
+	"RESPONSE_PROFILES", "RESPONSE_PROFILE_DEFAULT", "RULES_ALLOW", "RULES_DENY", "RULES_FILE",
+	"SECRET_REFRESH_SECONDS", "SHADOW_MODE", "SHUTDOWN_DRAIN_SECONDS", "STORAGE_BACKEND",
+	"STORAGE_PATH", "STORAGE_REDIS_ADDR", "STORAGE_REDIS_DB", "STORAGE_REDIS_PASSWORD",
+	"STORAGE_REDIS_PREFIX", "SYSLOG_ADDR", "SYSLOG_APP_NAME", "SYSLOG_NETWORK", "TARPIT_MAX_HELD",
+	"TARPIT_MAX_MS", "TARPIT_MIN_MS", "TENANTS_FILE", "TENANT_HEADER", "TENANT_MAX_IN_FLIGHT",
+	"TLS_CERT_FILE", "TLS_CLIENT_AUTH", "TLS_CLIENT_CA_FILE", "TLS_KEY_FILE", "TRUSTED_PROXIES",
+	"TUPLE_CACHE_TTL_MS", "UPSTREAM_API_KEY", "UPSTREAM_BASE_URL", "UPSTREAM_DAILY_KEY_BUDGET",
+	"UPSTREAM_DIAL_TIMEOUT", "UPSTREAM_GRPC_ADDR", "UPSTREAM_GRPC_INSECURE",
+	"UPSTREAM_HEALTH_BLOCK_READINESS", "UPSTREAM_HEALTH_INTERVAL", "UPSTREAM_HEALTH_PATH",
+	"UPSTREAM_HTTP2", "UPSTREAM_IDLE_CONN_TIMEOUT", "UPSTREAM_MAX_IDLE_CONNS_PER_HOST",
+	"UPSTREAM_PROTOCOL", "UPSTREAM_STREAMING", "UPSTREAM_TLS_HANDSHAKE_TIMEOUT", "VAULT_ADDR",
+	"VAULT_NAMESPACE", "VAULT_TOKEN", "WARMUP_ACTION", "WARMUP_PERSIST", "WARMUP_SECONDS",
+	"WARM_START", "WARM_START_BLOCK_READINESS", "WARM_START_LIMIT", "WINDOW_SECONDS",
+	"WINDOW_SECONDS_BY_TYPE",
+}
+
+// Flags are the command-line flags of the proxy binary: one per environment
+// variable, named after it in lower case with dashes (-upstream-base-url for
+// UPSTREAM_BASE_URL), plus -config, -version and -validate.
+type Flags struct {
+	ConfigFile string // KEY=value file read like .env (-config)
+	Version    bool   // Print the version and exit (-version)
+	Validate   bool   // Check the configuration and exit (-validate)
+
+	env map[string]string // Variables given on the command line
+}
+
+// FlagName returns the command-line flag for an environment variable.
+func FlagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+// ParseFlags parses the command-line arguments of the proxy binary. Errors
+// and -help are reported on stderr by the flag package.
+func ParseFlags(name string, args []string) (*Flags, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	f := &Flags{env: make(map[string]string)}
+	fs.StringVar(&f.ConfigFile, "config", "", "read settings from this KEY=value file; the environment and flags override it")
+	fs.BoolVar(&f.Version, "version", false, "print the version and exit")
+	fs.BoolVar(&f.Validate, "validate", false, "check the configuration, report any problems and exit")
+	values := make(map[string]*string, len(envVars))
+	for _, env := range envVars {
+		values[env] = fs.String(FlagName(env), "", "overrides $"+env)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		env := strings.ReplaceAll(strings.ToUpper(fl.Name), "-", "_")
+		if v, ok := values[env]; ok {
+			f.env[env] = *v
+		}
+	})
+	return f, nil
+}
+
+// Apply makes the flags visible to LoadConfig: variables given on the
+// command line override the environment, which overrides ConfigFile, which
+// overrides .env. Call it before LoadConfig.
+func (f *Flags) Apply() error {
+	for env, v := range f.env {
+		if err := os.Setenv(env, v); err != nil {
+			return err
+		}
+	}
+	if f.ConfigFile == "" {
+		return nil
+	}
+	// Load never overrides variables already set
+	return godotenv.Load(f.ConfigFile)
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	f, err := ParseFlags("apigate-proxy", []string{"-validate", "-config", "prod.env", "-upstream-base-url", "http://up:8000", "-port=9090"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Validate || f.Version || f.ConfigFile != "prod.env" {
+		t.Errorf("Expected -validate and -config parsed, got %+v", f)
+	}
+	want := map[string]string{"UPSTREAM_BASE_URL": "http://up:8000", "PORT": "9090"}
+	if len(f.env) != len(want) || f.env["UPSTREAM_BASE_URL"] != want["UPSTREAM_BASE_URL"] || f.env["PORT"] != want["PORT"] {
+		t.Errorf("Expected only the flags given kept, got %v", f.env)
+	}
+
+	if _, err := ParseFlags("apigate-proxy", []string{"-no-such-setting", "x"}); err == nil {
+		t.Error("Expected an unknown flag refused")
+	}
+	if got := FlagName("LIVE_CHECK_TIMEOUT_MS"); got != "live-check-timeout-ms" {
+		t.Errorf("FlagName: got %q", got)
+	}
+}
+
+// unsetenv unsets the variables for the test, restoring them afterwards.
+func unsetenv(t *testing.T, names ...string) {
+	for _, n := range names {
+		t.Setenv(n, "")
+		os.Unsetenv(n)
+	}
+}
+
+func TestFlags_Precedence(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	unsetenv(t, "PORT", "WINDOW_SECONDS", "LOG_BATCH_SIZE", "KAFKA_TOPIC")
+
+	// Each source sets one setting fewer than the one below it
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(".env", "PORT=1001\nWINDOW_SECONDS=31\nLOG_BATCH_SIZE=41\nKAFKA_TOPIC=from-dotenv\n")
+	write("prod.env", "PORT=1002\nWINDOW_SECONDS=32\nLOG_BATCH_SIZE=42\n")
+	t.Setenv("PORT", "1003")
+	t.Setenv("WINDOW_SECONDS", "33")
+
+	f, err := ParseFlags("apigate-proxy", []string{"-config", "prod.env", "-port", "1004"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := LoadConfig()
+	if cfg.ServerPort != "1004" {
+		t.Errorf("Expected the flag to win, got PORT %q", cfg.ServerPort)
+	}
+	if cfg.WindowSeconds != 33 {
+		t.Errorf("Expected the environment over the config file, got WINDOW_SECONDS %d", cfg.WindowSeconds)
+	}
+	if cfg.LogBatchSize != 42 {
+		t.Errorf("Expected the config file over .env, got LOG_BATCH_SIZE %d", cfg.LogBatchSize)
+	}
+	if cfg.KafkaTopic != "from-dotenv" {
+		t.Errorf("Expected .env used last, got KAFKA_TOPIC %q", cfg.KafkaTopic)
+	}
+
+	missing := &Flags{ConfigFile: filepath.Join(dir, "missing.env")}
+	if err := missing.Apply(); err == nil {
+		t.Error("Expected a missing config file reported")
+	}
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Log output formats (LOG_FORMAT).
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// configureLogging installs the process-wide slog logger described by
+// LOG_LEVEL (debug, info, warn or error; default info) and LOG_FORMAT (text
+// or json; default text), returning the level and format in effect. Records
+// go to stderr; anything still written with the standard log package is
+// routed through the same handler at info level.
+func configureLogging() (string, string) {
+	var level slog.Level
+	levelName := strings.ToLower(os.Getenv("LOG_LEVEL"))
+	badLevel := levelName != "" && level.UnmarshalText([]byte(levelName)) != nil
+	if badLevel {
+		level = slog.LevelInfo
+	}
+	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
+	badFormat := false
+	switch format {
+	case "":
+		format = LogFormatText
+	case LogFormatText, LogFormatJSON:
+	default:
+		badFormat = true
+		format = LogFormatText
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if format == LogFormatJSON {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+
+	if badLevel {
+		configLog().Warn("ignoring LOG_LEVEL: expected debug, info, warn or error", "value", levelName)
+	}
+	if badFormat {
+		configLog().Warn("ignoring LOG_FORMAT: expected text or json", "value", os.Getenv("LOG_FORMAT"))
+	}
+	return strings.ToLower(level.String()), format
+}
+
+// problems counts the warnings and errors logged about the configuration.
+var problems atomic.Int64
+
+// Problems returns how many warnings and errors were logged about the
+// configuration so far: settings LoadConfig ignored or files it failed to
+// read.
+func Problems() int {
+	return int(problems.Load())
+}
+
+// problemCounter counts the warnings and errors passing through to Handler.
+type problemCounter struct {
+	slog.Handler
+}
+
+func (h problemCounter) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		problems.Add(1)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h problemCounter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return problemCounter{h.Handler.WithAttrs(attrs)}
+}
+
+func (h problemCounter) WithGroup(name string) slog.Handler {
+	return problemCounter{h.Handler.WithGroup(name)}
+}
+
+func configLog() *slog.Logger {
+	return slog.New(problemCounter{slog.Default().Handler()}).With("component", "config")
+}
@@ -0,0 +1,69 @@
+package config
+
+// maskedSecret replaces a configured secret in Masked output.
+const maskedSecret = "********"
+
+// Masked returns a copy of c safe to show to operators: secrets are replaced
+// by a placeholder when set, and API keys by a placeholder ending in their
+// last four characters, so support can tell which key is configured without
+// learning it. Unset secrets stay empty.
+func (c *Config) Masked() *Config {
+	m := *c
+	for _, s := range []*string{
+		&m.UpstreamAPIKey,
+		&m.EmailEncryptionKey,
+		&m.EmailSecondaryKey,
+		&m.CallbackSecret,
+		&m.ArchiveAccessKey,
+		&m.ArchiveSecretKey,
+		&m.StorageRedisPassword,
+		&m.ReportSMTPPassword,
+		&m.LogRedactKey,
+		&m.ReportWebhookURL, // Webhook URLs embed their token
+	} {
+		if *s != "" {
+			*s = maskedSecret
+		}
+	}
+	m.ClientAPIKeys = maskKeys(c.ClientAPIKeys)
+	m.AdminAPIKeys = maskKeys(c.AdminAPIKeys)
+	if c.ResponseProfiles != nil {
+		m.ResponseProfiles = make(map[string]string, len(c.ResponseProfiles))
+		for k, p := range c.ResponseProfiles {
+			m.ResponseProfiles[maskKey(k)] = p
+		}
+	}
+	if c.Tenants != nil {
+		m.Tenants = make(map[string]Tenant, len(c.Tenants))
+		for id, t := range c.Tenants {
+			for _, s := range []*string{&t.UpstreamAPIKey, &t.EmailEncryptionKey, &t.EmailSecondaryKey} {
+				if *s != "" {
+					*s = maskedSecret
+				}
+			}
+			t.ClientAPIKeys = maskKeys(t.ClientAPIKeys)
+			m.Tenants[id] = t
+		}
+	}
+	return &m
+}
+
+// maskKey keeps the last four characters of keys long enough that they do
+// not give the key away.
+func maskKey(k string) string {
+	if len(k) < 12 {
+		return maskedSecret
+	}
+	return maskedSecret + k[len(k)-4:]
+}
+
+func maskKeys(keys []string) []string {
+	if keys == nil {
+		return nil
+	}
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = maskKey(k)
+	}
+	return out
+}
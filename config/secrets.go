@@ -0,0 +1,248 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/utils"
+)
+
+// secretTimeout bounds each read from a secrets backend.
+const secretTimeout = 10 * time.Second
+
+// Secret is a setting read from a secrets backend instead of the environment.
+// Its value is read when the configuration loads and again on every Refresh,
+// so a rotated secret is picked up without a restart. References are:
+//
+//	vault://<path>#<field>       a field of a HashiCorp Vault KV secret (VAULT_ADDR, VAULT_TOKEN)
+//	awssm://<secret-id>[#field]  an AWS Secrets Manager secret, or a field of its JSON value
+type Secret struct {
+	Ref   string // The reference; safe to log
+	fetch func(ctx context.Context) (string, error)
+	value atomic.Pointer[string]
+}
+
+// ParseSecret returns the Secret v refers to, or nil if v is a plain value.
+// Nothing is read until Refresh.
+func ParseSecret(v string) (*Secret, error) {
+	scheme, rest, ok := strings.Cut(v, "://")
+	if !ok {
+		return nil, nil
+	}
+	name, field, _ := strings.Cut(rest, "#")
+	if name == "" {
+		return nil, fmt.Errorf("%s: missing secret name", v)
+	}
+	s := &Secret{Ref: v}
+	switch scheme {
+	case "vault":
+		if field == "" {
+			return nil, fmt.Errorf("%s: missing #field", v)
+		}
+		addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+		if addr == "" {
+			return nil, fmt.Errorf("%s: VAULT_ADDR is not set", v)
+		}
+		s.fetch = vaultFetch(addr, os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_NAMESPACE"), name, field)
+	case "awssm":
+		region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+		// ARNs carry their region: arn:aws:secretsmanager:<region>:<account>:secret:<name>
+		if parts := strings.Split(name, ":"); len(parts) > 3 && parts[0] == "arn" {
+			region = parts[3]
+		}
+		if region == "" {
+			return nil, fmt.Errorf("%s: AWS_REGION is not set", v)
+		}
+		endpoint := os.Getenv("AWS_SECRETS_MANAGER_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+		}
+		s.fetch = awsSecretFetch(strings.TrimRight(endpoint, "/"), region, name, field)
+	default:
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Value returns the secret's latest value; empty until read successfully.
+func (s *Secret) Value() string {
+	if v := s.value.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// Refresh reads the secret again. A failed read keeps the previous value.
+func (s *Secret) Refresh(ctx context.Context) error {
+	v, err := s.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.Ref, err)
+	}
+	s.value.Store(&v)
+	return nil
+}
+
+// Secrets returns the secrets c refers to.
+func (c *Config) Secrets() []*Secret {
+	var out []*Secret
+	for _, s := range []*Secret{c.UpstreamAPIKeySecret, c.EmailKeySecret, c.EmailSecondarySecret} {
+		if s != nil {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// CurrentUpstreamAPIKey returns the upstream API key, as last read from its
+// secrets backend when UPSTREAM_API_KEY is a reference.
+func (c *Config) CurrentUpstreamAPIKey() string {
+	if c.UpstreamAPIKeySecret != nil {
+		return c.UpstreamAPIKeySecret.Value()
+	}
+	return c.UpstreamAPIKey
+}
+
+// CurrentEmailKey returns the identity encryption key, as last read from its
+// secrets backend when EMAIL_ENCRYPTION_KEY is a reference.
+func (c *Config) CurrentEmailKey() string {
+	if c.EmailKeySecret != nil {
+		return c.EmailKeySecret.Value()
+	}
+	return c.EmailEncryptionKey
+}
+
+// CurrentEmailSecondaryKey returns the previous identity encryption key, as
+// last read from its secrets backend when EMAIL_ENCRYPTION_KEY_SECONDARY is a
+// reference.
+func (c *Config) CurrentEmailSecondaryKey() string {
+	if c.EmailSecondarySecret != nil {
+		return c.EmailSecondarySecret.Value()
+	}
+	return c.EmailSecondaryKey
+}
+
+// secretEnv returns the value of env, read from a secrets backend when env
+// holds a reference, and the Secret it refers to.
+func secretEnv(env string) (string, *Secret) {
+	v := os.Getenv(env)
+	s, err := ParseSecret(v)
+	if err != nil {
+		configLog().Error("invalid secret reference", "env", env, "error", err)
+		return "", nil
+	}
+	if s == nil {
+		return v, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	if err := s.Refresh(ctx); err != nil {
+		configLog().Error("failed to read secret", "env", env, "error", err)
+	}
+	return s.Value(), s
+}
+
+// vaultFetch reads a field of a KV secret. Version 2 engines nest the fields
+// under data.data and take paths with a data/ segment, e.g.
+// vault://secret/data/apigate#key.
+func vaultFetch(addr, token, namespace, path, field string) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", addr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-Vault-Token", token)
+		if namespace != "" {
+			req.Header.Set("X-Vault-Namespace", namespace)
+		}
+		body, err := readSecretResponse(req)
+		if err != nil {
+			return "", err
+		}
+		var secret struct {
+			Data map[string]any `json:"data"`
+		}
+		if err := json.Unmarshal(body, &secret); err != nil {
+			return "", err
+		}
+		data := secret.Data
+		if nested, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+			data = nested
+		}
+		v, ok := data[field].(string)
+		if !ok {
+			return "", fmt.Errorf("no string field %q", field)
+		}
+		return v, nil
+	}
+}
+
+// awsSecretFetch reads a secret with the Secrets Manager GetSecretValue API,
+// signed with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+func awsSecretFetch(endpoint, region, id, field string) func(context.Context) (string, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	sessionToken := os.Getenv("AWS_SESSION_TOKEN")
+	return func(ctx context.Context) (string, error) {
+		payload, _ := json.Marshal(map[string]string{"SecretId": id})
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint+"/", bytes.NewReader(payload))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+		if sessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", sessionToken)
+		}
+		utils.SignV4(req, utils.SHA256Hex(payload), accessKey, secretKey, region, "secretsmanager", time.Now())
+		body, err := readSecretResponse(req)
+		if err != nil {
+			return "", err
+		}
+		var secret struct {
+			SecretString *string `json:"SecretString"`
+		}
+		if err := json.Unmarshal(body, &secret); err != nil {
+			return "", err
+		}
+		if secret.SecretString == nil {
+			return "", fmt.Errorf("secret has no string value")
+		}
+		if field == "" {
+			return *secret.SecretString, nil
+		}
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(*secret.SecretString), &fields); err != nil {
+			return "", fmt.Errorf("secret is not a JSON object: %w", err)
+		}
+		v, ok := fields[field].(string)
+		if !ok {
+			return "", fmt.Errorf("no string field %q", field)
+		}
+		return v, nil
+	}
+}
+
+// readSecretResponse sends req and returns the body of a 2xx response.
+func readSecretResponse(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
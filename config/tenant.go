@@ -0,0 +1,138 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+)
+
+// Tenant holds the settings one tenant overrides in TENANTS_FILE. Zero values
+// inherit the deployment-wide setting.
+type Tenant struct {
+	UpstreamAPIKey         string   `json:"upstream_api_key"`
+	ClientAPIKeys          []string `json:"client_api_keys"` // Keys bound to this tenant
+	EmailEncryptionKey     string   `json:"email_encryption_key"`
+	EmailSecondaryKey      string   `json:"email_encryption_key_secondary"`
+	EmailKeyID             string   `json:"email_encryption_key_id"`
+	EmailSecondaryKeyID    string   `json:"email_encryption_key_secondary_id"`
+	EmailEncryptionEnabled *bool    `json:"email_encryption_enabled"`
+	WindowSeconds          int      `json:"window_seconds"`
+	LogBatchSize           int      `json:"log_batch_size"`
+	LogFlushInterval       int      `json:"log_flush_interval"`
+	MaxInFlight            int      `json:"max_in_flight"`
+	BreakerFailures        int      `json:"circuit_breaker_failures"`
+	BreakerOpenSeconds     int      `json:"circuit_breaker_open_seconds"`
+}
+
+// TenantsFileContent is the JSON layout of TENANTS_FILE.
+type TenantsFileContent struct {
+	Tenants map[string]Tenant `json:"tenants"`
+}
+
+// Tenant IDs end up in directory names and object keys, so they are kept to
+// a safe alphabet.
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// ValidTenantID reports whether id may name a tenant.
+func ValidTenantID(id string) bool {
+	return tenantIDPattern.MatchString(id)
+}
+
+// Key IDs prefix every identity hash, so they are kept short and free of the
+// "$" that ends them.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+
+// ValidKeyID reports whether id may name an encryption key.
+func ValidKeyID(id string) bool {
+	return keyIDPattern.MatchString(id)
+}
+
+// LoadTenantsFile reads a JSON tenants file.
+func LoadTenantsFile(file string) (map[string]Tenant, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var content TenantsFileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	for id, t := range content.Tenants {
+		if !ValidTenantID(id) {
+			return nil, fmt.Errorf("invalid tenant ID %q", id)
+		}
+		for _, keyID := range []string{t.EmailKeyID, t.EmailSecondaryKeyID} {
+			if keyID != "" && !ValidKeyID(keyID) {
+				return nil, fmt.Errorf("tenant %q: invalid key ID %q", id, keyID)
+			}
+		}
+	}
+	return content.Tenants, nil
+}
+
+// ForTenant returns the configuration of tenant id: a copy of c with the
+// tenant's overrides applied, and on-disk and archive locations moved under a
+// per-tenant subdirectory so tenants never share spooled or archived logs.
+func (c *Config) ForTenant(id string, t Tenant) *Config {
+	tc := *c
+	tc.Tenants = nil
+	if t.UpstreamAPIKey != "" {
+		tc.UpstreamAPIKey = t.UpstreamAPIKey
+		tc.UpstreamAPIKeySecret = nil
+	}
+	tc.ClientAPIKeys = t.ClientAPIKeys
+	if t.EmailEncryptionKey != "" {
+		tc.EmailEncryptionKey = t.EmailEncryptionKey
+		tc.EmailKeySecret = nil
+		// The deployment's previous key and key IDs are not this tenant's
+		tc.EmailSecondaryKey = ""
+		tc.EmailSecondarySecret = nil
+		tc.EmailKeyID = t.EmailKeyID
+		tc.EmailSecondaryKeyID = ""
+	}
+	if t.EmailSecondaryKey != "" {
+		tc.EmailSecondaryKey = t.EmailSecondaryKey
+		tc.EmailSecondarySecret = nil
+		tc.EmailSecondaryKeyID = t.EmailSecondaryKeyID
+	}
+	if t.EmailEncryptionEnabled != nil {
+		tc.EmailEncryptionEnabled = *t.EmailEncryptionEnabled
+	}
+	if t.WindowSeconds > 0 {
+		tc.WindowSeconds = t.WindowSeconds
+	}
+	if t.LogBatchSize > 0 {
+		tc.LogBatchSize = t.LogBatchSize
+	}
+	if t.LogFlushInterval > 0 {
+		tc.LogFlushInterval = t.LogFlushInterval
+	}
+	if t.MaxInFlight > 0 {
+		tc.TenantMaxInFlight = t.MaxInFlight
+	}
+	if t.BreakerFailures > 0 {
+		tc.BreakerFailures = t.BreakerFailures
+	}
+	if t.BreakerOpenSeconds > 0 {
+		tc.BreakerOpenSeconds = t.BreakerOpenSeconds
+	}
+	if tc.LogSpillDir != "" {
+		tc.LogSpillDir = filepath.Join(tc.LogSpillDir, "tenants", id)
+	}
+	if tc.LogDLQDir != "" {
+		tc.LogDLQDir = filepath.Join(tc.LogDLQDir, "tenants", id)
+	}
+	tc.ArchivePrefix = path.Join(tc.ArchivePrefix, "tenant="+id)
+	// Scheduled reports cover the whole deployment
+	tc.ReportInterval = ""
+	// Gossip carries the default service's decisions only
+	tc.GossipBind = ""
+	// Pushed changes reach tenants through POST /admin/invalidate only
+	tc.InvalidationChannel = ""
+	// The default service refreshes the secrets tenants share with it
+	tc.SecretRefreshSecs = 0
+	return &tc
+}
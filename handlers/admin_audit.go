@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"apigate-proxy/service"
+)
+
+// HeaderAdminActor names the person or system behind an admin request, for
+// the admin audit trail. It is recorded as given, next to the key used.
+const HeaderAdminActor = "X-Admin-Actor"
+
+// recordAdmin adds an admin action taken by r to the admin audit trail.
+func (h *ProxyHandler) recordAdmin(r *http.Request, act service.AdminAction) {
+	if h.AdminAudit == nil {
+		return
+	}
+	act.Endpoint = r.URL.Path
+	act.KeyID = AdminKeyID(r)
+	act.Actor = r.Header.Get(HeaderAdminActor)
+	act.RemoteIP = remoteIP(r)
+	if h.Tenants != nil {
+		act.Tenant = r.Header.Get(h.Service.Config().TenantHeader)
+	}
+	if err := h.AdminAudit.Record(act); err != nil {
+		slog.Error("failed to record admin action", "component", "admin", "action", act.Action, "error", err)
+	}
+}
+
+// AdminAuditHandler queries the admin audit trail: since/until (RFC 3339),
+// action, actor (X-Admin-Actor or key ID) and limit. It must be mounted
+// behind AdminKeyAuth.
+func (h *ProxyHandler) AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if h.AdminAudit == nil {
+		http.NotFound(w, r)
+		return
+	}
+	params := r.URL.Query()
+	q := service.AdminAuditQuery{
+		Action: params.Get("action"),
+		Actor:  params.Get("actor"),
+	}
+	var err error
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid until parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	actions, err := h.AdminAudit.Query(q)
+	if err != nil {
+		slog.Error("failed to read admin audit trail", "component", "admin", "error", err)
+		http.Error(w, "Failed to read admin audit trail", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]service.AdminAction{"actions": actions})
+}
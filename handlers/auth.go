@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"apigate-proxy/models"
+	"apigate-proxy/utils"
+)
+
+type (
+	clientKeyContextKey struct{}
+	adminKeyContextKey  struct{}
+)
+
+// APIKeyAuth returns middleware requiring one of keys in the X-API-Key header
+// (or "Authorization: Bearer <key>"). With no keys configured it is a no-op.
+func APIKeyAuth(keys []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(keys) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if k := matchAPIKey(keys, requestAPIKey(r)); k != "" {
+				ctx := context.WithValue(r.Context(), clientKeyContextKey{}, k)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			writeAllowResponse(w, http.StatusUnauthorized, models.AllowResponse{
+				Allow:  false,
+				Status: "failure",
+				Error:  "Missing or invalid API key",
+			})
+		})
+	}
+}
+
+// AdminKeyAuth returns middleware requiring one of keys (ADMIN_API_KEYS), read
+// like APIKeyAuth. Unlike APIKeyAuth it fails closed: with no keys configured
+// admin endpoints answer 404, as if they did not exist.
+func AdminKeyAuth(keys []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(keys) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			k := matchAPIKey(keys, requestAPIKey(r))
+			if k == "" {
+				http.Error(w, "Missing or invalid admin API key", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminKeyContextKey{}, k)))
+		})
+	}
+}
+
+// matchAPIKey returns the configured key equal to presented, or "" if none is.
+func matchAPIKey(keys []string, presented string) string {
+	if presented == "" {
+		return ""
+	}
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(k)) == 1 {
+			return k
+		}
+	}
+	return ""
+}
+
+func requestAPIKey(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// ClientKey returns the API key the request was authenticated with, if any.
+func ClientKey(r *http.Request) string {
+	k, _ := r.Context().Value(clientKeyContextKey{}).(string)
+	return k
+}
+
+// AdminKeyID identifies the admin API key the request was authenticated with,
+// without revealing it: the first 12 hex digits of its SHA-256 hash.
+func AdminKeyID(r *http.Request) string {
+	k, _ := r.Context().Value(adminKeyContextKey{}).(string)
+	if k == "" {
+		return ""
+	}
+	return utils.SHA256Hex([]byte(k))[:12]
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	var gotKey string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = ClientKey(r)
+	})
+	h := APIKeyAuth([]string{"key-a", "key-b"})(next)
+
+	cases := []struct {
+		header, value string
+		code          int
+		key           string
+	}{
+		{"X-API-Key", "key-b", http.StatusOK, "key-b"},
+		{"Authorization", "Bearer key-a", http.StatusOK, "key-a"},
+		{"Authorization", "Basic key-a", http.StatusUnauthorized, ""},
+		{"X-API-Key", "key-c", http.StatusUnauthorized, ""},
+		{"", "", http.StatusUnauthorized, ""},
+	}
+	for _, c := range cases {
+		gotKey = ""
+		r := httptest.NewRequest(http.MethodPost, "/api/allow", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != c.code || gotKey != c.key {
+			t.Errorf("%s %q: got %d with key %q, want %d with %q", c.header, c.value, rec.Code, gotKey, c.code, c.key)
+		}
+	}
+
+	// Without CLIENT_API_KEYS every request passes
+	rec := httptest.NewRecorder()
+	APIKeyAuth(nil)(next).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/allow", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected no authentication without keys, got %d", rec.Code)
+	}
+}
+
+func TestAdminKeyAuth(t *testing.T) {
+	var keyID string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyID = AdminKeyID(r)
+	})
+	serve := func(keys []string, key string) int {
+		r := httptest.NewRequest(http.MethodPost, "/admin/invalidate", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		AdminKeyAuth(keys)(next).ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	// Admin endpoints do not exist without ADMIN_API_KEYS
+	if code := serve(nil, "anything"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 without admin keys, got %d", code)
+	}
+	if code := serve([]string{"admin"}, "client"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong key refused, got %d", code)
+	}
+	if code := serve([]string{"admin"}, "admin"); code != http.StatusOK || len(keyID) != 12 || keyID == "admin" {
+		t.Errorf("Expected the admin key accepted and identified by hash, got %d with ID %q", code, keyID)
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/service"
+)
+
+// Bulkhead caps concurrent in-flight requests per tenant, so one tenant's
+// spike or slow upstream lookups cannot occupy every server goroutine and
+// starve the others. Each tenant's limit is its TENANT_MAX_IN_FLIGHT, which
+// TENANTS_FILE may override with max_in_flight.
+type Bulkhead struct {
+	tenants *service.Tenants // nil = only the default tenant
+	header  string
+	limits  map[string]int // Tenant ID -> limit; "" is the default tenant
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// NewBulkhead returns nil (no limit) when no tenant has a positive limit.
+// tenants may be nil when TENANTS_FILE is unset.
+func NewBulkhead(cfg *config.Config, tenants *service.Tenants) *Bulkhead {
+	b := &Bulkhead{
+		tenants:  tenants,
+		header:   cfg.TenantHeader,
+		limits:   make(map[string]int),
+		inFlight: make(map[string]int),
+	}
+	if cfg.TenantMaxInFlight > 0 {
+		b.limits[""] = cfg.TenantMaxInFlight
+	}
+	if tenants != nil {
+		for _, id := range tenants.IDs() {
+			if max := tenants.Proxy(id).Config().TenantMaxInFlight; max > 0 {
+				b.limits[id] = max
+			}
+		}
+	}
+	if len(b.limits) == 0 {
+		return nil
+	}
+	return b
+}
+
+// Acquire reserves a slot for tenant. Callers that got true must Release.
+func (b *Bulkhead) Acquire(tenant string) bool {
+	max, ok := b.limits[tenant]
+	if !ok {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.inFlight[tenant] >= max {
+		return false
+	}
+	b.inFlight[tenant]++
+	return true
+}
+
+// Release frees a slot taken by Acquire. Idle tenants are forgotten.
+func (b *Bulkhead) Release(tenant string) {
+	if _, ok := b.limits[tenant]; !ok {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.inFlight[tenant]--; b.inFlight[tenant] <= 0 {
+		delete(b.inFlight, tenant)
+	}
+}
+
+// tenant returns the tenant r is counted against, resolved like the handler
+// resolves it: the tenant header, or else the body's tenant_id, and the tenant
+// bound to its API key. The body is read ahead and restored for the handler.
+// ok is false when the request names a tenant it may not use; the handler then
+// rejects it.
+func (b *Bulkhead) tenant(r *http.Request) (id string, ok bool) {
+	if b.tenants == nil {
+		return "", true
+	}
+	var field string
+	if r.Header.Get(b.header) == "" && r.Body != nil {
+		body, _ := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		// Invalid bodies name no tenant; the handler rejects them
+		var named struct {
+			TenantID string `json:"tenant_id"`
+		}
+		if json.Unmarshal(body, &named) == nil {
+			field = named.TenantID
+		}
+	}
+	id, err := b.tenants.Resolve(requestedTenant(r, b.header, field), ClientKey(r))
+	return id, err == nil
+}
+
+// Middleware rejects requests beyond their tenant's concurrency limit with
+// 503. Like RateLimiter.Middleware it must run after APIKeyAuth.
+func (b *Bulkhead) Middleware(next http.Handler) http.Handler {
+	if b == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, ok := b.tenant(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !b.Acquire(tenant) {
+			w.Header().Set("Retry-After", "1")
+			writeAllowResponse(w, http.StatusServiceUnavailable, models.AllowResponse{
+				Allow:  false,
+				Status: "failure",
+				Error:  "Too many concurrent requests for this tenant",
+			})
+			return
+		}
+		defer b.Release(tenant)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/service"
+)
+
+func TestBulkhead_PerTenant(t *testing.T) {
+	cfg := &config.Config{
+		TenantHeader: "X-Tenant-ID",
+		Tenants: map[string]config.Tenant{
+			"acme":   {ClientAPIKeys: []string{"acme-client"}, MaxInFlight: 1},
+			"globex": {},
+		},
+	}
+	svc := service.NewProxyService(cfg, nil, nil)
+	tenants := service.NewTenants(cfg, svc, service.NewLoggerService(cfg, nil, nil))
+
+	// acme's requests are held in the handler until released
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := APIKeyAuth([]string{"acme-client", "other-client"})(NewBulkhead(cfg, tenants).Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ClientKey(r) == "acme-client" {
+				entered <- struct{}{}
+				<-release
+			}
+		})))
+	serve := func(key, tenant string) chan int {
+		r := httptest.NewRequest(http.MethodPost, "/api/allow", nil)
+		r.Header.Set("X-API-Key", key)
+		if tenant != "" {
+			r.Header.Set("X-Tenant-ID", tenant)
+		}
+		done := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			done <- rec.Code
+		}()
+		return done
+	}
+
+	// acme's one slot is taken by its bound key
+	first := serve("acme-client", "")
+	<-entered
+
+	second := serve("acme-client", "acme")
+	if code := <-second; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected acme's second request rejected, got %d", code)
+	}
+
+	// Other tenants have no limit of their own
+	for _, tenant := range []string{"globex", ""} {
+		if code := <-serve("other-client", tenant); code != http.StatusOK {
+			t.Errorf("Expected tenant %q unaffected by acme's limit, got %d", tenant, code)
+		}
+	}
+
+	release <- struct{}{}
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("Expected the first request served, got %d", code)
+	}
+	third := serve("acme-client", "")
+	<-entered
+	release <- struct{}{}
+	if code := <-third; code != http.StatusOK {
+		t.Errorf("Expected acme's slot freed, got %d", code)
+	}
+}
+
+func TestBulkhead_DefaultTenant(t *testing.T) {
+	if NewBulkhead(&config.Config{}, nil) != nil {
+		t.Error("Expected no bulkhead without TENANT_MAX_IN_FLIGHT")
+	}
+
+	b := NewBulkhead(&config.Config{TenantMaxInFlight: 2}, nil)
+	if !b.Acquire("") || !b.Acquire("") {
+		t.Fatal("Expected two slots")
+	}
+	if b.Acquire("") {
+		t.Error("Expected the third request over the limit")
+	}
+	b.Release("")
+	if !b.Acquire("") {
+		t.Error("Expected a released slot reused")
+	}
+}
+
+func TestBulkhead_BodyTenant(t *testing.T) {
+	cfg := &config.Config{
+		TenantHeader: "X-Tenant-ID",
+		Tenants:      map[string]config.Tenant{"globex": {MaxInFlight: 1}},
+	}
+	svc := service.NewProxyService(cfg, nil, nil)
+	tenants := service.NewTenants(cfg, svc, service.NewLoggerService(cfg, nil, nil))
+
+	// globex's requests are held in the handler, which reads the body itself
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := APIKeyAuth([]string{"client"})(NewBulkhead(cfg, tenants).Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req models.AllowRequest
+			if json.NewDecoder(r.Body).Decode(&req) == nil && req.TenantID == "globex" {
+				entered <- struct{}{}
+				<-release
+			}
+		})))
+	serve := func(body string) chan int {
+		r := httptest.NewRequest(http.MethodPost, "/api/allow", strings.NewReader(body))
+		r.Header.Set("X-API-Key", "client")
+		done := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			done <- rec.Code
+		}()
+		return done
+	}
+
+	first := serve(`{"ip_address":"1.1.1.1","tenant_id":"globex"}`)
+	<-entered
+	// Naming the tenant in the body does not escape its limit
+	if code := <-serve(`{"ip_address":"1.1.1.1","tenant_id":"globex"}`); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected globex's second request rejected, got %d", code)
+	}
+	if code := <-serve(`{"ip_address":"1.1.1.1"}`); code != http.StatusOK {
+		t.Errorf("Expected the default tenant unaffected, got %d", code)
+	}
+	release <- struct{}{}
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("Expected the first request served, got %d", code)
+	}
+}
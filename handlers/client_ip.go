@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"apigate-proxy/config"
+)
+
+// clientIP returns the client address of a request whose body names none:
+// the one given by trusted proxies' forwarding headers or, with
+// CLIENT_IP_FROM_REMOTE_ADDR, the connection's source address. A trusted
+// proxy's own address is never used, since it is not the client's. The
+// result is empty when neither applies.
+func clientIP(r *http.Request, cfg *config.Config) string {
+	if ip := forwardedClientIP(r, cfg.TrustedProxies); ip != "" {
+		return ip
+	}
+	if !cfg.ClientIPFromRemoteAddr {
+		return ""
+	}
+	peer, ok := parseHop(remoteIP(r))
+	if !ok || isTrustedProxy(peer, cfg.TrustedProxies) {
+		return ""
+	}
+	return peer.String()
+}
+
+// forwardedClientIP returns the client address named by r's forwarding
+// headers: the Forwarded header (RFC 7239), X-Forwarded-For or X-Real-IP, the
+// first one present. The headers are only believed when the peer is one of
+// the trusted proxies; otherwise, or when they name no valid address, the
+// result is empty.
+func forwardedClientIP(r *http.Request, trusted []netip.Prefix) string {
+	if len(trusted) == 0 {
+		return ""
+	}
+	peer, ok := parseHop(remoteIP(r))
+	if !ok || !isTrustedProxy(peer, trusted) {
+		return ""
+	}
+	if hops := forwardedHops(r.Header.Values("Forwarded")); len(hops) > 0 {
+		return clientFromHops(hops, trusted)
+	}
+	if hops := listHops(r.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		return clientFromHops(hops, trusted)
+	}
+	if ip, ok := parseHop(r.Header.Get("X-Real-IP")); ok {
+		return ip.String()
+	}
+	return ""
+}
+
+// clientFromHops walks a forwarding chain from the nearest hop back and
+// returns the first address that is not a trusted proxy. Addresses further
+// back were written by the client itself and could be anything. A hop that is
+// not an address, such as "unknown", ends the walk without a result.
+func clientFromHops(hops []string, trusted []netip.Prefix) string {
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseHop(hops[i])
+		if !ok {
+			return ""
+		}
+		if i == 0 || !isTrustedProxy(ip, trusted) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// listHops splits X-Forwarded-For values, which may be repeated, into hops.
+func listHops(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedHops returns the for= parameters of Forwarded header values, e.g.
+// `for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`.
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, element := range listHops(values) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				hops = append(hops, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address as written in forwarding headers: optionally
+// with a port, IPv6 addresses then in brackets.
+func parseHop(v string) (netip.Addr, bool) {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "[") {
+		v, _, _ = strings.Cut(v[1:], "]")
+	} else if strings.Count(v, ":") == 1 {
+		v, _, _ = strings.Cut(v, ":")
+	}
+	ip, err := netip.ParseAddr(v)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
+
+func isTrustedProxy(ip netip.Addr, trusted []netip.Prefix) bool {
+	for _, p := range trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
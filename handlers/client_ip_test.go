@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"apigate-proxy/config"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+	cases := []struct {
+		name       string
+		peer       string
+		headers    http.Header
+		trusted    []netip.Prefix
+		fromRemote bool // CLIENT_IP_FROM_REMOTE_ADDR
+		want       string
+	}{
+		// Anyone can send forwarding headers; only trusted proxies are believed
+		{"spoofed X-Forwarded-For", "203.0.113.7:40000", http.Header{"X-Forwarded-For": {"198.51.100.9"}}, trusted, false, ""},
+		{"spoofed Forwarded", "203.0.113.7:40000", http.Header{"Forwarded": {"for=198.51.100.9"}}, trusted, false, ""},
+		{"spoofed X-Real-IP", "203.0.113.7:40000", http.Header{"X-Real-Ip": {"198.51.100.9"}}, trusted, false, ""},
+		{"no trusted proxies", "10.0.0.1:40000", http.Header{"X-Forwarded-For": {"198.51.100.9"}}, nil, false, ""},
+
+		// The right-most address that is not a trusted proxy is the client
+		{"single hop", "10.0.0.1:40000", http.Header{"X-Forwarded-For": {"198.51.100.9"}}, trusted, false, "198.51.100.9"},
+		{"trusted hops", "10.0.0.1:40000", http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.9, 10.0.0.3, 10.0.0.2"}}, trusted, false, "198.51.100.9"},
+		{"repeated header", "10.0.0.1:40000", http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.9", "10.0.0.2"}}, trusted, false, "198.51.100.9"},
+		{"only trusted hops", "10.0.0.1:40000", http.Header{"X-Forwarded-For": {"10.0.0.5, 10.0.0.3"}}, trusted, false, "10.0.0.5"},
+		{"invalid hop", "10.0.0.1:40000", http.Header{"X-Forwarded-For": {"198.51.100.9, not-an-ip"}}, trusted, false, ""},
+		{"trusted IPv6 peer", "[fd00::1]:40000", http.Header{"X-Forwarded-For": {"2001:db8::7"}}, trusted, false, "2001:db8::7"},
+
+		// Forwarded (RFC 7239)
+		{"forwarded chain", "10.0.0.1:40000", http.Header{"Forwarded": {"for=6.6.6.6, for=198.51.100.9;proto=https, for=10.0.0.2"}}, trusted, false, "198.51.100.9"},
+		{"unknown hop", "10.0.0.1:40000", http.Header{"Forwarded": {"for=198.51.100.9, for=unknown"}}, trusted, false, ""},
+		{"quoted IPv6 with port", "10.0.0.1:40000", http.Header{"Forwarded": {`for="[2001:db8::1]:4711"`}}, trusted, false, "2001:db8::1"},
+		{"IPv4 with port", "10.0.0.1:40000", http.Header{"Forwarded": {`For="198.51.100.9:4711"`}}, trusted, false, "198.51.100.9"},
+
+		// Forwarded wins over X-Forwarded-For, which wins over X-Real-IP
+		{"Forwarded first", "10.0.0.1:40000", http.Header{
+			"Forwarded":       {"for=198.51.100.1"},
+			"X-Forwarded-For": {"198.51.100.2"},
+			"X-Real-Ip":       {"198.51.100.3"},
+		}, trusted, false, "198.51.100.1"},
+		{"X-Forwarded-For second", "10.0.0.1:40000", http.Header{
+			"X-Forwarded-For": {"198.51.100.2"},
+			"X-Real-Ip":       {"198.51.100.3"},
+		}, trusted, false, "198.51.100.2"},
+		{"X-Real-IP last", "10.0.0.1:40000", http.Header{"X-Real-Ip": {"198.51.100.3"}}, trusted, false, "198.51.100.3"},
+		{"Forwarded without for", "10.0.0.1:40000", http.Header{
+			"Forwarded":       {"proto=https;by=10.0.0.1"},
+			"X-Forwarded-For": {"198.51.100.2"},
+		}, trusted, false, "198.51.100.2"},
+		{"no headers", "10.0.0.1:40000", nil, trusted, false, ""},
+
+		// Without forwarding headers, CLIENT_IP_FROM_REMOTE_ADDR falls back to
+		// the direct peer, unless that is a trusted proxy
+		{"direct peer", "203.0.113.7:40000", nil, trusted, true, "203.0.113.7"},
+		{"direct peer without port", "203.0.113.7", nil, trusted, true, "203.0.113.7"},
+		{"direct IPv6 peer", "[2001:db8::2]:40000", nil, trusted, true, "2001:db8::2"},
+		{"direct peer, no trusted proxies", "203.0.113.7:40000", nil, nil, true, "203.0.113.7"},
+		{"peer is a trusted proxy", "10.0.0.1:40000", nil, trusted, true, ""},
+		{"spoofed headers, direct peer", "203.0.113.7:40000", http.Header{"X-Forwarded-For": {"198.51.100.9"}}, trusted, true, "203.0.113.7"},
+		{"forwarded beats peer", "10.0.0.1:40000", http.Header{"X-Forwarded-For": {"198.51.100.9"}}, trusted, true, "198.51.100.9"},
+		{"invalid peer", "not-an-ip:40000", nil, trusted, true, ""},
+		{"fallback off", "203.0.113.7:40000", nil, trusted, false, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/api/allow", nil)
+		r.RemoteAddr = c.peer
+		for k, v := range c.headers {
+			r.Header[k] = v
+		}
+		cfg := &config.Config{TrustedProxies: c.trusted, ClientIPFromRemoteAddr: c.fromRemote}
+		if got := clientIP(r, cfg); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"apigate-proxy/service"
+)
+
+// DebugHandler serves net/http/pprof under /debug/pprof/ and expvar under
+// /debug/vars, for the separate DEBUG_ADDR listener only: it is neither
+// authenticated nor mounted on the public router (the handlers pprof registers
+// on http.DefaultServeMux are served by no listener). Besides the runtime's
+// memstats and cmdline, expvar publishes the proxy's cache and log stats,
+// read at each request. The API explorer is served at /docs, over the
+// OpenAPI document at /openapi.json. It must be called once per process.
+func DebugHandler(svc *service.ProxyService, logger *service.LoggerService) http.Handler {
+	expvar.Publish("cache", expvar.Func(func() any { return svc.Stats() }))
+	expvar.Publish("log", expvar.Func(func() any { return logger.Stats() }))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("GET /openapi.json", OpenAPIHandler(svc.Config()))
+	mux.Handle("GET /docs", APIExplorerHandler())
+	mux.Handle("GET /docs/", APIExplorerHandler())
+	return mux
+}
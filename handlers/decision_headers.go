@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"apigate-proxy/models"
+	"apigate-proxy/service"
+)
+
+// Headers carrying the proxy's conclusions about a request to backend applications.
+const (
+	HeaderDecision     = "X-Apigate-Decision" // "allow", "block" or "unknown" (FAIL_MODE=unknown)
+	HeaderIdentity     = "X-Apigate-Identity" // Hashed email/user ID, as sent upstream
+	HeaderIdentityType = "X-Apigate-Identity-Type"
+	HeaderCountry      = "X-Apigate-Country"
+	HeaderContinent    = "X-Apigate-Continent"
+	HeaderASN          = "X-Apigate-ASN"
+	HeaderUAClass      = "X-Apigate-UA-Class"   // "browser", "bot", "headless", "library" or "unknown"
+	HeaderOverQuota    = "X-Apigate-Over-Quota" // "true" when a key is over a local velocity limit
+	HeaderRequestID    = "X-Request-ID"
+)
+
+// decisionHeaders builds the tracing headers for a decision, so backends can
+// log and act on it without a second lookup. requestID is reused when the
+// caller already has one and generated otherwise.
+func decisionHeaders(svc *service.ProxyService, req models.AllowRequest, resp models.AllowResponse, requestID string) http.Header {
+	h := make(http.Header)
+	switch {
+	case resp.Status == service.StatusUnknown:
+		h.Set(HeaderDecision, "unknown")
+	case resp.Allow:
+		h.Set(HeaderDecision, "allow")
+	default:
+		h.Set(HeaderDecision, "block")
+	}
+	if req.Email != "" {
+		identity, identityType := svc.IdentityKey(req.Email, req.IdentityType)
+		h.Set(HeaderIdentity, identity)
+		h.Set(HeaderIdentityType, identityType)
+	}
+	if country, continent := svc.Locate(req.IPAddress); country != "" || continent != "" {
+		h.Set(HeaderCountry, country)
+		h.Set(HeaderContinent, continent)
+	}
+	if asn := svc.ASN(req.IPAddress); asn != "" {
+		h.Set(HeaderASN, asn)
+	}
+	if resp.UAClass != "" {
+		h.Set(HeaderUAClass, resp.UAClass)
+	}
+	if resp.OverQuota {
+		h.Set(HeaderOverQuota, "true")
+	}
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	h.Set(HeaderRequestID, requestID)
+	return h
+}
+
+// withDecisionHeaders returns a copy of r, as forwarded to a backend, carrying
+// the tracing headers for its decision. X-Apigate-* headers the client sent
+// are dropped so a backend never trusts a spoofed decision.
+func withDecisionHeaders(svc *service.ProxyService, r *http.Request, req models.AllowRequest, resp models.AllowResponse) *http.Request {
+	r = r.Clone(r.Context())
+	for k := range r.Header {
+		if strings.HasPrefix(k, "X-Apigate-") {
+			delete(r.Header, k)
+		}
+	}
+	for k, v := range decisionHeaders(svc, req, resp, req.RequestID) {
+		r.Header[k] = v
+	}
+	return r
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
+	"apigate-proxy/service"
+)
+
+func TestEnforcementProxy_InjectsDecisionHeaders(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll)
+
+	got := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	svc := service.NewProxyService(&config.Config{
+		UpstreamBaseURL:       upstream.URL,
+		WarmupAction:          service.WarmupLive,
+		EnforceBackendURL:     backend.URL,
+		EnforceIdentityHeader: "X-User-Email",
+	}, nil, nil)
+	enforcer, err := NewEnforcementProxy(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req.Header.Set("X-User-Email", "alice@example.com")
+	req.Header.Set(HeaderRequestID, "req-1")
+	req.Header.Set(HeaderDecision, "allow")   // Spoofed by the client
+	req.Header.Set("X-Apigate-Admin", "true") // Unknown, but in our namespace
+	rec := httptest.NewRecorder()
+	enforcer.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the request forwarded, got %d", rec.Code)
+	}
+
+	h := <-got
+	identity, identityType := svc.IdentityKey("alice@example.com", "")
+	if h.Get(HeaderDecision) != "allow" || h.Get(HeaderIdentity) != identity || h.Get(HeaderIdentityType) != identityType {
+		t.Errorf("Expected the decision and hashed identity on the backend request, got %v", h)
+	}
+	if h.Get(HeaderRequestID) != "req-1" {
+		t.Errorf("Expected the client's request ID kept, got %q", h.Get(HeaderRequestID))
+	}
+	if h.Get("X-Apigate-Admin") != "" || len(h.Values(HeaderDecision)) != 1 {
+		t.Errorf("Expected client X-Apigate-* headers dropped, got %v", h)
+	}
+	if rec.Header().Get(HeaderDecision) != "" {
+		t.Error("Expected the decision headers only on the backend request")
+	}
+}
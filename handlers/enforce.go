@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"apigate-proxy/models"
+	"apigate-proxy/service"
+	"apigate-proxy/utils"
+)
+
+// Enforcer decides every request it receives and passes the allowed ones to
+// next, answering the blocked ones with 403 itself. Applications behind it
+// are protected without calling /api/allow.
+type Enforcer struct {
+	svc  *service.ProxyService
+	next http.Handler
+
+	// Request builds the AllowRequest deciding r (default AllowRequest)
+	Request func(r *http.Request) models.AllowRequest
+	// Blocked answers blocked requests (default 403 Forbidden)
+	Blocked http.Handler
+	// Logger queues a log record of every request with its response code (nil = none)
+	Logger *service.LoggerService
+}
+
+// NewEnforcer returns an Enforcer forwarding allowed requests to next.
+func NewEnforcer(svc *service.ProxyService, next http.Handler) *Enforcer {
+	return &Enforcer{svc: svc, next: next}
+}
+
+// NewEnforcementProxy returns an Enforcer reverse-proxying allowed requests
+// to ENFORCE_BACKEND_URL.
+func NewEnforcementProxy(svc *service.ProxyService) (*Enforcer, error) {
+	backend, err := url.Parse(svc.Config().EnforceBackendURL)
+	if err != nil {
+		return nil, err
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(backend)
+			pr.SetXForwarded()
+			pr.Out.Host = pr.In.Host
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if !errors.Is(err, context.Canceled) {
+				slog.Warn("backend request failed", "component", "enforce", "backend", backend.Host, "error", err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return NewEnforcer(svc, rp), nil
+}
+
+// ServeHTTP decides r. Forwarded requests carry the X-Apigate-* decision
+// headers in place of any the client sent. Answers given under
+// FAIL_MODE=unknown are forwarded for the backend to judge.
+func (e *Enforcer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req models.AllowRequest
+	if e.Request != nil {
+		req = e.Request(r)
+	} else {
+		req = e.AllowRequest(r)
+	}
+	if e.Logger != nil {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		defer func() { e.queueLog(r, req, rec.code) }()
+		w = rec
+	}
+
+	resp, err := e.svc.Check(r.Context(), req)
+	if err != nil {
+		code, _ := errorStatus(err)
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	if !resp.Allow && resp.Status != service.StatusUnknown {
+		e.svc.Tarpit(r.Context(), resp)
+		if e.Blocked != nil {
+			e.Blocked.ServeHTTP(w, r)
+		} else {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+		return
+	}
+
+	e.next.ServeHTTP(w, withDecisionHeaders(e.svc, r, req, resp))
+}
+
+// AllowRequest describes r by its source address, User-Agent, TLS and
+// header-shape fingerprints, path and ENFORCE_IDENTITY_HEADER.
+func (e *Enforcer) AllowRequest(r *http.Request) models.AllowRequest {
+	cfg := e.svc.Config()
+	req := models.AllowRequest{
+		IPAddress:             remoteIP(r),
+		UserAgent:             r.UserAgent(),
+		ClientCertFingerprint: clientCertFingerprint(r, cfg.ClientCertHeader),
+		JA3:                   ja3Fingerprint(r, cfg.JA3Header),
+		RequestFingerprint:    utils.RequestFingerprint(r),
+		RequestID:             r.Header.Get(HeaderRequestID),
+		Endpoint:              r.URL.Path,
+	}
+	if cfg.EnforceIdentityHeader != "" {
+		req.Email = r.Header.Get(cfg.EnforceIdentityHeader)
+	}
+	return req
+}
+
+// queueLog records a request as POST /api/log would.
+func (e *Enforcer) queueLog(r *http.Request, req models.AllowRequest, code int) {
+	e.Logger.QueueLog(models.LogRequest{
+		IPAddress:             req.IPAddress,
+		Email:                 req.Email,
+		IdentityType:          req.IdentityType,
+		UserAgent:             req.UserAgent,
+		ClientCertFingerprint: req.ClientCertFingerprint,
+		JA3:                   req.JA3,
+		RequestFingerprint:    req.RequestFingerprint,
+		HTTPMethod:            r.Method,
+		Endpoint:              r.URL.Path,
+		EventType:             r.URL.Path,
+		ResponseCode:          code,
+		TrackRequest:          true,
+	})
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
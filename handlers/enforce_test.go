@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
+	"apigate-proxy/service"
+)
+
+// enforced serves a request from ip through e and returns its status. backend
+// is cleared first, for the backend handler to set when it is reached.
+func enforced(e *Enforcer, backend *bool, ip string) int {
+	*backend = false
+	r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	r.RemoteAddr = ip + ":40000"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, r)
+	return rec.Code
+}
+
+func TestEnforcer_BlocksAndForwards(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.Block("6.6.6.6"))
+	svc := service.NewProxyService(&config.Config{
+		UpstreamBaseURL: upstream.URL,
+		WarmupAction:    service.WarmupLive,
+	}, nil, nil)
+	var reached bool
+	e := NewEnforcer(svc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	if code := enforced(e, &reached, "6.6.6.6"); code != http.StatusForbidden || reached {
+		t.Errorf("Expected a blocked source answered 403 without the backend, got %d", code)
+	}
+	if code := enforced(e, &reached, "1.1.1.1"); code != http.StatusOK || !reached {
+		t.Errorf("Expected an allowed source forwarded, got %d", code)
+	}
+
+	// A custom answer for blocked requests
+	e.Blocked = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	if code := enforced(e, &reached, "6.6.6.6"); code != http.StatusTeapot || reached {
+		t.Errorf("Expected the Blocked handler used, got %d", code)
+	}
+}
+
+func TestEnforcer_FailMode(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll, func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	})
+
+	for _, c := range []struct {
+		failMode string
+		code     int
+		decision string
+	}{
+		// Unknown answers are the backend's to judge
+		{service.FailUnknown, http.StatusOK, "unknown"},
+		{service.FailClosed, http.StatusForbidden, ""},
+		{service.FailOpen, http.StatusOK, "allow"},
+	} {
+		svc := service.NewProxyService(&config.Config{
+			UpstreamBaseURL: upstream.URL,
+			WarmupAction:    service.WarmupLive,
+			FailMode:        c.failMode,
+		}, nil, nil)
+		var reached bool
+		var decision string
+		e := NewEnforcer(svc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reached = true
+			decision = r.Header.Get(HeaderDecision)
+		}))
+		code := enforced(e, &reached, "1.1.1.1")
+		if code != c.code || reached != (c.code == http.StatusOK) || decision != c.decision {
+			t.Errorf("FAIL_MODE=%s: got %d, forwarded %v with decision %q; want %d with %q",
+				c.failMode, code, reached, decision, c.code, c.decision)
+		}
+	}
+}
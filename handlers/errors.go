@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+
+	"apigate-proxy/service"
+)
+
+// Machine-readable error codes reported in AllowResponse.ErrorCode.
+const (
+	ErrorCodeNoKeys               = "no_keys"
+	ErrorCodeInvalidIP            = "invalid_ip_address"
+	ErrorCodeIdempotencyReused    = "idempotency_key_reused"
+	ErrorCodeUpstreamTimeout      = "upstream_timeout"
+	ErrorCodeUpstreamUnauthorized = "upstream_unauthorized"
+	ErrorCodeCircuitOpen          = "circuit_open"
+	ErrorCodeUnknownTenant        = "unknown_tenant"
+	ErrorCodeTenantForbidden      = "tenant_forbidden"
+	ErrorCodeCanceled             = "canceled"
+	ErrorCodeDeadlineExceeded     = "deadline_exceeded"
+	ErrorCodeInternal             = "internal"
+)
+
+// statusClientClosedRequest answers a request whose client disconnected
+// before its decision was made.
+const statusClientClosedRequest = 499
+
+// errorStatus maps a service error to its HTTP status and error code.
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, service.ErrNoKeys):
+		return http.StatusBadRequest, ErrorCodeNoKeys
+	case errors.Is(err, service.ErrInvalidIP):
+		return http.StatusBadRequest, ErrorCodeInvalidIP
+	case errors.Is(err, service.ErrIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity, ErrorCodeIdempotencyReused
+	case errors.Is(err, service.ErrUpstreamTimeout):
+		return http.StatusGatewayTimeout, ErrorCodeUpstreamTimeout
+	case errors.Is(err, service.ErrUpstreamUnauthorized):
+		// The proxy's own credentials are wrong, not the caller's
+		return http.StatusBadGateway, ErrorCodeUpstreamUnauthorized
+	case errors.Is(err, service.ErrCircuitOpen):
+		return http.StatusServiceUnavailable, ErrorCodeCircuitOpen
+	case errors.Is(err, service.ErrUnknownTenant):
+		return http.StatusBadRequest, ErrorCodeUnknownTenant
+	case errors.Is(err, service.ErrTenantForbidden):
+		return http.StatusForbidden, ErrorCodeTenantForbidden
+	case errors.Is(err, context.Canceled):
+		// The client went away; nginx's "client closed request"
+		return statusClientClosedRequest, ErrorCodeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, ErrorCodeDeadlineExceeded
+	default:
+		return http.StatusInternalServerError, ErrorCodeInternal
+	}
+}
+
+// grpcCode maps a service error to its gRPC status code.
+func grpcCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, service.ErrNoKeys), errors.Is(err, service.ErrInvalidIP):
+		return codes.InvalidArgument
+	case errors.Is(err, service.ErrIdempotencyKeyReused):
+		return codes.FailedPrecondition
+	case errors.Is(err, service.ErrUpstreamTimeout):
+		return codes.DeadlineExceeded
+	case errors.Is(err, service.ErrUpstreamUnauthorized), errors.Is(err, service.ErrCircuitOpen):
+		return codes.Unavailable
+	case errors.Is(err, service.ErrUnknownTenant):
+		return codes.NotFound
+	case errors.Is(err, service.ErrTenantForbidden):
+		return codes.PermissionDenied
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
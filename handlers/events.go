@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"apigate-proxy/service"
+)
+
+// eventsHeartbeat is how often an idle event stream gets a comment line, so
+// proxies and load balancers do not time it out.
+const eventsHeartbeat = 15 * time.Second
+
+// EventsHandler streams decisions and cache swaps as server-sent events:
+// GET /api/events?events=decision,swap&key_types=ip,email&outcome=block.
+// Each event is an "event: <type>" line and a "data: <JSON>" line.
+func (h *ProxyHandler) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	svc, _, err := h.proxyFor(r, "")
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	params := r.URL.Query()
+	f := service.EventFilter{
+		Types:    splitParam(params.Get("events")),
+		KeyTypes: splitParam(params.Get("key_types")),
+		Outcome:  params.Get("outcome"),
+	}
+	for _, t := range f.Types {
+		if t != service.EventDecision && t != service.EventSwap {
+			http.Error(w, "Invalid events parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if f.Outcome != "" && f.Outcome != "allow" && f.Outcome != "block" {
+		http.Error(w, "Invalid outcome parameter", http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	sub := svc.SubscribeEvents(f)
+	defer sub.Close()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// splitParam parses a comma-separated query parameter, dropping blank entries.
+func splitParam(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
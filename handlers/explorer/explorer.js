@@ -0,0 +1,141 @@
+// Renders /openapi.json as a browsable list of operations. It is served from
+// the proxy itself, so the explorer loads nothing from third parties.
+"use strict";
+
+(async function () {
+  const main = document.getElementById("operations");
+  let spec;
+  try {
+    const resp = await fetch("/openapi.json");
+    spec = await resp.json();
+  } catch (err) {
+    main.textContent = "Could not load /openapi.json: " + err;
+    return;
+  }
+  const schemas = (spec.components && spec.components.schemas) || {};
+
+  document.getElementById("title").textContent = spec.info.title + " " + spec.info.version;
+  document.getElementById("description").textContent = spec.info.description || "";
+  document.title = spec.info.title;
+
+  function el(tag, attrs, ...children) {
+    const node = document.createElement(tag);
+    for (const [k, v] of Object.entries(attrs || {})) {
+      node.setAttribute(k, v);
+    }
+    for (const child of children) {
+      if (child != null) {
+        node.append(child);
+      }
+    }
+    return node;
+  }
+
+  // example builds a sample value of schema, following references once per
+  // path so recursive types terminate.
+  function example(schema, seen) {
+    if (!schema) {
+      return null;
+    }
+    if (schema.$ref) {
+      const name = schema.$ref.split("/").pop();
+      if (seen.has(name)) {
+        return {};
+      }
+      return example(schemas[name], new Set(seen).add(name));
+    }
+    switch (schema.type) {
+      case "object":
+        if (schema.properties) {
+          const out = {};
+          for (const [k, v] of Object.entries(schema.properties)) {
+            out[k] = example(v, seen);
+          }
+          return out;
+        }
+        if (schema.additionalProperties) {
+          return { key: example(schema.additionalProperties, seen) };
+        }
+        return {};
+      case "array":
+        return [example(schema.items, seen)];
+      case "string":
+        return schema.format === "date-time" ? "2024-01-01T00:00:00Z" : "string";
+      case "integer":
+        return 0;
+      case "number":
+        return 0.0;
+      case "boolean":
+        return false;
+    }
+    return null;
+  }
+
+  function json(schema) {
+    return el("pre", {}, JSON.stringify(example(schema, new Set()), null, 2));
+  }
+
+  function operation(method, path, op) {
+    const body = el("div", { class: "body" });
+    if (op.description) {
+      body.append(el("p", {}, op.description));
+    }
+    if (op.security && op.security.length) {
+      body.append(el("p", {}, "Authentication: ", el("code", {}, op.security.map((s) => Object.keys(s)[0]).join(" or "))));
+    }
+    if (op.parameters && op.parameters.length) {
+      const rows = op.parameters.map((p) =>
+        el("tr", {},
+          el("td", {}, el("code", p.required ? { class: "required" } : {}, p.name)),
+          el("td", {}, p.in),
+          el("td", {}, p.description || "")));
+      body.append(el("h3", {}, "Parameters"),
+        el("table", {}, el("tr", {}, el("th", {}, "Name"), el("th", {}, "In"), el("th", {}, "Description")), ...rows));
+    }
+    const request = op.requestBody && op.requestBody.content && op.requestBody.content["application/json"];
+    if (request) {
+      body.append(el("h3", {}, "Request body"), json(request.schema));
+    }
+    if (op.responses) {
+      body.append(el("h3", {}, "Responses"));
+      for (const [status, r] of Object.entries(op.responses)) {
+        const content = r.content && r.content["application/json"];
+        body.append(el("p", {}, el("span", { class: "status" }, status), " " + (r.description || "")));
+        if (content) {
+          body.append(json(content.schema));
+        }
+      }
+    }
+    return el("details", { class: op.deprecated ? "deprecated" : "", "data-search": [path, op.summary, ...(op.tags || [])].join(" ").toLowerCase() },
+      el("summary", {},
+        el("span", { class: "method " + method }, method),
+        el("span", { class: "path" }, path),
+        el("span", { class: "summary" }, op.summary || "")),
+      body);
+  }
+
+  const byTag = new Map();
+  for (const [path, methods] of Object.entries(spec.paths)) {
+    for (const [method, op] of Object.entries(methods)) {
+      const tag = (op.tags && op.tags[0]) || "other";
+      if (!byTag.has(tag)) {
+        byTag.set(tag, []);
+      }
+      byTag.get(tag).push(operation(method, path, op));
+    }
+  }
+  main.replaceChildren();
+  for (const [tag, ops] of byTag) {
+    main.append(el("section", {}, el("h2", {}, tag), ...ops));
+  }
+
+  document.getElementById("filter").addEventListener("input", (e) => {
+    const q = e.target.value.toLowerCase();
+    for (const d of main.querySelectorAll("details")) {
+      d.hidden = q !== "" && !d.dataset.search.includes(q);
+    }
+    for (const s of main.querySelectorAll("section")) {
+      s.hidden = [...s.querySelectorAll("details")].every((d) => d.hidden);
+    }
+  });
+})();
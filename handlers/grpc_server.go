@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"apigate-proxy/models"
+	apigatev1 "apigate-proxy/proto/apigate/v1"
+	"apigate-proxy/service"
+)
+
+// GRPCServer exposes ProxyService.Check and LoggerService.QueueLog over gRPC
+// with the same validation rules as the REST handlers.
+type GRPCServer struct {
+	apigatev1.UnimplementedDecisionServiceServer
+
+	Proxy  *service.ProxyService
+	Logger *service.LoggerService
+}
+
+func NewGRPCServer(proxy *service.ProxyService, logger *service.LoggerService) *GRPCServer {
+	return &GRPCServer{Proxy: proxy, Logger: logger}
+}
+
+func (g *GRPCServer) Check(ctx context.Context, in *apigatev1.AllowRequest) (*apigatev1.AllowResponse, error) {
+	req := models.AllowRequest{
+		IPAddress:             in.GetIpAddress(),
+		Email:                 in.GetEmail(),
+		UserAgent:             in.GetUserAgent(),
+		IdentityType:          in.GetIdentityType(),
+		ClientCertFingerprint: in.GetClientCertFingerprint(),
+		JA3:                   in.GetJa3(),
+		RequestFingerprint:    in.GetRequestFingerprint(),
+	}
+	if req.IPAddress == "" && req.Email == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing required fields (ip_address or email/user_id)")
+	}
+
+	resp, err := g.Proxy.Check(ctx, req)
+	if err != nil {
+		return nil, status.Error(grpcCode(err), err.Error())
+	}
+	g.Proxy.Tarpit(ctx, resp)
+	resp = g.Proxy.Redact(grpcClientKey(ctx), resp)
+	out := &apigatev1.AllowResponse{
+		Allow:   resp.Allow,
+		Status:  resp.Status,
+		Message: resp.Message,
+		Error:   resp.Error,
+	}
+	for _, b := range resp.BlockedBy {
+		out.BlockedBy = append(out.BlockedBy, &apigatev1.BlockReason{Key: b.Key, Type: b.Type, Reason: b.Reason})
+	}
+	return out, nil
+}
+
+func (g *GRPCServer) QueueLog(ctx context.Context, in *apigatev1.LogRequest) (*apigatev1.LogResponse, error) {
+	req := models.LogRequest{
+		IPAddress:             in.GetIpAddress(),
+		Email:                 in.GetEmail(),
+		IdentityType:          in.GetIdentityType(),
+		UserAgent:             in.GetUserAgent(),
+		ClientCertFingerprint: in.GetClientCertFingerprint(),
+		JA3:                   in.GetJa3(),
+		RequestFingerprint:    in.GetRequestFingerprint(),
+		HTTPMethod:            in.GetHttpMethod(),
+		Endpoint:              in.GetEndpoint(),
+		EventType:             in.GetEventType(),
+		Username:              in.GetUsername(),
+		ResponseCode:          int(in.GetResponseCode()),
+		TrackRequest:          in.GetTrackRequest(),
+	}
+	if req.IPAddress == "" || req.Email == "" || req.UserAgent == "" || req.HTTPMethod == "" || req.Endpoint == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing required fields")
+	}
+	if req.EventType == "" {
+		req.EventType = req.Endpoint
+	}
+
+	g.Logger.QueueLog(req)
+	return &apigatev1.LogResponse{Status: "success", Message: "Log queued"}, nil
+}
+
+// GRPCInterceptor applies the client API key check and rate limit used by the
+// REST endpoints. Keys are read from the "x-api-key" metadata entry.
+func GRPCInterceptor(keys []string, limiter *RateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		var presented string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if v := md.Get("x-api-key"); len(v) > 0 {
+				presented = v[0]
+			}
+		}
+
+		clientKey := matchAPIKey(keys, presented)
+		if len(keys) > 0 && clientKey == "" {
+			return nil, status.Error(codes.Unauthenticated, "Missing or invalid API key")
+		}
+
+		if limiter != nil {
+			limitKey := clientKey
+			if limitKey == "" {
+				if p, ok := peer.FromContext(ctx); ok {
+					host, _, err := net.SplitHostPort(p.Addr.String())
+					if err != nil {
+						host = p.Addr.String()
+					}
+					limitKey = "ip:" + host
+				}
+			}
+			if ok, _ := limiter.Allow(limitKey); !ok {
+				return nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+			}
+		}
+
+		if clientKey != "" {
+			ctx = context.WithValue(ctx, clientKeyContextKey{}, clientKey)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcClientKey returns the API key GRPCInterceptor authenticated the call with, if any.
+func grpcClientKey(ctx context.Context) string {
+	k, _ := ctx.Value(clientKeyContextKey{}).(string)
+	return k
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
+	apigatev1 "apigate-proxy/proto/apigate/v1"
+	"apigate-proxy/service"
+)
+
+func TestGRPCServer_Check(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.Block("6.6.6.6"))
+	svc := service.NewProxyService(&config.Config{
+		UpstreamBaseURL: upstream.URL,
+		WarmupAction:    service.WarmupLive,
+	}, nil, nil)
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(GRPCInterceptor([]string{"key-a", "key-b"}, NewRateLimiter(10, 2))))
+	apigatev1.RegisterDecisionServiceServer(srv, NewGRPCServer(svc, nil))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := apigatev1.NewDecisionServiceClient(conn)
+	check := func(key, ip string) (*apigatev1.AllowResponse, codes.Code) {
+		ctx := context.Background()
+		if key != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", key)
+		}
+		resp, err := client.Check(ctx, &apigatev1.AllowRequest{IpAddress: ip})
+		return resp, status.Code(err)
+	}
+
+	if _, code := check("", "1.1.1.1"); code != codes.Unauthenticated {
+		t.Errorf("Expected a call without a key refused, got %v", code)
+	}
+	if _, code := check("wrong", "1.1.1.1"); code != codes.Unauthenticated {
+		t.Errorf("Expected a call with an unknown key refused, got %v", code)
+	}
+
+	resp, code := check("key-a", "1.1.1.1")
+	if code != codes.OK || !resp.GetAllow() {
+		t.Errorf("Expected an allowed source allowed, got %v, %v", code, resp)
+	}
+	resp, code = check("key-a", "6.6.6.6")
+	if code != codes.OK || resp.GetAllow() || len(resp.GetBlockedBy()) != 1 || resp.GetBlockedBy()[0].GetKey() != "6.6.6.6" {
+		t.Errorf("Expected a blocked source blocked by its address, got %v, %v", code, resp)
+	}
+	// The burst of two is spent
+	if _, code := check("key-a", "1.1.1.1"); code != codes.ResourceExhausted {
+		t.Errorf("Expected the third call rate limited, got %v", code)
+	}
+
+	// Another key has its own bucket; requests are validated as over REST
+	if _, code := check("key-b", ""); code != codes.InvalidArgument {
+		t.Errorf("Expected a call without keys refused as invalid, got %v", code)
+	}
+}
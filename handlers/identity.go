@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"net/http"
+
+	"apigate-proxy/utils"
+)
+
+// clientCertFingerprint returns the fingerprint of the verified client certificate
+// when TLS is terminated here, or the value forwarded by an mTLS terminator in header.
+func clientCertFingerprint(r *http.Request, header string) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return utils.CertFingerprint(r.TLS.PeerCertificates[0])
+	}
+	if header == "" {
+		return ""
+	}
+	return r.Header.Get(header)
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// IPGuard protects the proxy itself from abusive sources, independently of
+// decisioning and of client API keys: each source IP gets a token bucket of
+// IP_LIMIT_RPS, and a source rejected IP_BAN_STRIKES times within
+// IP_BAN_WINDOW_SECONDS is banned for IP_BAN_SECONDS, during which all its
+// requests are refused before authentication or any other work.
+type IPGuard struct {
+	limiter *RateLimiter
+	strikes int // 0 = never ban
+	window  time.Duration
+	banFor  time.Duration
+
+	mu        sync.Mutex
+	offenders map[string]*ipOffender
+	lastSweep time.Time
+
+	limited atomic.Int64
+	refused atomic.Int64
+	bans    atomic.Int64
+}
+
+type ipOffender struct {
+	strikes int
+	since   time.Time // Start of the strike window
+	until   time.Time // End of the ban; zero when not banned
+}
+
+// IPGuardStats meters the guard since startup.
+type IPGuardStats struct {
+	Limited int64 `json:"limited"` // Requests over the source's rate
+	Refused int64 `json:"refused"` // Requests from banned sources
+	Bans    int64 `json:"bans"`    // Bans imposed
+	Banned  int   `json:"banned"`  // Sources banned now
+	Enabled bool  `json:"enabled"`
+}
+
+// NewIPGuard returns nil (no protection) when IP_LIMIT_RPS is not positive.
+func NewIPGuard(cfg *config.Config) *IPGuard {
+	limiter := NewRateLimiter(cfg.IPLimitRPS, cfg.IPLimitBurst)
+	if limiter == nil {
+		return nil
+	}
+	return &IPGuard{
+		limiter:   limiter,
+		strikes:   cfg.IPBanStrikes,
+		window:    time.Duration(cfg.IPBanWindowSecs) * time.Second,
+		banFor:    time.Duration(cfg.IPBanSeconds) * time.Second,
+		offenders: make(map[string]*ipOffender),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow admits a request from ip, returning how long to wait when refused.
+func (g *IPGuard) Allow(ip string) (bool, time.Duration) {
+	now := time.Now()
+	if wait := g.banned(ip, now); wait > 0 {
+		g.refused.Add(1)
+		return false, wait
+	}
+	ok, wait := g.limiter.Allow(ip)
+	if !ok {
+		g.limited.Add(1)
+		g.strike(ip, now)
+	}
+	return ok, wait
+}
+
+// banned returns the time left on ip's ban.
+func (g *IPGuard) banned(ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(now)
+	if o, ok := g.offenders[ip]; ok && now.Before(o.until) {
+		return o.until.Sub(now)
+	}
+	return 0
+}
+
+// strike counts a rejection against ip and bans it at IP_BAN_STRIKES.
+func (g *IPGuard) strike(ip string, now time.Time) {
+	if g.strikes <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	o, ok := g.offenders[ip]
+	if !ok || now.Sub(o.since) > g.window {
+		o = &ipOffender{since: now}
+		g.offenders[ip] = o
+	}
+	if o.strikes++; o.strikes < g.strikes {
+		return
+	}
+	o.strikes, o.since, o.until = 0, now, now.Add(g.banFor)
+	g.bans.Add(1)
+	slog.Warn("source banned after repeated rate limiting", "component", "ip_guard", "alert", true,
+		"ip", ip, "ban", g.banFor, "strikes", g.strikes, "strike_window", g.window)
+}
+
+// sweep forgets sources whose ban and strike window are over. Callers hold g.mu.
+func (g *IPGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	for ip, o := range g.offenders {
+		if !now.Before(o.until) && now.Sub(o.since) > g.window {
+			delete(g.offenders, ip)
+		}
+	}
+}
+
+// Stats returns the guard's counters; all zero when it is disabled.
+func (g *IPGuard) Stats() IPGuardStats {
+	if g == nil {
+		return IPGuardStats{}
+	}
+	now := time.Now()
+	g.mu.Lock()
+	banned := 0
+	for _, o := range g.offenders {
+		if now.Before(o.until) {
+			banned++
+		}
+	}
+	g.mu.Unlock()
+	return IPGuardStats{
+		Limited: g.limited.Load(),
+		Refused: g.refused.Load(),
+		Bans:    g.bans.Load(),
+		Banned:  banned,
+		Enabled: true,
+	}
+}
+
+// Middleware rejects requests from sources over their rate, or banned, with
+// 429 and a Retry-After header. It runs before APIKeyAuth, so abusive
+// sources are turned away without key checks.
+func (g *IPGuard) Middleware(next http.Handler) http.Handler {
+	if g == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := g.Allow(remoteIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeAllowResponse(w, http.StatusTooManyRequests, models.AllowResponse{
+				Allow:  false,
+				Status: "failure",
+				Error:  "Too many requests from this address",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StatsHandler serves Stats as JSON.
+func (g *IPGuard) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g.Stats())
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"apigate-proxy/config"
+)
+
+func TestIPGuard_RateAndBan(t *testing.T) {
+	g := NewIPGuard(&config.Config{
+		IPLimitRPS:      20,
+		IPLimitBurst:    2,
+		IPBanStrikes:    2,
+		IPBanWindowSecs: 60,
+		IPBanSeconds:    1,
+	})
+	g.banFor = 300 * time.Millisecond // Shorter than IP_BAN_SECONDS allows
+	h := g.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(peer string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/allow", nil)
+		r.RemoteAddr = peer + ":40000"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	// The burst passes, the next request is over the rate: the first strike
+	for i := 0; i < 2; i++ {
+		if rec := serve("203.0.113.7"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: got %d", i, rec.Code)
+		}
+	}
+	if rec := serve("203.0.113.7"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected 429 with Retry-After over the rate, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	// Other sources have their own bucket
+	if rec := serve("198.51.100.9"); rec.Code != http.StatusOK {
+		t.Errorf("Expected another source unaffected, got %d", rec.Code)
+	}
+
+	// The second strike bans the source, even once its bucket has refilled
+	serve("203.0.113.7")
+	time.Sleep(120 * time.Millisecond)
+	if rec := serve("203.0.113.7"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected a banned source refused, got %d", rec.Code)
+	}
+	st := g.Stats()
+	if st.Bans != 1 || st.Banned != 1 || st.Limited != 2 || st.Refused != 1 || !st.Enabled {
+		t.Errorf("Expected one ban after two limited requests, got %+v", st)
+	}
+
+	rec := httptest.NewRecorder()
+	g.StatsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/ip-guard/stats", nil))
+	var served IPGuardStats
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil || served != g.Stats() {
+		t.Errorf("Expected the stats served as JSON, got %+v, %v", served, err)
+	}
+
+	// The ban expires
+	time.Sleep(250 * time.Millisecond)
+	if rec := serve("203.0.113.7"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the ban over, got %d", rec.Code)
+	}
+	if st := g.Stats(); st.Banned != 0 {
+		t.Errorf("Expected no source banned, got %+v", st)
+	}
+}
+
+func TestIPGuard_Disabled(t *testing.T) {
+	g := NewIPGuard(&config.Config{})
+	if g != nil {
+		t.Fatal("Expected no guard without IP_LIMIT_RPS")
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	rec := httptest.NewRecorder()
+	g.Middleware(next).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/allow", nil))
+	if rec.Code != http.StatusOK || g.Stats().Enabled {
+		t.Errorf("Expected requests passed through, got %d", rec.Code)
+	}
+}
@@ -2,18 +2,21 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"apigate-proxy/models"
 	"apigate-proxy/service"
+	"apigate-proxy/utils"
 )
 
 type LoggerHandler struct {
-	Service *service.LoggerService
+	Service *service.LoggerService // Default tenant
+	Tenants *service.Tenants       // nil = single tenant
 }
 
-func NewLoggerHandler(svc *service.LoggerService) *LoggerHandler {
-	return &LoggerHandler{Service: svc}
+func NewLoggerHandler(svc *service.LoggerService, tenants *service.Tenants) *LoggerHandler {
+	return &LoggerHandler{Service: svc, Tenants: tenants}
 }
 
 func (h *LoggerHandler) LogRequestHandler(w http.ResponseWriter, r *http.Request) {
@@ -27,17 +30,31 @@ func (h *LoggerHandler) LogRequestHandler(w http.ResponseWriter, r *http.Request
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	svc, tenant, err := h.loggerFor(r, req.TenantID)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	req.TenantID = tenant
 
+	// Thin clients and load balancers leave the client IP to the connection
+	if req.IPAddress == "" {
+		req.IPAddress = clientIP(r, svc.Config())
+	}
 	// Capture User-Agent from header if not in body
 	if req.UserAgent == "" {
 		req.UserAgent = r.UserAgent()
 	}
+	if req.ClientCertFingerprint == "" {
+		req.ClientCertFingerprint = clientCertFingerprint(r, svc.Config().ClientCertHeader)
+	}
+	if req.JA3 == "" {
+		req.JA3 = ja3Fingerprint(r, svc.Config().JA3Header)
+	}
 
 	// Basic Validation (from prompt)
 	if req.IPAddress == "" || req.Email == "" || req.UserAgent == "" || req.HTTPMethod == "" || req.Endpoint == "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(models.AllowResponse{ // Reusing generic response structure or custom?
+		writeAllowResponse(w, http.StatusBadRequest, models.AllowResponse{ // Reusing generic response structure or custom?
 			Allow:  false, // Not applicable really
 			Status: "failure",
 			Error:  "Missing required fields",
@@ -45,13 +62,23 @@ func (h *LoggerHandler) LogRequestHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if _, ok := utils.NormalizeIP(req.IPAddress); !ok {
+		writeAllowResponse(w, http.StatusBadRequest, models.AllowResponse{
+			Allow:     false,
+			Status:    "failure",
+			Error:     "Invalid ip_address",
+			ErrorCode: ErrorCodeInvalidIP,
+		})
+		return
+	}
+
 	// Defaults (from prompt)
 	if req.EventType == "" {
 		req.EventType = req.Endpoint
 	}
 
 	// Queue the log
-	h.Service.QueueLog(req)
+	svc.QueueLog(req)
 
 	// Return success immediately
 	w.Header().Set("Content-Type", "application/json")
@@ -65,3 +92,68 @@ func (h *LoggerHandler) LogRequestHandler(w http.ResponseWriter, r *http.Request
 		"message": "Log queued",
 	})
 }
+
+// StatsHandler reports log buffer occupancy and the number of dropped records.
+func (h *LoggerHandler) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	svc, _, err := h.loggerFor(r, "")
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(svc.Stats())
+}
+
+// DeadLettersHandler lists log batches in the dead-letter queue.
+func (h *LoggerHandler) DeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	svc, err := h.adminLoggerFor(r)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	letters, err := svc.DeadLetters()
+	if errors.Is(err, service.ErrDLQDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letters)
+}
+
+// RedriveHandler re-sends the dead letter named by the id query parameter, or
+// every dead letter when id is omitted.
+func (h *LoggerHandler) RedriveHandler(w http.ResponseWriter, r *http.Request) {
+	svc, err := h.adminLoggerFor(r)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	redriven := 0
+	if id := r.URL.Query().Get("id"); id != "" {
+		if err = svc.Redrive(id); err == nil {
+			redriven = 1
+		}
+	} else {
+		redriven, err = svc.RedriveAll()
+	}
+
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, service.ErrDLQDisabled), errors.Is(err, service.ErrDeadLetterNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		status = http.StatusBadGateway
+	}
+	resp := map[string]interface{}{"redriven": redriven}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
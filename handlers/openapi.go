@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"maps"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/service"
+)
+
+// apiOperation describes one route for the OpenAPI document. Request and
+// response bodies are Go values whose types are reflected into schemas, so
+// the document follows the JSON tags the handlers actually encode.
+type apiOperation struct {
+	method, path string // Legacy path; the document lists its /v1 path too
+	unversioned  bool   // Served at path only
+	summary      string
+	tag          string
+	auth         string // "client", "admin" or "" (none)
+	params       []apiParam
+	request      any
+	responses    map[int]any // status -> body (nil = no JSON body)
+}
+
+type apiParam struct {
+	name, in, description string
+	required              bool
+}
+
+// Bodies of responses encoded from maps.
+type (
+	encryptEmailResponse struct {
+		Email        string `json:"email"`
+		Encrypted    string `json:"encrypted"`
+		IdentityType string `json:"identity_type"`
+	}
+	encryptBatchResponse struct {
+		Results []service.EncryptedEmail `json:"results"`
+	}
+	encryptJobAccepted struct {
+		JobID     string `json:"job_id"`
+		Status    string `json:"status"`
+		Total     int    `json:"total"`
+		StatusURL string `json:"status_url"`
+	}
+	decryptEmailResponse struct {
+		Encrypted string `json:"encrypted"`
+		Email     string `json:"email"`
+	}
+	invalidateResponse struct {
+		Applied int `json:"applied"`
+	}
+	redriveResponse struct {
+		Redriven int    `json:"redriven"`
+		Error    string `json:"error,omitempty"`
+	}
+	adminAuditResponse struct {
+		Actions []service.AdminAction `json:"actions"`
+	}
+)
+
+func apiOperations(cfg *config.Config) []apiOperation {
+	tenantHeader := cfg.TenantHeader
+	if tenantHeader == "" {
+		tenantHeader = "X-Tenant-ID"
+	}
+	tenant := apiParam{name: tenantHeader, in: "header", description: "Tenant to act for (TENANTS_FILE)"}
+	idPath := apiParam{name: "id", in: "path", required: true}
+	return []apiOperation{
+		{method: "post", path: "/api/allow", summary: "Decide whether a request is allowed", tag: "decisions", auth: "client",
+			params: []apiParam{
+				tenant,
+				{name: HeaderIdempotencyKey, in: "header", description: "Replay the first decision for retries of the same request"},
+				{name: HeaderRequestID, in: "header", description: "Request ID to record the decision under in the debug store"},
+			},
+			request: models.AllowRequest{},
+			responses: map[int]any{
+				200: models.AllowResponse{}, 400: models.AllowResponse{}, 401: models.AllowResponse{},
+				422: models.AllowResponse{}, 429: nil, 499: models.AllowResponse{}, 504: models.AllowResponse{},
+			}},
+		{method: "get", path: "/api/encrypt-email", summary: "Hash or encrypt an identity as sent upstream", tag: "identities",
+			params: []apiParam{
+				tenant,
+				{name: "email", in: "query", required: true, description: "Email or user ID"},
+				{name: "identity_type", in: "query", description: "email or user_id (default: detected)"},
+			},
+			responses: map[int]any{200: encryptEmailResponse{}, 400: nil}},
+		{method: "post", path: "/api/encrypt-email", summary: "Hash or encrypt an identity, keeping it out of query strings", tag: "identities",
+			params:    []apiParam{tenant},
+			request:   encryptEmailRequest{},
+			responses: map[int]any{200: encryptEmailResponse{}, 400: nil}},
+		{method: "post", path: "/api/encrypt-email/batch", summary: "Hash or encrypt identities in bulk", tag: "identities",
+			params:    []apiParam{tenant},
+			request:   encryptBatchRequest{},
+			responses: map[int]any{200: encryptBatchResponse{}, 202: encryptJobAccepted{}, 400: nil, 503: nil}},
+		{method: "get", path: "/api/jobs/{id}", summary: "Status or results of an encrypt job", tag: "identities", auth: "client",
+			params:    []apiParam{tenant, idPath, {name: "download", in: "query", description: "true to download the results of a finished job"}},
+			responses: map[int]any{200: service.EncryptJob{}, 401: nil, 404: nil, 409: nil, 429: nil}},
+		{method: "post", path: "/api/log", summary: "Queue a request log record for the upstream", tag: "logs", auth: "client",
+			params:    []apiParam{tenant},
+			request:   models.LogRequest{},
+			responses: map[int]any{200: models.LogResponse{}, 400: models.AllowResponse{}, 401: models.AllowResponse{}, 429: nil}},
+		{method: "get", path: "/api/stats", summary: "Cache freshness and counters", tag: "stats", auth: "client",
+			params:    []apiParam{tenant},
+			responses: map[int]any{200: service.CacheStats{}}},
+		{method: "get", path: "/api/upstream/status", summary: "Upstream health checks and prefetch outcomes", tag: "stats", auth: "client",
+			params:    []apiParam{tenant},
+			responses: map[int]any{200: service.UpstreamStatus{}}},
+		{method: "get", path: "/api/audit/decisions", summary: "Query recent decisions", tag: "stats", auth: "admin",
+			params: []apiParam{
+				tenant,
+				{name: "since", in: "query", description: "RFC 3339"},
+				{name: "until", in: "query", description: "RFC 3339"},
+				{name: "outcome", in: "query", description: "allow or block"},
+				{name: "key_prefix", in: "query"},
+				{name: "cursor", in: "query"},
+				{name: "limit", in: "query"},
+			},
+			responses: map[int]any{200: service.AuditPage{}, 400: nil, 404: nil}},
+		{method: "get", path: "/api/events", summary: "Stream decisions and cache swaps (text/event-stream of service.Event)", tag: "stats", auth: "client",
+			params: []apiParam{
+				tenant,
+				{name: "events", in: "query", description: "Comma-separated event types: decision, swap (default: all)"},
+				{name: "key_types", in: "query", description: "Comma-separated key types, e.g. ip,email (default: all)"},
+				{name: "outcome", in: "query", description: "allow or block"},
+			},
+			responses: map[int]any{200: nil, 400: nil}},
+		{method: "get", path: "/api/log/stats", summary: "Log buffer occupancy and loss", tag: "logs", auth: "client",
+			params:    []apiParam{tenant},
+			responses: map[int]any{200: service.LogStats{}}},
+		{method: "get", path: "/api/log/dlq", summary: "List dead-lettered log batches", tag: "logs", auth: "admin",
+			params:    []apiParam{tenant},
+			responses: map[int]any{200: []service.DeadLetter{}, 404: nil}},
+		{method: "post", path: "/api/log/dlq/redrive", summary: "Re-send one or every dead-lettered batch", tag: "logs", auth: "admin",
+			params:    []apiParam{tenant, {name: "id", in: "query", description: "Dead letter to re-send (default: all)"}},
+			responses: map[int]any{200: redriveResponse{}, 404: nil, 502: redriveResponse{}}},
+		{method: "get", path: "/api/ip-guard/stats", summary: "Sources rejected or banned by the IP guard", tag: "stats", auth: "client",
+			responses: map[int]any{200: IPGuardStats{}}},
+		{method: "post", path: "/api/decrypt-email", summary: "Reverse a reversibly encrypted identity", tag: "admin", auth: "admin",
+			params:    []apiParam{tenant},
+			request:   decryptEmailRequest{},
+			responses: map[int]any{200: decryptEmailResponse{}, 400: nil, 404: nil, 422: nil}},
+		{method: "get", path: "/api/debug/decisions/{id}", summary: "Full context of a sampled decision", tag: "admin", auth: "admin",
+			params:    []apiParam{tenant, idPath},
+			responses: map[int]any{200: service.DebugRecord{}, 404: nil}},
+		{method: "post", path: "/admin/rules/validate", summary: "Run rules test cases", tag: "admin", auth: "admin",
+			params:    []apiParam{tenant},
+			request:   validateRulesRequest{},
+			responses: map[int]any{200: service.RuleTestReport{}, 400: nil}},
+		{method: "get", path: "/admin/state", summary: "Effective configuration and cache state", tag: "admin", auth: "admin",
+			params:    []apiParam{tenant},
+			responses: map[int]any{200: service.AdminState{}}},
+		{method: "post", path: "/admin/invalidate", summary: "Apply decision changes pushed by the upstream", tag: "admin", auth: "admin",
+			params:    []apiParam{tenant},
+			request:   models.InvalidationRequest{},
+			responses: map[int]any{200: invalidateResponse{}, 400: nil}},
+		{method: "get", path: "/admin/audit", summary: "Query the admin audit trail", tag: "admin", auth: "admin",
+			params: []apiParam{
+				{name: "since", in: "query", description: "RFC 3339"},
+				{name: "until", in: "query", description: "RFC 3339"},
+				{name: "action", in: "query", description: "invalidate or decrypt_email"},
+				{name: "actor", in: "query", description: "X-Admin-Actor or key ID"},
+				{name: "limit", in: "query"},
+			},
+			responses: map[int]any{200: adminAuditResponse{}, 400: nil}},
+		{method: "get", path: "/readyz", summary: "Readiness probe", tag: "health", unversioned: true,
+			responses: map[int]any{200: nil, 503: nil}},
+	}
+}
+
+// OpenAPISpec builds the OpenAPI 3 document of the proxy's HTTP API.
+func OpenAPISpec(cfg *config.Config) map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations(cfg) {
+		o := map[string]any{"summary": op.summary, "tags": []string{op.tag}}
+		switch op.auth {
+		case "client":
+			o["security"] = []map[string][]string{{"clientKey": {}}, {"clientBearer": {}}}
+		case "admin":
+			o["security"] = []map[string][]string{{"adminKey": {}}, {"adminBearer": {}}}
+		}
+		var params []map[string]any
+		for _, p := range op.params {
+			param := map[string]any{"name": p.name, "in": p.in, "required": p.required, "schema": map[string]string{"type": "string"}}
+			if p.description != "" {
+				param["description"] = p.description
+			}
+			params = append(params, param)
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		if op.request != nil {
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.request), schemas)}},
+			}
+		}
+		responses := map[string]any{}
+		for code, body := range op.responses {
+			resp := map[string]any{"description": statusText(code)}
+			if body != nil {
+				resp["content"] = map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(body), schemas)}}
+			}
+			responses[strconv.Itoa(code)] = resp
+		}
+		o["responses"] = responses
+		addPath := func(path string, o map[string]any) {
+			if paths[path] == nil {
+				paths[path] = map[string]any{}
+			}
+			paths[path][op.method] = o
+		}
+		if op.unversioned {
+			addPath(op.path, o)
+			continue
+		}
+		addPath(V1Path(op.path), o)
+		legacy := maps.Clone(o)
+		legacy["deprecated"] = true
+		legacy["description"] = "Unversioned alias of " + V1Path(op.path) + "."
+		addPath(op.path, legacy)
+	}
+
+	keyScheme := func(description string) map[string]string {
+		return map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key", "description": description}
+	}
+	bearerScheme := func(description string) map[string]string {
+		return map[string]string{"type": "http", "scheme": "bearer", "description": description}
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":       "APIGate Proxy",
+			"version":     APIVersion,
+			"description": "Decision cache and log buffer in front of the APIGate upstream.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"clientKey":    keyScheme("One of CLIENT_API_KEYS; endpoints are open when none are configured"),
+				"clientBearer": bearerScheme("One of CLIENT_API_KEYS"),
+				"adminKey":     keyScheme("One of ADMIN_API_KEYS; admin endpoints answer 404 when none are configured"),
+				"adminBearer":  bearerScheme("One of ADMIN_API_KEYS"),
+			},
+		},
+	}
+}
+
+// OpenAPIHandler serves OpenAPISpec as JSON.
+func OpenAPIHandler(cfg *config.Config) http.Handler {
+	spec, _ := json.Marshal(OpenAPISpec(cfg))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	})
+}
+
+// explorerFiles is the API explorer: a page rendering the document at
+// /openapi.json of the same listener, with its script and styles.
+//
+//go:embed explorer
+var explorerFiles embed.FS
+
+// APIExplorerHandler serves an interactive explorer of OpenAPISpec at /docs
+// and its assets below /docs/. Everything it loads comes from the proxy, and
+// the Content-Security-Policy keeps it that way.
+func APIExplorerHandler() http.Handler {
+	assets, _ := fs.Sub(explorerFiles, "explorer")
+	files := http.StripPrefix("/docs/", http.FileServerFS(assets))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		if r.URL.Path == "/docs" || r.URL.Path == "/docs/" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			page, _ := fs.ReadFile(assets, "index.html")
+			w.Write(page)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns the JSON schema of t, adding named structs to schemas and
+// referring to them, so shared and recursive types are described once.
+func schemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name := schemaName(t)
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = nil // Placeholder for recursive references
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return structSchema(t, schemas)
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	default:
+		return map[string]any{} // Any value
+	}
+}
+
+// structSchema describes the fields encoding/json would encode.
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	props := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				// Embedded fields are promoted into the parent object
+				for k, v := range structSchema(ft, schemas)["properties"].(map[string]any) {
+					props[k] = v
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type, schemas)
+	}
+	return map[string]any{"type": "object", "properties": props}
+}
+
+func schemaName(t reflect.Type) string {
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+func statusText(code int) string {
+	if code == statusClientClosedRequest {
+		return "Client Closed Request"
+	}
+	return http.StatusText(code)
+}
@@ -2,18 +2,37 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
+
+	"apigate-proxy/config"
 	"apigate-proxy/models"
 	"apigate-proxy/service"
+	"apigate-proxy/utils"
+)
+
+// Idempotency headers on /api/allow (see ProxyService.CheckIdempotent).
+const (
+	HeaderIdempotencyKey     = "Idempotency-Key"
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLen = 255
 )
 
 type ProxyHandler struct {
-	Service *service.ProxyService
+	Service    *service.ProxyService // Default tenant
+	Tenants    *service.Tenants      // nil = single tenant
+	AdminAudit *service.AdminAudit   // Records admin actions (nil = not recorded)
 }
 
-func NewProxyHandler(svc *service.ProxyService) *ProxyHandler {
-	return &ProxyHandler{Service: svc}
+func NewProxyHandler(svc *service.ProxyService, tenants *service.Tenants) *ProxyHandler {
+	return &ProxyHandler{Service: svc, Tenants: tenants}
 }
 
 func (h *ProxyHandler) AllowDecisionHandler(w http.ResponseWriter, r *http.Request) {
@@ -27,17 +46,45 @@ func (h *ProxyHandler) AllowDecisionHandler(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	svc, tenant, err := h.proxyFor(r, req.TenantID)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	req.TenantID = tenant
 
+	// Thin clients and load balancers leave the client IP to the connection.
+	// Their request is the end user's (forward auth copies its headers), so
+	// its header shape fingerprints the client too.
+	if req.IPAddress == "" {
+		req.IPAddress = clientIP(r, svc.Config())
+		if req.IPAddress != "" && req.RequestFingerprint == "" {
+			req.RequestFingerprint = utils.RequestFingerprint(r)
+		}
+	}
 	// Capture User-Agent from header if not in body
 	if req.UserAgent == "" {
 		req.UserAgent = r.UserAgent()
 	}
+	if req.ClientCertFingerprint == "" {
+		req.ClientCertFingerprint = clientCertFingerprint(r, svc.Config().ClientCertHeader)
+	}
+	if req.JA3 == "" {
+		req.JA3 = ja3Fingerprint(r, svc.Config().JA3Header)
+	}
+	req.RequestID = r.Header.Get(HeaderRequestID)
+	if svc.DebugEnabled() {
+		if req.RequestID == "" {
+			req.RequestID = newRequestID()
+			req.RequestIDGenerated = true
+		}
+		// Quoted back by callers to look the decision up in the debug store
+		w.Header().Set(HeaderRequestID, req.RequestID)
+	}
 
 	// Basic validation
 	if req.IPAddress == "" && req.Email == "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(models.AllowResponse{
+		writeAllowResponse(w, http.StatusBadRequest, models.AllowResponse{
 			Allow:  false,
 			Status: "failure",
 			Error:  "Missing required fields (ip_address or email/user_id)",
@@ -45,35 +92,390 @@ func (h *ProxyHandler) AllowDecisionHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	resp, err := h.Service.Check(req)
-	if err != nil {
-		// Log error?
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(models.AllowResponse{
+	if req.CallbackURL != "" && !svc.CallbackAllowed(req.CallbackURL) {
+		writeAllowResponse(w, http.StatusBadRequest, models.AllowResponse{
 			Allow:  false,
-			Status: "error",
-			Error:  err.Error(),
+			Status: "failure",
+			Error:  "callback_url host is not in CALLBACK_ALLOWED_HOSTS",
 		})
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	var (
+		resp     models.AllowResponse
+		replayed bool
+	)
+	if key := r.Header.Get(HeaderIdempotencyKey); key != "" {
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+		// Scoped per client so keys chosen by different applications never collide
+		resp, replayed, err = svc.CheckIdempotent(r.Context(), ClientKey(r)+"\x00"+key, req)
+		if replayed {
+			w.Header().Set(HeaderIdempotentReplayed, "true")
+		}
+	} else {
+		resp, err = svc.Check(r.Context(), req)
+	}
+	setFreshnessHeaders(w, svc)
+	if err != nil {
+		code, errorCode := errorStatus(err)
+		writeAllowResponse(w, code, models.AllowResponse{
+			Allow:     false,
+			Status:    "error",
+			Error:     err.Error(),
+			ErrorCode: errorCode,
+		})
+		return
+	}
+
+	svc.Tarpit(r.Context(), resp)
+	setCacheControl(w, svc.Config(), resp)
+	if svc.Config().DecisionHeaders {
+		// ForwardAuth-style integrations copy these onto the backend request
+		for k, v := range decisionHeaders(svc, req, resp, req.RequestID) {
+			w.Header()[k] = v
+		}
+	}
+	writeAllowResponse(w, http.StatusOK, svc.Redact(ClientKey(r), resp))
+}
+
+// encryptEmailRequest is the body of POST /api/encrypt-email.
+type encryptEmailRequest struct {
+	Email        string `json:"email"`
+	IdentityType string `json:"identity_type"`
 }
 
+// EncryptEmailHandler encrypts one email or user ID, given in the query of a
+// GET or as {"email": "", "identity_type": ""} in the body of a POST. POST
+// keeps the plaintext out of access logs, which record query strings.
 func (h *ProxyHandler) EncryptEmailHandler(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
-	if email == "" {
+	body := encryptEmailRequest{
+		Email:        r.URL.Query().Get("email"),
+		IdentityType: r.URL.Query().Get("identity_type"),
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Email == "" {
+			http.Error(w, "Missing email field", http.StatusBadRequest)
+			return
+		}
+	}
+	if body.Email == "" {
 		http.Error(w, "Missing email query parameter", http.StatusBadRequest)
 		return
 	}
+	svc, _, err := h.proxyFor(r, "")
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
 
-	encrypted := h.Service.EncryptEmail(email)
+	encrypted, identityType := svc.IdentityKey(body.Email, body.IdentityType)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
+		"email":         body.Email,
+		"encrypted":     encrypted,
+		"identity_type": identityType,
+	})
+}
+
+// encryptBatchRequest is the body of POST /api/encrypt-email/batch.
+type encryptBatchRequest struct {
+	Emails       []string `json:"emails"`
+	IdentityType string   `json:"identity_type"`
+}
+
+// EncryptEmailBatchHandler encrypts {"emails": [...], "identity_type": ""}.
+// Batches up to ENCRYPT_ASYNC_THRESHOLD are answered directly; larger ones
+// are submitted as a job and answered with 202 and the job's status URL.
+func (h *ProxyHandler) EncryptEmailBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var body encryptBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Emails) == 0 {
+		http.Error(w, "Missing emails field", http.StatusBadRequest)
+		return
+	}
+	svc, _, err := h.proxyFor(r, "")
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !svc.EncryptAsync(len(body.Emails)) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"results": svc.EncryptEmails(body.Emails, body.IdentityType),
+		})
+		return
+	}
+
+	job, err := svc.SubmitEncryptJob(body.Emails, body.IdentityType)
+	if err != nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	statusURL := "/api/jobs/" + job.ID
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		statusURL = V1Path(statusURL)
+	}
+	w.Header().Set("Location", statusURL)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{
+		"job_id":     job.ID,
+		"status":     job.Status,
+		"total":      job.Total,
+		"status_url": statusURL,
+	})
+}
+
+// JobHandler reports the status of the encrypt job in the {id} path segment.
+// With ?download=true it returns the results of a finished job as a JSON
+// attachment instead, or 409 while the job is still running.
+func (h *ProxyHandler) JobHandler(w http.ResponseWriter, r *http.Request) {
+	svc, _, err := h.proxyFor(r, "")
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	job, found := svc.EncryptJob(mux.Vars(r)["id"])
+	if !found {
+		http.Error(w, "No such job", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("download") != "true" {
+		job.Results = nil
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+	if job.Status != service.JobDone {
+		http.Error(w, "Job is not done yet", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+job.ID+`.json"`)
+	json.NewEncoder(w).Encode(map[string]any{"results": job.Results})
+}
+
+// decryptEmailRequest is the body of POST /api/decrypt-email.
+type decryptEmailRequest struct {
+	Encrypted string `json:"encrypted"`
+}
+
+// DecryptEmailHandler reverses a key produced with EMAIL_ENCRYPTION_MODE=reversible,
+// for support workflows. It must be mounted behind AdminKeyAuth.
+func (h *ProxyHandler) DecryptEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var body decryptEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Encrypted == "" {
+		http.Error(w, "Missing encrypted field", http.StatusBadRequest)
+		return
+	}
+
+	svc, err := h.adminProxyFor(r)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+
+	email, err := svc.DecryptEmail(body.Encrypted)
+	switch {
+	case errors.Is(err, service.ErrDecryptionDisabled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	// Who looked up whom, without the plaintext
+	slog.Info("email decrypted", "component", "admin", "remote_addr", r.RemoteAddr, "encrypted", body.Encrypted)
+	h.recordAdmin(r, service.AdminAction{Action: service.AdminActionDecryptEmail, Target: body.Encrypted})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"encrypted": body.Encrypted,
 		"email":     email,
-		"encrypted": encrypted,
 	})
 }
+
+// StatsHandler reports warmup and cache-swap timing so clients can reason about
+// decision freshness.
+func (h *ProxyHandler) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	svc, _, err := h.proxyFor(r, "")
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(svc.Stats())
+}
+
+// UpstreamStatusHandler reports upstream health checks and prefetch outcomes.
+func (h *ProxyHandler) UpstreamStatusHandler(w http.ResponseWriter, r *http.Request) {
+	svc, _, err := h.proxyFor(r, "")
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(svc.UpstreamStatus())
+}
+
+// AuditHandler queries recent decisions: since/until (RFC 3339), outcome
+// (allow|block), key_prefix, cursor and limit.
+func (h *ProxyHandler) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	svc, err := h.adminProxyFor(r)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	params := r.URL.Query()
+	q := service.AuditQuery{
+		Outcome:   params.Get("outcome"),
+		KeyPrefix: params.Get("key_prefix"),
+		Cursor:    params.Get("cursor"),
+	}
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid until parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if q.Outcome != "" && q.Outcome != "allow" && q.Outcome != "block" {
+		http.Error(w, "Invalid outcome parameter", http.StatusBadRequest)
+		return
+	}
+
+	page, ok := svc.QueryDecisions(q)
+	if !ok {
+		http.Error(w, "Decision audit store is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// DebugDecisionHandler returns the debug store record of the request in the
+// {id} path segment. It must be mounted behind AdminKeyAuth.
+func (h *ProxyHandler) DebugDecisionHandler(w http.ResponseWriter, r *http.Request) {
+	svc, err := h.adminProxyFor(r)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	rec, found, enabled := svc.DebugDecision(mux.Vars(r)["id"])
+	switch {
+	case !enabled:
+		http.Error(w, "Debug store is disabled", http.StatusNotFound)
+		return
+	case !found:
+		http.Error(w, "No debug record for this request ID", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// validateRulesRequest is the body of POST /admin/rules/validate.
+type validateRulesRequest struct {
+	Rules *config.RulesFileContent `json:"rules"`
+	Tests []service.RuleTestCase   `json:"tests"`
+}
+
+// ValidateRulesHandler runs rules test cases posted as
+// {"rules": {"allow": [...], "deny": [...]}, "tests": [...]}. Without rules,
+// the running rules are tested. It must be mounted behind AdminKeyAuth.
+func (h *ProxyHandler) ValidateRulesHandler(w http.ResponseWriter, r *http.Request) {
+	var body validateRulesRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	svc, err := h.adminProxyFor(r)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(svc.ValidateRules(body.Rules, body.Tests))
+}
+
+// StateHandler returns the proxy's effective configuration (secrets masked),
+// enabled features and cache state as one document to attach to support
+// tickets. It must be mounted behind AdminKeyAuth.
+func (h *ProxyHandler) StateHandler(w http.ResponseWriter, r *http.Request) {
+	svc, err := h.adminProxyFor(r)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(svc.State())
+}
+
+// InvalidateHandler applies decision changes pushed by the upstream to the
+// cache at once. It must be mounted behind AdminKeyAuth.
+func (h *ProxyHandler) InvalidateHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.InvalidationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	svc, err := h.adminProxyFor(r)
+	if err != nil {
+		writeTenantError(w, err)
+		return
+	}
+	applied := svc.Invalidate(req.Decisions)
+	if applied > 0 {
+		h.recordAdmin(r, service.AdminAction{Action: service.AdminActionInvalidate, Decisions: req.Decisions})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"applied": applied})
+}
+
+// ReadyHandler answers load balancer readiness probes: 503 while the proxy
+// should not receive traffic (see ProxyService.Ready).
+func (h *ProxyHandler) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.Service.Ready() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// setCacheControl lets a CDN in front of the proxy cache decisions per outcome,
+// e.g. blocks for a few seconds and allows never.
+func setCacheControl(w http.ResponseWriter, cfg *config.Config, resp models.AllowResponse) {
+	if resp.Status != "success" {
+		// Unknown outcomes (FAIL_MODE=unknown) must be retried, not cached
+		return
+	}
+	value := cfg.CacheControlBlock
+	if resp.Allow {
+		value = cfg.CacheControlAllow
+	}
+	if value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+}
+
+// setFreshnessHeaders mirrors the Stats countdowns on /api/allow responses.
+func setFreshnessHeaders(w http.ResponseWriter, svc *service.ProxyService) {
+	warmupRemaining, nextSwap := svc.Freshness()
+	w.Header().Set("X-Apigate-Warmup-Remaining", strconv.FormatFloat(warmupRemaining, 'f', -1, 64))
+	w.Header().Set("X-Apigate-Next-Swap", strconv.FormatFloat(nextSwap, 'f', -1, 64))
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
+	"apigate-proxy/service"
+	"apigate-proxy/utils"
+)
+
+func TestAllowDecisionHandler_RequestFingerprint(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll)
+	svc := service.NewProxyService(&config.Config{
+		UpstreamBaseURL:        upstream.URL,
+		WarmupAction:           service.WarmupLive,
+		ClientIPFromRemoteAddr: true,
+	}, nil, nil)
+	h := NewProxyHandler(svc, nil)
+
+	allow := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/allow", strings.NewReader(body))
+		r.Header.Set("Accept-Language", "en-US,en;q=0.9")
+		r.Header.Set("Sec-Fetch-Mode", "navigate")
+		return r
+	}
+
+	// Left to the connection, the request is the end user's and is fingerprinted
+	r := allow(`{}`)
+	fp := utils.RequestFingerprint(r)
+	rec := httptest.NewRecorder()
+	h.AllowDecisionHandler(rec, r)
+	if rec.Code != http.StatusOK || !upstream.Asked(fp) {
+		t.Errorf("Expected the header-shape fingerprint %q checked, got %d", fp, rec.Code)
+	}
+
+	// A fingerprint in the body wins
+	rec = httptest.NewRecorder()
+	h.AllowDecisionHandler(rec, allow(`{"request_fingerprint":"given"}`))
+	if !upstream.Asked("given") {
+		t.Error("Expected the supplied fingerprint checked")
+	}
+
+	// An application naming the client's address is not its client
+	r = allow(`{"ip_address":"203.0.113.9"}`)
+	r.Header.Set("Dnt", "1")
+	fp = utils.RequestFingerprint(r)
+	h.AllowDecisionHandler(httptest.NewRecorder(), r)
+	if upstream.Asked(fp) {
+		t.Error("Expected no fingerprint of an application's own request")
+	}
+}
+
+func TestAllowDecisionHandler_FreshnessHeaders(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll)
+	svc := service.NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL}, nil, nil)
+	h := NewProxyHandler(svc, nil)
+
+	rec := httptest.NewRecorder()
+	h.AllowDecisionHandler(rec, httptest.NewRequest(http.MethodPost, "/api/allow", strings.NewReader(`{"ip_address":"1.1.1.1"}`)))
+	warmup, next := svc.Freshness()
+	if got := rec.Header().Get("X-Apigate-Next-Swap"); got != strconv.FormatFloat(next, 'f', -1, 64) {
+		t.Errorf("Expected X-Apigate-Next-Swap %v before Start, got %q", next, got)
+	}
+	if got := rec.Header().Get("X-Apigate-Warmup-Remaining"); got != strconv.FormatFloat(warmup, 'f', -1, 64) {
+		t.Errorf("Expected X-Apigate-Warmup-Remaining %v before Start, got %q", warmup, got)
+	}
+}
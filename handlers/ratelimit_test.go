@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Middleware(t *testing.T) {
+	const burst = 3
+	l := NewRateLimiter(10, burst)
+	h := APIKeyAuth([]string{"key-a", "key-b"})(l.Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	serve := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/allow", nil)
+		r.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	// A burst of N passes and request N+1 is limited
+	for i := 0; i < burst; i++ {
+		if rec := serve("key-a"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: got %d", i, rec.Code)
+		}
+	}
+	rec := serve("key-a")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected request %d limited, got %d", burst+1, rec.Code)
+	}
+	// Under a second to the next token, rounded up
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", got)
+	}
+
+	// Buckets are per API key
+	if rec := serve("key-b"); rec.Code != http.StatusOK {
+		t.Errorf("Expected another client unaffected, got %d", rec.Code)
+	}
+
+	// A token is back after 1/rps
+	time.Sleep(120 * time.Millisecond)
+	if rec := serve("key-a"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the bucket refilled, got %d", rec.Code)
+	}
+	if rec := serve("key-a"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected only one token refilled, got %d", rec.Code)
+	}
+}
+
+func TestRateLimiter_RetryAfter(t *testing.T) {
+	// At 0.25 rps the next token is four seconds away
+	l := NewRateLimiter(0.25, 1)
+	if ok, _ := l.Allow("ip:203.0.113.7"); !ok {
+		t.Fatal("Expected the first request allowed")
+	}
+	ok, wait := l.Allow("ip:203.0.113.7")
+	if ok || wait <= 3900*time.Millisecond || wait > 4*time.Second {
+		t.Errorf("Expected a wait of about 4s, got %v, %v", ok, wait)
+	}
+
+	// Unauthenticated requests are keyed by source address
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodPost, "/api/allow", nil)
+	r.RemoteAddr = "203.0.113.7:40000"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "4" {
+		t.Errorf("Expected 429 with Retry-After 4, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	if NewRateLimiter(0, 0) != nil {
+		t.Error("Expected no limiter without RATE_LIMIT_RPS")
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+
+	"apigate-proxy/models"
+	"apigate-proxy/service"
+)
+
+// requestedTenant returns the tenant a request names: the tenant header, or
+// else the tenant_id field of its body.
+func requestedTenant(r *http.Request, header, field string) string {
+	if id := r.Header.Get(header); id != "" {
+		return id
+	}
+	return field
+}
+
+// proxyFor resolves the tenant of an /api request and returns its service.
+func (h *ProxyHandler) proxyFor(r *http.Request, field string) (*service.ProxyService, string, error) {
+	if h.Tenants == nil {
+		return h.Service, "", nil
+	}
+	id, err := h.Tenants.Resolve(requestedTenant(r, h.Service.Config().TenantHeader, field), ClientKey(r))
+	if err != nil {
+		return nil, "", err
+	}
+	return h.Tenants.Proxy(id), id, nil
+}
+
+// adminProxyFor is proxyFor for admin endpoints, whose keys may act for any tenant.
+func (h *ProxyHandler) adminProxyFor(r *http.Request) (*service.ProxyService, error) {
+	if h.Tenants == nil {
+		return h.Service, nil
+	}
+	id, err := h.Tenants.Lookup(r.Header.Get(h.Service.Config().TenantHeader))
+	if err != nil {
+		return nil, err
+	}
+	return h.Tenants.Proxy(id), nil
+}
+
+func (h *LoggerHandler) loggerFor(r *http.Request, field string) (*service.LoggerService, string, error) {
+	if h.Tenants == nil {
+		return h.Service, "", nil
+	}
+	id, err := h.Tenants.Resolve(requestedTenant(r, h.Service.Config().TenantHeader, field), ClientKey(r))
+	if err != nil {
+		return nil, "", err
+	}
+	return h.Tenants.Logger(id), id, nil
+}
+
+// adminLoggerFor is loggerFor for admin endpoints, whose keys may act for any tenant.
+func (h *LoggerHandler) adminLoggerFor(r *http.Request) (*service.LoggerService, error) {
+	if h.Tenants == nil {
+		return h.Service, nil
+	}
+	id, err := h.Tenants.Lookup(r.Header.Get(h.Service.Config().TenantHeader))
+	if err != nil {
+		return nil, err
+	}
+	return h.Tenants.Logger(id), nil
+}
+
+// writeTenantError answers a request whose tenant could not be resolved.
+func writeTenantError(w http.ResponseWriter, err error) {
+	code, errorCode := errorStatus(err)
+	writeAllowResponse(w, code, models.AllowResponse{
+		Allow:     false,
+		Status:    "failure",
+		Error:     err.Error(),
+		ErrorCode: errorCode,
+	})
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"apigate-proxy/config"
+)
+
+// ServerTLSConfig builds the TLS settings of the main listener: TLS 1.2+ and,
+// with TLS_CLIENT_AUTH, client certificates verified against TLS_CLIENT_CA_FILE.
+func ServerTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	switch cfg.TLSClientAuth {
+	case "", "none":
+		return tc, nil
+	case "request":
+		// Certificates are fingerprinted as identity keys but not verified
+		tc.ClientAuth = tls.RequestClientCert
+		return tc, nil
+	case "verify-if-given":
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown TLS_CLIENT_AUTH %q", cfg.TLSClientAuth)
+	}
+
+	if cfg.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH=%s requires TLS_CLIENT_CA_FILE", cfg.TLSClientAuth)
+	}
+	pem, err := os.ReadFile(cfg.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.TLSClientCAFile)
+	}
+	tc.ClientCAs = pool
+	return tc, nil
+}
+
+// PlainHTTPHandler answers requests on the plain HTTP listener (HTTP_PORT):
+// "redirect" sends clients to the same URL over HTTPS on httpsPort, "reject"
+// refuses them so credentials are never accepted in cleartext.
+func PlainHTTPHandler(mode, httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mode == "reject" {
+			http.Error(w, "HTTPS required", http.StatusForbidden)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]") // Bare IPv6 literal
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		// 308 keeps the method and body, so POSTs are retried as POSTs
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
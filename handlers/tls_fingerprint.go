@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"apigate-proxy/utils"
+)
+
+type ja3ContextKey struct{}
+
+// JA3Recorder captures the JA3 fingerprint of each TLS client handshake and
+// makes it available to handlers through the request context.
+//
+// http.Server creates the connection context before the handshake runs, so a
+// slot is registered per connection in ConnContext and filled in later from
+// GetConfigForClient once the ClientHello has been parsed.
+type JA3Recorder struct {
+	conns sync.Map // net.Conn -> *atomic.Value
+}
+
+func NewJA3Recorder() *JA3Recorder {
+	return &JA3Recorder{}
+}
+
+// Wrap installs the recorder hooks on srv and its TLS config.
+func (rec *JA3Recorder) Wrap(srv *http.Server) {
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = &tls.Config{}
+	}
+	srv.TLSConfig.GetConfigForClient = rec.getConfigForClient
+	srv.ConnContext = rec.connContext
+	srv.ConnState = rec.connState
+}
+
+func (rec *JA3Recorder) connContext(ctx context.Context, c net.Conn) context.Context {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	slot := &atomic.Value{}
+	rec.conns.Store(tc.NetConn(), slot)
+	return context.WithValue(ctx, ja3ContextKey{}, slot)
+}
+
+func (rec *JA3Recorder) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if v, ok := rec.conns.Load(hello.Conn); ok {
+		_, hash := utils.JA3(hello)
+		v.(*atomic.Value).Store(hash)
+	}
+	// nil keeps the server's TLS config unchanged
+	return nil, nil
+}
+
+func (rec *JA3Recorder) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		rec.conns.Delete(tc.NetConn())
+	}
+}
+
+// ja3Fingerprint returns the JA3 hash of the connection serving r, or the value
+// forwarded by an upstream TLS terminator in header.
+func ja3Fingerprint(r *http.Request, header string) string {
+	if slot, ok := r.Context().Value(ja3ContextKey{}).(*atomic.Value); ok {
+		if hash, ok := slot.Load().(string); ok && hash != "" {
+			return hash
+		}
+	}
+	if header == "" {
+		return ""
+	}
+	return r.Header.Get(header)
+}
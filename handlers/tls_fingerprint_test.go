@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"apigate-proxy/utils"
+)
+
+func TestJA3Recorder(t *testing.T) {
+	hashes := make(chan string, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, ja3Fingerprint(r, "X-JA3"))
+	}))
+	NewJA3Recorder().Wrap(srv.Config)
+	// Record the hash of the ClientHello the recorder sees, to compare with
+	getConfig := srv.Config.TLSConfig.GetConfigForClient
+	srv.Config.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		_, hash := utils.JA3(hello)
+		hashes <- hash
+		return getConfig(hello)
+	}
+	srv.TLS = srv.Config.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("X-JA3", "forwarded")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got, want := string(body), <-hashes; got != want || !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(got) {
+		t.Errorf("Expected the handshake's JA3 hash %q over the forwarded one, got %q", want, got)
+	}
+
+	// Without a TLS handshake the forwarded hash is used
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-JA3", "forwarded")
+	if got := ja3Fingerprint(r, "X-JA3"); got != "forwarded" {
+		t.Errorf("Expected the forwarded hash, got %q", got)
+	}
+	if got := ja3Fingerprint(r, ""); got != "" {
+		t.Errorf("Expected no hash without JA3_HEADER, got %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"apigate-proxy/config"
+)
+
+func TestPlainHTTPHandler_Redirect(t *testing.T) {
+	cases := []struct {
+		host, httpsPort, want string
+	}{
+		{"example.com", "443", "https://example.com/api/allow?v=1"},
+		{"example.com:8080", "443", "https://example.com/api/allow?v=1"},
+		{"example.com:8080", "8443", "https://example.com:8443/api/allow?v=1"},
+		{"[::1]:8080", "443", "https://[::1]/api/allow?v=1"},
+		{"[::1]:8080", "8443", "https://[::1]:8443/api/allow?v=1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/api/allow?v=1", nil)
+		r.Host = c.host
+		rec := httptest.NewRecorder()
+		PlainHTTPHandler("redirect", c.httpsPort).ServeHTTP(rec, r)
+		// 308, so the POST is retried as a POST
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != c.want {
+			t.Errorf("%s to port %s: got %d %q, want %q", c.host, c.httpsPort, rec.Code, rec.Header().Get("Location"), c.want)
+		}
+	}
+}
+
+func TestPlainHTTPHandler_Reject(t *testing.T) {
+	rec := httptest.NewRecorder()
+	PlainHTTPHandler("reject", "443").ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/allow", nil))
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Location") != "" {
+		t.Errorf("Expected cleartext requests refused, got %d", rec.Code)
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	tc, err := ServerTLSConfig(&config.Config{TLSClientAuth: "request"})
+	if err != nil || tc.ClientAuth != tls.RequestClientCert || tc.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected requested, unverified client certificates, got %+v, %v", tc, err)
+	}
+	if _, err := ServerTLSConfig(&config.Config{TLSClientAuth: "require"}); err == nil {
+		t.Error("Expected verifying client certificates to require TLS_CLIENT_CA_FILE")
+	}
+	if _, err := ServerTLSConfig(&config.Config{TLSClientAuth: "sometimes"}); err == nil {
+		t.Error("Expected an unknown TLS_CLIENT_AUTH refused")
+	}
+}
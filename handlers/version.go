@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"apigate-proxy/models"
+)
+
+// APIVersion is the version of the HTTP API served under /v1, reported as
+// api_version in every AllowResponse. The unversioned legacy paths are
+// aliases of /v1 and answer alike; a later version gets its own prefix and
+// leaves both unchanged.
+const APIVersion = "1"
+
+// V1Path returns the /v1 path of a legacy route: /api/allow is served at
+// /v1/allow and /admin/state at /v1/admin/state.
+func V1Path(legacy string) string {
+	return "/v1" + strings.TrimPrefix(legacy, "/api")
+}
+
+// writeAllowResponse answers with resp, stamped with APIVersion.
+func writeAllowResponse(w http.ResponseWriter, code int, resp models.AllowResponse) {
+	resp.APIVersion = APIVersion
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
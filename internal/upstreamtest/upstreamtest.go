@@ -0,0 +1,106 @@
+// Package upstreamtest runs a fake upstream decision API for tests.
+package upstreamtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"apigate-proxy/models"
+)
+
+// Decide returns the upstream's decision for a key.
+type Decide func(key string) models.BatchAllowResponseItem
+
+// AllowAll allows every key.
+func AllowAll(key string) models.BatchAllowResponseItem {
+	return models.BatchAllowResponseItem{Key: key, Allow: true}
+}
+
+// BlockAll blocks every key.
+func BlockAll(key string) models.BatchAllowResponseItem {
+	return models.BatchAllowResponseItem{Key: key, Allow: false}
+}
+
+// Block blocks keys and allows every other key.
+func Block(keys ...string) Decide {
+	return func(key string) models.BatchAllowResponseItem {
+		return models.BatchAllowResponseItem{Key: key, Allow: !slices.Contains(keys, key)}
+	}
+}
+
+// Hook runs before a request is answered. Returning false ends the request
+// without an answer, e.g. after the hook wrote an error status.
+type Hook func(w http.ResponseWriter, r *http.Request) bool
+
+// Server answers batch checks (a JSON array of keys, e.g. on
+// /api/allow/batch) with a decision for every key, recording the requests and
+// keys it answered. Hooks run once the body is read. It is closed when the
+// test ends.
+type Server struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	calls int
+	keys  []string
+}
+
+// New starts a Server deciding keys with decide after running hooks in order.
+func New(t testing.TB, decide Decide, hooks ...Hook) *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read first: the request's context only ends with the client's
+		// connection once the body is consumed.
+		var keys []string
+		json.NewDecoder(r.Body).Decode(&keys)
+		for _, hook := range hooks {
+			if !hook(w, r) {
+				return
+			}
+		}
+		res := make([]models.BatchAllowResponseItem, 0, len(keys))
+		for _, k := range keys {
+			res = append(res, decide(k))
+		}
+		s.mu.Lock()
+		s.calls++
+		s.keys = append(s.keys, keys...)
+		s.mu.Unlock()
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Calls returns how many checks were answered.
+func (s *Server) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// Keys returns every key asked about, in order.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.keys)
+}
+
+// Asked reports whether key was asked about.
+func (s *Server) Asked(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(s.keys, key)
+}
+
+// Delay returns a Hook holding every request for d.
+func Delay(d time.Duration) Hook {
+	return func(http.ResponseWriter, *http.Request) bool {
+		time.Sleep(d)
+		return true
+	}
+}
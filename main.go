@@ -2,78 +2,243 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
 
+	"apigate-proxy/apigateproxy"
 	"apigate-proxy/config"
 	"apigate-proxy/handlers"
-	"apigate-proxy/service"
 )
 
-func main() {
-	// Load Configuration
-	cfg := config.LoadConfig()
+// version is the build's version, set with -ldflags "-X main.version=...".
+var version = "dev"
 
-	// Initialize Service
-	svc := service.NewProxyService(cfg)
-	svc.Start()
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rules" {
+		os.Exit(rulesCommand(os.Args[2:]))
+	}
 
-	// Initialize Handlers
-	proxyHandler := handlers.NewProxyHandler(svc)
+	flags, err := config.ParseFlags(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		os.Exit(2)
+	}
+	if flags.Version {
+		fmt.Println(version)
+		return
+	}
+	if err := flags.Apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config file %s: %v\n", flags.ConfigFile, err)
+		os.Exit(2)
+	}
 
-	loggerSvc := service.NewLoggerService(cfg)
-	loggerSvc.Start()
-	loggerHandler := handlers.NewLoggerHandler(loggerSvc)
+	// Load Configuration
+	cfg := config.LoadConfig()
+	if flags.Validate {
+		os.Exit(validateConfig(cfg))
+	}
 
-	// Router
-	r := mux.NewRouter()
-	r.HandleFunc("/api/allow", proxyHandler.AllowDecisionHandler).Methods("POST")
-	r.HandleFunc("/api/encrypt-email", proxyHandler.EncryptEmailHandler).Methods("GET")
-	r.HandleFunc("/api/log", loggerHandler.LogRequestHandler).Methods("POST")
+	// Services and the HTTP API over them
+	proxy := apigateproxy.New(cfg)
+	proxy.Start()
+	tenants := proxy.Tenants
 
 	// Start Server
-
 	srv := &http.Server{
 		Addr:    ":" + cfg.ServerPort,
-		Handler: r,
+		Handler: proxy.Handler(),
+	}
+	useTLS := cfg.TLSCertFile != "" && cfg.TLSKeyFile != ""
+	var plainSrv *http.Server
+	if useTLS {
+		tlsConfig, err := handlers.ServerTLSConfig(cfg)
+		if err != nil {
+			fatal("invalid TLS configuration", "error", err)
+		}
+		srv.TLSConfig = tlsConfig
+		handlers.NewJA3Recorder().Wrap(srv)
+
+		// Optional plain HTTP listener that redirects to or rejects in favour of HTTPS
+		if cfg.HTTPPort != "" {
+			plainSrv = &http.Server{
+				Addr:    ":" + cfg.HTTPPort,
+				Handler: handlers.PlainHTTPHandler(cfg.HTTPMode, cfg.ServerPort),
+			}
+			go func() {
+				serverLog().Info("plain HTTP listener starting", "port", cfg.HTTPPort, "mode", cfg.HTTPMode)
+				if err := plainSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					fatal("plain HTTP listener failed", "error", err)
+				}
+			}()
+		}
 	}
 
 	go func() {
-		log.Printf("Proxy Server starting on port %s", cfg.ServerPort)
-		log.Printf("Upstream Configured: %s", cfg.UpstreamBaseURL)
-		log.Printf("Window Size: %ds", cfg.WindowSeconds)
-		log.Printf("Log Flush: %ds, Batch Size: %d", cfg.LogFlushInterval, cfg.LogBatchSize)
-		if cfg.UpstreamAPIKey != "" {
-			log.Printf("Upstream API Key: Configured (Length: %d)", len(cfg.UpstreamAPIKey))
-		} else {
-			log.Printf("Upstream API Key: NOT Configured")
+		serverLog().Info("proxy server starting",
+			"version", version,
+			"port", cfg.ServerPort,
+			"upstreams", cfg.UpstreamBaseURLs,
+			"window_seconds", cfg.WindowSeconds,
+			"log_flush_seconds", cfg.LogFlushInterval,
+			"batch_size", cfg.LogBatchSize,
+			"upstream_api_key_length", len(cfg.CurrentUpstreamAPIKey()),
+			"client_api_keys", len(tenants.ClientAPIKeys(cfg)))
+		if cfg.CurrentUpstreamAPIKey() == "" {
+			serverLog().Warn("upstream API key not configured")
+		}
+		if len(tenants.ClientAPIKeys(cfg)) == 0 {
+			serverLog().Warn("client API keys not configured, endpoints are open")
+		}
+		if ids := tenants.IDs(); len(ids) > 0 {
+			serverLog().Info("tenants configured", "tenants", ids, "header", cfg.TenantHeader)
 		}
 
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed to start: %v", err)
+		var err error
+		if useTLS {
+			serverLog().Info("TLS enabled", "cert", cfg.TLSCertFile, "client_auth", cfg.TLSClientAuth)
+			err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("server failed to start", "error", err)
 		}
 	}()
 
+	// Optional inline enforcement in front of a backend application
+	var enforceSrv *http.Server
+	if cfg.EnforceBackendURL != "" {
+		enforcer, err := handlers.NewEnforcementProxy(proxy.Decisions)
+		if err != nil {
+			fatal("invalid enforcement backend", "error", err)
+		}
+		enforceSrv = &http.Server{
+			Addr:      ":" + cfg.EnforcePort,
+			Handler:   enforcer,
+			TLSConfig: srv.TLSConfig,
+		}
+		go func() {
+			serverLog().Info("enforcement listener starting", "port", cfg.EnforcePort, "backend", cfg.EnforceBackendURL, "tls", useTLS)
+			var err error
+			if useTLS {
+				err = enforceSrv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+			} else {
+				err = enforceSrv.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				fatal("enforcement listener failed", "error", err)
+			}
+		}()
+	}
+
+	// Optional gRPC server sharing the same services
+	var grpcServer *grpc.Server
+	if cfg.GRPCPort != "" {
+		lis, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			fatal("gRPC server failed to listen", "error", err)
+		}
+		grpcServer = proxy.GRPCServer()
+		go func() {
+			serverLog().Info("gRPC server starting", "port", cfg.GRPCPort)
+			if err := grpcServer.Serve(lis); err != nil {
+				fatal("gRPC server failed", "error", err)
+			}
+		}()
+	}
+
+	// Optional profiling and runtime metrics, never on the public port
+	var debugSrv *http.Server
+	if cfg.DebugAddr != "" {
+		debugSrv = &http.Server{
+			Addr:    cfg.DebugAddr,
+			Handler: handlers.DebugHandler(proxy.Decisions, proxy.Logger),
+		}
+		go func() {
+			serverLog().Info("debug listener starting", "addr", cfg.DebugAddr)
+			if err := debugSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("debug listener failed", "error", err)
+			}
+		}()
+	}
+
 	// Graceful Shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
-	log.Println("Shutting down server...")
+
+	// Fail readiness first so the load balancer stops sending new traffic,
+	// then give it time to notice before connections are closed
+	proxy.Decisions.Drain()
+	if cfg.ShutdownDrainSeconds > 0 {
+		serverLog().Info("draining before shutdown", "drain_seconds", cfg.ShutdownDrainSeconds)
+		srv.SetKeepAlivesEnabled(false)
+		time.Sleep(time.Duration(cfg.ShutdownDrainSeconds) * time.Second)
+	}
+	serverLog().Info("shutting down server")
 
 	// Context for server shutdown (give it 5 seconds to finish requests)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+		serverLog().Error("server forced to shutdown", "error", err)
+	}
+	if enforceSrv != nil {
+		enforceSrv.Shutdown(ctx)
+	}
+	if plainSrv != nil {
+		plainSrv.Shutdown(ctx)
+	}
+	if debugSrv != nil {
+		debugSrv.Shutdown(ctx)
 	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+
+	// No further prefetches; wait for those in flight within the same grace period
+	if err := proxy.Stop(ctx); err != nil {
+		serverLog().Warn("abandoned prefetch in flight", "error", err)
+	}
+	serverLog().Info("server exited properly")
+}
+
+// validateConfig reports the problems found in cfg and returns the exit code:
+// 1 if LoadConfig ignored a setting or failed to read a file, or the TLS
+// files are unusable.
+func validateConfig(cfg *config.Config) int {
+	n := config.Problems()
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		if _, err := handlers.ServerTLSConfig(cfg); err != nil {
+			serverLog().Error("invalid TLS configuration", "error", err)
+			n++
+		}
+	}
+	if n > 0 {
+		fmt.Fprintf(os.Stderr, "%d configuration problem(s) found\n", n)
+		return 1
+	}
+	fmt.Println("configuration is valid")
+	return 0
+}
+
+func serverLog() *slog.Logger {
+	return slog.With("component", "server")
+}
 
-	loggerSvc.Stop()
-	log.Println("Server exited properly")
+// fatal logs an error the server cannot run with and exits.
+func fatal(msg string, args ...any) {
+	serverLog().Error(msg, args...)
+	os.Exit(1)
 }
@@ -5,6 +5,32 @@ type AllowRequest struct {
 	IPAddress string `json:"ip_address"`
 	Email     string `json:"email"`      // Can be Email OR any unique User ID
 	UserAgent string `json:"user_agent"` // Optional, can be populated from header
+	// Optional "email" or "user_id"; auto-detected from Email when empty
+	IdentityType string `json:"identity_type,omitempty"`
+	// Optional SHA-256 fingerprint of the client TLS certificate (mTLS deployments)
+	ClientCertFingerprint string `json:"client_cert_fingerprint,omitempty"`
+	// Optional JA3 hash of the client TLS handshake
+	JA3 string `json:"ja3,omitempty"`
+	// Optional header-shape fingerprint (see utils.RequestFingerprint)
+	RequestFingerprint string `json:"request_fingerprint,omitempty"`
+	// Optional URL notified with the final decision when the live check is
+	// deferred (LIVE_CHECK_BUDGET_MS); must be in CALLBACK_ALLOWED_HOSTS
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Optional tenant, when the X-Tenant-ID header is not used
+	TenantID string `json:"tenant_id,omitempty"`
+	// Optional path the request is for, e.g. "/signup"; matched by
+	// path-scoped local rules
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Resolved locally from IPAddress when a GeoIP database is configured
+	Country   string `json:"-"`
+	Continent string `json:"-"`
+	// Resolved locally from IPAddress when an ASN database is configured
+	ASN string `json:"-"`
+	// X-Request-ID of the HTTP request, keying the debug store
+	RequestID string `json:"-"`
+	// RequestID was generated by the proxy rather than supplied by the caller
+	RequestIDGenerated bool `json:"-"`
 }
 
 // AllowResponse represents the response from the individual check.
@@ -13,14 +39,76 @@ type AllowResponse struct {
 	Status        string   `json:"status"`
 	Message       string   `json:"message,omitempty"`
 	Error         string   `json:"error,omitempty"`
+	ErrorCode     string   `json:"error_code,omitempty"`  // Machine-readable Error, e.g. "upstream_timeout"
+	DecisionID    string   `json:"decision_id,omitempty"` // Set on deferred answers, matches the callback
 	MissingFields []string `json:"missing_fields,omitempty"`
+	WouldBlock    bool     `json:"would_block,omitempty"` // SHADOW_MODE: the decision was a block, answered as an allow
+	OverQuota     bool     `json:"over_quota,omitempty"`  // A key is over a local velocity limit (QUOTA_RULES)
+	APIVersion    string   `json:"api_version,omitempty"` // HTTP API version that shaped this response, e.g. "1"
+	// Keys that caused a block, with the upstream's reason code when known
+	BlockedBy []BlockReason `json:"blocked_by,omitempty"`
+	// Class and client name of the User-Agent, e.g. "library" and "curl"
+	// (see utils.ClassifyUserAgent); omitted without a User-Agent
+	UAClass  string `json:"ua_class,omitempty"`
+	UAClient string `json:"ua_client,omitempty"`
+}
+
+// BlockReason explains one blocked key of a decision.
+type BlockReason struct {
+	Key    string `json:"key"`  // As looked up (identities hashed)
+	Type   string `json:"type"` // Key type, e.g. "ip" or "email"
+	Reason string `json:"reason,omitempty"`
 }
 
+// Key types reported in BatchAllowResponseItem.Type.
+const (
+	KeyTypeIP         = "ip"
+	KeyTypeEmail      = "email"
+	KeyTypeUserID     = "user_id"
+	KeyTypeUserAgent  = "user_agent"
+	KeyTypeClientCert = "client_cert"
+	KeyTypeJA3        = "ja3"
+	KeyTypeRequestFP  = "request_fp"
+	KeyTypeCountry    = "country"
+	KeyTypeContinent  = "continent"
+	KeyTypeASN        = "asn"
+)
+
+// Key types derived from the User-Agent for local rules only; they are never
+// cached or sent upstream.
+const (
+	KeyTypeUAClass  = "ua_class"
+	KeyTypeUAClient = "ua_client"
+)
+
 // BatchAllowResponseItem represents a single item in the batch response.
 type BatchAllowResponseItem struct {
 	Key   string `json:"key"`
-	Type  string `json:"type"` // "ip" or "email" or "user_agent"
+	Type  string `json:"type"` // "ip", "email", "user_id", "user_agent", "client_cert", "ja3", "request_fp" or "asn"
 	Allow bool   `json:"allow"`
+	// Optional reason code for blocks, e.g. "abuse_report"; returned to callers in blocked_by
+	Reason string `json:"reason,omitempty"`
+	// Optional metadata about the key, e.g. "disposable_email" or "datacenter_ip";
+	// attached to log records and debug records, never to decisions
+	Labels []string `json:"labels,omitempty"`
+}
+
+// ChangesResponse is the upstream's answer to GET /api/allow/changes?since=<version>:
+// the decisions changed since that version, and the version they bring the
+// caller up to. An empty since returns the current version and no changes.
+type ChangesResponse struct {
+	Version string                   `json:"version"`
+	Changes []BatchAllowResponseItem `json:"changes,omitempty"`
+	// Set when since is unknown or too old to answer from; the caller must
+	// fetch its keys in full and continue from Version
+	Reset bool `json:"reset,omitempty"`
+}
+
+// InvalidationRequest is a decision change pushed by the upstream, as the
+// body of POST /admin/invalidate or a message on INVALIDATION_CHANNEL. Each
+// decision replaces the cached one for its key (and type) at once.
+type InvalidationRequest struct {
+	Decisions []BatchAllowResponseItem `json:"decisions"`
 }
 
 // BatchAllowRequest represents the body for the upstream batch request.
@@ -29,15 +117,32 @@ type BatchAllowRequest []string
 
 // LogRequest represents the full request details for logging.
 type LogRequest struct {
-	IPAddress    string `json:"ip_address"`
-	Email        string `json:"email"`
-	UserAgent    string `json:"user_agent"`
-	HTTPMethod   string `json:"http_method"`
-	Endpoint     string `json:"endpoint"`
-	EventType    string `json:"event_type,omitempty"`
-	Username     string `json:"username,omitempty"`
-	ResponseCode int    `json:"response_code,omitempty"`
-	TrackRequest bool   `json:"track_request"`
+	IPAddress             string `json:"ip_address"`
+	Email                 string `json:"email"`
+	IdentityType          string `json:"identity_type,omitempty"`
+	UserAgent             string `json:"user_agent"`
+	ClientCertFingerprint string `json:"client_cert_fingerprint,omitempty"`
+	JA3                   string `json:"ja3,omitempty"`
+	RequestFingerprint    string `json:"request_fingerprint,omitempty"`
+	Country               string `json:"country,omitempty"`
+	Continent             string `json:"continent,omitempty"`
+	UAClass               string `json:"ua_class,omitempty"`  // Added by the proxy, see AllowResponse
+	UAClient              string `json:"ua_client,omitempty"` // Added by the proxy, see AllowResponse
+	HTTPMethod            string `json:"http_method"`
+	Endpoint              string `json:"endpoint"`
+	EventType             string `json:"event_type,omitempty"`
+	Username              string `json:"username,omitempty"`
+	ResponseCode          int    `json:"response_code,omitempty"`
+	TrackRequest          bool   `json:"track_request"`
+	TenantID              string `json:"tenant_id,omitempty"` // Tenant the record belongs to (or X-Tenant-ID)
+	// Upstream labels cached for the record's keys, added by the proxy
+	Labels []string `json:"labels,omitempty"`
+	// Identical events this record stands for when rolled up by
+	// LOG_AGGREGATE_EVENT_TYPES; omitted (one event) for raw records
+	Count int `json:"count,omitempty"`
+	// Share of records like this one kept by LOG_SAMPLE_RATES, e.g. 0.1 when
+	// it stands for ten; omitted when all are kept
+	SampleRate float64 `json:"sample_rate,omitempty"`
 }
 
 // LogResponse represents the response to the client for the log endpoint.
@@ -0,0 +1,558 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: apigate/v1/apigate.proto
+
+package apigatev1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type AllowRequest struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	IpAddress string                 `protobuf:"bytes,1,opt,name=ip_address,json=ipAddress,proto3" json:"ip_address,omitempty"`
+	// Email OR any unique user ID
+	Email     string `protobuf:"bytes,2,opt,name=email,proto3" json:"email,omitempty"`
+	UserAgent string `protobuf:"bytes,3,opt,name=user_agent,json=userAgent,proto3" json:"user_agent,omitempty"`
+	// "email" or "user_id"; auto-detected when empty
+	IdentityType          string `protobuf:"bytes,4,opt,name=identity_type,json=identityType,proto3" json:"identity_type,omitempty"`
+	ClientCertFingerprint string `protobuf:"bytes,5,opt,name=client_cert_fingerprint,json=clientCertFingerprint,proto3" json:"client_cert_fingerprint,omitempty"`
+	Ja3                   string `protobuf:"bytes,6,opt,name=ja3,proto3" json:"ja3,omitempty"`
+	RequestFingerprint    string `protobuf:"bytes,7,opt,name=request_fingerprint,json=requestFingerprint,proto3" json:"request_fingerprint,omitempty"`
+	unknownFields         protoimpl.UnknownFields
+	sizeCache             protoimpl.SizeCache
+}
+
+func (x *AllowRequest) Reset() {
+	*x = AllowRequest{}
+	mi := &file_apigate_v1_apigate_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllowRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllowRequest) ProtoMessage() {}
+
+func (x *AllowRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_apigate_v1_apigate_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllowRequest.ProtoReflect.Descriptor instead.
+func (*AllowRequest) Descriptor() ([]byte, []int) {
+	return file_apigate_v1_apigate_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *AllowRequest) GetIpAddress() string {
+	if x != nil {
+		return x.IpAddress
+	}
+	return ""
+}
+
+func (x *AllowRequest) GetEmail() string {
+	if x != nil {
+		return x.Email
+	}
+	return ""
+}
+
+func (x *AllowRequest) GetUserAgent() string {
+	if x != nil {
+		return x.UserAgent
+	}
+	return ""
+}
+
+func (x *AllowRequest) GetIdentityType() string {
+	if x != nil {
+		return x.IdentityType
+	}
+	return ""
+}
+
+func (x *AllowRequest) GetClientCertFingerprint() string {
+	if x != nil {
+		return x.ClientCertFingerprint
+	}
+	return ""
+}
+
+func (x *AllowRequest) GetJa3() string {
+	if x != nil {
+		return x.Ja3
+	}
+	return ""
+}
+
+func (x *AllowRequest) GetRequestFingerprint() string {
+	if x != nil {
+		return x.RequestFingerprint
+	}
+	return ""
+}
+
+type AllowResponse struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Allow   bool                   `protobuf:"varint,1,opt,name=allow,proto3" json:"allow,omitempty"`
+	Status  string                 `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+	Message string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	Error   string                 `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	// Keys that caused a block
+	BlockedBy     []*BlockReason `protobuf:"bytes,5,rep,name=blocked_by,json=blockedBy,proto3" json:"blocked_by,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllowResponse) Reset() {
+	*x = AllowResponse{}
+	mi := &file_apigate_v1_apigate_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllowResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllowResponse) ProtoMessage() {}
+
+func (x *AllowResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_apigate_v1_apigate_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllowResponse.ProtoReflect.Descriptor instead.
+func (*AllowResponse) Descriptor() ([]byte, []int) {
+	return file_apigate_v1_apigate_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AllowResponse) GetAllow() bool {
+	if x != nil {
+		return x.Allow
+	}
+	return false
+}
+
+func (x *AllowResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *AllowResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *AllowResponse) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *AllowResponse) GetBlockedBy() []*BlockReason {
+	if x != nil {
+		return x.BlockedBy
+	}
+	return nil
+}
+
+type BlockReason struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// As looked up (identities hashed)
+	Key  string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Type string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	// Upstream reason code, or "local_rule"; empty when unknown
+	Reason        string `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlockReason) Reset() {
+	*x = BlockReason{}
+	mi := &file_apigate_v1_apigate_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlockReason) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockReason) ProtoMessage() {}
+
+func (x *BlockReason) ProtoReflect() protoreflect.Message {
+	mi := &file_apigate_v1_apigate_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockReason.ProtoReflect.Descriptor instead.
+func (*BlockReason) Descriptor() ([]byte, []int) {
+	return file_apigate_v1_apigate_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *BlockReason) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *BlockReason) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *BlockReason) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+type LogRequest struct {
+	state                 protoimpl.MessageState `protogen:"open.v1"`
+	IpAddress             string                 `protobuf:"bytes,1,opt,name=ip_address,json=ipAddress,proto3" json:"ip_address,omitempty"`
+	Email                 string                 `protobuf:"bytes,2,opt,name=email,proto3" json:"email,omitempty"`
+	IdentityType          string                 `protobuf:"bytes,3,opt,name=identity_type,json=identityType,proto3" json:"identity_type,omitempty"`
+	UserAgent             string                 `protobuf:"bytes,4,opt,name=user_agent,json=userAgent,proto3" json:"user_agent,omitempty"`
+	ClientCertFingerprint string                 `protobuf:"bytes,5,opt,name=client_cert_fingerprint,json=clientCertFingerprint,proto3" json:"client_cert_fingerprint,omitempty"`
+	Ja3                   string                 `protobuf:"bytes,6,opt,name=ja3,proto3" json:"ja3,omitempty"`
+	RequestFingerprint    string                 `protobuf:"bytes,7,opt,name=request_fingerprint,json=requestFingerprint,proto3" json:"request_fingerprint,omitempty"`
+	HttpMethod            string                 `protobuf:"bytes,8,opt,name=http_method,json=httpMethod,proto3" json:"http_method,omitempty"`
+	Endpoint              string                 `protobuf:"bytes,9,opt,name=endpoint,proto3" json:"endpoint,omitempty"`
+	EventType             string                 `protobuf:"bytes,10,opt,name=event_type,json=eventType,proto3" json:"event_type,omitempty"`
+	Username              string                 `protobuf:"bytes,11,opt,name=username,proto3" json:"username,omitempty"`
+	ResponseCode          int32                  `protobuf:"varint,12,opt,name=response_code,json=responseCode,proto3" json:"response_code,omitempty"`
+	TrackRequest          bool                   `protobuf:"varint,13,opt,name=track_request,json=trackRequest,proto3" json:"track_request,omitempty"`
+	unknownFields         protoimpl.UnknownFields
+	sizeCache             protoimpl.SizeCache
+}
+
+func (x *LogRequest) Reset() {
+	*x = LogRequest{}
+	mi := &file_apigate_v1_apigate_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogRequest) ProtoMessage() {}
+
+func (x *LogRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_apigate_v1_apigate_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogRequest.ProtoReflect.Descriptor instead.
+func (*LogRequest) Descriptor() ([]byte, []int) {
+	return file_apigate_v1_apigate_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *LogRequest) GetIpAddress() string {
+	if x != nil {
+		return x.IpAddress
+	}
+	return ""
+}
+
+func (x *LogRequest) GetEmail() string {
+	if x != nil {
+		return x.Email
+	}
+	return ""
+}
+
+func (x *LogRequest) GetIdentityType() string {
+	if x != nil {
+		return x.IdentityType
+	}
+	return ""
+}
+
+func (x *LogRequest) GetUserAgent() string {
+	if x != nil {
+		return x.UserAgent
+	}
+	return ""
+}
+
+func (x *LogRequest) GetClientCertFingerprint() string {
+	if x != nil {
+		return x.ClientCertFingerprint
+	}
+	return ""
+}
+
+func (x *LogRequest) GetJa3() string {
+	if x != nil {
+		return x.Ja3
+	}
+	return ""
+}
+
+func (x *LogRequest) GetRequestFingerprint() string {
+	if x != nil {
+		return x.RequestFingerprint
+	}
+	return ""
+}
+
+func (x *LogRequest) GetHttpMethod() string {
+	if x != nil {
+		return x.HttpMethod
+	}
+	return ""
+}
+
+func (x *LogRequest) GetEndpoint() string {
+	if x != nil {
+		return x.Endpoint
+	}
+	return ""
+}
+
+func (x *LogRequest) GetEventType() string {
+	if x != nil {
+		return x.EventType
+	}
+	return ""
+}
+
+func (x *LogRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *LogRequest) GetResponseCode() int32 {
+	if x != nil {
+		return x.ResponseCode
+	}
+	return 0
+}
+
+func (x *LogRequest) GetTrackRequest() bool {
+	if x != nil {
+		return x.TrackRequest
+	}
+	return false
+}
+
+type LogResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogResponse) Reset() {
+	*x = LogResponse{}
+	mi := &file_apigate_v1_apigate_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogResponse) ProtoMessage() {}
+
+func (x *LogResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_apigate_v1_apigate_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogResponse.ProtoReflect.Descriptor instead.
+func (*LogResponse) Descriptor() ([]byte, []int) {
+	return file_apigate_v1_apigate_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *LogResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *LogResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+var File_apigate_v1_apigate_proto protoreflect.FileDescriptor
+
+const file_apigate_v1_apigate_proto_rawDesc = "" +
+	"\n" +
+	"\x18apigate/v1/apigate.proto\x12\n" +
+	"apigate.v1\"\x82\x02\n" +
+	"\fAllowRequest\x12\x1d\n" +
+	"\n" +
+	"ip_address\x18\x01 \x01(\tR\tipAddress\x12\x14\n" +
+	"\x05email\x18\x02 \x01(\tR\x05email\x12\x1d\n" +
+	"\n" +
+	"user_agent\x18\x03 \x01(\tR\tuserAgent\x12#\n" +
+	"\ridentity_type\x18\x04 \x01(\tR\fidentityType\x126\n" +
+	"\x17client_cert_fingerprint\x18\x05 \x01(\tR\x15clientCertFingerprint\x12\x10\n" +
+	"\x03ja3\x18\x06 \x01(\tR\x03ja3\x12/\n" +
+	"\x13request_fingerprint\x18\a \x01(\tR\x12requestFingerprint\"\xa5\x01\n" +
+	"\rAllowResponse\x12\x14\n" +
+	"\x05allow\x18\x01 \x01(\bR\x05allow\x12\x16\n" +
+	"\x06status\x18\x02 \x01(\tR\x06status\x12\x18\n" +
+	"\amessage\x18\x03 \x01(\tR\amessage\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\x126\n" +
+	"\n" +
+	"blocked_by\x18\x05 \x03(\v2\x17.apigate.v1.BlockReasonR\tblockedBy\"K\n" +
+	"\vBlockReason\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x16\n" +
+	"\x06reason\x18\x03 \x01(\tR\x06reason\"\xc2\x03\n" +
+	"\n" +
+	"LogRequest\x12\x1d\n" +
+	"\n" +
+	"ip_address\x18\x01 \x01(\tR\tipAddress\x12\x14\n" +
+	"\x05email\x18\x02 \x01(\tR\x05email\x12#\n" +
+	"\ridentity_type\x18\x03 \x01(\tR\fidentityType\x12\x1d\n" +
+	"\n" +
+	"user_agent\x18\x04 \x01(\tR\tuserAgent\x126\n" +
+	"\x17client_cert_fingerprint\x18\x05 \x01(\tR\x15clientCertFingerprint\x12\x10\n" +
+	"\x03ja3\x18\x06 \x01(\tR\x03ja3\x12/\n" +
+	"\x13request_fingerprint\x18\a \x01(\tR\x12requestFingerprint\x12\x1f\n" +
+	"\vhttp_method\x18\b \x01(\tR\n" +
+	"httpMethod\x12\x1a\n" +
+	"\bendpoint\x18\t \x01(\tR\bendpoint\x12\x1d\n" +
+	"\n" +
+	"event_type\x18\n" +
+	" \x01(\tR\teventType\x12\x1a\n" +
+	"\busername\x18\v \x01(\tR\busername\x12#\n" +
+	"\rresponse_code\x18\f \x01(\x05R\fresponseCode\x12#\n" +
+	"\rtrack_request\x18\r \x01(\bR\ftrackRequest\"?\n" +
+	"\vLogResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage2\x8c\x01\n" +
+	"\x0fDecisionService\x12<\n" +
+	"\x05Check\x12\x18.apigate.v1.AllowRequest\x1a\x19.apigate.v1.AllowResponse\x12;\n" +
+	"\bQueueLog\x12\x16.apigate.v1.LogRequest\x1a\x17.apigate.v1.LogResponseB*Z(apigate-proxy/proto/apigate/v1;apigatev1b\x06proto3"
+
+var (
+	file_apigate_v1_apigate_proto_rawDescOnce sync.Once
+	file_apigate_v1_apigate_proto_rawDescData []byte
+)
+
+func file_apigate_v1_apigate_proto_rawDescGZIP() []byte {
+	file_apigate_v1_apigate_proto_rawDescOnce.Do(func() {
+		file_apigate_v1_apigate_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_apigate_v1_apigate_proto_rawDesc), len(file_apigate_v1_apigate_proto_rawDesc)))
+	})
+	return file_apigate_v1_apigate_proto_rawDescData
+}
+
+var file_apigate_v1_apigate_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_apigate_v1_apigate_proto_goTypes = []any{
+	(*AllowRequest)(nil),  // 0: apigate.v1.AllowRequest
+	(*AllowResponse)(nil), // 1: apigate.v1.AllowResponse
+	(*BlockReason)(nil),   // 2: apigate.v1.BlockReason
+	(*LogRequest)(nil),    // 3: apigate.v1.LogRequest
+	(*LogResponse)(nil),   // 4: apigate.v1.LogResponse
+}
+var file_apigate_v1_apigate_proto_depIdxs = []int32{
+	2, // 0: apigate.v1.AllowResponse.blocked_by:type_name -> apigate.v1.BlockReason
+	0, // 1: apigate.v1.DecisionService.Check:input_type -> apigate.v1.AllowRequest
+	3, // 2: apigate.v1.DecisionService.QueueLog:input_type -> apigate.v1.LogRequest
+	1, // 3: apigate.v1.DecisionService.Check:output_type -> apigate.v1.AllowResponse
+	4, // 4: apigate.v1.DecisionService.QueueLog:output_type -> apigate.v1.LogResponse
+	3, // [3:5] is the sub-list for method output_type
+	1, // [1:3] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_apigate_v1_apigate_proto_init() }
+func file_apigate_v1_apigate_proto_init() {
+	if File_apigate_v1_apigate_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_apigate_v1_apigate_proto_rawDesc), len(file_apigate_v1_apigate_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_apigate_v1_apigate_proto_goTypes,
+		DependencyIndexes: file_apigate_v1_apigate_proto_depIdxs,
+		MessageInfos:      file_apigate_v1_apigate_proto_msgTypes,
+	}.Build()
+	File_apigate_v1_apigate_proto = out.File
+	file_apigate_v1_apigate_proto_goTypes = nil
+	file_apigate_v1_apigate_proto_depIdxs = nil
+}
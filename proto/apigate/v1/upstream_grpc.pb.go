@@ -0,0 +1,220 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: apigate/v1/upstream.proto
+
+package apigatev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	UpstreamService_AllowBatch_FullMethodName = "/apigate.v1.UpstreamService/AllowBatch"
+	UpstreamService_Snapshot_FullMethodName   = "/apigate.v1.UpstreamService/Snapshot"
+	UpstreamService_SubmitLogs_FullMethodName = "/apigate.v1.UpstreamService/SubmitLogs"
+)
+
+// UpstreamServiceClient is the client API for UpstreamService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// UpstreamService is the binary alternative to the upstream JSON/HTTP
+// endpoints (/api/allow/batch, /api/allow/snapshot and /api/logs), used when
+// UPSTREAM_PROTOCOL=grpc.
+type UpstreamServiceClient interface {
+	// AllowBatch streams one decision per requested key.
+	AllowBatch(ctx context.Context, in *AllowBatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AllowBatchItem], error)
+	// Snapshot streams the project's current decisions, most relevant first,
+	// for warm starts.
+	Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AllowBatchItem], error)
+	// SubmitLogs delivers a batch of request log records.
+	SubmitLogs(ctx context.Context, in *SubmitLogsRequest, opts ...grpc.CallOption) (*SubmitLogsResponse, error)
+}
+
+type upstreamServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewUpstreamServiceClient(cc grpc.ClientConnInterface) UpstreamServiceClient {
+	return &upstreamServiceClient{cc}
+}
+
+func (c *upstreamServiceClient) AllowBatch(ctx context.Context, in *AllowBatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AllowBatchItem], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &UpstreamService_ServiceDesc.Streams[0], UpstreamService_AllowBatch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AllowBatchRequest, AllowBatchItem]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type UpstreamService_AllowBatchClient = grpc.ServerStreamingClient[AllowBatchItem]
+
+func (c *upstreamServiceClient) Snapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AllowBatchItem], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &UpstreamService_ServiceDesc.Streams[1], UpstreamService_Snapshot_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SnapshotRequest, AllowBatchItem]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type UpstreamService_SnapshotClient = grpc.ServerStreamingClient[AllowBatchItem]
+
+func (c *upstreamServiceClient) SubmitLogs(ctx context.Context, in *SubmitLogsRequest, opts ...grpc.CallOption) (*SubmitLogsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SubmitLogsResponse)
+	err := c.cc.Invoke(ctx, UpstreamService_SubmitLogs_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpstreamServiceServer is the server API for UpstreamService service.
+// All implementations must embed UnimplementedUpstreamServiceServer
+// for forward compatibility.
+//
+// UpstreamService is the binary alternative to the upstream JSON/HTTP
+// endpoints (/api/allow/batch, /api/allow/snapshot and /api/logs), used when
+// UPSTREAM_PROTOCOL=grpc.
+type UpstreamServiceServer interface {
+	// AllowBatch streams one decision per requested key.
+	AllowBatch(*AllowBatchRequest, grpc.ServerStreamingServer[AllowBatchItem]) error
+	// Snapshot streams the project's current decisions, most relevant first,
+	// for warm starts.
+	Snapshot(*SnapshotRequest, grpc.ServerStreamingServer[AllowBatchItem]) error
+	// SubmitLogs delivers a batch of request log records.
+	SubmitLogs(context.Context, *SubmitLogsRequest) (*SubmitLogsResponse, error)
+	mustEmbedUnimplementedUpstreamServiceServer()
+}
+
+// UnimplementedUpstreamServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedUpstreamServiceServer struct{}
+
+func (UnimplementedUpstreamServiceServer) AllowBatch(*AllowBatchRequest, grpc.ServerStreamingServer[AllowBatchItem]) error {
+	return status.Errorf(codes.Unimplemented, "method AllowBatch not implemented")
+}
+func (UnimplementedUpstreamServiceServer) Snapshot(*SnapshotRequest, grpc.ServerStreamingServer[AllowBatchItem]) error {
+	return status.Errorf(codes.Unimplemented, "method Snapshot not implemented")
+}
+func (UnimplementedUpstreamServiceServer) SubmitLogs(context.Context, *SubmitLogsRequest) (*SubmitLogsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitLogs not implemented")
+}
+func (UnimplementedUpstreamServiceServer) mustEmbedUnimplementedUpstreamServiceServer() {}
+func (UnimplementedUpstreamServiceServer) testEmbeddedByValue()                         {}
+
+// UnsafeUpstreamServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UpstreamServiceServer will
+// result in compilation errors.
+type UnsafeUpstreamServiceServer interface {
+	mustEmbedUnimplementedUpstreamServiceServer()
+}
+
+func RegisterUpstreamServiceServer(s grpc.ServiceRegistrar, srv UpstreamServiceServer) {
+	// If the following call pancis, it indicates UnimplementedUpstreamServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&UpstreamService_ServiceDesc, srv)
+}
+
+func _UpstreamService_AllowBatch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(AllowBatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UpstreamServiceServer).AllowBatch(m, &grpc.GenericServerStream[AllowBatchRequest, AllowBatchItem]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type UpstreamService_AllowBatchServer = grpc.ServerStreamingServer[AllowBatchItem]
+
+func _UpstreamService_Snapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SnapshotRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UpstreamServiceServer).Snapshot(m, &grpc.GenericServerStream[SnapshotRequest, AllowBatchItem]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type UpstreamService_SnapshotServer = grpc.ServerStreamingServer[AllowBatchItem]
+
+func _UpstreamService_SubmitLogs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitLogsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpstreamServiceServer).SubmitLogs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UpstreamService_SubmitLogs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpstreamServiceServer).SubmitLogs(ctx, req.(*SubmitLogsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// UpstreamService_ServiceDesc is the grpc.ServiceDesc for UpstreamService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var UpstreamService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "apigate.v1.UpstreamService",
+	HandlerType: (*UpstreamServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitLogs",
+			Handler:    _UpstreamService_SubmitLogs_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "AllowBatch",
+			Handler:       _UpstreamService_AllowBatch_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Snapshot",
+			Handler:       _UpstreamService_Snapshot_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "apigate/v1/upstream.proto",
+}
@@ -0,0 +1,6 @@
+// Package proto holds the protobuf definitions for the gRPC API.
+// Regenerate the Go code with `go generate ./proto` (requires buf,
+// protoc-gen-go and protoc-gen-go-grpc on PATH).
+package proto
+
+//go:generate buf generate
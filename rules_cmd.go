@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"apigate-proxy/config"
+	"apigate-proxy/service"
+)
+
+const rulesUsage = `Usage: apigate-proxy rules test [-rules rules.json] tests.json
+
+Evaluates local rules against the example requests in tests.json and exits
+non-zero if any case fails or a rule entry is invalid. Rules default to the
+configured RULES_ALLOW, RULES_DENY and RULES_FILE; identities are keyed with
+the configured EMAIL_ENCRYPTION_* settings, as the server would.
+`
+
+// rulesCommand runs the "rules" subcommand and returns the exit code.
+func rulesCommand(args []string) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprint(os.Stderr, rulesUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("rules test", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, rulesUsage) }
+	rulesFile := fs.String("rules", "", "rules file to test instead of the configured rules")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg := config.LoadConfig()
+	rules := config.RulesFileContent{Allow: cfg.RulesAllow, Deny: cfg.RulesDeny}
+	if *rulesFile != "" {
+		content, err := config.LoadRulesFile(*rulesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load rules file %s: %v\n", *rulesFile, err)
+			return 2
+		}
+		rules = *content
+	}
+	cases, err := service.LoadRuleTestsFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load tests file %s: %v\n", fs.Arg(0), err)
+		return 2
+	}
+
+	report := service.RunRuleTests(cfg, rules, cases)
+	for _, msg := range report.Invalid {
+		fmt.Printf("INVALID %s\n", msg)
+	}
+	for _, res := range report.Results {
+		if res.Pass {
+			fmt.Printf("PASS    %s\n", res.Name)
+		} else {
+			fmt.Printf("FAIL    %s: expected %s, got %s\n", res.Name, res.Expect, res.Got)
+		}
+	}
+	fmt.Printf("%d passed, %d failed, %d invalid rules\n", len(report.Results)-report.Failed, report.Failed, len(report.Invalid))
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// adminAuditMax caps the actions kept in memory without ADMIN_AUDIT_FILE and
+// the results of each query.
+const adminAuditMax = 1000
+
+// Admin actions recorded in the admin audit trail.
+const (
+	AdminActionInvalidate   = "invalidate"    // Decisions overridden with POST /admin/invalidate
+	AdminActionDecryptEmail = "decrypt_email" // Identity revealed with POST /api/decrypt-email
+)
+
+// AdminAction is one entry of the admin audit trail.
+type AdminAction struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Endpoint string    `json:"endpoint"`
+	KeyID    string    `json:"key_id"`          // Fingerprint of the admin API key used
+	Actor    string    `json:"actor,omitempty"` // X-Admin-Actor, as stated by the caller
+	RemoteIP string    `json:"remote_ip,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	// Decisions overridden (invalidate)
+	Decisions []models.BatchAllowResponseItem `json:"decisions,omitempty"`
+	// Encrypted identity revealed, never its plaintext (decrypt_email)
+	Target string `json:"target,omitempty"`
+}
+
+// AdminAuditQuery filters the admin audit trail. Zero values match everything.
+type AdminAuditQuery struct {
+	Since  time.Time
+	Until  time.Time
+	Action string
+	Actor  string // Matches Actor or KeyID
+	Limit  int
+}
+
+// AdminAudit is the append-only trail of admin actions. With ADMIN_AUDIT_FILE
+// every action is appended to that file as a JSON line and queries read it
+// back; otherwise only the most recent actions are kept, in memory. With
+// ADMIN_AUDIT_UPSTREAM actions are also queued as log records with event type
+// "admin.<action>".
+type AdminAudit struct {
+	logger *LoggerService // nil = not sent upstream
+
+	mu     sync.Mutex
+	file   *os.File      // nil = memory only
+	recent []AdminAction // Without file, oldest first
+}
+
+// NewAdminAudit opens cfg's admin audit trail. When ADMIN_AUDIT_FILE cannot be
+// opened the error is logged and actions are kept in memory instead.
+func NewAdminAudit(cfg *config.Config, logger *LoggerService) *AdminAudit {
+	a := &AdminAudit{}
+	if cfg.AdminAuditUpstream {
+		a.logger = logger
+	}
+	if cfg.AdminAuditFile != "" {
+		f, err := os.OpenFile(cfg.AdminAuditFile, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o600)
+		if err != nil {
+			logFor(componentProxy).Error("cannot open admin audit file, keeping admin actions in memory", "path", cfg.AdminAuditFile, "error", err)
+		} else {
+			a.file = f
+		}
+	}
+	return a
+}
+
+// Record appends act to the trail, stamping its time.
+func (a *AdminAudit) Record(act AdminAction) error {
+	act.Time = time.Now().UTC()
+	if a.logger != nil {
+		user := act.Actor
+		if user == "" {
+			user = act.KeyID
+		}
+		a.logger.QueueLog(models.LogRequest{
+			IPAddress:    act.RemoteIP,
+			HTTPMethod:   "POST",
+			Endpoint:     act.Endpoint,
+			EventType:    "admin." + act.Action,
+			Username:     user,
+			ResponseCode: 200,
+			TenantID:     act.Tenant,
+		})
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		if len(a.recent) == adminAuditMax {
+			a.recent = append(a.recent[:0], a.recent[1:]...)
+		}
+		a.recent = append(a.recent, act)
+		return nil
+	}
+	line, err := json.Marshal(act)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Query returns the actions matching q, newest first, at most q.Limit of
+// them (capped at 1000).
+func (a *AdminAudit) Query(q AdminAuditQuery) ([]AdminAction, error) {
+	limit := q.Limit
+	if limit <= 0 || limit > adminAuditMax {
+		limit = adminAuditMax
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	actions := a.recent
+	if a.file != nil {
+		var err error
+		if actions, err = a.readFile(); err != nil {
+			return nil, err
+		}
+	}
+	out := []AdminAction{}
+	for i := len(actions) - 1; i >= 0 && len(out) < limit; i-- {
+		if q.matches(actions[i]) {
+			out = append(out, actions[i])
+		}
+	}
+	return out, nil
+}
+
+// readFile reads every action in the file; lines that do not parse, such as
+// one cut short by a crash, are skipped.
+func (a *AdminAudit) readFile() ([]AdminAction, error) {
+	if _, err := a.file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	var actions []AdminAction
+	sc := bufio.NewScanner(a.file)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		var act AdminAction
+		if json.Unmarshal(sc.Bytes(), &act) == nil {
+			actions = append(actions, act)
+		}
+	}
+	return actions, sc.Err()
+}
+
+func (q AdminAuditQuery) matches(act AdminAction) bool {
+	switch {
+	case !q.Since.IsZero() && act.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && act.Time.After(q.Until):
+		return false
+	case q.Action != "" && act.Action != q.Action:
+		return false
+	case q.Actor != "" && act.Actor != q.Actor && act.KeyID != q.Actor:
+		return false
+	}
+	return true
+}
+
+// Close closes ADMIN_AUDIT_FILE.
+func (a *AdminAudit) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
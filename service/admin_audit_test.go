@@ -0,0 +1,60 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+func TestAdminAudit_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.jsonl")
+	cfg := &config.Config{AdminAuditFile: path}
+
+	a := NewAdminAudit(cfg, nil)
+	a.Record(AdminAction{Action: AdminActionInvalidate, KeyID: "k1", Actor: "alice",
+		Decisions: []models.BatchAllowResponseItem{{Key: "1.2.3.4", Allow: false}}})
+	a.Record(AdminAction{Action: AdminActionDecryptEmail, KeyID: "k2", Target: "enc"})
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Fatalf("Expected 2 lines in the audit file, got %d", lines)
+	}
+
+	// Reopened, the trail is appended to and queried from the file
+	a = NewAdminAudit(cfg, nil)
+	defer a.Close()
+	a.Record(AdminAction{Action: AdminActionInvalidate, KeyID: "k2"})
+
+	all, err := a.Query(AdminAuditQuery{})
+	if err != nil || len(all) != 3 || all[0].KeyID != "k2" || all[2].Actor != "alice" {
+		t.Fatalf("Expected 3 actions newest first, got %+v (%v)", all, err)
+	}
+	if got, _ := a.Query(AdminAuditQuery{Action: AdminActionInvalidate, Actor: "alice"}); len(got) != 1 || len(got[0].Decisions) != 1 {
+		t.Errorf("Expected alice's invalidation, got %+v", got)
+	}
+	if got, _ := a.Query(AdminAuditQuery{Actor: "k2", Limit: 1}); len(got) != 1 || got[0].Action != AdminActionInvalidate {
+		t.Errorf("Expected the latest action of key k2, got %+v", got)
+	}
+	if got, _ := a.Query(AdminAuditQuery{Since: time.Now().Add(time.Minute)}); len(got) != 0 {
+		t.Errorf("Expected no future actions, got %+v", got)
+	}
+}
+
+func TestAdminAudit_Memory(t *testing.T) {
+	a := NewAdminAudit(&config.Config{}, nil)
+	for i := 0; i < adminAuditMax+5; i++ {
+		a.Record(AdminAction{Action: AdminActionDecryptEmail, KeyID: "k"})
+	}
+	got, err := a.Query(AdminAuditQuery{})
+	if err != nil || len(got) != adminAuditMax {
+		t.Errorf("Expected the latest %d actions, got %d (%v)", adminAuditMax, len(got), err)
+	}
+}
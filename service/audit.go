@@ -0,0 +1,273 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+// DecisionRecord is one Check outcome kept by the decision audit store.
+type DecisionRecord struct {
+	Seq     uint64        `json:"seq"`
+	Time    time.Time     `json:"time"`
+	Allow   bool          `json:"allow"`
+	Source  string        `json:"source"`
+	Message string        `json:"message,omitempty"`
+	Keys    []DecisionKey `json:"keys"`
+}
+
+// DecisionKey is a key evaluated for a decision (identities are hashed as sent upstream).
+type DecisionKey struct {
+	Type   string   `json:"type"`
+	Key    string   `json:"key"`
+	Labels []string `json:"labels,omitempty"` // Upstream metadata, in debug records only
+}
+
+// AuditQuery filters the decision audit store. Zero values match everything.
+type AuditQuery struct {
+	Since     time.Time
+	Until     time.Time
+	Outcome   string // "allow" or "block"
+	KeyPrefix string // Matches any evaluated key
+	Cursor    string // NextCursor of the previous page
+	Limit     int
+}
+
+// AuditPage is one page of query results, newest first.
+type AuditPage struct {
+	Records    []DecisionRecord `json:"records"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// auditPrefix holds the decision history, one chunk of records per flush
+// under "audit/<ts>.<records>".
+const auditPrefix = "audit/"
+
+// decisionAudit is a fixed-size ring of recent decisions (AUDIT_STORE_SIZE).
+// Memory is bounded by the ring and each query by AUDIT_MAX_RESULTS. Queries
+// are answered from the ring; the records added since the last flush are
+// written to the store every window swap and on Stop, and read back into the
+// ring on start, so the history survives restarts.
+type decisionAudit struct {
+	maxResults int
+	store      storage.Storage
+
+	mu      sync.RWMutex
+	records []DecisionRecord
+	next    int    // Ring position for the next record
+	seq     uint64 // Last assigned sequence number
+
+	flushMu sync.Mutex // Serializes flushes
+	flushed uint64     // Last sequence number written to the store
+	last    int64      // Timestamp of the last chunk, keeping chunk keys ordered
+}
+
+func newDecisionAudit(size, maxResults int, store storage.Storage) *decisionAudit {
+	if size <= 0 {
+		return nil
+	}
+	if maxResults <= 0 {
+		maxResults = 1000
+	}
+	a := &decisionAudit{maxResults: maxResults, store: store, records: make([]DecisionRecord, 0, size)}
+	a.load()
+	return a
+}
+
+// load fills the ring with the newest stored records. They are renumbered in
+// order, since instances sharing the store number their records alike.
+func (a *decisionAudit) load() {
+	chunks, err := a.chunks()
+	if err != nil {
+		logFor(componentProxy).Error("error reading decision history", "error", err)
+		return
+	}
+	var records []DecisionRecord
+	for _, key := range chunks {
+		data, ok, err := a.store.Get(key)
+		if err != nil || !ok {
+			continue
+		}
+		var chunk []DecisionRecord
+		if json.Unmarshal(data, &chunk) == nil {
+			records = append(records, chunk...)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	if n := cap(a.records); len(records) > n {
+		records = records[len(records)-n:]
+	}
+	for _, rec := range records {
+		a.seq++
+		rec.Seq = a.seq
+		a.records = append(a.records, rec)
+	}
+	a.next = len(a.records) % cap(a.records)
+	a.flushed = a.seq
+}
+
+// chunks lists the stored chunk keys, oldest first.
+func (a *decisionAudit) chunks() ([]string, error) {
+	var keys []string
+	err := a.store.Scan(auditPrefix, func(key string, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// flush writes the records added since the last flush as one chunk, then
+// deletes the chunks no longer needed to fill the ring.
+func (a *decisionAudit) flush() {
+	if a == nil {
+		return
+	}
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.mu.RLock()
+	var pending []DecisionRecord
+	n := len(a.records)
+	for i := 1; i <= n; i++ {
+		rec := a.records[(a.next-i+n)%n]
+		if rec.Seq <= a.flushed {
+			break
+		}
+		pending = append(pending, rec)
+	}
+	a.mu.RUnlock()
+	if len(pending) == 0 {
+		return
+	}
+	for i, j := 0, len(pending)-1; i < j; i, j = i+1, j-1 {
+		pending[i], pending[j] = pending[j], pending[i]
+	}
+
+	a.last = max(time.Now().UnixNano(), a.last+1)
+	data, _ := json.Marshal(pending)
+	if err := a.store.Set(fmt.Sprintf("%s%020d.%d", auditPrefix, a.last, len(pending)), data, 0); err != nil {
+		logFor(componentProxy).Error("error storing decision history", "error", err)
+		return
+	}
+	a.flushed = pending[len(pending)-1].Seq
+
+	chunks, err := a.chunks()
+	if err != nil {
+		return
+	}
+	kept := 0
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if kept >= cap(a.records) {
+			a.store.Delete(chunks[i])
+			continue
+		}
+		kept += chunkRecords(chunks[i])
+	}
+}
+
+// chunkRecords returns the record count encoded in a chunk key.
+func chunkRecords(key string) int {
+	n, _ := strconv.Atoi(key[strings.LastIndexByte(key, '.')+1:])
+	return n
+}
+
+func (a *decisionAudit) record(resp models.AllowResponse, trace decisionTrace) {
+	if a == nil {
+		return
+	}
+	keys := make([]DecisionKey, len(trace.Keys))
+	for i, k := range trace.Keys {
+		keys[i] = DecisionKey{Type: k.Type, Key: k.Value}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	rec := DecisionRecord{Seq: a.seq, Time: time.Now(), Allow: resp.Allow, Source: trace.Source, Message: resp.Message, Keys: keys}
+	if len(a.records) < cap(a.records) {
+		a.records = append(a.records, rec)
+	} else {
+		a.records[a.next] = rec
+	}
+	a.next = (a.next + 1) % cap(a.records)
+}
+
+// query walks the ring newest first. The cursor is the sequence number of the
+// last record returned, so pages stay stable while new decisions arrive.
+func (a *decisionAudit) query(q AuditQuery) AuditPage {
+	limit := q.Limit
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+	var before uint64
+	if q.Cursor != "" {
+		before, _ = strconv.ParseUint(q.Cursor, 10, 64)
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	page := AuditPage{Records: []DecisionRecord{}}
+	n := len(a.records)
+	for i := 1; i <= n; i++ {
+		rec := a.records[(a.next-i+n)%n]
+		if before != 0 && rec.Seq >= before {
+			continue
+		}
+		// Records are in time order, so nothing older can match once past Since.
+		if !q.Since.IsZero() && rec.Time.Before(q.Since) {
+			break
+		}
+		if !q.matches(rec) {
+			continue
+		}
+		if len(page.Records) == limit {
+			page.NextCursor = strconv.FormatUint(page.Records[limit-1].Seq, 10)
+			break
+		}
+		page.Records = append(page.Records, rec)
+	}
+	return page
+}
+
+func (q AuditQuery) matches(rec DecisionRecord) bool {
+	if !q.Until.IsZero() && rec.Time.After(q.Until) {
+		return false
+	}
+	switch q.Outcome {
+	case "allow":
+		if !rec.Allow {
+			return false
+		}
+	case "block":
+		if rec.Allow {
+			return false
+		}
+	}
+	if q.KeyPrefix == "" {
+		return true
+	}
+	for _, k := range rec.Keys {
+		if strings.HasPrefix(k.Key, q.KeyPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryDecisions searches recent decisions. ok is false when the audit store
+// is disabled.
+func (s *ProxyService) QueryDecisions(q AuditQuery) (AuditPage, bool) {
+	if s.audit == nil {
+		return AuditPage{}, false
+	}
+	return s.audit.query(q), true
+}
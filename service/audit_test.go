@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+func TestDecisionAudit_Query(t *testing.T) {
+	a := newDecisionAudit(5, 2, storage.NewMemory())
+	for i := 0; i < 7; i++ {
+		a.record(models.AllowResponse{Allow: i%2 == 0}, decisionTrace{
+			Source: sourceCache,
+			Keys:   []requestKey{{models.KeyTypeIP, fmt.Sprintf("10.0.%d.1", i)}},
+		})
+	}
+
+	// Only the newest 5 are kept; limit is capped at 2
+	page := a.query(AuditQuery{Limit: 100})
+	if len(page.Records) != 2 || page.Records[0].Seq != 7 || page.Records[1].Seq != 6 || page.NextCursor != "6" {
+		t.Fatalf("first page: %+v", page)
+	}
+	page = a.query(AuditQuery{Cursor: page.NextCursor})
+	if len(page.Records) != 2 || page.Records[0].Seq != 5 || page.NextCursor != "4" {
+		t.Fatalf("second page: %+v", page)
+	}
+	page = a.query(AuditQuery{Cursor: page.NextCursor})
+	if len(page.Records) != 1 || page.Records[0].Seq != 3 || page.NextCursor != "" {
+		t.Fatalf("last page: %+v", page)
+	}
+
+	if page := a.query(AuditQuery{Outcome: "block"}); len(page.Records) != 2 || page.Records[0].Allow || page.Records[0].Seq != 6 {
+		t.Errorf("outcome filter: %+v", page)
+	}
+	if page := a.query(AuditQuery{KeyPrefix: "10.0.5."}); len(page.Records) != 1 || page.Records[0].Seq != 6 {
+		t.Errorf("key prefix filter: %+v", page)
+	}
+	if page := a.query(AuditQuery{Since: time.Now().Add(time.Minute)}); len(page.Records) != 0 {
+		t.Errorf("since filter: %+v", page)
+	}
+	if page := a.query(AuditQuery{Until: time.Now().Add(-time.Minute)}); len(page.Records) != 0 {
+		t.Errorf("until filter: %+v", page)
+	}
+}
+
+func TestDecisionAudit_Persisted(t *testing.T) {
+	st := storage.NewMemory()
+	a := newDecisionAudit(3, 10, st)
+	for i := 0; i < 2; i++ {
+		a.record(models.AllowResponse{Allow: true}, decisionTrace{Source: sourceCache})
+	}
+	a.flush()
+	for i := 0; i < 3; i++ {
+		a.record(models.AllowResponse{Allow: false, Message: fmt.Sprint(i)}, decisionTrace{Source: sourceLive})
+	}
+	a.flush()
+	a.flush() // Nothing new: no empty chunk
+
+	// The first chunk no longer holds records the ring keeps
+	chunks, _ := a.chunks()
+	if len(chunks) != 1 || chunkRecords(chunks[0]) != 3 {
+		t.Fatalf("Expected only the newest chunk kept, got %v", chunks)
+	}
+
+	// A restarted instance starts from the stored history
+	b := newDecisionAudit(3, 10, st)
+	page := b.query(AuditQuery{})
+	if len(page.Records) != 3 || page.Records[0].Seq != 3 || page.Records[0].Message != "2" || page.Records[2].Message != "0" {
+		t.Fatalf("Expected the stored history after a restart, got %+v", page.Records)
+	}
+	b.record(models.AllowResponse{Allow: true}, decisionTrace{Source: sourceCache})
+	if page := b.query(AuditQuery{Limit: 1}); page.Records[0].Seq != 4 {
+		t.Errorf("Expected numbering to continue after the loaded records, got %+v", page.Records)
+	}
+}
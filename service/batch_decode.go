@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"runtime"
+	"sync"
+
+	"apigate-proxy/models"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// parallelDecodeThreshold is the result count below which spinning up workers
+// costs more than it saves.
+const parallelDecodeThreshold = 1024
+
+// decodeBatchItems decodes an upstream batch response. Large responses are first
+// split into raw array elements and then unmarshalled by up to workers goroutines,
+// each writing into its own slice of the preallocated result.
+func decodeBatchItems(r io.Reader, workers int) ([]models.BatchAllowResponseItem, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	items := make([]models.BatchAllowResponseItem, len(raw))
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if len(raw) < parallelDecodeThreshold || workers == 1 {
+		for i, msg := range raw {
+			if err := json.Unmarshal(msg, &items[i]); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	chunk := (len(raw) + workers - 1) / workers
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := w * chunk
+		if start >= len(raw) {
+			break
+		}
+		end := min(start+chunk, len(raw))
+
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				if err := json.Unmarshal(raw[i], &items[i]); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w, start, end)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// decodeNDJSONItems streams newline-delimited decision objects to visit without
+// materializing the full response.
+func decodeNDJSONItems(r io.Reader, visit func(models.BatchAllowResponseItem)) error {
+	dec := json.NewDecoder(r)
+	for {
+		var item models.BatchAllowResponseItem
+		if err := dec.Decode(&item); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		visit(item)
+	}
+}
+
+func isNDJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == ndjsonContentType
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"apigate-proxy/models"
+)
+
+func TestDecodeBatchItems_Parallel(t *testing.T) {
+	var items []models.BatchAllowResponseItem
+	for i := 0; i < 5000; i++ {
+		items = append(items, models.BatchAllowResponseItem{Key: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Allow: i%3 != 0})
+	}
+	body, _ := json.Marshal(items)
+
+	got, err := decodeBatchItems(strings.NewReader(string(body)), 4)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(got) != len(items) {
+		t.Fatalf("Expected %d items, got %d", len(items), len(got))
+	}
+	for i := range items {
+		if !reflect.DeepEqual(got[i], items[i]) {
+			t.Fatalf("Item %d mismatch: %v vs %v", i, got[i], items[i])
+		}
+	}
+
+	if _, err := decodeBatchItems(strings.NewReader(`[{"key":1}]`), 4); err == nil {
+		t.Error("Expected error for malformed item")
+	}
+}
+
+func TestDecodeNDJSONItems(t *testing.T) {
+	body := "{\"key\":\"1.2.3.4\",\"allow\":false}\n{\"key\":\"5.6.7.8\",\"allow\":true}\n"
+	var got []models.BatchAllowResponseItem
+	err := decodeNDJSONItems(strings.NewReader(body), func(item models.BatchAllowResponseItem) {
+		got = append(got, item)
+	})
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(got) != 2 || got[0].Allow || !got[1].Allow {
+		t.Errorf("Unexpected items: %v", got)
+	}
+	if !isNDJSON("application/x-ndjson; charset=utf-8") || isNDJSON("application/json") {
+		t.Error("isNDJSON content type detection failed")
+	}
+}
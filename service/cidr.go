@@ -0,0 +1,99 @@
+package service
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// prefixTree is a binary radix tree mapping IP prefixes (CIDR ranges) to a
+// decision. Lookups return the value of the longest matching prefix, so a more
+// specific allow can carve a hole out of a broader block.
+type prefixTree struct {
+	v4   *trieNode
+	v6   *trieNode
+	size int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	set      bool
+	value    bool
+}
+
+func newPrefixTree() *prefixTree {
+	return &prefixTree{v4: &trieNode{}, v6: &trieNode{}}
+}
+
+// Insert stores value for prefix, replacing any previous value for the same prefix.
+func (t *prefixTree) Insert(prefix netip.Prefix, value bool) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+	node := t.root(addr)
+	bytes := addr.AsSlice()
+
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := (bytes[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	if !node.set {
+		t.size++
+	}
+	node.set = true
+	node.value = value
+}
+
+// Lookup returns the value of the longest prefix containing addr.
+func (t *prefixTree) Lookup(addr netip.Addr) (bool, bool) {
+	if t == nil || t.size == 0 {
+		return false, false
+	}
+	addr = addr.Unmap()
+	node := t.root(addr)
+	bytes := addr.AsSlice()
+
+	value, found := false, false
+	for i := 0; node != nil; i++ {
+		if node.set {
+			value, found = node.value, true
+		}
+		if i == len(bytes)*8 {
+			break
+		}
+		bit := (bytes[i/8] >> (7 - uint(i%8))) & 1
+		node = node.children[bit]
+	}
+	return value, found
+}
+
+// Len returns the number of prefixes stored.
+func (t *prefixTree) Len() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
+
+func (t *prefixTree) root(addr netip.Addr) *trieNode {
+	if addr.Unmap().Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+// parseCIDRKey reports whether key is a CIDR range (e.g. "10.0.0.0/8").
+func parseCIDRKey(key string) (netip.Prefix, bool) {
+	if !strings.Contains(key, "/") {
+		return netip.Prefix{}, false
+	}
+	prefix, err := netip.ParsePrefix(key)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix, true
+}
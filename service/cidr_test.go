@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+func TestPrefixTree_LongestMatch(t *testing.T) {
+	tree := newPrefixTree()
+	tree.Insert(netip.MustParsePrefix("10.0.0.0/8"), false)
+	tree.Insert(netip.MustParsePrefix("10.1.0.0/16"), true)
+	tree.Insert(netip.MustParsePrefix("2001:db8::/32"), false)
+
+	cases := []struct {
+		addr         string
+		value, found bool
+	}{
+		{"10.2.3.4", false, true},
+		{"10.1.2.3", true, true},
+		{"11.0.0.1", false, false},
+		{"2001:db8::1", false, true},
+		{"2001:db9::1", false, false},
+		{"::ffff:10.2.3.4", false, true},
+	}
+	for _, c := range cases {
+		value, found := tree.Lookup(netip.MustParseAddr(c.addr))
+		if value != c.value || found != c.found {
+			t.Errorf("Lookup(%s) = %v, %v; want %v, %v", c.addr, value, found, c.value, c.found)
+		}
+	}
+}
+
+func TestProxyService_CIDRCacheAndRules(t *testing.T) {
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL: "http://127.0.0.1:0",
+		RulesDeny:       []string{"ip:203.0.113.0/24"},
+	}, nil, nil)
+
+	resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "203.0.113.99"})
+	if resp.Allow {
+		t.Errorf("Expected CIDR deny rule to block, got %v", resp)
+	}
+
+	// A single upstream range entry covers every address inside it
+	svc.swapCache()
+	svc.current.Load().put(models.BatchAllowResponseItem{Key: "198.51.100.0/24", Allow: false})
+
+	resp, _ = svc.Check(context.Background(), models.AllowRequest{IPAddress: "198.51.100.7"})
+	if resp.Allow || resp.Message != "Cache Hit: Blocked" {
+		t.Errorf("Expected range cache hit, got %v", resp)
+	}
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+)
+
+// Circuit breaker states, as reported in BreakerStats.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// BreakerStats describes the upstream circuit breaker (CIRCUIT_BREAKER_FAILURES).
+type BreakerStats struct {
+	State    string `json:"state"`    // closed, open or half_open
+	Failures int    `json:"failures"` // Consecutive failed upstream calls
+	Opened   int64  `json:"opened"`   // Times the breaker opened since start
+	Rejected int64  `json:"rejected"` // Upstream calls refused while open
+}
+
+// circuitBreaker stops calling an upstream that keeps failing. After
+// CIRCUIT_BREAKER_FAILURES consecutive failed calls it opens, and calls fail
+// at once with ErrCircuitOpen for CIRCUIT_BREAKER_OPEN_SECONDS. It then goes
+// half-open and lets a single trial call through: success closes it, failure
+// opens it again. Each tenant's service has its own breaker, so one tenant's
+// failing upstream key does not cut the others off.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	until    time.Time // When an open breaker goes half-open
+	trial    bool      // A half-open trial call is in flight
+	opened   int64
+	rejected int64
+}
+
+func newCircuitBreaker(cfg *config.Config) *circuitBreaker {
+	if cfg.BreakerFailures <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		threshold: cfg.BreakerFailures,
+		cooldown:  time.Duration(max(cfg.BreakerOpenSeconds, 1)) * time.Second,
+		state:     breakerClosed,
+	}
+}
+
+// allow reports whether an upstream call may start at now. Callers that got
+// true must report its outcome with record, or release it when abandoned.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && !now.Before(b.until) {
+		b.state = breakerHalfOpen
+	}
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if !b.trial {
+			b.trial = true
+			return true
+		}
+	}
+	b.rejected++
+	return false
+}
+
+// record counts the outcome of an allowed upstream call.
+func (b *circuitBreaker) record(err error, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if err == nil {
+		if b.state != breakerClosed {
+			logFor(componentProxy).Info("upstream circuit breaker closed")
+		}
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state, b.until = breakerOpen, now.Add(b.cooldown)
+		b.opened++
+		logFor(componentProxy).Warn("upstream circuit breaker opened",
+			"alert", true, "failures", b.failures, "open_for", b.cooldown, "error", err)
+	}
+}
+
+// release gives back an allowed call that ended without an upstream answer
+// (e.g. its requests went away), so a half-open breaker can try again.
+func (b *circuitBreaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) stats() *BreakerStats {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state
+	if state == breakerOpen && !time.Now().Before(b.until) {
+		state = breakerHalfOpen
+	}
+	return &BreakerStats{State: state, Failures: b.failures, Opened: b.opened, Rejected: b.rejected}
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"slices"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// Ways of combining per-key decisions (DECISION_COMBINE).
+const (
+	CombineAnyBlock   = "any_block"  // Any blocked key blocks the request
+	CombinePrecedence = "precedence" // The strongest key present decides (KEY_PRECEDENCE)
+	CombineWeighted   = "weighted"   // Allows and blocks are summed by weight (KEY_WEIGHTS)
+)
+
+// keyDecision is the decision for one request key; known is false when it
+// is not cached.
+type keyDecision struct {
+	key   requestKey
+	allow bool
+	known bool
+}
+
+// decisionCombiner turns the decisions for a request's keys into one. With
+// "precedence", key types are ranked by KEY_PRECEDENCE, unlisted types after
+// listed ones in request order. With "weighted", each allow adds and each
+// block subtracts its type's KEY_WEIGHTS weight (default 1), and the request
+// is allowed only when the sum is positive.
+type decisionCombiner struct {
+	mode    string
+	rank    map[string]int
+	weights map[string]float64
+}
+
+func newDecisionCombiner(cfg *config.Config) *decisionCombiner {
+	c := &decisionCombiner{mode: cfg.DecisionCombine, rank: make(map[string]int), weights: cfg.KeyWeights}
+	for i, keyType := range cfg.KeyPrecedence {
+		if _, ok := c.rank[keyType]; !ok {
+			c.rank[keyType] = i
+		}
+	}
+	return c
+}
+
+func (c *decisionCombiner) rankOf(keyType string) int {
+	if r, ok := c.rank[keyType]; ok {
+		return r
+	}
+	return len(c.rank)
+}
+
+func (c *decisionCombiner) weightOf(keyType string) float64 {
+	if w, ok := c.weights[keyType]; ok {
+		return w
+	}
+	return 1
+}
+
+// combine returns the decision for a request, whether it could be made from
+// the known decisions, and the key that decided it (zero when every key
+// agreed on an allow).
+func (c *decisionCombiner) combine(decisions []keyDecision) (allow, found bool, winner requestKey) {
+	if len(decisions) == 0 {
+		return false, false, requestKey{}
+	}
+	switch c.mode {
+	case CombinePrecedence:
+		top := slices.MinFunc(decisions, func(a, b keyDecision) int {
+			return c.rankOf(a.key.Type) - c.rankOf(b.key.Type)
+		})
+		if !top.known {
+			return false, false, requestKey{}
+		}
+		return top.allow, true, top.key
+
+	case CombineWeighted:
+		var score, heaviest float64
+		for _, d := range decisions {
+			if !d.known {
+				return false, false, requestKey{}
+			}
+			w := c.weightOf(d.key.Type)
+			if d.allow {
+				score += w
+			} else {
+				score -= w
+			}
+		}
+		allow = score > 0
+		for _, d := range decisions {
+			if w := c.weightOf(d.key.Type); d.allow == allow && (winner.Value == "" || w > heaviest) {
+				winner, heaviest = d.key, w
+			}
+		}
+		return allow, true, winner
+
+	default:
+		// Any known block decides, even when other keys are unknown
+		allKnown := true
+		for _, d := range decisions {
+			if d.known && !d.allow {
+				return false, true, d.key
+			}
+			allKnown = allKnown && d.known
+		}
+		return allKnown, allKnown, requestKey{}
+	}
+}
+
+// explain narrows the blocked keys of a blocked request to those that
+// decided it: only the winner under "precedence", where weaker blocks were
+// outranked. Without a known winner (e.g. a tuple cache hit) all are kept.
+func (c *decisionCombiner) explain(reasons []models.BlockReason, winner requestKey) []models.BlockReason {
+	if c.mode != CombinePrecedence || winner.Value == "" {
+		return reasons
+	}
+	out := reasons[:0]
+	for _, r := range reasons {
+		if r.Key == winner.Value {
+			out = append(out, r)
+		}
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
+	"apigate-proxy/models"
+)
+
+func TestDecisionCombiner(t *testing.T) {
+	ip := requestKey{models.KeyTypeIP, "1.1.1.1"}
+	email := requestKey{models.KeyTypeEmail, "hash"}
+	ua := requestKey{models.KeyTypeUserAgent, "ua"}
+	known := func(k requestKey, allow bool) keyDecision { return keyDecision{key: k, allow: allow, known: true} }
+
+	tests := []struct {
+		name      string
+		cfg       config.Config
+		decisions []keyDecision
+		allow     bool
+		found     bool
+		winner    requestKey
+	}{
+		{"any block", config.Config{}, []keyDecision{known(ip, true), known(email, false)}, false, true, email},
+		{"any block with a miss", config.Config{}, []keyDecision{{key: ip}, known(email, false)}, false, true, email},
+		{"all allow", config.Config{}, []keyDecision{known(ip, true), known(email, true)}, true, true, requestKey{}},
+		{"partial miss", config.Config{}, []keyDecision{known(ip, true), {key: email}}, false, false, requestKey{}},
+
+		{"email outranks ip", config.Config{DecisionCombine: CombinePrecedence, KeyPrecedence: []string{"email", "ip"}},
+			[]keyDecision{known(ip, false), known(email, true)}, true, true, email},
+		{"unlisted types rank last", config.Config{DecisionCombine: CombinePrecedence, KeyPrecedence: []string{"ip"}},
+			[]keyDecision{known(ua, false), known(ip, true)}, true, true, ip},
+		{"strongest key unknown", config.Config{DecisionCombine: CombinePrecedence, KeyPrecedence: []string{"email", "ip"}},
+			[]keyDecision{known(ip, false), {key: email}}, false, false, requestKey{}},
+
+		{"weights outvote", config.Config{DecisionCombine: CombineWeighted, KeyWeights: map[string]float64{"email": 3}},
+			[]keyDecision{known(ip, false), known(ua, false), known(email, true)}, true, true, email},
+		{"ties block", config.Config{DecisionCombine: CombineWeighted},
+			[]keyDecision{known(ip, false), known(email, true)}, false, true, ip},
+		{"weighted needs every key", config.Config{DecisionCombine: CombineWeighted},
+			[]keyDecision{known(ip, false), {key: email}}, false, false, requestKey{}},
+	}
+	for _, tt := range tests {
+		allow, found, winner := newDecisionCombiner(&tt.cfg).combine(tt.decisions)
+		if allow != tt.allow || found != tt.found || winner != tt.winner {
+			t.Errorf("%s: got allow=%v found=%v winner=%v", tt.name, allow, found, winner)
+		}
+	}
+}
+
+func TestProxyService_KeyPrecedence(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.Block("6.6.6.6"))
+
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:      upstream.URL,
+		DecisionCombine:      CombinePrecedence,
+		KeyPrecedence:        []string{"email", "ip"},
+		DebugStoreTTLSeconds: 60,
+		DebugSampleRate:      1,
+	}, nil, nil)
+	svc.swapCache() // leave warmup
+
+	req := models.AllowRequest{IPAddress: "6.6.6.6", Email: "a@example.com", RequestID: "r1"}
+	if resp, _ := svc.Check(context.Background(), req); !resp.Allow || resp.Message != "Allowed (Live Check)" {
+		t.Errorf("Expected the email to outrank the blocked IP, got %+v", resp)
+	}
+	req.RequestID = "r2"
+	if resp, _ := svc.Check(context.Background(), req); !resp.Allow || resp.Message != "Cache Hit" {
+		t.Errorf("Expected the cached email to outrank the blocked IP, got %+v", resp)
+	}
+	svc.debug.drain()
+	rec, found, _ := svc.DebugDecision("r2")
+	if !found || rec.DecidedBy == nil || rec.DecidedBy.Type != models.KeyTypeEmail {
+		t.Errorf("Expected the debug record to name the email as decisive, got %+v", rec.DecidedBy)
+	}
+
+	// Without an email the IP decides
+	if resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"}); resp.Allow || len(resp.BlockedBy) != 1 {
+		t.Errorf("Expected the IP to block on its own, got %+v", resp)
+	}
+}
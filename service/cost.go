@@ -0,0 +1,117 @@
+package service
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+)
+
+// costMeter counts keys sent to the upstream, which bills per key checked,
+// and enforces UPSTREAM_DAILY_KEY_BUDGET. Days are UTC calendar days.
+type costMeter struct {
+	budget        int64 // Keys per day (0 = unlimited)
+	alertPercent  int64
+	degradeFactor int
+
+	mu       sync.Mutex
+	day      string
+	today    int64
+	window   int64 // Since the last default-window swap
+	total    int64
+	warned   bool // Alert threshold crossed today
+	exceeded bool // Budget exhausted today
+}
+
+// UpstreamKeyStats reports keys sent to the upstream and the daily budget.
+type UpstreamKeyStats struct {
+	Window      int64   `json:"window"`
+	Today       int64   `json:"today"`
+	Total       int64   `json:"total"`
+	DailyBudget int64   `json:"daily_budget,omitempty"`
+	BudgetUsed  float64 `json:"budget_used,omitempty"` // Fraction of today's budget
+	Degraded    bool    `json:"degraded,omitempty"`    // Windows are stretched to save keys
+}
+
+func newCostMeter(cfg *config.Config) *costMeter {
+	alert := int64(cfg.BudgetAlertPercent)
+	if alert <= 0 || alert > 100 {
+		alert = 80
+	}
+	return &costMeter{
+		budget:        int64(cfg.UpstreamDailyKeyBudget),
+		alertPercent:  alert,
+		degradeFactor: cfg.BudgetDegradeFactor,
+		day:           time.Now().UTC().Format(time.DateOnly),
+	}
+}
+
+// record counts n keys sent upstream and raises budget alerts once per day
+// for each threshold crossed.
+func (m *costMeter) record(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rollover()
+	m.today += int64(n)
+	m.window += int64(n)
+	m.total += int64(n)
+	if m.budget <= 0 {
+		return
+	}
+	if !m.warned && m.today*100 >= m.budget*m.alertPercent {
+		m.warned = true
+		logFor(componentProxy).Warn("upstream key budget threshold reached", "alert", true, "percent", m.today*100/m.budget, "keys_today", m.today, "budget", m.budget)
+	}
+	if !m.exceeded && m.today >= m.budget {
+		m.exceeded = true
+		logFor(componentProxy).Warn("upstream key budget exhausted", "alert", true, "keys_today", m.today, "budget", m.budget)
+	}
+}
+
+// rollover starts a new day's count; the caller holds m.mu.
+func (m *costMeter) rollover() {
+	if day := time.Now().UTC().Format(time.DateOnly); day != m.day {
+		m.day, m.today, m.warned, m.exceeded = day, 0, false, false
+	}
+}
+
+// endWindow resets the per-window count and returns it.
+func (m *costMeter) endWindow() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.window
+	m.window = 0
+	return n
+}
+
+// degraded reports whether today's usage passed the alert threshold while
+// BUDGET_DEGRADE_WINDOW_FACTOR is set.
+func (m *costMeter) degraded() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rollover()
+	return m.degradeFactor > 1 && m.warned
+}
+
+// stretch is the scheduler's window multiplier: BUDGET_DEGRADE_WINDOW_FACTOR
+// while degraded, else 1. Stretched windows keep their cache longer and
+// prefetch each tracked key once per stretched window instead of every window.
+func (m *costMeter) stretch() int {
+	if m.degraded() {
+		return m.degradeFactor
+	}
+	return 1
+}
+
+func (m *costMeter) stats() UpstreamKeyStats {
+	degraded := m.degraded()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := UpstreamKeyStats{Window: m.window, Today: m.today, Total: m.total, DailyBudget: m.budget, Degraded: degraded}
+	if m.budget > 0 {
+		st.BudgetUsed = math.Round(float64(m.today)/float64(m.budget)*1000) / 1000
+	}
+	return st
+}
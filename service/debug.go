@@ -0,0 +1,209 @@
+package service
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+// DebugRecord is the full context of one sampled decision, kept by the debug
+// store for support investigations.
+type DebugRecord struct {
+	RequestID string               `json:"request_id"`
+	Supplied  bool                 `json:"supplied,omitempty"` // The request ID came from the caller
+	Time      time.Time            `json:"time"`
+	Request   models.AllowRequest  `json:"request"` // As received, with the identity hashed as sent upstream
+	Response  models.AllowResponse `json:"response"`
+	Source    string               `json:"source"`
+	Cache     string               `json:"cache,omitempty"` // "tuple_hit", "hit" or "miss"; empty if not consulted
+	Keys      []DecisionKey        `json:"keys"`
+	DecidedBy *DecisionKey         `json:"decided_by,omitempty"` // Key whose decision won (DECISION_COMBINE)
+	Upstream  *DebugUpstream       `json:"upstream,omitempty"`
+}
+
+// DebugUpstream describes the live check behind a decision.
+type DebugUpstream struct {
+	Keys      []string                        `json:"keys"` // Keys sent upstream
+	Results   []models.BatchAllowResponseItem `json:"results,omitempty"`
+	Error     string                          `json:"error,omitempty"`
+	LatencyMs int64                           `json:"latency_ms"`
+	Shared    bool                            `json:"shared,omitempty"`   // Joined a concurrent identical check
+	Deferred  bool                            `json:"deferred,omitempty"` // Over LIVE_CHECK_BUDGET_MS
+}
+
+// debugStore samples decisions into the shared storage backend for
+// DEBUG_STORE_TTL_SECONDS: every block, and DEBUG_SAMPLE_RATE of allows.
+// Records are keyed by request ID, so a support ticket quoting X-Request-ID
+// can be traced end to end. They are written in the background from a
+// bounded queue; a flood of blocks fills it and further decisions are
+// dropped instead of each waiting for a storage write.
+type debugStore struct {
+	cfg    *config.Config
+	ttl    time.Duration
+	rate   float64
+	store  storage.Storage
+	labels *keyLabels
+	queue  chan debugEntry
+
+	dropped atomic.Int64
+}
+
+type debugEntry struct {
+	req   models.AllowRequest
+	resp  models.AllowResponse
+	trace decisionTrace
+	time  time.Time
+}
+
+const (
+	debugPrefix = "debug/"
+	// Request IDs supplied by callers are kept apart from the ones the proxy
+	// generated, so a caller cannot overwrite another request's record by
+	// quoting its ID
+	debugSuppliedPrefix = debugPrefix + "supplied/"
+	// debugQueue bounds the decisions waiting to be written.
+	debugQueue = 1024
+)
+
+func newDebugStore(cfg *config.Config, store storage.Storage, labels *keyLabels) *debugStore {
+	if cfg.DebugStoreTTLSeconds <= 0 {
+		return nil
+	}
+	return &debugStore{
+		cfg:    cfg,
+		ttl:    time.Duration(cfg.DebugStoreTTLSeconds) * time.Second,
+		rate:   cfg.DebugSampleRate,
+		store:  store,
+		labels: labels,
+		queue:  make(chan debugEntry, debugQueue),
+	}
+}
+
+// record queues a sampled decision for writing; it never blocks.
+func (d *debugStore) record(req models.AllowRequest, resp models.AllowResponse, trace decisionTrace) {
+	if d == nil || req.RequestID == "" {
+		return
+	}
+	if resp.Allow && rand.Float64() >= d.rate {
+		return
+	}
+	select {
+	case d.queue <- debugEntry{req: req, resp: resp, trace: trace, time: time.Now()}:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// run writes queued decisions until done is closed, then the ones still
+// queued.
+func (d *debugStore) run(done <-chan struct{}) {
+	for {
+		select {
+		case e := <-d.queue:
+			d.write(e)
+		case <-done:
+			d.drain()
+			return
+		}
+	}
+}
+
+// drain writes the decisions queued now.
+func (d *debugStore) drain() {
+	for {
+		select {
+		case e := <-d.queue:
+			d.write(e)
+		default:
+			return
+		}
+	}
+}
+
+func (d *debugStore) write(e debugEntry) {
+	req := e.req
+	if req.Email != "" {
+		// Only the hashed identity is kept, never the plaintext
+		req.Email, req.IdentityType = identityKey(d.cfg, req.Email, req.IdentityType)
+	}
+	keys := make([]DecisionKey, len(e.trace.Keys))
+	for i, k := range e.trace.Keys {
+		keys[i] = DecisionKey{Type: k.Type, Key: k.Value, Labels: d.labels.get(k.Value)}
+	}
+	rec := DebugRecord{
+		RequestID: req.RequestID,
+		Supplied:  !req.RequestIDGenerated,
+		Time:      e.time,
+		Request:   req,
+		Response:  e.resp,
+		Source:    e.trace.Source,
+		Cache:     e.trace.Cache,
+		Keys:      keys,
+		Upstream:  e.trace.Upstream,
+	}
+	if e.trace.Winner.Value != "" {
+		rec.DecidedBy = &DecisionKey{Type: e.trace.Winner.Type, Key: e.trace.Winner.Value}
+	}
+	key := debugSuppliedPrefix + req.RequestID
+	if req.RequestIDGenerated {
+		key = debugPrefix + req.RequestID
+	}
+	data, _ := json.Marshal(rec)
+	if err := d.store.Set(key, data, d.ttl); err != nil {
+		logFor(componentProxy).Error("error storing debug record", "error", err)
+	}
+}
+
+// get returns the record of requestID, preferring a request ID the proxy
+// generated over one a caller supplied.
+func (d *debugStore) get(requestID string) (DebugRecord, bool) {
+	data, ok, err := d.store.Get(debugPrefix + requestID)
+	if err == nil && !ok {
+		data, ok, err = d.store.Get(debugSuppliedPrefix + requestID)
+	}
+	if err != nil {
+		logFor(componentProxy).Error("error reading debug record", "error", err)
+		return DebugRecord{}, false
+	}
+	var rec DebugRecord
+	if !ok || json.Unmarshal(data, &rec) != nil {
+		return DebugRecord{}, false
+	}
+	return rec, true
+}
+
+func (d *debugStore) droppedCount() int64 {
+	if d == nil {
+		return 0
+	}
+	return d.dropped.Load()
+}
+
+// sweep drops expired records.
+func (d *debugStore) sweep() {
+	if d == nil {
+		return
+	}
+	sweepStorage(d.store)
+}
+
+// DebugEnabled reports whether decisions are sampled into the debug store.
+func (s *ProxyService) DebugEnabled() bool {
+	return s.debug != nil
+}
+
+// DebugDecision returns the debug record of a request. found is false when the
+// request was not sampled or its record expired; enabled is false when the
+// debug store is disabled.
+func (s *ProxyService) DebugDecision(requestID string) (rec DebugRecord, found, enabled bool) {
+	if s.debug == nil {
+		return DebugRecord{}, false, false
+	}
+	rec, found = s.debug.get(requestID)
+	return rec, found, true
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+
+	"apigate-proxy/models"
+)
+
+// cacheShards is the number of independently locked parts of a decisionCache.
+const cacheShards = 64
+
+// decisionCache holds one window's decisions: by key, split into shards by key
+// hash with a lock each, and by CIDR range. Lookups and live writes of
+// different keys only contend when they share a shard. A window's cache is
+// replaced whole at each swap by storing a new one in an atomic pointer, so
+// lookups never take ProxyService.mu.
+type decisionCache struct {
+	shards [cacheShards]cacheShard
+	size   atomic.Int64
+
+	rangesMu sync.RWMutex
+	ranges   *prefixTree
+}
+
+type cacheShard struct {
+	mu sync.RWMutex
+	m  map[string]bool
+}
+
+func newDecisionCache() *decisionCache {
+	c := &decisionCache{ranges: newPrefixTree()}
+	for i := range c.shards {
+		c.shards[i].m = make(map[string]bool)
+	}
+	return c
+}
+
+// cacheOf returns a cache holding the decisions in m.
+func cacheOf(m map[string]bool) *decisionCache {
+	c := newDecisionCache()
+	for k, allow := range m {
+		c.put(models.BatchAllowResponseItem{Key: k, Allow: allow})
+	}
+	return c
+}
+
+func (c *decisionCache) shard(key string) *cacheShard {
+	return &c.shards[xxhash.Sum64String(key)%cacheShards]
+}
+
+// get returns the decision cached for key. A nil cache is empty.
+func (c *decisionCache) get(key string) (allow, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	sh := c.shard(key)
+	sh.mu.RLock()
+	allow, ok = sh.m[key]
+	sh.mu.RUnlock()
+	return allow, ok
+}
+
+// lookupRange returns the decision of the most specific cached range
+// covering addr.
+func (c *decisionCache) lookupRange(addr netip.Addr) (allow, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	c.rangesMu.RLock()
+	defer c.rangesMu.RUnlock()
+	return c.ranges.Lookup(addr)
+}
+
+// put stores an upstream decision, indexing CIDR range keys so they cover
+// every address inside the range. It returns the decision it replaced, if
+// any.
+func (c *decisionCache) put(item models.BatchAllowResponseItem) (prev, replaced bool) {
+	sh := c.shard(item.Key)
+	sh.mu.Lock()
+	prev, replaced = sh.m[item.Key]
+	sh.m[item.Key] = item.Allow
+	sh.mu.Unlock()
+	if !replaced {
+		c.size.Add(1)
+	}
+	if prefix, ok := parseCIDRKey(item.Key); ok {
+		c.rangesMu.Lock()
+		c.ranges.Insert(prefix, item.Allow)
+		c.rangesMu.Unlock()
+	}
+	return prev, replaced
+}
+
+// len returns the number of cached keys. A nil cache is empty.
+func (c *decisionCache) len() int {
+	if c == nil {
+		return 0
+	}
+	return int(c.size.Load())
+}
+
+func (c *decisionCache) rangeLen() int {
+	if c == nil {
+		return 0
+	}
+	c.rangesMu.RLock()
+	defer c.rangesMu.RUnlock()
+	return c.ranges.Len()
+}
+
+// each calls fn with every cached decision, a shard at a time, until fn
+// returns false. fn runs without the shard's lock, so it may use the cache.
+func (c *decisionCache) each(fn func(key string, allow bool) bool) {
+	if c == nil {
+		return
+	}
+	var items []models.BatchAllowResponseItem
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.RLock()
+		items = items[:0]
+		for k, allow := range sh.m {
+			items = append(items, models.BatchAllowResponseItem{Key: k, Allow: allow})
+		}
+		sh.mu.RUnlock()
+		for _, item := range items {
+			if !fn(item.Key, item.Allow) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"apigate-proxy/models"
+)
+
+// toMap returns the cached decisions by key.
+func (c *decisionCache) toMap() map[string]bool {
+	m := make(map[string]bool)
+	c.each(func(key string, allow bool) bool {
+		m[key] = allow
+		return true
+	})
+	return m
+}
+
+func TestDecisionCache_PutGet(t *testing.T) {
+	c := newDecisionCache()
+	if _, replaced := c.put(models.BatchAllowResponseItem{Key: "1.1.1.1", Allow: true}); replaced {
+		t.Error("Expected a new key not to replace anything")
+	}
+	if prev, replaced := c.put(models.BatchAllowResponseItem{Key: "1.1.1.1", Allow: false}); !replaced || !prev {
+		t.Errorf("Expected the earlier allow to be replaced, got prev=%v replaced=%v", prev, replaced)
+	}
+	if allow, ok := c.get("1.1.1.1"); !ok || allow {
+		t.Errorf("Expected the newer block, got allow=%v ok=%v", allow, ok)
+	}
+	if c.len() != 1 {
+		t.Errorf("Expected one key, got %d", c.len())
+	}
+
+	c.put(models.BatchAllowResponseItem{Key: "198.51.100.0/24", Allow: false})
+	if allow, ok := c.lookupRange(netip.MustParseAddr("198.51.100.7")); !ok || allow {
+		t.Errorf("Expected the range to cover its addresses, got allow=%v ok=%v", allow, ok)
+	}
+	if c.rangeLen() != 1 {
+		t.Errorf("Expected one range, got %d", c.rangeLen())
+	}
+
+	var none *decisionCache
+	if _, ok := none.get("1.1.1.1"); ok || none.len() != 0 {
+		t.Error("Expected a nil cache to be empty")
+	}
+}
+
+func TestDecisionCache_Concurrent(t *testing.T) {
+	c := newDecisionCache()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("10.%d.%d.%d", w, i/256, i%256)
+				c.put(models.BatchAllowResponseItem{Key: key, Allow: i%2 == 0})
+				c.get(key)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if c.len() != 8*500 || len(c.toMap()) != 8*500 {
+		t.Errorf("Expected %d keys, got len=%d each=%d", 8*500, c.len(), len(c.toMap()))
+	}
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// decisionTTLs gives allow and block decisions their own lifetimes
+// (CACHE_ALLOW_TTL_SECONDS, CACHE_BLOCK_TTL_SECONDS) on top of the window
+// they are cached in. A decision older than its TTL is a cache miss even
+// though its window is current, and at a swap, decisions the new cache did
+// not fetch are carried over while still within their TTL, so e.g. blocks
+// can outlive several windows while allows are re-checked every 30 seconds.
+// Like blockReasons, the fetch times live beside the caches, keyed by cache
+// key, and are pruned at each default-window swap.
+type decisionTTLs struct {
+	allow time.Duration // 0 = the window's lifetime
+	block time.Duration
+
+	mu      sync.RWMutex
+	fetched map[string]time.Time
+}
+
+func newDecisionTTLs(cfg *config.Config) *decisionTTLs {
+	if cfg.CacheAllowTTLSeconds <= 0 && cfg.CacheBlockTTLSeconds <= 0 {
+		return nil
+	}
+	return &decisionTTLs{
+		allow:   time.Duration(cfg.CacheAllowTTLSeconds) * time.Second,
+		block:   time.Duration(cfg.CacheBlockTTLSeconds) * time.Second,
+		fetched: make(map[string]time.Time),
+	}
+}
+
+func (d *decisionTTLs) ttl(allow bool) time.Duration {
+	if allow {
+		return d.allow
+	}
+	return d.block
+}
+
+// note records when the upstream returned item.
+func (d *decisionTTLs) note(item models.BatchAllowResponseItem, now time.Time) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.fetched[item.Key] = now
+	d.mu.Unlock()
+}
+
+// expired reports whether the cached decision allow for key has outlived its
+// TTL. Decisions with no recorded fetch time (e.g. from a warm start) live
+// as long as their window.
+func (d *decisionTTLs) expired(key string, allow bool, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	ttl := d.ttl(allow)
+	if ttl <= 0 {
+		return false
+	}
+	d.mu.RLock()
+	at, ok := d.fetched[key]
+	d.mu.RUnlock()
+	return ok && now.Sub(at) > ttl
+}
+
+// carry copies decisions from prev that next lacks into next while they are
+// within their TTL, and returns how many it copied. Decision types without a
+// TTL are left to expire with their window. Callers hold s.mu.
+func (d *decisionTTLs) carry(prev, next *decisionCache, now time.Time) int {
+	if d == nil || prev == next {
+		return 0
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	n := 0
+	prev.each(func(k string, allow bool) bool {
+		if _, ok := next.get(k); ok {
+			return true
+		}
+		at, ok := d.fetched[k]
+		if ttl := d.ttl(allow); !ok || ttl <= 0 || now.Sub(at) > ttl {
+			return true
+		}
+		next.put(models.BatchAllowResponseItem{Key: k, Allow: allow})
+		n++
+		return true
+	})
+	return n
+}
+
+// prune forgets fetch times of keys no longer cached.
+func (d *decisionTTLs) prune(cached func(key string) bool) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k := range d.fetched {
+		if !cached(k) {
+			delete(d.fetched, k)
+		}
+	}
+}
+
+// cachedAnywhere reports whether key is in any current or pending window.
+// Callers hold s.mu.
+func (s *ProxyService) cachedAnywhere(key string) bool {
+	for _, c := range s.windowCaches() {
+		if _, ok := c.get(key); ok {
+			return true
+		}
+	}
+	return false
+}
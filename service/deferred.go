@@ -0,0 +1,144 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"apigate-proxy/models"
+)
+
+// DeferredDecision is posted to a request's callback_url once the live check
+// that outlived LIVE_CHECK_BUDGET_MS completes. DecisionID matches the
+// decision_id of the provisional response.
+type DeferredDecision struct {
+	DecisionID string `json:"decision_id"`
+	Allow      bool   `json:"allow"`
+	Status     string `json:"status"`
+	Message    string `json:"message,omitempty"`
+	Error      string `json:"error,omitempty"`
+	WouldBlock bool   `json:"would_block,omitempty"`
+
+	BlockedBy []models.BlockReason `json:"blocked_by,omitempty"`
+}
+
+// Header carrying the hex HMAC-SHA256 of a callback body under CALLBACK_SIGNING_SECRET.
+const callbackSignatureHeader = "X-Apigate-Signature"
+
+// CallbackAllowed reports whether rawURL may receive deferred decisions: an
+// http(s) URL whose host is listed in CALLBACK_ALLOWED_HOSTS. Callers choose
+// the URL, so anything else is refused rather than becoming an open relay.
+func (s *ProxyService) CallbackAllowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	for _, h := range s.config.CallbackAllowedHosts {
+		if strings.EqualFold(h, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitLive waits up to LIVE_CHECK_BUDGET_MS for a live check, or until ctx
+// ends. It reports false when the budget ran out; the check keeps running in
+// the background, still joined, for deferLive to finish. Otherwise it leaves
+// the call, which is canceled if ctx ended and nobody else waits for it.
+func (s *ProxyService) awaitLive(ctx context.Context, c *liveCall) (bool, error) {
+	var budget <-chan time.Time
+	if s.config.LiveCheckBudgetMs > 0 {
+		timer := time.NewTimer(time.Duration(s.config.LiveCheckBudgetMs) * time.Millisecond)
+		defer timer.Stop()
+		budget = timer.C
+	}
+	select {
+	case <-c.done:
+		s.live.leave(c)
+		return true, nil
+	case <-ctx.Done():
+		s.live.leave(c)
+		return false, ctx.Err()
+	case <-budget:
+		return false, nil
+	}
+}
+
+// deferLive answers a live check that exceeded its budget provisionally (fail
+// open) and finishes it in the background: the results are cached as usual and,
+// with a callback URL, the authoritative decision is posted there. The caller
+// has been answered, so the check is no longer tied to its request.
+func (s *ProxyService) deferLive(c *liveCall, reqKeys []requestKey, callbackURL string) models.AllowResponse {
+	id := newDecisionID()
+	go func() {
+		<-c.done
+		s.live.leave(c)
+		final := DeferredDecision{DecisionID: id, Allow: true, Status: "error"}
+		if c.err != nil {
+			final.Error = c.err.Error()
+		} else {
+			resp, _ := s.applyLive(reqKeys, c.items)
+			resp = s.shadow(resp)
+			final.Allow, final.Status, final.Message, final.WouldBlock = resp.Allow, resp.Status, resp.Message, resp.WouldBlock
+			final.BlockedBy = resp.BlockedBy
+		}
+		if callbackURL != "" && s.CallbackAllowed(callbackURL) {
+			s.postCallback(callbackURL, final)
+		}
+	}()
+	return models.AllowResponse{Allow: true, Status: "success", Message: "Allowed (Deferred)", DecisionID: id}
+}
+
+// postCallback delivers a deferred decision, retrying transient failures.
+func (s *ProxyService) postCallback(callbackURL string, d DeferredDecision) {
+	body, _ := json.Marshal(d)
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = s.sendCallback(callbackURL, body); err == nil {
+			return
+		}
+	}
+	logFor(componentProxy).Error("error delivering deferred decision", "decision_id", d.DecisionID, "error", err)
+}
+
+func (s *ProxyService) sendCallback(callbackURL string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.CallbackSecret != "" {
+		mac := hmac.New(sha256.New, []byte(s.config.CallbackSecret))
+		mac.Write(body)
+		req.Header.Set(callbackSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func newDecisionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"apigate-proxy/models"
+)
+
+// errDeltaUnsupported means the upstream transport has no change feed, so
+// PREFETCH_DELTA falls back to fetching every key.
+var errDeltaUnsupported = errors.New("upstream transport has no change feed")
+
+// fetchDelta builds the default window's next cache from the upstream change
+// feed (PREFETCH_DELTA). Tracked keys already in the current cache keep their
+// decision unless it changed since the cache's version; only keys not cached
+// yet are fetched. Without a version, or when the upstream cannot answer from
+// it, every key is fetched in full and the feed continues from the version
+// read before the fetch, so no change made during it is missed.
+func (s *ProxyService) fetchDelta(keys []string) {
+	s.mu.RLock()
+	since := s.currentVersion
+	current := s.current.Load()
+	var known []models.BatchAllowResponseItem
+	var fresh []string
+	for _, k := range keys {
+		if allow, ok := current.get(k); ok && since != "" && !s.stale {
+			known = append(known, models.BatchAllowResponseItem{Key: k, Allow: allow})
+		} else {
+			fresh = append(fresh, k)
+		}
+	}
+	s.mu.RUnlock()
+
+	changes, err := s.fetchChanges(since)
+	switch {
+	case err != nil:
+		if !errors.Is(err, errDeltaUnsupported) {
+			logFor(componentProxy).Error("error reading upstream changes", "error", err)
+		}
+		s.fetchPending(keys, s.storePending(""))
+		return
+	case changes.Reset || since == "":
+		if changes.Reset {
+			logFor(componentProxy).Warn("upstream cannot answer changes since version, refetching", "window", "default", "since", since, "batch_size", len(keys))
+		}
+		s.fetchPending(keys, s.storePending(changes.Version))
+		return
+	}
+
+	changed := make(map[string]models.BatchAllowResponseItem, len(changes.Changes))
+	for _, item := range changes.Changes {
+		changed[item.Key] = item
+	}
+	newCache := newDecisionCache()
+	now := time.Now()
+	updated := 0
+	for _, item := range known {
+		if c, ok := changed[item.Key]; ok {
+			item = c
+			s.reasons.note(item)
+			s.labels.note(item)
+			updated++
+		}
+		// Unchanged decisions are as current as the feed
+		newCache.put(item)
+		s.ttls.note(item, now)
+	}
+	fetched := 0
+	if len(fresh) > 0 {
+		fetched = s.fetchInto(newCache, fresh)
+	}
+	if len(known) == 0 && fetched == 0 {
+		return
+	}
+	logFor(componentProxy).Info("delta prefetch", "window", "default", "version", changes.Version,
+		"kept", len(known)-updated, "changed", updated, "fetched", fetched, "batch_size", len(fresh))
+
+	s.mu.Lock()
+	s.storePending(changes.Version)(newCache)
+	s.mu.Unlock()
+}
+
+// fetchChanges reads the upstream change feed, counting the call toward
+// upstream availability.
+func (s *ProxyService) fetchChanges(since string) (models.ChangesResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout(s.config))
+	defer cancel()
+	changes, err := s.transport.Changes(ctx, since)
+	if errors.Is(err, errDeltaUnsupported) {
+		return changes, err
+	}
+	s.usage.recordUpstream(err)
+	s.failSwitch.record(err, time.Now())
+	return changes, err
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"math"
+	"sync"
+)
+
+// EfficiencyCounters count decisions by whether the cache answered them.
+type EfficiencyCounters struct {
+	Requests      int64   `json:"requests"`
+	CacheHits     int64   `json:"cache_hits"`     // Answered from the cache or the decision memo
+	UpstreamCalls int64   `json:"upstream_calls"` // Cache misses looked up live
+	HitRatio      float64 `json:"hit_ratio"`      // CacheHits / (CacheHits + UpstreamCalls)
+}
+
+// WindowEfficiency is EfficiencyCounters over a period, overall and by the
+// type of the keys decisions evaluated.
+type WindowEfficiency struct {
+	EfficiencyCounters
+	// Keys prefetched for the following window (windows only)
+	BatchSize int64                         `json:"batch_size,omitempty"`
+	KeyTypes  map[string]EfficiencyCounters `json:"key_types"`
+}
+
+// EfficiencyStats is how well the default window's cache spares the upstream.
+type EfficiencyStats struct {
+	Window     WindowEfficiency  `json:"window"`                // Since the last swap
+	LastWindow *WindowEfficiency `json:"last_window,omitempty"` // The window before (nil until the first swap)
+	Total      WindowEfficiency  `json:"total"`                 // Since start
+}
+
+// efficiency tracks EfficiencyStats; the window counters reset at every swap.
+type efficiency struct {
+	mu     sync.Mutex
+	window WindowEfficiency
+	last   *WindowEfficiency
+	total  WindowEfficiency
+}
+
+func newEfficiency() *efficiency {
+	return &efficiency{
+		window: WindowEfficiency{KeyTypes: map[string]EfficiencyCounters{}},
+		total:  WindowEfficiency{KeyTypes: map[string]EfficiencyCounters{}},
+	}
+}
+
+// record counts a decision under every key type it evaluated.
+func (e *efficiency) record(trace decisionTrace) {
+	var hit, miss int64
+	switch trace.Source {
+	case sourceCache, sourceMemo:
+		hit = 1
+	case sourceLive, sourceFailOpen, sourceFailClosed, sourceUnknown, sourceDeferred:
+		miss = 1
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, w := range []*WindowEfficiency{&e.window, &e.total} {
+		w.add(hit, miss)
+		for i, k := range trace.Keys {
+			if seenType(trace.Keys[:i], k.Type) {
+				continue
+			}
+			c := w.KeyTypes[k.Type]
+			c.add(hit, miss)
+			w.KeyTypes[k.Type] = c
+		}
+	}
+}
+
+// endWindow returns the window just ended, during which batchSize keys were
+// prefetched, and starts counting the next.
+func (e *efficiency) endWindow(batchSize int64) WindowEfficiency {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ended := e.window
+	ended.BatchSize = batchSize
+	e.last = &ended
+	e.window = WindowEfficiency{KeyTypes: map[string]EfficiencyCounters{}}
+	return ended
+}
+
+// stats reports the counters; batchSize is the current window's prefetch so far.
+func (e *efficiency) stats(batchSize int64) EfficiencyStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := EfficiencyStats{Window: e.window.clone(), Total: e.total.clone()}
+	st.Window.BatchSize = batchSize
+	if e.last != nil {
+		last := e.last.clone()
+		st.LastWindow = &last
+	}
+	return st
+}
+
+func (c *EfficiencyCounters) add(hit, miss int64) {
+	c.Requests++
+	c.CacheHits += hit
+	c.UpstreamCalls += miss
+	if looked := c.CacheHits + c.UpstreamCalls; looked > 0 {
+		c.HitRatio = math.Round(float64(c.CacheHits)/float64(looked)*1000) / 1000
+	}
+}
+
+func (w WindowEfficiency) clone() WindowEfficiency {
+	types := make(map[string]EfficiencyCounters, len(w.KeyTypes))
+	for t, c := range w.KeyTypes {
+		types[t] = c
+	}
+	w.KeyTypes = types
+	return w
+}
+
+func seenType(keys []requestKey, t string) bool {
+	for _, k := range keys {
+		if k.Type == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned by the service package. Upstream failures wrap one of the
+// upstream sentinels, so callers can tell them apart with errors.Is.
+var (
+	// ErrNoKeys means a check request carried nothing to decide on.
+	ErrNoKeys = errors.New("no keys provided")
+	// ErrInvalidIP means a request's ip_address is not an IP address.
+	ErrInvalidIP = errors.New("invalid ip_address")
+	// ErrIdempotencyKeyReused means an Idempotency-Key was resent with a
+	// different request within its TTL.
+	ErrIdempotencyKeyReused = errors.New("idempotency key reused for a different request")
+	// ErrDecryptionDisabled means emails are not encrypted reversibly, so
+	// there is nothing to decrypt.
+	ErrDecryptionDisabled = errors.New("email decryption requires EMAIL_ENCRYPTION_MODE=reversible")
+	// ErrInvalidCiphertext means a value was not encrypted under any
+	// configured key.
+	ErrInvalidCiphertext = errors.New("value was not encrypted with a configured key")
+	// ErrJobQueueFull means too many encrypt jobs are waiting for a worker.
+	ErrJobQueueFull = errors.New("too many encrypt jobs queued")
+	// ErrUnknownTenant means a request named a tenant that is not configured.
+	ErrUnknownTenant = errors.New("unknown tenant")
+	// ErrTenantForbidden means the request's API key may not act for the
+	// tenant it named.
+	ErrTenantForbidden = errors.New("API key not allowed for this tenant")
+	// ErrUpstreamTimeout means the upstream did not answer in time.
+	ErrUpstreamTimeout = errors.New("upstream timed out")
+	// ErrUpstreamUnauthorized means the upstream rejected UPSTREAM_API_KEY.
+	ErrUpstreamUnauthorized = errors.New("upstream rejected the API key")
+	// ErrCircuitOpen means the upstream was not called because its circuit
+	// breaker is open after repeated failures.
+	ErrCircuitOpen = errors.New("upstream circuit breaker is open")
+)
+
+// upstreamError tags err with the matching upstream sentinel, if any.
+func upstreamError(err error) error {
+	if err == nil || errors.Is(err, ErrUpstreamTimeout) || errors.Is(err, ErrUpstreamUnauthorized) {
+		return err
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return fmt.Errorf("%w: %v", ErrUpstreamTimeout, err)
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.DeadlineExceeded:
+			return fmt.Errorf("%w: %s", ErrUpstreamTimeout, st.Message())
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return fmt.Errorf("%w: %s", ErrUpstreamUnauthorized, st.Message())
+		}
+	}
+	return err
+}
+
+// statusError reports a non-success upstream HTTP status, tagging 401 and 403.
+func statusError(code int) error {
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		return fmt.Errorf("%w: status %d", ErrUpstreamUnauthorized, code)
+	}
+	return fmt.Errorf("upstream returned status: %d", code)
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/models"
+)
+
+// Event types streamed by GET /api/events.
+const (
+	EventDecision = "decision"
+	EventSwap     = "swap"
+)
+
+// eventBuffer is how many events a subscriber may fall behind by before
+// further events are dropped for it.
+const eventBuffer = 256
+
+// Event is a decision or cache swap, as streamed to event subscribers.
+type Event struct {
+	Type     string         `json:"type"`
+	Time     time.Time      `json:"time"`
+	Decision *DecisionEvent `json:"decision,omitempty"` // Type "decision"
+	Swap     *SwapEvent     `json:"swap,omitempty"`     // Type "swap"
+}
+
+// DecisionEvent is a Check outcome. It is the real decision, also in
+// SHADOW_MODE.
+type DecisionEvent struct {
+	Allow   bool          `json:"allow"`
+	Status  string        `json:"status"` // "success", or "unknown" with FAIL_MODE=unknown
+	Source  string        `json:"source"`
+	Message string        `json:"message,omitempty"`
+	Keys    []DecisionKey `json:"keys"`
+}
+
+// SwapEvent is a window's cache being replaced at the end of the window.
+type SwapEvent struct {
+	Window string `json:"window"` // "default" or a WINDOW_SECONDS_BY_TYPE key type
+	Keys   int    `json:"keys"`   // Decisions in the new cache
+	Stale  bool   `json:"stale"`  // The previous cache was kept (CACHE_STALE_POLICY=retain)
+}
+
+// EventFilter selects the events a subscriber receives. Zero values match
+// everything.
+type EventFilter struct {
+	Types    []string // Event types
+	KeyTypes []string // Decisions with a key of one of these types, swaps of their windows and the default window
+	Outcome  string   // Decisions that "allow" or "block"; swaps always match
+}
+
+// EventSubscription receives events until Close, or until the service drains.
+type EventSubscription struct {
+	C <-chan Event // Closed when the subscription ends
+
+	ch     chan Event
+	filter EventFilter
+	hub    *eventHub
+}
+
+// Close ends the subscription.
+func (sub *EventSubscription) Close() {
+	sub.hub.remove(sub)
+}
+
+// eventHub fans events out to subscribers, dropping events for those that
+// fall behind rather than slowing decisions down.
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[*EventSubscription]struct{}
+	closed bool
+
+	active  atomic.Int32 // len(subs), read without mu on the decision path
+	dropped atomic.Int64
+}
+
+// SubscribeEvents streams the decisions and cache swaps matching f.
+func (s *ProxyService) SubscribeEvents(f EventFilter) *EventSubscription {
+	return s.events.add(f)
+}
+
+func (h *eventHub) add(f EventFilter) *EventSubscription {
+	ch := make(chan Event, eventBuffer)
+	sub := &EventSubscription{C: ch, ch: ch, filter: f, hub: h}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return sub
+	}
+	if h.subs == nil {
+		h.subs = make(map[*EventSubscription]struct{})
+	}
+	h.subs[sub] = struct{}{}
+	h.active.Store(int32(len(h.subs)))
+	return sub
+}
+
+func (h *eventHub) remove(sub *EventSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		h.active.Store(int32(len(h.subs)))
+		close(sub.ch)
+	}
+}
+
+// close ends every subscription and refuses new ones.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		close(sub.ch)
+	}
+	h.subs = nil
+	h.active.Store(0)
+}
+
+// listening reports whether anyone subscribes, so events are only built for them.
+func (h *eventHub) listening() bool {
+	return h.active.Load() > 0
+}
+
+func (h *eventHub) publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !sub.filter.matches(ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			h.dropped.Add(1)
+		}
+	}
+}
+
+func (f EventFilter) matches(ev Event) bool {
+	if len(f.Types) > 0 && !contains(f.Types, ev.Type) {
+		return false
+	}
+	if f.Outcome != "" && ev.Decision != nil && (f.Outcome == "allow") != ev.Decision.Allow {
+		return false
+	}
+	if len(f.KeyTypes) == 0 {
+		return true
+	}
+	switch {
+	case ev.Decision != nil:
+		for _, k := range ev.Decision.Keys {
+			if contains(f.KeyTypes, k.Type) {
+				return true
+			}
+		}
+		return false
+	case ev.Swap != nil:
+		return ev.Swap.Window == "default" || contains(f.KeyTypes, ev.Swap.Window)
+	}
+	return true
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// publishDecision streams a Check outcome to subscribers.
+func (s *ProxyService) publishDecision(resp models.AllowResponse, trace decisionTrace) {
+	if !s.events.listening() {
+		return
+	}
+	keys := make([]DecisionKey, len(trace.Keys))
+	for i, k := range trace.Keys {
+		keys[i] = DecisionKey{Type: k.Type, Key: k.Value}
+	}
+	s.events.publish(Event{Type: EventDecision, Time: time.Now(), Decision: &DecisionEvent{
+		Allow:   resp.Allow,
+		Status:  resp.Status,
+		Source:  trace.Source,
+		Message: resp.Message,
+		Keys:    keys,
+	}})
+}
+
+// publishSwap streams a window swap to subscribers.
+func (s *ProxyService) publishSwap(window string, keys int, stale bool) {
+	if !s.events.listening() {
+		return
+	}
+	s.events.publish(Event{Type: EventSwap, Time: time.Now(), Swap: &SwapEvent{Window: window, Keys: keys, Stale: stale}})
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+func TestProxyService_Events(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"key":"10.0.0.1","allow":false},{"key":"a@example.com","allow":true}]`))
+	}))
+	defer upstream.Close()
+	svc := NewProxyService(&config.Config{UpstreamBaseURLs: []string{upstream.URL}, WarmupAction: WarmupLive}, nil, nil)
+
+	all := svc.SubscribeEvents(EventFilter{})
+	blocks := svc.SubscribeEvents(EventFilter{Outcome: "block"})
+	emails := svc.SubscribeEvents(EventFilter{Types: []string{EventDecision}, KeyTypes: []string{models.KeyTypeEmail}})
+	defer emails.Close()
+
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "10.0.0.1"})
+	svc.Check(context.Background(), models.AllowRequest{Email: "a@example.com"})
+	svc.swapCache()
+
+	var got []Event
+	for range 3 {
+		got = append(got, <-all.C)
+	}
+	if got[0].Decision == nil || got[0].Decision.Allow || got[0].Decision.Keys[0].Key != "10.0.0.1" {
+		t.Errorf("Expected the IP block first, got %+v", got[0])
+	}
+	if got[1].Decision == nil || !got[1].Decision.Allow {
+		t.Errorf("Expected the email allow second, got %+v", got[1])
+	}
+	if got[2].Type != EventSwap || got[2].Swap.Window != "default" {
+		t.Errorf("Expected the swap last, got %+v", got[2])
+	}
+	if ev := <-blocks.C; ev.Decision == nil || ev.Decision.Allow {
+		t.Errorf("Expected only the block and the swap for outcome=block, got %+v", ev)
+	}
+	if ev := <-emails.C; ev.Decision == nil || ev.Decision.Keys[0].Type != models.KeyTypeEmail {
+		t.Errorf("Expected only the email decision, got %+v", ev)
+	}
+	select {
+	case ev := <-emails.C:
+		t.Errorf("Unexpected event for the email subscriber: %+v", ev)
+	default:
+	}
+
+	// Closed subscriptions stop receiving; draining ends the rest
+	all.Close()
+	if _, ok := <-all.C; ok {
+		t.Error("Expected a closed channel after Close")
+	}
+	svc.Drain()
+	<-blocks.C // The swap
+	if _, ok := <-blocks.C; ok {
+		t.Error("Expected Drain to end the subscription")
+	}
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+)
+
+// failSwitchMinCalls is how many upstream calls the window must hold before
+// its availability is trusted, so a couple of early errors do not trip it.
+const failSwitchMinCalls = 20
+
+// failSwitch measures upstream availability over a sliding window of
+// FAIL_SWITCH_WINDOW_SECONDS and, when it drops below FAIL_SWITCH_BELOW,
+// answers failed live checks with FAIL_SWITCH_TO instead of FAIL_MODE for
+// FAIL_SWITCH_SECONDS. Measuring restarts when the switch expires, so a
+// still-degraded upstream switches again once the window fills up.
+type failSwitch struct {
+	below float64
+	base  string
+	to    string
+	hold  time.Duration
+
+	mu       sync.Mutex
+	buckets  []availBucket // One per second of the window
+	switched bool
+	until    time.Time
+}
+
+type availBucket struct {
+	sec    int64
+	calls  int64
+	errors int64
+}
+
+func newFailSwitch(cfg *config.Config) *failSwitch {
+	if cfg.FailSwitchBelow <= 0 || cfg.FailSwitchTo == cfg.FailMode {
+		return nil
+	}
+	return &failSwitch{
+		below:   cfg.FailSwitchBelow,
+		base:    cfg.FailMode,
+		to:      cfg.FailSwitchTo,
+		hold:    time.Duration(cfg.FailSwitchSeconds) * time.Second,
+		buckets: make([]availBucket, max(cfg.FailSwitchWindowSecs, 1)),
+	}
+}
+
+// record counts an upstream call and switches modes when availability over
+// the window falls below the threshold.
+func (f *failSwitch) record(err error, now time.Time) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.expire(now)
+	sec := now.Unix()
+	b := &f.buckets[sec%int64(len(f.buckets))]
+	if b.sec != sec {
+		*b = availBucket{sec: sec}
+	}
+	b.calls++
+	if err != nil {
+		b.errors++
+	}
+	if f.switched {
+		return
+	}
+
+	var calls, failed int64
+	for _, b := range f.buckets {
+		if sec-b.sec < int64(len(f.buckets)) {
+			calls += b.calls
+			failed += b.errors
+		}
+	}
+	if calls < failSwitchMinCalls {
+		return
+	}
+	if avail := float64(calls-failed) / float64(calls); avail < f.below {
+		f.switched, f.until = true, now.Add(f.hold)
+		logFor(componentProxy).Warn("upstream availability below FAIL_SWITCH_BELOW, switching fail mode",
+			"alert", true, "availability", avail, "below", f.below, "window_seconds", len(f.buckets),
+			"fail_mode", f.to, "base_fail_mode", f.base, "hold", f.hold)
+	}
+}
+
+// mode returns the fail mode in effect at now.
+func (f *failSwitch) mode(now time.Time) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire(now)
+	if f.switched {
+		return f.to
+	}
+	return f.base
+}
+
+// expire reverts to the configured mode once the switch has lasted
+// FAIL_SWITCH_SECONDS. Callers hold f.mu.
+func (f *failSwitch) expire(now time.Time) {
+	if !f.switched || now.Before(f.until) {
+		return
+	}
+	f.switched = false
+	clear(f.buckets)
+	logFor(componentProxy).Info("fail mode switch expired", "fail_mode", f.base)
+}
+
+// failMode returns the FAIL_MODE currently applied to failed live checks,
+// which FAIL_SWITCH_BELOW may have temporarily overridden.
+func (s *ProxyService) failMode() string {
+	if s.failSwitch == nil {
+		return s.config.FailMode
+	}
+	return s.failSwitch.mode(time.Now())
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	"apigate-proxy/config"
+)
+
+// GeoIP resolves client IPs to country and continent codes using a MaxMind
+// GeoLite2/GeoIP2 Country or City database, and to autonomous system numbers
+// using a GeoLite2/GeoIP2 ASN database.
+type GeoIP struct {
+	reader *maxminddb.Reader // nil = no country database
+	asn    *maxminddb.Reader // nil = no ASN database
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+}
+
+type asnRecord struct {
+	Number uint `maxminddb:"autonomous_system_number"`
+}
+
+// OpenGeoIP memory-maps the database at path.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{reader: reader}, nil
+}
+
+// Lookup returns the ISO country code and continent code for ip. Unknown or
+// unparseable addresses yield empty strings.
+func (g *GeoIP) Lookup(ip string) (string, string) {
+	if g == nil || g.reader == nil || ip == "" {
+		return "", ""
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", ""
+	}
+	var rec geoRecord
+	if err := g.reader.Lookup(parsed, &rec); err != nil {
+		return "", ""
+	}
+	return rec.Country.ISOCode, rec.Continent.Code
+}
+
+// LookupASN returns the autonomous system announcing ip as "AS<number>", or
+// an empty string when it is unknown or no ASN database is open.
+func (g *GeoIP) LookupASN(ip string) string {
+	if g == nil || g.asn == nil || ip == "" {
+		return ""
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	var rec asnRecord
+	if err := g.asn.Lookup(parsed, &rec); err != nil || rec.Number == 0 {
+		return ""
+	}
+	return "AS" + strconv.FormatUint(uint64(rec.Number), 10)
+}
+
+// Close releases the database mappings.
+func (g *GeoIP) Close() error {
+	if g == nil {
+		return nil
+	}
+	var err error
+	if g.reader != nil {
+		err = g.reader.Close()
+	}
+	if g.asn != nil {
+		if asnErr := g.asn.Close(); err == nil {
+			err = asnErr
+		}
+	}
+	return err
+}
+
+// normalizeASN returns an ASN given as "AS13335", "as13335" or "13335" in
+// the "AS13335" form of ASN keys.
+func normalizeASN(v string) (string, bool) {
+	digits := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "AS")
+	n, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil || n == 0 {
+		return "", false
+	}
+	return "AS" + strconv.FormatUint(n, 10), true
+}
+
+func openGeoIP(cfg *config.Config) *GeoIP {
+	if cfg.GeoIPDBPath == "" && cfg.ASNDBPath == "" {
+		return nil
+	}
+	geo := &GeoIP{}
+	if cfg.GeoIPDBPath != "" {
+		reader, err := maxminddb.Open(cfg.GeoIPDBPath)
+		if err != nil {
+			logFor(componentGeoIP).Error("failed to open database", "path", cfg.GeoIPDBPath, "error", err)
+		}
+		geo.reader = reader
+	}
+	if cfg.ASNDBPath != "" {
+		reader, err := maxminddb.Open(cfg.ASNDBPath)
+		if err != nil {
+			logFor(componentGeoIP).Error("failed to open ASN database", "path", cfg.ASNDBPath, "error", err)
+		}
+		geo.asn = reader
+	}
+	if geo.reader == nil && geo.asn == nil {
+		return nil
+	}
+	return geo
+}
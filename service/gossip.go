@@ -0,0 +1,284 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+const (
+	// gossipMaxItems bounds the decisions per message, keeping it to one datagram.
+	gossipMaxItems = 32
+	// gossipFlushInterval is how long live-check results wait to be batched.
+	gossipFlushInterval = 100 * time.Millisecond
+	// gossipMaxAge drops older messages, so captured ones cannot be replayed
+	// later; younger ones are refused if they were seen before.
+	gossipMaxAge = 10 * time.Second
+	// gossipQueue bounds results waiting to be sent; beyond it they are dropped.
+	gossipQueue = 1024
+)
+
+// gossip shares live-check results between instances (GOSSIP_BIND), so a
+// miss answered by the upstream on one instance warms the cache of every
+// other and is not looked up again there. Results are sent over UDP to each
+// of GOSSIP_PEERS, signed with GOSSIP_SECRET; peers apply them to their
+// current windows like their own live checks but do not forward them, so
+// every instance must list all others. Delivery is best effort: a lost
+// message only costs the peer a live check.
+type gossip struct {
+	id     string // Distinguishes this instance's own messages
+	conn   *net.UDPConn
+	peers  []*net.UDPAddr
+	secret []byte
+	out    chan models.BatchAllowResponseItem
+
+	// Messages accepted within gossipMaxAge, by sender and send time, so a
+	// captured datagram cannot be replayed while it is still fresh
+	mu     sync.Mutex
+	seen   map[gossipSeen]struct{}
+	pruned time.Time
+
+	sent     atomic.Int64
+	received atomic.Int64
+	rejected atomic.Int64
+	dropped  atomic.Int64
+}
+
+// GossipStats counts decisions shared with peers since start.
+type GossipStats struct {
+	Peers    int   `json:"peers"`
+	Sent     int64 `json:"sent"`     // Decisions sent (once per peer)
+	Received int64 `json:"received"` // Decisions applied from peers
+	Rejected int64 `json:"rejected"` // Messages with a bad MAC, stale, replayed or malformed
+	Dropped  int64 `json:"dropped"`  // Decisions not sent because the queue was full
+}
+
+type gossipSeen struct {
+	from string
+	sent int64 // UnixNano
+}
+
+type gossipMessage struct {
+	From  string                          `json:"from"`
+	Sent  time.Time                       `json:"sent"`
+	Items []models.BatchAllowResponseItem `json:"items"`
+}
+
+func newGossip(cfg *config.Config) *gossip {
+	if cfg.GossipBind == "" {
+		return nil
+	}
+	if cfg.GossipSecret == "" {
+		logFor(componentProxy).Warn("gossip disabled: GOSSIP_SECRET is not set")
+		return nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", cfg.GossipBind)
+	if err != nil {
+		logFor(componentProxy).Warn("gossip disabled", "error", err)
+		return nil
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		logFor(componentProxy).Warn("gossip disabled", "error", err)
+		return nil
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	g := &gossip{
+		id:     hex.EncodeToString(id),
+		conn:   conn,
+		secret: []byte(cfg.GossipSecret),
+		out:    make(chan models.BatchAllowResponseItem, gossipQueue),
+		seen:   make(map[gossipSeen]struct{}),
+	}
+	for _, p := range cfg.GossipPeers {
+		peer, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			logFor(componentProxy).Warn("ignoring gossip peer", "peer", p, "error", err)
+			continue
+		}
+		g.peers = append(g.peers, peer)
+	}
+	return g
+}
+
+// start sends queued results to the peers and hands results received from
+// them to apply, until done is closed.
+func (g *gossip) start(done <-chan struct{}, apply func([]models.BatchAllowResponseItem)) {
+	if g == nil {
+		return
+	}
+	logFor(componentProxy).Info("gossip started", "addr", g.conn.LocalAddr().String(), "peers", len(g.peers))
+	go g.sendLoop(done)
+	go g.receiveLoop(done, apply)
+}
+
+// publish queues a live-check result for the peers, without blocking.
+func (g *gossip) publish(item models.BatchAllowResponseItem) {
+	if g == nil || len(g.peers) == 0 {
+		return
+	}
+	select {
+	case g.out <- item:
+	default:
+		g.dropped.Add(1)
+	}
+}
+
+// sendLoop closes the connection when done, which ends receiveLoop.
+func (g *gossip) sendLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(gossipFlushInterval)
+	defer ticker.Stop()
+	batch := make([]models.BatchAllowResponseItem, 0, gossipMaxItems)
+	for {
+		select {
+		case <-done:
+			g.conn.Close()
+			return
+		case item := <-g.out:
+			if batch = append(batch, item); len(batch) < gossipMaxItems {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		g.send(batch)
+		batch = batch[:0]
+	}
+}
+
+func (g *gossip) send(items []models.BatchAllowResponseItem) {
+	payload, _ := json.Marshal(gossipMessage{From: g.id, Sent: time.Now(), Items: items})
+	packet := append(g.sign(payload), payload...)
+	for _, peer := range g.peers {
+		if _, err := g.conn.WriteToUDP(packet, peer); err != nil {
+			logFor(componentProxy).Error("error gossiping", "peer", peer.String(), "error", err)
+			continue
+		}
+		g.sent.Add(int64(len(items)))
+	}
+}
+
+func (g *gossip) receiveLoop(done <-chan struct{}, apply func([]models.BatchAllowResponseItem)) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			logFor(componentProxy).Error("gossip listener stopped", "error", err)
+			return
+		}
+		msg, ok := g.open(buf[:n])
+		if !ok {
+			g.rejected.Add(1)
+			continue
+		}
+		if msg.From == g.id || len(msg.Items) == 0 {
+			continue
+		}
+		g.received.Add(int64(len(msg.Items)))
+		apply(msg.Items)
+	}
+}
+
+// open verifies and decodes a packet: a SHA-256 HMAC followed by the
+// message. A message is accepted once.
+func (g *gossip) open(packet []byte) (gossipMessage, bool) {
+	if len(packet) <= sha256.Size {
+		return gossipMessage{}, false
+	}
+	mac, payload := packet[:sha256.Size], packet[sha256.Size:]
+	if !hmac.Equal(mac, g.sign(payload)) {
+		return gossipMessage{}, false
+	}
+	var msg gossipMessage
+	if json.Unmarshal(payload, &msg) != nil {
+		return gossipMessage{}, false
+	}
+	if age := time.Since(msg.Sent); age > gossipMaxAge || age < -gossipMaxAge {
+		return gossipMessage{}, false
+	}
+	if !g.firstSeen(msg) {
+		return gossipMessage{}, false
+	}
+	return msg, true
+}
+
+// firstSeen records msg and reports whether it was not seen before. Records
+// are dropped once their message is too old to be accepted anyway.
+func (g *gossip) firstSeen(msg gossipMessage) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if now.Sub(g.pruned) > gossipMaxAge {
+		for k := range g.seen {
+			if now.Sub(time.Unix(0, k.sent)) > gossipMaxAge {
+				delete(g.seen, k)
+			}
+		}
+		g.pruned = now
+	}
+	k := gossipSeen{from: msg.From, sent: msg.Sent.UnixNano()}
+	if _, ok := g.seen[k]; ok {
+		return false
+	}
+	g.seen[k] = struct{}{}
+	return true
+}
+
+func (g *gossip) sign(payload []byte) []byte {
+	h := hmac.New(sha256.New, g.secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func (g *gossip) stats() *GossipStats {
+	if g == nil {
+		return nil
+	}
+	return &GossipStats{
+		Peers:    len(g.peers),
+		Sent:     g.sent.Load(),
+		Received: g.received.Load(),
+		Rejected: g.rejected.Load(),
+		Dropped:  g.dropped.Load(),
+	}
+}
+
+// applyGossip caches decisions a peer got from its live checks, in the
+// windows owning their key types.
+func (s *ProxyService) applyGossip(items []models.BatchAllowResponseItem) {
+	// Held for reading, like a live write
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	flipped := false
+	for _, item := range items {
+		if prev, ok := s.cacheFor(item.Type).put(item); ok && prev != item.Allow {
+			flipped = true
+		}
+		s.reasons.note(item)
+		s.labels.note(item)
+		s.ttls.note(item, now)
+	}
+	if flipped {
+		// Responses combined from the old decisions must not be served again
+		s.tuples.invalidate()
+		s.memo.clear()
+	}
+}
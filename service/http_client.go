@@ -0,0 +1,87 @@
+package service
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"apigate-proxy/config"
+)
+
+// Timeouts of the upstream calls that have no setting of their own.
+const (
+	probeTimeout    = 10 * time.Second // Health probes
+	callbackTimeout = 10 * time.Second // Deferred-decision callbacks
+)
+
+// newUpstreamClient returns an HTTP client for upstream calls made with cfg.
+// NewProxyService builds one and the LoggerService and tenants are handed the
+// same client, so they share one tuned Transport and so one connection pool.
+// The default Transport keeps only 2 idle connections per host, which forces
+// a new connection (and TLS handshake) for most concurrent misses. The client
+// has no overall timeout: every call carries the deadline of its kind in its
+// context.
+func newUpstreamClient(cfg *config.Config) *http.Client {
+	return &http.Client{Transport: newUpstreamHTTPTransport(cfg)}
+}
+
+// liveCheckTimeout bounds a cache miss's upstream lookup (LIVE_CHECK_TIMEOUT_MS).
+func liveCheckTimeout(cfg *config.Config) time.Duration {
+	if cfg.LiveCheckTimeoutMs <= 0 {
+		return time.Second
+	}
+	return time.Duration(cfg.LiveCheckTimeoutMs) * time.Millisecond
+}
+
+// prefetchTimeout bounds each prefetch request, warm start and change-feed
+// read (PREFETCH_TIMEOUT_SECONDS).
+func prefetchTimeout(cfg *config.Config) time.Duration {
+	if cfg.PrefetchTimeoutSecs <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(cfg.PrefetchTimeoutSecs) * time.Second
+}
+
+// logFlushTimeout bounds each log batch delivered upstream
+// (LOG_FLUSH_TIMEOUT_SECONDS).
+func logFlushTimeout(cfg *config.Config) time.Duration {
+	if cfg.LogFlushTimeoutSecs <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(cfg.LogFlushTimeoutSecs) * time.Second
+}
+
+func newUpstreamHTTPTransport(cfg *config.Config) *http.Transport {
+	dialTimeout := time.Duration(cfg.UpstreamDialTimeoutSec) * time.Second
+	if dialTimeout <= 0 {
+		dialTimeout = 5 * time.Second
+	}
+	idleTimeout := time.Duration(cfg.UpstreamIdleTimeoutSec) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = 90 * time.Second
+	}
+	tlsTimeout := time.Duration(cfg.UpstreamTLSTimeoutSec) * time.Second
+	if tlsTimeout <= 0 {
+		tlsTimeout = 10 * time.Second
+	}
+	maxIdle := cfg.UpstreamMaxIdlePerHost
+	if maxIdle <= 0 {
+		maxIdle = http.DefaultMaxIdleConnsPerHost
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:          maxIdle * max(len(cfg.UpstreamBaseURLs), 1),
+		MaxIdleConnsPerHost:   maxIdle,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   tlsTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     cfg.UpstreamHTTP2,
+	}
+	if !cfg.UpstreamHTTP2 {
+		// A non-nil empty map disables HTTP/2 negotiation over TLS
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
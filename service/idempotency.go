@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+// idempotencyStore remembers the decision returned for each Idempotency-Key
+// for IDEMPOTENCY_TTL_SECONDS. Unlike decisionMemo it is keyed by the caller's
+// key rather than the request contents, and also holds provisional answers,
+// so a retried submission always gets back exactly what the first one did.
+// Entries live in the shared storage backend, so with a file or Redis backend
+// they survive restarts (and, with Redis, are honoured by every instance).
+type idempotencyStore struct {
+	ttl      time.Duration
+	store    storage.Storage
+	inflight singleflight.Group
+}
+
+type idempotencyEntry struct {
+	Fingerprint uint64               `json:"fingerprint"` // memoKey of the original request
+	Resp        models.AllowResponse `json:"resp"`
+}
+
+const idempotencyPrefix = "idempotency/"
+
+func newIdempotencyStore(ttl time.Duration, store storage.Storage) *idempotencyStore {
+	if ttl <= 0 {
+		return nil
+	}
+	return &idempotencyStore{ttl: ttl, store: store}
+}
+
+func (st *idempotencyStore) get(key string) (idempotencyEntry, bool) {
+	data, ok, err := st.store.Get(idempotencyPrefix + key)
+	if err != nil {
+		logFor(componentProxy).Error("error reading idempotency key", "error", err)
+		return idempotencyEntry{}, false
+	}
+	var entry idempotencyEntry
+	if !ok || json.Unmarshal(data, &entry) != nil {
+		return idempotencyEntry{}, false
+	}
+	return entry, true
+}
+
+func (st *idempotencyStore) put(key string, entry idempotencyEntry) {
+	data, _ := json.Marshal(entry)
+	if err := st.store.Set(idempotencyPrefix+key, data, st.ttl); err != nil {
+		// The decision still stands; only its replay is lost
+		logFor(componentProxy).Error("error storing idempotency key", "error", err)
+	}
+}
+
+// sweep drops expired entries that were never replayed.
+func (st *idempotencyStore) sweep() {
+	if st == nil {
+		return
+	}
+	sweepStorage(st.store)
+}
+
+// CheckIdempotent is Check for a request carrying an idempotency key. The
+// first submission for key is evaluated normally; repeats within the TTL,
+// including ones arriving while it is still being evaluated, get the same
+// response back with replayed set, without being evaluated or counted again.
+// Reusing a key for a different request fails with ErrIdempotencyKeyReused.
+// Without IDEMPOTENCY_TTL_SECONDS the key is ignored. Repeats waiting on a
+// first submission whose caller went away get its context error, nothing is
+// stored, and the next retry is evaluated afresh.
+func (s *ProxyService) CheckIdempotent(ctx context.Context, key string, req models.AllowRequest) (resp models.AllowResponse, replayed bool, err error) {
+	st := s.idempotency
+	if st == nil {
+		resp, err = s.Check(ctx, req)
+		return resp, false, err
+	}
+	// Retries writing the IP differently are still the same request
+	if err := canonicalIP(&req); err != nil {
+		return models.AllowResponse{}, false, err
+	}
+
+	fp := memoKey(req)
+	if entry, ok := st.get(key); ok {
+		if entry.Fingerprint != fp {
+			return models.AllowResponse{}, false, ErrIdempotencyKeyReused
+		}
+		return entry.Resp, true, nil
+	}
+
+	leader := false
+	v, err, _ := st.inflight.Do(key, func() (interface{}, error) {
+		leader = true
+		resp, err := s.Check(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		entry := idempotencyEntry{Fingerprint: fp, Resp: resp}
+		st.put(key, entry)
+		return entry, nil
+	})
+	if err != nil {
+		return models.AllowResponse{}, false, err
+	}
+	entry := v.(idempotencyEntry)
+	if !leader && entry.Fingerprint != fp {
+		return models.AllowResponse{}, false, ErrIdempotencyKeyReused
+	}
+	return entry.Resp, !leader, nil
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/utils"
+)
+
+// userIDPrefix namespaces user-ID keys so they never share a key with an email.
+const userIDPrefix = "uid:"
+
+// pseudonymize applies the configured one-way hash (or, with
+// EMAIL_ENCRYPTION_MODE=reversible, deterministic AES-GCM encryption), or
+// returns value unchanged when encryption is disabled or no key is configured.
+func pseudonymize(cfg *config.Config, value string) string {
+	return pseudonymizeWith(cfg, cfg.CurrentEmailKey(), cfg.EmailKeyID, value)
+}
+
+// pseudonymizeWith pseudonymizes value under key. With a key ID the value is
+// hashed (or encrypted) under the key's HKDF subkey instead of the key itself
+// and the result is prefixed with the ID, e.g. "k2$3f1c...", so consumers can
+// tell which key made it.
+func pseudonymizeWith(cfg *config.Config, key, keyID, value string) string {
+	if value == "" || !cfg.EmailEncryptionEnabled || key == "" {
+		return value
+	}
+	k := []byte(key)
+	if keyID != "" {
+		k = utils.DeriveSubkey(k, utils.SubkeyEmailHash)
+		if cfg.EmailEncryptionMode != "reversible" && cfg.EmailEncryptionAlgo == utils.HashSipHash {
+			// A prefix of an HKDF output is the HKDF output of that length
+			k = k[:utils.SipHashKeySize]
+		}
+	}
+	out := pseudonymizeUnder(cfg, k, value)
+	if keyID != "" {
+		out = utils.WithKeyID(keyID, out)
+	}
+	return out
+}
+
+func pseudonymizeUnder(cfg *config.Config, key []byte, value string) string {
+	if cfg.EmailEncryptionMode == "reversible" {
+		// Cannot fail: the AES key is always derived to 32 bytes
+		enc, _ := utils.EncryptReversible(key, value)
+		return enc
+	}
+	if cfg.EmailEncryptionAlgo != "" {
+		// LoadConfig only accepts known algorithms, and keys fitting them,
+		// but a secrets backend may rotate in a key that does not fit
+		h, err := utils.OneWayKeyedHashAlgo(cfg.EmailEncryptionAlgo, key, value, cfg.EmailEncryptionFormat, cfg.EmailEncryptionLength)
+		if err == nil {
+			return h
+		}
+		logUnfitKey(cfg.EmailEncryptionAlgo, key, err)
+	}
+	// The legacy unprefixed HMAC-SHA256
+	sum, _ := utils.KeyedHash(utils.HashHMACSHA256, key, value)
+	return utils.EncodeHash(sum, cfg.EmailEncryptionFormat, cfg.EmailEncryptionLength)
+}
+
+// unfitKeysLogged holds the fingerprints of the identity keys logged as not
+// fitting EMAIL_ENCRYPTION_ALGO, so each is reported once, not per request.
+var unfitKeysLogged sync.Map
+
+// logUnfitKey reports that key cannot be used with algo, so identities are
+// hashed with the legacy HMAC-SHA256 and no longer match keys made under algo.
+func logUnfitKey(algo string, key []byte, err error) {
+	sum := sha256.Sum256(append([]byte(algo+"\x00"), key...))
+	if _, logged := unfitKeysLogged.LoadOrStore(hex.EncodeToString(sum[:8]), true); !logged {
+		logFor(componentProxy).Error("identity key does not fit EMAIL_ENCRYPTION_ALGO; hashing identities with the legacy HMAC-SHA256 until it is replaced",
+			"algo", algo, "error", err)
+	}
+}
+
+// userAgentKey hashes a User-Agent for use as a key: unkeyed (see
+// utils.CompressUserAgent) or, with EMAIL_ENCRYPTION_KEY_ID, keyed with the
+// UA subkey and prefixed with the key ID.
+func userAgentKey(cfg *config.Config, ua string) string {
+	key := cfg.CurrentEmailKey()
+	if cfg.EmailKeyID == "" || key == "" {
+		return utils.CompressUserAgent(ua)
+	}
+	subkey := utils.DeriveSubkey([]byte(key), utils.SubkeyUAHash)
+	return utils.WithKeyID(cfg.EmailKeyID, utils.KeyedUserAgentHash(subkey, ua))
+}
+
+// keyDerivationProbe is hashed to fingerprint the identity key derivation.
+const keyDerivationProbe = "key-derivation-probe@apigate.invalid"
+
+// keyDerivation fingerprints how identity keys are derived: any change to
+// EMAIL_ENCRYPTION_KEY, _KEY_ID, _ALGO, _FORMAT, _LENGTH, _MODE or _ENABLED
+// changes it, so
+// persisted state can tell whether its keys still match. It reveals nothing
+// about the key.
+func keyDerivation(cfg *config.Config) string {
+	sum := sha256.Sum256([]byte(pseudonymize(cfg, keyDerivationProbe)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// identityKey normalizes and pseudonymizes an email or user ID, returning the
+// key used for caching, upstream checks and logs along with the resolved type.
+func identityKey(cfg *config.Config, value, declared string) (string, string) {
+	return identityKeyWith(cfg, cfg.CurrentEmailKey(), cfg.EmailKeyID, value, declared)
+}
+
+func identityKeyWith(cfg *config.Config, hashKey, keyID, value, declared string) (string, string) {
+	if value == "" {
+		return "", ""
+	}
+	normalized, kind := utils.ClassifyIdentity(value, declared)
+	key := pseudonymizeWith(cfg, hashKey, keyID, normalized)
+	if kind == utils.IdentityUserID {
+		key = userIDPrefix + key
+	}
+	return key, kind
+}
+
+// secondaryKey returns the request's identity key hashed under
+// EMAIL_ENCRYPTION_KEY_SECONDARY while a key rotation is in progress. Only
+// lookups use it; logs and new cache entries are written under the primary key.
+func (s *ProxyService) secondaryKey(req models.AllowRequest) (requestKey, bool) {
+	secondary := s.config.CurrentEmailSecondaryKey()
+	if req.Email == "" || !s.config.EmailEncryptionEnabled || secondary == "" {
+		return requestKey{}, false
+	}
+	key, kind := identityKeyWith(s.config, secondary, s.config.EmailSecondaryKeyID, req.Email, req.IdentityType)
+	keyType := models.KeyTypeEmail
+	if kind == utils.IdentityUserID {
+		keyType = models.KeyTypeUserID
+	}
+	return requestKey{keyType, key}, true
+}
+
+// DecryptEmail recovers the email or user ID behind a key produced with
+// EMAIL_ENCRYPTION_MODE=reversible, trying the secondary key too during a
+// rotation. A value prefixed with a key ID is only tried with that key.
+func (s *ProxyService) DecryptEmail(value string) (string, error) {
+	if !s.config.EmailEncryptionEnabled || s.config.EmailEncryptionMode != "reversible" || s.config.CurrentEmailKey() == "" {
+		return "", ErrDecryptionDisabled
+	}
+	value = strings.TrimPrefix(value, userIDPrefix)
+	valueID, ciphertext, _ := utils.SplitKeyID(value)
+	keys := []struct{ key, id string }{
+		{s.config.CurrentEmailKey(), s.config.EmailKeyID},
+		{s.config.CurrentEmailSecondaryKey(), s.config.EmailSecondaryKeyID},
+	}
+	for _, k := range keys {
+		if k.key == "" || k.id != valueID {
+			continue
+		}
+		key := []byte(k.key)
+		if k.id != "" {
+			key = utils.DeriveSubkey(key, utils.SubkeyEmailHash)
+		}
+		if plain, err := utils.DecryptReversible(key, ciphertext); err == nil {
+			return plain, nil
+		}
+	}
+	return "", ErrInvalidCiphertext
+}
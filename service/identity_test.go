@@ -0,0 +1,274 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/utils"
+)
+
+func TestIdentityKey(t *testing.T) {
+	cfg := &config.Config{EmailEncryptionKey: "0123456789abcdef0123456789abcdef", EmailEncryptionEnabled: true}
+
+	upper, kind := identityKey(cfg, " Alice@Example.COM ", "")
+	lower, _ := identityKey(cfg, "alice@example.com", "")
+	if kind != utils.IdentityEmail || upper != lower {
+		t.Errorf("Expected normalized email keys to match, got %s (%s) vs %s", upper, kind, lower)
+	}
+
+	id1, kind := identityKey(cfg, "User_ABC", "")
+	id2, _ := identityKey(cfg, "user_abc", "")
+	if kind != utils.IdentityUserID || id1 == id2 {
+		t.Errorf("User IDs must keep their case, got %s (%s) and %s", id1, kind, id2)
+	}
+	if !strings.HasPrefix(id1, userIDPrefix) {
+		t.Errorf("Expected user ID key in its own namespace, got %s", id1)
+	}
+
+	// A declared type overrides detection
+	if _, kind := identityKey(cfg, "a@b.co", utils.IdentityUserID); kind != utils.IdentityUserID {
+		t.Errorf("Expected declared user_id to be honoured, got %s", kind)
+	}
+}
+
+func TestProxyService_KeyRotation(t *testing.T) {
+	oldKey, newKey := "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:        "http://127.0.0.1:0",
+		EmailEncryptionEnabled: true,
+		EmailEncryptionKey:     newKey,
+		EmailSecondaryKey:      oldKey,
+	}, nil, nil)
+
+	oldHash, _ := identityKey(&config.Config{EmailEncryptionEnabled: true, EmailEncryptionKey: oldKey}, "bob@example.com", "")
+	newHash, _ := svc.IdentityKey("bob@example.com", "")
+
+	// Decisions cached under the old key still apply
+	svc.pending = cacheOf(map[string]bool{"1.1.1.1": true, oldHash: false})
+	svc.swapCache()
+
+	req := models.AllowRequest{IPAddress: "1.1.1.1", Email: "bob@example.com"}
+	if resp, _ := svc.Check(context.Background(), req); resp.Allow || resp.Message != "Cache Hit: Blocked" {
+		t.Errorf("Expected the old-key block to apply, got %+v", resp)
+	}
+
+	// Both hashes are tracked for the next prefetch
+	if !svc.batchedKeys.has(oldHash) {
+		t.Error("Expected the secondary-key hash to be tracked")
+	}
+	if !svc.batchedKeys.has(newHash) {
+		t.Error("Expected the primary-key hash to be tracked")
+	}
+
+	// An allow known only under the old key is a hit as well
+	svc.pending = cacheOf(map[string]bool{"1.1.1.1": true, oldHash: true})
+	svc.swapCache()
+	if resp, _ := svc.Check(context.Background(), req); !resp.Allow || resp.Message != "Cache Hit" {
+		t.Errorf("Expected a cache hit via the secondary key, got %+v", resp)
+	}
+}
+
+func TestIdentityKey_SipHashKeyID(t *testing.T) {
+	// Under a key ID any key works: SipHash gets a 16-byte subkey
+	cfg := &config.Config{EmailEncryptionKey: "0123456789abcdef0123456789abcdef", EmailKeyID: "k1", EmailEncryptionEnabled: true, EmailEncryptionAlgo: utils.HashSipHash}
+	got, _ := identityKey(cfg, "alice@example.com", "")
+	if !strings.HasPrefix(got, "k1$siphash:") {
+		t.Errorf("Expected a SipHash under the key ID, got %s", got)
+	}
+}
+
+func TestIdentityKey_Algorithms(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	legacy, _ := identityKey(&config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true}, "alice@example.com", "")
+
+	seen := map[string]bool{}
+	for _, algo := range []string{utils.HashHMACSHA256, utils.HashHMACSHA512256, utils.HashBLAKE2b, utils.HashSipHash} {
+		cfg := &config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true, EmailEncryptionAlgo: algo}
+		if algo == utils.HashSipHash {
+			cfg.EmailEncryptionKey = key[:utils.SipHashKeySize]
+		}
+		got, _ := identityKey(cfg, "alice@example.com", "")
+		if !strings.HasPrefix(got, algo+":") {
+			t.Errorf("%s: expected algorithm prefix, got %s", algo, got)
+		}
+		if again, _ := identityKey(cfg, "Alice@Example.com", ""); again != got {
+			t.Errorf("%s: expected a deterministic hash, got %s vs %s", algo, got, again)
+		}
+		if seen[got] {
+			t.Errorf("%s: collides with another algorithm", algo)
+		}
+		seen[got] = true
+
+		cfg.EmailEncryptionFormat = "numeric"
+		if num, _ := identityKey(cfg, "alice@example.com", ""); !strings.HasPrefix(num, algo+":") || strings.ContainsAny(num[len(algo)+1:], "abcdef") {
+			t.Errorf("%s: expected a prefixed numeric hash, got %s", algo, num)
+		}
+	}
+
+	// HMAC-SHA256 is the legacy hash, just labelled
+	if !seen[utils.HashHMACSHA256+":"+legacy] {
+		t.Errorf("Expected hmac-sha256 to match the unprefixed legacy hash %s", legacy)
+	}
+}
+
+func TestIdentityKey_UnfitKey(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	unfitKeysLogged.Clear()
+
+	// A key rotated in by a secrets backend, too long for SipHash
+	key := "fedcba9876543210fedcba9876543210"
+	cfg := &config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true, EmailEncryptionAlgo: utils.HashSipHash}
+	legacy, _ := identityKey(&config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true}, "alice@example.com", "")
+
+	if got, _ := identityKey(cfg, "alice@example.com", ""); got != legacy {
+		t.Errorf("Expected the legacy HMAC-SHA256, got %s", got)
+	}
+	identityKey(cfg, "bob@example.com", "")
+	if n := strings.Count(logs.String(), "level=ERROR"); n != 1 || !strings.Contains(logs.String(), "algo=siphash") {
+		t.Errorf("Expected the unfit key logged once as an error, got %q", logs.String())
+	}
+}
+
+func TestProxyService_ReversibleEmails(t *testing.T) {
+	cfg := &config.Config{EmailEncryptionKey: "0123456789abcdef0123456789abcdef", EmailEncryptionEnabled: true, EmailEncryptionMode: "reversible"}
+	svc := NewProxyService(cfg, nil, nil)
+
+	key, _ := svc.IdentityKey("Alice@Example.com", "")
+	again, _ := svc.IdentityKey("alice@example.com", "")
+	if !strings.HasPrefix(key, utils.ReversiblePrefix) || key != again {
+		t.Fatalf("Expected a deterministic %s key, got %s vs %s", utils.ReversiblePrefix, key, again)
+	}
+	if email, err := svc.DecryptEmail(key); err != nil || email != "alice@example.com" {
+		t.Errorf("DecryptEmail: %q, %v", email, err)
+	}
+	uid, _ := svc.IdentityKey("user-42", models.KeyTypeUserID)
+	if id, err := svc.DecryptEmail(uid); err != nil || id != "user-42" {
+		t.Errorf("DecryptEmail user ID: %q, %v", id, err)
+	}
+
+	// Tampered values and values under unknown keys are rejected
+	if _, err := svc.DecryptEmail(key[:len(key)-2] + "AA"); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Errorf("tampered: got %v", err)
+	}
+	foreign, _ := utils.EncryptReversible([]byte("another key"), "bob@example.com")
+	if _, err := svc.DecryptEmail(foreign); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Errorf("foreign key: got %v", err)
+	}
+
+	// During a rotation, values under the previous key still decrypt
+	rotated := *cfg
+	rotated.EmailEncryptionKey, rotated.EmailSecondaryKey = "fedcba9876543210fedcba9876543210", cfg.EmailEncryptionKey
+	if email, err := NewProxyService(&rotated, nil, nil).DecryptEmail(key); err != nil || email != "alice@example.com" {
+		t.Errorf("DecryptEmail after rotation: %q, %v", email, err)
+	}
+
+	hashed := *cfg
+	hashed.EmailEncryptionMode = "hash"
+	if _, err := NewProxyService(&hashed, nil, nil).DecryptEmail(key); !errors.Is(err, ErrDecryptionDisabled) {
+		t.Errorf("hash mode: got %v", err)
+	}
+}
+
+func TestProxyService_KeyIDs(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	legacyCfg := &config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true}
+	cfg := &config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true, EmailKeyID: "k1"}
+
+	legacy, _ := identityKey(legacyCfg, "alice@example.com", "")
+	hash, _ := identityKey(cfg, "alice@example.com", "")
+	if !strings.HasPrefix(hash, "k1$") || hash == "k1$"+legacy {
+		t.Errorf("Expected a k1$ hash under the HKDF subkey, got %s (legacy %s)", hash, legacy)
+	}
+	if uid, _ := identityKey(cfg, "user-42", utils.IdentityUserID); !strings.HasPrefix(uid, userIDPrefix+"k1$") {
+		t.Errorf("Expected uid:k1$..., got %s", uid)
+	}
+
+	// The UA key is keyed too, with its own subkey
+	ua := "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0"
+	if got := userAgentKey(legacyCfg, ua); got != utils.CompressUserAgent(ua) {
+		t.Errorf("Expected the unkeyed UA hash without a key ID, got %s", got)
+	}
+	if got := userAgentKey(cfg, ua); !strings.HasPrefix(got, "k1$") || got == "k1$"+utils.CompressUserAgent(ua) {
+		t.Errorf("Expected a keyed k1$ UA hash, got %s", got)
+	}
+
+	// Rotating from unprefixed hashes: the old hash is still looked up
+	rotated := &config.Config{
+		UpstreamBaseURL:        "http://127.0.0.1:0",
+		EmailEncryptionEnabled: true,
+		EmailEncryptionKey:     "fedcba9876543210fedcba9876543210",
+		EmailKeyID:             "k2",
+		EmailSecondaryKey:      key,
+	}
+	if k, ok := NewProxyService(rotated, nil, nil).secondaryKey(models.AllowRequest{Email: "alice@example.com"}); !ok || k.Value != legacy {
+		t.Errorf("Expected the unprefixed secondary hash %s, got %+v", legacy, k)
+	}
+
+	// Reversible values decrypt with the key their ID names only
+	rev := &config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true, EmailEncryptionMode: "reversible", EmailKeyID: "k1"}
+	enc, _ := NewProxyService(rev, nil, nil).IdentityKey("alice@example.com", "")
+	if !strings.HasPrefix(enc, "k1$"+utils.ReversiblePrefix) {
+		t.Fatalf("Expected k1$aes-gcm:..., got %s", enc)
+	}
+	next := *rev
+	next.EmailEncryptionKey, next.EmailKeyID = "fedcba9876543210fedcba9876543210", "k2"
+	next.EmailSecondaryKey, next.EmailSecondaryKeyID = key, "k1"
+	if email, err := NewProxyService(&next, nil, nil).DecryptEmail(enc); err != nil || email != "alice@example.com" {
+		t.Errorf("DecryptEmail by key ID: %q, %v", email, err)
+	}
+	if _, err := NewProxyService(&next, nil, nil).DecryptEmail("k9$" + strings.TrimPrefix(enc, "k1$")); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Errorf("unknown key ID: got %v", err)
+	}
+}
+
+func TestIdentityKey_Encoding(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	legacy, _ := identityKey(&config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true}, "alice@example.com", "")
+
+	cases := []struct {
+		format string
+		length int
+		want   string // Characters allowed
+		size   int
+	}{
+		{utils.HashFormatHex, 0, "0123456789abcdef", 32},
+		{utils.HashFormatHex, 64, "0123456789abcdef", 64},
+		{utils.HashFormatHex, 500, "0123456789abcdef", 64}, // Capped at the digest
+		{utils.HashFormatBase64URL, 0, "", 22},
+		{utils.HashFormatBase64URL, 16, "", 16},
+		{utils.HashFormatNumeric, 20, "0123456789", 20},
+		{utils.HashFormatNumeric, 8, "0123456789", 8},
+	}
+	for _, c := range cases {
+		cfg := &config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true, EmailEncryptionFormat: c.format, EmailEncryptionLength: c.length}
+		got, _ := identityKey(cfg, "alice@example.com", "")
+		if len(got) != c.size || (c.want != "" && strings.Trim(got, c.want) != "") {
+			t.Errorf("%s/%d: expected %d characters from %q, got %s", c.format, c.length, c.size, c.want, got)
+		}
+		if again, _ := identityKey(cfg, "Alice@Example.com", ""); again != got {
+			t.Errorf("%s/%d: expected a deterministic hash, got %s vs %s", c.format, c.length, got, again)
+		}
+	}
+
+	// Hex output only grows: shorter lengths are prefixes of the legacy hash
+	cfg := &config.Config{EmailEncryptionKey: key, EmailEncryptionEnabled: true, EmailEncryptionFormat: utils.HashFormatHex, EmailEncryptionLength: 64}
+	if full, _ := identityKey(cfg, "alice@example.com", ""); !strings.HasPrefix(full, legacy) {
+		t.Errorf("Expected %s to extend the legacy hash %s", full, legacy)
+	}
+
+	// Algorithm prefixes are not counted
+	cfg.EmailEncryptionAlgo, cfg.EmailEncryptionKey = utils.HashSipHash, key[:utils.SipHashKeySize]
+	cfg.EmailEncryptionFormat, cfg.EmailEncryptionLength = utils.HashFormatNumeric, 12
+	if got, _ := identityKey(cfg, "alice@example.com", ""); len(got) != len("siphash:")+12 {
+		t.Errorf("Expected siphash: and 12 digits, got %s", got)
+	}
+}
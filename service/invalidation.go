@@ -0,0 +1,141 @@
+package service
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+	"apigate-proxy/utils"
+)
+
+// overridePrefix holds the decisions pushed with Invalidate, under
+// "override/<type>/<key>", so a restart does not bring back the decisions
+// they replaced with a persisted or warm start snapshot.
+const overridePrefix = "override/"
+
+// invalidationRetry is how long to wait before resubscribing to
+// INVALIDATION_CHANNEL after the subscription broke.
+const invalidationRetry = 5 * time.Second
+
+// Invalidate applies decision changes pushed by the upstream
+// (POST /admin/invalidate) at once instead of at the next window swap, and
+// shares them with gossip peers. It returns how many were applied.
+func (s *ProxyService) Invalidate(items []models.BatchAllowResponseItem) int {
+	n := s.applyInvalidation(items)
+	s.saveOverrides(items)
+	for _, item := range items {
+		if item.Key != "" {
+			s.gossip.publish(item)
+		}
+	}
+	return n
+}
+
+// applyInvalidation replaces the cached decisions of items in the windows
+// owning their types. A prefetched cache waiting for the swap is updated too,
+// so the change is not undone by it; a prefetch still in flight may overtake
+// the change with the upstream's answer.
+func (s *ProxyService) applyInvalidation(items []models.BatchAllowResponseItem) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for _, item := range items {
+		if item.Key == "" {
+			continue
+		}
+		if item.Type == models.KeyTypeIP {
+			if ip, ok := utils.NormalizeIP(item.Key); ok {
+				item.Key = ip
+			}
+		}
+		s.cacheFor(item.Type).put(item)
+		if pending := s.pendingFor(item.Type); pending != nil {
+			pending.put(item)
+		}
+		s.reasons.note(item)
+		s.labels.note(item)
+		s.ttls.note(item, now)
+		n++
+	}
+	if n > 0 {
+		// Responses combined from the old decisions must not be served again
+		s.tuples.invalidate()
+		s.memo.clear()
+		atomic.AddInt64(&s.invalidations, int64(n))
+	}
+	return n
+}
+
+// subscribeInvalidations applies the changes the upstream publishes on
+// INVALIDATION_CHANNEL, a Redis channel on the STORAGE_BACKEND server. Every
+// instance subscribes, so changes received there are not gossiped.
+func (s *ProxyService) subscribeInvalidations() {
+	channel := s.config.InvalidationChannel
+	if channel == "" {
+		return
+	}
+	sub, ok := s.store.(storage.Subscriber)
+	if !ok {
+		logFor(componentProxy).Warn("ignoring INVALIDATION_CHANNEL: requires STORAGE_BACKEND=redis")
+		return
+	}
+	s.goWorker(func() {
+		for {
+			err := sub.Subscribe(s.done, channel, func(msg []byte) {
+				var req models.InvalidationRequest
+				if err := json.Unmarshal(msg, &req); err != nil {
+					logFor(componentProxy).Warn("ignoring malformed invalidation", "error", err)
+					return
+				}
+				s.applyInvalidation(req.Decisions)
+			})
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			logFor(componentProxy).Error("invalidation subscription lost, retrying", "channel", channel, "retry_in", invalidationRetry, "error", err)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(invalidationRetry):
+			}
+		}
+	})
+}
+
+// saveOverrides stores items until two of the longest windows have passed, by
+// when a prefetch has brought the upstream's own answer for them.
+func (s *ProxyService) saveOverrides(items []models.BatchAllowResponseItem) {
+	ttl := s.windowDuration()
+	for _, w := range s.typed {
+		ttl = max(ttl, w.window)
+	}
+	for _, item := range items {
+		if item.Key == "" {
+			continue
+		}
+		data, _ := json.Marshal(item)
+		if err := s.store.Set(overridePrefix+item.Type+"/"+item.Key, data, 2*ttl); err != nil {
+			logFor(componentProxy).Error("error storing decision override", "error", err)
+			return
+		}
+	}
+}
+
+// scanOverrides calls visit with every stored override.
+func (s *ProxyService) scanOverrides(visit func(models.BatchAllowResponseItem)) {
+	err := s.store.Scan(overridePrefix, func(_ string, value []byte) bool {
+		var item models.BatchAllowResponseItem
+		if json.Unmarshal(value, &item) == nil {
+			visit(item)
+		}
+		return true
+	})
+	if err != nil {
+		logFor(componentProxy).Error("error reading decision overrides", "error", err)
+	}
+}
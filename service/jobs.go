@@ -0,0 +1,209 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+)
+
+// Encrypt job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// encryptJobQueue bounds jobs waiting for a worker; submissions beyond it
+// fail with ErrJobQueueFull.
+const encryptJobQueue = 64
+
+// EncryptedEmail is one result of an encrypt batch, as returned by
+// GET /api/encrypt-email.
+type EncryptedEmail struct {
+	Email        string `json:"email"`
+	Encrypted    string `json:"encrypted"`
+	IdentityType string `json:"identity_type"`
+}
+
+// EncryptJob is an encrypt batch processed in the background. Results are
+// only set once the job is done.
+type EncryptJob struct {
+	ID         string           `json:"id"`
+	Status     string           `json:"status"`
+	Total      int              `json:"total"`
+	Processed  int              `json:"processed"`
+	CreatedAt  time.Time        `json:"created_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Results    []EncryptedEmail `json:"results,omitempty"`
+
+	emails       []string
+	identityType string
+}
+
+// encryptJobs runs encrypt batches above ENCRYPT_ASYNC_THRESHOLD on a pool
+// of ENCRYPT_JOB_WORKERS goroutines, started on first use, and keeps
+// finished jobs for ENCRYPT_JOB_TTL_SECONDS. Jobs live in memory, so they
+// are only known to the instance that accepted them.
+type encryptJobs struct {
+	workers int
+	ttl     time.Duration
+	queue   chan *EncryptJob
+	start   sync.Once
+	running sync.WaitGroup
+
+	mu     sync.Mutex
+	jobs   map[string]*EncryptJob
+	closed bool // queue is closed; guarded by mu
+}
+
+func newEncryptJobs(cfg *config.Config) *encryptJobs {
+	return &encryptJobs{
+		workers: max(cfg.EncryptJobWorkers, 1),
+		ttl:     time.Duration(cfg.EncryptJobTTLSeconds) * time.Second,
+		queue:   make(chan *EncryptJob, encryptJobQueue),
+		jobs:    make(map[string]*EncryptJob),
+	}
+}
+
+func (j *encryptJobs) submit(emails []string, identityType string, encrypt func(string, string) EncryptedEmail) (EncryptJob, error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	job := &EncryptJob{
+		ID:           hex.EncodeToString(b),
+		Status:       JobQueued,
+		Total:        len(emails),
+		CreatedAt:    time.Now(),
+		emails:       emails,
+		identityType: identityType,
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return EncryptJob{}, ErrJobQueueFull
+	}
+	// Under j.mu, so stop never waits while workers are being added
+	j.start.Do(func() {
+		j.running.Add(j.workers)
+		for i := 0; i < j.workers; i++ {
+			go j.work(encrypt)
+		}
+	})
+	select {
+	case j.queue <- job:
+	default:
+		return EncryptJob{}, ErrJobQueueFull
+	}
+	j.jobs[job.ID] = job
+	return j.snapshot(job), nil
+}
+
+// jobProgressEvery is how many emails a worker encrypts between progress updates.
+const jobProgressEvery = 1000
+
+func (j *encryptJobs) work(encrypt func(string, string) EncryptedEmail) {
+	defer j.running.Done()
+	for job := range j.queue {
+		j.mu.Lock()
+		if j.closed {
+			// Stopping: jobs still queued are dropped with the instance
+			j.mu.Unlock()
+			continue
+		}
+		job.Status = JobRunning
+		j.mu.Unlock()
+
+		results := make([]EncryptedEmail, len(job.emails))
+		for i, email := range job.emails {
+			results[i] = encrypt(email, job.identityType)
+			if (i+1)%jobProgressEvery == 0 {
+				j.mu.Lock()
+				job.Processed = i + 1
+				j.mu.Unlock()
+			}
+		}
+
+		now := time.Now()
+		j.mu.Lock()
+		job.Status, job.Processed, job.FinishedAt = JobDone, len(results), &now
+		job.Results, job.emails = results, nil
+		j.mu.Unlock()
+		logFor(componentProxy).Info("encrypt job done", "job_id", job.ID, "batch_size", len(results), "duration", now.Sub(job.CreatedAt).Round(time.Millisecond))
+	}
+}
+
+// stop closes the queue and waits for the jobs running to finish. Jobs still
+// queued are not started, and later submissions fail.
+func (j *encryptJobs) stop() {
+	j.mu.Lock()
+	if !j.closed {
+		j.closed = true
+		close(j.queue)
+	}
+	j.mu.Unlock()
+	j.running.Wait()
+}
+
+func (j *encryptJobs) get(id string) (EncryptJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return EncryptJob{}, false
+	}
+	return j.snapshot(job), true
+}
+
+// snapshot copies job for callers. Callers hold j.mu.
+func (j *encryptJobs) snapshot(job *EncryptJob) EncryptJob {
+	c := *job
+	c.emails = nil
+	return c
+}
+
+// sweep drops finished jobs older than the TTL.
+func (j *encryptJobs) sweep() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for id, job := range j.jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > j.ttl {
+			delete(j.jobs, id)
+		}
+	}
+}
+
+// EncryptEmails returns the identity keys of emails, as IdentityKey would.
+func (s *ProxyService) EncryptEmails(emails []string, identityType string) []EncryptedEmail {
+	results := make([]EncryptedEmail, len(emails))
+	for i, email := range emails {
+		results[i] = s.encryptedEmail(email, identityType)
+	}
+	return results
+}
+
+// EncryptAsync reports whether a batch of n emails should be submitted as a
+// job rather than encrypted in the request (ENCRYPT_ASYNC_THRESHOLD).
+func (s *ProxyService) EncryptAsync(n int) bool {
+	return n > s.config.EncryptAsyncThreshold
+}
+
+// SubmitEncryptJob queues emails for encryption in the background and
+// returns the job, whose progress and results are read with EncryptJob.
+// It fails with ErrJobQueueFull when too many jobs are waiting or the
+// service is stopping.
+func (s *ProxyService) SubmitEncryptJob(emails []string, identityType string) (EncryptJob, error) {
+	return s.jobs.submit(emails, identityType, s.encryptedEmail)
+}
+
+// EncryptJob returns the current state of a submitted job. found is false
+// for unknown IDs and for jobs past ENCRYPT_JOB_TTL_SECONDS.
+func (s *ProxyService) EncryptJob(id string) (job EncryptJob, found bool) {
+	return s.jobs.get(id)
+}
+
+func (s *ProxyService) encryptedEmail(email, identityType string) EncryptedEmail {
+	encrypted, resolved := s.IdentityKey(email, identityType)
+	return EncryptedEmail{Email: email, Encrypted: encrypted, IdentityType: resolved}
+}
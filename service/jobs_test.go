@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"apigate-proxy/config"
+)
+
+func TestProxyService_EncryptJobs(t *testing.T) {
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:        "http://127.0.0.1:0",
+		EmailEncryptionKey:     "0123456789abcdef0123456789abcdef",
+		EmailEncryptionEnabled: true,
+		EncryptAsyncThreshold:  2,
+		EncryptJobWorkers:      2,
+		EncryptJobTTLSeconds:   60,
+	}, nil, nil)
+	if svc.EncryptAsync(2) || !svc.EncryptAsync(3) {
+		t.Fatal("Expected only batches above the threshold to run as jobs")
+	}
+
+	emails := make([]string, 2500)
+	for i := range emails {
+		emails[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+	job, err := svc.SubmitEncryptJob(emails, "")
+	if err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if job.ID == "" || job.Total != len(emails) {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status != JobDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("Job did not finish: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		job, _ = svc.EncryptJob(job.ID)
+	}
+	if job.Processed != len(emails) || len(job.Results) != len(emails) || job.FinishedAt == nil {
+		t.Fatalf("Expected all emails processed, got %d/%d", job.Processed, len(job.Results))
+	}
+	want := svc.EncryptEmails(emails[:1], "")[0]
+	if job.Results[0] != want {
+		t.Errorf("Expected job results to match sync encryption, got %+v vs %+v", job.Results[0], want)
+	}
+
+	if _, found := svc.EncryptJob("missing"); found {
+		t.Error("Unknown job IDs should not be found")
+	}
+	svc.jobs.ttl = 0
+	svc.jobs.sweep()
+	if _, found := svc.EncryptJob(job.ID); found {
+		t.Error("Finished jobs past the TTL should be swept")
+	}
+}
+
+func TestProxyService_StopEncryptJobs(t *testing.T) {
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:   "http://127.0.0.1:0",
+		EncryptJobWorkers: 1,
+	}, nil, nil)
+	emails := make([]string, 5000)
+	for i := range emails {
+		emails[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+	var jobs []EncryptJob
+	for i := 0; i < 3; i++ {
+		job, err := svc.SubmitEncryptJob(emails, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.Stop(ctx); err != nil {
+		t.Fatalf("Expected Stop to wait for the workers, got %v", err)
+	}
+	// Stop returned once no job was running: each is done or was dropped
+	for _, job := range jobs {
+		if got, _ := svc.EncryptJob(job.ID); got.Status == JobRunning {
+			t.Errorf("Expected no job running after Stop, got %+v", got)
+		}
+	}
+	if _, err := svc.SubmitEncryptJob(emails, ""); !errors.Is(err, ErrJobQueueFull) {
+		t.Errorf("Expected submissions refused after Stop, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// batchShards is the number of independently locked parts of a keyBatch.
+const batchShards = 64
+
+// keyBatch collects the keys requested in a window, with request counts, for
+// the window's prefetch. Every request adds its keys, so the set is split
+// into shards by key hash, each with its own lock, instead of living under
+// ProxyService.mu: concurrent requests only contend when their keys share a
+// shard, and never block cache lookups. MAX_KEYS_PER_WINDOW is enforced over
+// all shards with an atomic count.
+type keyBatch struct {
+	limit    int64 // 0 = unlimited
+	size     atomic.Int64
+	overflow atomic.Int64 // Keys refused since the last drain
+	shards   [batchShards]batchShard
+}
+
+type batchShard struct {
+	mu   sync.Mutex
+	keys map[string]int
+}
+
+func newKeyBatch(limit int) *keyBatch {
+	b := &keyBatch{limit: int64(limit)}
+	for i := range b.shards {
+		b.shards[i].keys = make(map[string]int)
+	}
+	return b
+}
+
+func (b *keyBatch) shard(key string) *batchShard {
+	return &b.shards[xxhash.Sum64String(key)%batchShards]
+}
+
+// add counts a request for key. It returns false when key is new and the
+// batch is full, in which case the key is not tracked.
+func (b *keyBatch) add(key string) bool {
+	sh := b.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.keys[key]; ok {
+		sh.keys[key]++
+		return true
+	}
+	if n := b.size.Add(1); b.limit > 0 && n > b.limit {
+		b.size.Add(-1)
+		b.overflow.Add(1)
+		return false
+	}
+	sh.keys[key] = 1
+	return true
+}
+
+func (b *keyBatch) has(key string) bool {
+	sh := b.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	_, ok := sh.keys[key]
+	return ok
+}
+
+func (b *keyBatch) len() int {
+	return int(b.size.Load())
+}
+
+// drain empties the batch and returns its keys with their request counts,
+// and how many keys were refused since the last drain. Keys added while it
+// runs land either in the result or in the next window's batch.
+func (b *keyBatch) drain() (map[string]int, int) {
+	keys := make(map[string]int, b.len())
+	for i := range b.shards {
+		sh := &b.shards[i]
+		sh.mu.Lock()
+		taken := sh.keys
+		sh.keys = make(map[string]int)
+		b.size.Add(-int64(len(taken)))
+		sh.mu.Unlock()
+		for k, n := range taken {
+			keys[k] = n
+		}
+	}
+	return keys, int(b.overflow.Swap(0))
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestKeyBatch_Concurrent(t *testing.T) {
+	b := newKeyBatch(100)
+	b.add("shared")
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				b.add("shared")
+				b.add(fmt.Sprintf("key-%d-%d", g, i))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// 400 distinct keys compete for the 99 slots "shared" left
+	if b.len() != 100 {
+		t.Errorf("Expected the cap to hold across shards, got %d keys", b.len())
+	}
+	keys, overflow := b.drain()
+	if len(keys) != 100 || overflow != 301 {
+		t.Errorf("Expected 100 keys and 301 refused, got %d and %d", len(keys), overflow)
+	}
+	if keys["shared"] != 401 {
+		t.Errorf("Expected every request for a tracked key counted, got %d", keys["shared"])
+	}
+	if b.len() != 0 || b.has("shared") {
+		t.Error("Drain should empty the batch")
+	}
+	if !b.add("next") || b.len() != 1 {
+		t.Error("A drained batch should accept keys for the next window")
+	}
+}
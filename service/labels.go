@@ -0,0 +1,87 @@
+package service
+
+import (
+	"slices"
+	"sync"
+
+	"apigate-proxy/models"
+)
+
+// maxKeyLabels bounds the label table; once full, labels of further keys are
+// not remembered.
+const maxKeyLabels = 100000
+
+// keyLabels remembers the metadata labels the upstream returned with each
+// key's decision (e.g. "disposable_email"). Labels never affect decisions;
+// they enrich log records and debug records for the identities they belong
+// to. Like blockReasons, they live beside the caches, keyed by cache key, and
+// are pruned at each default-window swap.
+type keyLabels struct {
+	mu sync.RWMutex
+	m  map[string][]string
+}
+
+func newKeyLabels() *keyLabels {
+	return &keyLabels{m: make(map[string][]string)}
+}
+
+func (l *keyLabels) note(item models.BatchAllowResponseItem) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(item.Labels) == 0 {
+		delete(l.m, item.Key)
+		return
+	}
+	if _, ok := l.m[item.Key]; ok || len(l.m) < maxKeyLabels {
+		l.m[item.Key] = item.Labels
+	}
+}
+
+func (l *keyLabels) get(key string) []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.m[key]
+}
+
+// prune drops labels of keys no longer cached.
+func (l *keyLabels) prune(cached func(key string) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k := range l.m {
+		if !cached(k) {
+			delete(l.m, k)
+		}
+	}
+}
+
+// Labels returns the sorted union of the upstream labels cached for keys,
+// or nil when none has any.
+func (s *ProxyService) Labels(keys ...string) []string {
+	var out []string
+	for _, k := range keys {
+		out = append(out, s.labels.get(k)...)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// recordLabels returns the labels cached for a log record's keys.
+func (s *ProxyService) recordLabels(req models.LogRequest) []string {
+	keys := requestKeys(s.config, models.AllowRequest{
+		IPAddress:             req.IPAddress,
+		Email:                 req.Email,
+		IdentityType:          req.IdentityType,
+		UserAgent:             req.UserAgent,
+		ClientCertFingerprint: req.ClientCertFingerprint,
+		JA3:                   req.JA3,
+		RequestFingerprint:    req.RequestFingerprint,
+	})
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = k.Value
+	}
+	return s.Labels(values...)
+}
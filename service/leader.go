@@ -0,0 +1,235 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+// Keys of the prefetch leader's state in STORAGE_BACKEND.
+const (
+	leaderLeaseKey = "leader/lease"
+	leaderCacheKey = "leader/cache"
+	leaderKeysKey  = "leader/keys/" // + instance ID
+)
+
+// errNoLeaderCache means no leader published a cache recently enough to use.
+var errNoLeaderCache = errors.New("no recent leader cache")
+
+// prefetchLeader elects one instance among those sharing STORAGE_BACKEND to
+// prefetch the default window (LEADER_ELECTION). The lease is taken or renewed
+// at each prefetch; the holder fetches the keys tracked by every instance and
+// publishes its cache after each swap, and the others load that cache as
+// their next window instead of calling the upstream. Instances whose leader
+// published nothing within the last window, or that cannot reach the storage,
+// prefetch on their own, so losing the leader costs upstream calls, never
+// decisions. Per-type windows are prefetched by every instance.
+type prefetchLeader struct {
+	id     string
+	store  storage.Storage
+	locker storage.Locker
+	lease  time.Duration
+	window time.Duration
+
+	leading atomic.Bool
+	shared  atomic.Int64
+	local   atomic.Int64
+}
+
+// LeaderStats describes this instance's part in prefetch leader election.
+type LeaderStats struct {
+	ID      string `json:"id"`
+	Leading bool   `json:"leading"`
+	Shared  int64  `json:"shared"` // Windows loaded from the leader's cache
+	Local   int64  `json:"local"`  // Windows prefetched by this instance while following
+}
+
+func newPrefetchLeader(cfg *config.Config, st storage.Storage, window time.Duration) *prefetchLeader {
+	if !cfg.LeaderElection {
+		return nil
+	}
+	locker, ok := st.(storage.Locker)
+	if !ok {
+		logFor(componentProxy).Warn("leader election disabled: STORAGE_BACKEND cannot hold leases", "backend", cfg.StorageBackend)
+		return nil
+	}
+	if b := strings.ToLower(cfg.StorageBackend); b != "redis" {
+		logFor(componentProxy).Warn("leader election over this STORAGE_BACKEND is only shared within this process", "backend", b)
+	}
+	lease := time.Duration(cfg.LeaderLeaseSecs) * time.Second
+	if lease <= 0 {
+		lease = 2 * window
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	host, _ := os.Hostname()
+	return &prefetchLeader{
+		id:     host + "-" + hex.EncodeToString(suffix),
+		store:  st,
+		locker: locker,
+		lease:  lease,
+		window: window,
+	}
+}
+
+// elect takes or renews the lease, reporting whether this instance should
+// prefetch itself. When the storage is unreachable every instance does.
+func (l *prefetchLeader) elect() bool {
+	ok, err := l.locker.Acquire(leaderLeaseKey, l.id, l.lease)
+	if err != nil {
+		logFor(componentProxy).Error("error renewing prefetch leader lease, prefetching locally", "error", err)
+		ok = false
+	}
+	if was := l.leading.Swap(ok); was != ok {
+		if ok {
+			logFor(componentProxy).Info("elected prefetch leader", "instance", l.id)
+		} else if err == nil {
+			logFor(componentProxy).Info("following the prefetch leader", "instance", l.id)
+		}
+	}
+	return ok || err != nil
+}
+
+// shareKeys publishes the keys this follower tracked for the leader to fetch.
+func (l *prefetchLeader) shareKeys(batched map[string]int) {
+	data, _ := json.Marshal(batched)
+	if err := l.store.Set(leaderKeysKey+l.id, data, 2*l.window); err != nil {
+		logFor(componentProxy).Error("error sharing tracked keys with the prefetch leader", "batch_size", len(batched), "error", err)
+	}
+}
+
+// mergeKeys adds the keys the followers tracked to batched.
+func (l *prefetchLeader) mergeKeys(batched map[string]int) {
+	err := l.store.Scan(leaderKeysKey, func(key string, value []byte) bool {
+		if key == leaderKeysKey+l.id {
+			return true
+		}
+		var keys map[string]int
+		if json.Unmarshal(value, &keys) != nil {
+			return true
+		}
+		for k, n := range keys {
+			batched[k] += n
+		}
+		return true
+	})
+	if err != nil {
+		logFor(componentProxy).Error("error reading keys tracked by followers", "error", err)
+	}
+}
+
+// publish shares the leader's cache until the followers' next prefetch, at
+// most a window later.
+func (l *prefetchLeader) publish(snap persistedSnapshot, keyDerivation string) {
+	data, _ := json.Marshal(snap)
+	data = storage.Seal(storage.KindLeaderCache, keyDerivation, data)
+	if err := l.store.Set(leaderCacheKey, data, l.window+5*time.Second); err != nil {
+		logFor(componentProxy).Error("error publishing the prefetch leader's cache", "error", err)
+	}
+}
+
+// load reads the cache the leader published last.
+func (l *prefetchLeader) load(keyDerivation string) (persistedSnapshot, error) {
+	var snap persistedSnapshot
+	data, ok, err := l.store.Get(leaderCacheKey)
+	if err != nil {
+		return snap, err
+	}
+	if !ok {
+		return snap, errNoLeaderCache
+	}
+	h, payload, err := storage.Unseal(data, storage.KindLeaderCache)
+	if err != nil {
+		return snap, err
+	}
+	if h.KeyDerivation != keyDerivation {
+		return snap, errKeyDerivationChanged
+	}
+	err = json.Unmarshal(payload, &snap)
+	return snap, err
+}
+
+func (l *prefetchLeader) stats() *LeaderStats {
+	if l == nil {
+		return nil
+	}
+	return &LeaderStats{ID: l.id, Leading: l.leading.Load(), Shared: l.shared.Load(), Local: l.local.Load()}
+}
+
+// prefetchClustered prefetches the default window under LEADER_ELECTION:
+// the leader fetches the keys of all instances, followers load its cache.
+func (s *ProxyService) prefetchClustered(batched map[string]int) {
+	if s.leader.elect() {
+		if s.leader.leading.Load() {
+			s.leader.mergeKeys(batched)
+		}
+		s.prefetchKeys(batched)
+		return
+	}
+	s.leader.shareKeys(batched)
+	if err := s.followLeader(); err != nil {
+		logFor(componentProxy).Warn("prefetching locally, leader cache unusable", "window", "default", "error", err)
+		s.leader.local.Add(1)
+		s.prefetchKeys(batched)
+		return
+	}
+	s.leader.shared.Add(1)
+}
+
+// followLeader makes the leader's published cache the default window's next
+// cache.
+func (s *ProxyService) followLeader() error {
+	snap, err := s.leader.load(keyDerivation(s.config))
+	if err != nil {
+		return err
+	}
+	cache := newDecisionCache()
+	for _, item := range snap.Decisions {
+		cache.put(item)
+		s.reasons.note(item)
+		s.labels.note(item)
+		s.ttls.note(item, snap.SavedAt)
+	}
+	atomic.StoreInt64(&s.lastBatchSize, int64(cache.len()))
+	logFor(componentProxy).Info("loaded decisions from the prefetch leader for next window", "window", "default", "batch_size", cache.len())
+
+	s.mu.Lock()
+	s.storePending(snap.Version)(cache)
+	s.mu.Unlock()
+	return nil
+}
+
+// publishLeaderCache shares the default window's cache, just swapped in, with
+// the followers. A cache kept stale is not shared, so followers fall back to
+// their own prefetch as the leader did not manage one.
+func (s *ProxyService) publishLeaderCache() {
+	if s.leader == nil || !s.leader.leading.Load() {
+		return
+	}
+	s.mu.RLock()
+	if s.stale {
+		s.mu.RUnlock()
+		return
+	}
+	snap := persistedSnapshot{SavedAt: s.freshAt, Version: s.currentVersion}
+	s.current.Load().each(func(k string, allow bool) bool {
+		snap.Decisions = append(snap.Decisions, models.BatchAllowResponseItem{
+			Key:    k,
+			Allow:  allow,
+			Reason: s.reasons.get(k),
+			Labels: s.labels.get(k),
+		})
+		return true
+	})
+	s.mu.RUnlock()
+	s.leader.publish(snap, keyDerivation(s.config))
+}
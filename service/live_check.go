@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"apigate-proxy/models"
+)
+
+// liveGroup coalesces concurrent live checks for the same key set into one
+// upstream call. The call carries the values and deadline of the request
+// that started it, but is canceled only once every request waiting for it
+// has gone: one client disconnecting must not fail the others.
+type liveGroup struct {
+	mu    sync.Mutex
+	calls map[string]*liveCall
+}
+
+// liveCall is an upstream call shared by the requests waiting for it. Its
+// results may be read once done is closed.
+type liveCall struct {
+	done    chan struct{}
+	items   []models.BatchAllowResponseItem
+	err     error
+	shared  bool // Joined by more than one request
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// join waits on the call in flight for key, starting one with fetch if there
+// is none. Every join must be matched by a leave.
+func (g *liveGroup) join(ctx context.Context, key string, fetch func(context.Context) ([]models.BatchAllowResponseItem, error)) *liveCall {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		c.shared = true
+		return c
+	}
+
+	callCtx := context.WithoutCancel(ctx)
+	var cancel context.CancelFunc
+	if deadline, ok := ctx.Deadline(); ok {
+		callCtx, cancel = context.WithDeadline(callCtx, deadline)
+	} else {
+		callCtx, cancel = context.WithCancel(callCtx)
+	}
+	c := &liveCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	if g.calls == nil {
+		g.calls = make(map[string]*liveCall)
+	}
+	g.calls[key] = c
+	go func() {
+		c.items, c.err = fetch(callCtx)
+		cancel()
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	return c
+}
+
+// leave stops waiting on c, canceling it when no request waits any longer.
+func (g *liveGroup) leave(c *liveCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c.waiters--; c.waiters == 0 {
+		c.cancel()
+	}
+}
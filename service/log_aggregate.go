@@ -0,0 +1,127 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// logAggregator rolls up repeated identical events (same IP, identity,
+// endpoint, response code and event type) into one record with a count per
+// flush interval, for the event types in LOG_AGGREGATE_EVENT_TYPES. Blocked
+// and security events (401, 403 and 429 responses, and the types in
+// LOG_RAW_EVENT_TYPES) are always sent raw, so attack reports keep every
+// occurrence. It is guarded by LoggerService.mu.
+type logAggregator struct {
+	all   bool
+	types map[string]bool
+	raw   map[string]bool
+
+	records map[string]int // Roll-up key -> index in pending
+	pending []models.LogRequest
+}
+
+func newLogAggregator(cfg *config.Config) *logAggregator {
+	if len(cfg.LogAggregateEventTypes) == 0 {
+		return nil
+	}
+	a := &logAggregator{types: make(map[string]bool), raw: make(map[string]bool), records: make(map[string]int)}
+	for _, t := range cfg.LogAggregateEventTypes {
+		if t == "*" {
+			a.all = true
+		}
+		a.types[t] = true
+	}
+	for _, t := range cfg.LogRawEventTypes {
+		a.raw[t] = true
+	}
+	return a
+}
+
+// eligible reports whether req may be rolled up.
+func (a *logAggregator) eligible(req models.LogRequest) bool {
+	if a == nil || a.raw[req.EventType] {
+		return false
+	}
+	switch req.ResponseCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return a.all || a.types[req.EventType]
+}
+
+func aggregateKey(req models.LogRequest) string {
+	return strings.Join([]string{req.IPAddress, req.Email, req.Endpoint, strconv.Itoa(req.ResponseCode), req.EventType}, "\x00")
+}
+
+// fold counts req into its roll-up, reporting false when there is none yet.
+func (a *logAggregator) fold(req models.LogRequest) bool {
+	i, ok := a.records[aggregateKey(req)]
+	if ok {
+		a.pending[i].Count++
+	}
+	return ok
+}
+
+// add starts a roll-up for req, or folds it into one started concurrently
+// (reporting false).
+func (a *logAggregator) add(req models.LogRequest) bool {
+	if a.fold(req) {
+		return false
+	}
+	req.Count = 1
+	a.records[aggregateKey(req)] = len(a.pending)
+	a.pending = append(a.pending, req)
+	return true
+}
+
+// drain returns the roll-ups of the interval and starts a new one.
+func (a *logAggregator) drain() []models.LogRequest {
+	if a == nil || len(a.pending) == 0 {
+		return nil
+	}
+	out := a.pending
+	a.pending = nil
+	a.records = make(map[string]int)
+	return out
+}
+
+// aggregate rolls req up if it is eligible, reporting whether it was taken.
+// The first event of a roll-up claims buffer space like a raw record; the
+// ones folded into it take none.
+func (s *LoggerService) aggregate(req models.LogRequest) bool {
+	if !s.agg.eligible(req) {
+		return false
+	}
+	s.mu.Lock()
+	folded := s.agg.fold(req)
+	s.mu.Unlock()
+	if folded {
+		atomic.AddInt64(&s.aggregated, 1)
+		return true
+	}
+
+	if !s.reserve() {
+		s.overflow(req)
+		return true
+	}
+	s.mu.Lock()
+	started := s.agg.add(req)
+	s.mu.Unlock()
+	if !started {
+		s.release(1)
+		atomic.AddInt64(&s.aggregated, 1)
+	}
+	return true
+}
+
+// flushAggregates moves the interval's roll-ups into the send buffer.
+func (s *LoggerService) flushAggregates() {
+	s.mu.Lock()
+	s.buffer = append(s.buffer, s.agg.drain()...)
+	s.mu.Unlock()
+}
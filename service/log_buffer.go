@@ -0,0 +1,181 @@
+package service
+
+import (
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/models"
+)
+
+// Log buffer overflow policies (LOG_OVERFLOW_POLICY).
+const (
+	OverflowDropOldest = "drop-oldest"
+	OverflowDropNewest = "drop-newest"
+	OverflowBlock      = "block"
+)
+
+// LogStats reports the logger's buffer occupancy and loss.
+type LogStats struct {
+	Buffered int   `json:"buffered"`
+	InFlight int64 `json:"in_flight"`
+	Capacity int   `json:"capacity"` // 0 = unbounded
+	Dropped  int64 `json:"dropped"`
+	Spilled  int64 `json:"spilled"`  // Written to a LOG_SPILL_DIR spool (per sink)
+	Replayed int64 `json:"replayed"` // Delivered from the spool
+
+	DeadLettered int64 `json:"dead_lettered"` // Moved to LOG_DLQ_DIR after exhausting retries
+	Aggregated   int64 `json:"aggregated"`    // Events folded into roll-up records instead of sent raw
+	SampledOut   int64 `json:"sampled_out"`   // Records left out by LOG_SAMPLE_RATES
+}
+
+// reserve claims buffer space for one record according to the overflow
+// policy. It reports false when the record must be dropped. Records claimed
+// here are released by release once their batch has been sent (or failed).
+func (s *LoggerService) reserve() bool {
+	if s.slots == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	switch s.config.LogOverflowPolicy {
+	case OverflowDropNewest:
+		return false
+	case OverflowBlock:
+		timer := time.NewTimer(time.Duration(s.config.LogBlockTimeoutMs) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case s.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+			return false
+		}
+	default: // drop-oldest
+		// Evict the oldest buffered record and take over its slot. When
+		// everything is already in flight there is nothing to evict.
+		s.mu.Lock()
+		if len(s.buffer) == 0 {
+			s.mu.Unlock()
+			return false
+		}
+		evicted := s.buffer[0]
+		s.buffer = s.buffer[1:]
+		s.mu.Unlock()
+		s.overflow(evicted)
+		return true
+	}
+}
+
+// overflow disposes of records that no longer fit in memory: they are spilled
+// to every sink's spool when LOG_SPILL_DIR is set, else dropped.
+func (s *LoggerService) overflow(records ...models.LogRequest) {
+	kept := false
+	for _, r := range s.sinks {
+		if s.spill(r, records) {
+			kept = true
+		}
+	}
+	if !kept {
+		for range records {
+			s.recordDrop()
+		}
+	}
+}
+
+// spill appends records to the sink's spool, reporting whether they were kept.
+func (s *LoggerService) spill(r *sinkRoute, records []models.LogRequest) bool {
+	if r.spool == nil {
+		return false
+	}
+	if err := r.spool.append(records); err != nil {
+		logFor(componentLogger).Error("error spilling log records", "sink", r.sink.Name(), "batch_size", len(records), "error", err)
+		return false
+	}
+	atomic.AddInt64(&s.spilled, int64(len(records)))
+	return true
+}
+
+// replaySpool delivers spilled records once each sink accepts logs again.
+func (s *LoggerService) replaySpool() {
+	for _, r := range s.sinks {
+		if r.spool == nil {
+			continue
+		}
+		n, err := r.spool.replay(s.config.LogBatchSize, r.sink.Send, s.giveUp(r))
+		atomic.AddInt64(&s.replayed, int64(n))
+		if n > 0 {
+			logFor(componentLogger).Info("replayed spilled log records", "sink", r.sink.Name(), "batch_size", n)
+		}
+		if err != nil {
+			logFor(componentLogger).Warn("spool replay paused", "sink", r.sink.Name(), "error", err)
+		}
+	}
+}
+
+// giveUp returns the spool replay hook that dead-letters a segment once it
+// has failed LOG_MAX_ATTEMPTS times, or nil when there is no DLQ.
+func (s *LoggerService) giveUp(r *sinkRoute) func([]models.LogRequest, int, error) bool {
+	if s.dlq == nil || s.config.LogMaxAttempts <= 0 {
+		return nil
+	}
+	return func(records []models.LogRequest, attempts int, err error) bool {
+		if attempts < s.config.LogMaxAttempts {
+			return false
+		}
+		return s.deadLetter(r, records, attempts, err)
+	}
+}
+
+// deadLetter moves records sink failed to accept into the DLQ, reporting
+// whether they were kept.
+func (s *LoggerService) deadLetter(r *sinkRoute, records []models.LogRequest, attempts int, cause error) bool {
+	if s.dlq == nil {
+		return false
+	}
+	if err := s.dlq.put(r.sink.Name(), records, attempts, cause); err != nil {
+		logFor(componentLogger).Error("error dead-lettering log records", "sink", r.sink.Name(), "batch_size", len(records), "error", err)
+		return false
+	}
+	atomic.AddInt64(&s.deadLettered, int64(len(records)))
+	logFor(componentLogger).Warn("dead-lettered log records", "sink", r.sink.Name(), "batch_size", len(records), "attempts", attempts, "error", cause)
+	return true
+}
+
+func (s *LoggerService) release(n int) {
+	if s.slots == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		<-s.slots
+	}
+}
+
+func (s *LoggerService) recordDrop() {
+	atomic.AddInt64(&s.dropped, 1)
+	atomic.AddInt64(&s.recentDrops, 1)
+}
+
+// Stats returns the current buffer occupancy and the total records dropped.
+func (s *LoggerService) Stats() LogStats {
+	s.mu.Lock()
+	buffered := len(s.buffer)
+	if s.agg != nil {
+		buffered += len(s.agg.pending)
+	}
+	s.mu.Unlock()
+	return LogStats{
+		Buffered: buffered,
+		InFlight: atomic.LoadInt64(&s.inFlight),
+		Capacity: cap(s.slots),
+		Dropped:  atomic.LoadInt64(&s.dropped),
+		Spilled:  atomic.LoadInt64(&s.spilled),
+		Replayed: atomic.LoadInt64(&s.replayed),
+
+		DeadLettered: atomic.LoadInt64(&s.deadLettered),
+		Aggregated:   atomic.LoadInt64(&s.aggregated),
+		SampledOut:   atomic.LoadInt64(&s.sampledOut),
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+func TestLoggerService_OverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{OverflowDropOldest, []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+		{OverflowDropNewest, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2"}},
+		{OverflowBlock, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			svc := NewLoggerService(&config.Config{
+				UpstreamBaseURL:   "http://127.0.0.1:0",
+				LogBatchSize:      100,
+				LogMaxBuffer:      3,
+				LogOverflowPolicy: tt.policy,
+				LogBlockTimeoutMs: 10,
+			}, nil, nil)
+			for i := 0; i < 5; i++ {
+				svc.QueueLog(models.LogRequest{IPAddress: fmt.Sprintf("10.0.0.%d", i)})
+			}
+
+			if st := svc.Stats(); st.Buffered != 3 || st.Dropped != 2 {
+				t.Fatalf("got %+v", st)
+			}
+			for i, ip := range tt.want {
+				if svc.buffer[i].IPAddress != ip {
+					t.Errorf("buffer[%d] = %s, want %s", i, svc.buffer[i].IPAddress, ip)
+				}
+			}
+		})
+	}
+}
+
+func TestLoggerService_ReleasesAfterSend(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	svc := NewLoggerService(&config.Config{
+		UpstreamBaseURL:   upstream.URL,
+		LogBatchSize:      2,
+		LogMaxBuffer:      2,
+		LogOverflowPolicy: OverflowBlock,
+		LogBlockTimeoutMs: 2000,
+	}, nil, nil)
+
+	// The second record fills the buffer and triggers a flush; the third waits
+	// for that batch to be delivered instead of being dropped.
+	for i := 0; i < 3; i++ {
+		svc.QueueLog(models.LogRequest{IPAddress: fmt.Sprintf("10.0.0.%d", i)})
+	}
+	if st := svc.Stats(); st.Dropped != 0 || st.Buffered != 1 {
+		t.Fatalf("got %+v", st)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for svc.Stats().InFlight != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := svc.Stats(); st.InFlight != 0 {
+		t.Errorf("batch still in flight: %+v", st)
+	}
+}
+
+func TestLoggerService_StopWaitsForSends(t *testing.T) {
+	var received atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []models.LogRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+		time.Sleep(100 * time.Millisecond)
+		received.Add(int32(len(batch)))
+	}))
+	defer upstream.Close()
+
+	svc := NewLoggerService(&config.Config{UpstreamBaseURL: upstream.URL, LogBatchSize: 2}, nil, nil)
+	svc.Start()
+	// The second record starts a send, which Stop must wait for
+	svc.QueueLog(models.LogRequest{IPAddress: "10.0.0.1"})
+	svc.QueueLog(models.LogRequest{IPAddress: "10.0.0.2"})
+	svc.Stop()
+	if n := received.Load(); n != 2 {
+		t.Fatalf("Expected the batch in flight delivered before Stop returned, got %d records", n)
+	}
+
+	// Nothing is sent through the closed sinks afterwards
+	svc.QueueLog(models.LogRequest{IPAddress: "10.0.0.3"})
+	svc.QueueLog(models.LogRequest{IPAddress: "10.0.0.4"})
+	time.Sleep(150 * time.Millisecond)
+	if n := received.Load(); n != 2 {
+		t.Errorf("Expected no sends after Stop, got %d records", n)
+	}
+	svc.Stop()
+}
+
+func TestLoggerService_Aggregation(t *testing.T) {
+	svc := NewLoggerService(&config.Config{
+		UpstreamBaseURL:        "http://127.0.0.1:0",
+		LogBatchSize:           100,
+		LogMaxBuffer:           10,
+		LogAggregateEventTypes: []string{"*"},
+		LogRawEventTypes:       []string{"login"},
+	}, nil, nil)
+	page := models.LogRequest{IPAddress: "10.0.0.1", Endpoint: "/home", EventType: "page_view", ResponseCode: 200}
+	for i := 0; i < 3; i++ {
+		svc.QueueLog(page)
+	}
+	other := page
+	other.ResponseCode = 404
+	svc.QueueLog(other)
+	// Security events are never rolled up
+	for i := 0; i < 2; i++ {
+		svc.QueueLog(models.LogRequest{IPAddress: "10.0.0.1", Endpoint: "/login", EventType: "login", ResponseCode: 200})
+		svc.QueueLog(models.LogRequest{IPAddress: "10.0.0.1", Endpoint: "/admin", EventType: "page_view", ResponseCode: 403})
+	}
+
+	if st := svc.Stats(); st.Buffered != 6 || st.Aggregated != 2 || cap(svc.slots)-len(svc.slots) != 4 {
+		t.Fatalf("got %+v, free slots %d", st, cap(svc.slots)-len(svc.slots))
+	}
+	svc.flushAggregates()
+	var counts []int
+	for _, r := range svc.buffer {
+		counts = append(counts, r.Count)
+	}
+	if fmt.Sprint(counts) != "[0 0 0 0 3 1]" {
+		t.Errorf("Expected raw records then roll-ups with counts, got %v", counts)
+	}
+}
+
+func TestLoggerService_Sampling(t *testing.T) {
+	svc := NewLoggerService(&config.Config{
+		UpstreamBaseURL:  "http://127.0.0.1:0",
+		LogBatchSize:     10000,
+		LogSampleRates:   map[string]float64{"GET": 0.1, "*": 1},
+		LogRawEventTypes: []string{"login"},
+	}, nil, nil)
+	for i := 0; i < 1000; i++ {
+		svc.QueueLog(models.LogRequest{HTTPMethod: "get", Endpoint: "/home", ResponseCode: 200})
+	}
+	// Failures, raw event types and other methods are always kept
+	svc.QueueLog(models.LogRequest{HTTPMethod: "GET", Endpoint: "/admin", ResponseCode: 403})
+	svc.QueueLog(models.LogRequest{HTTPMethod: "GET", Endpoint: "/login", EventType: "login", ResponseCode: 200})
+	svc.QueueLog(models.LogRequest{HTTPMethod: "POST", Endpoint: "/cart", ResponseCode: 200})
+
+	st := svc.Stats()
+	if kept := 1000 - st.SampledOut; kept < 50 || kept > 150 || st.Buffered != int(kept)+3 {
+		t.Fatalf("Expected about 10%% of GETs kept, got %+v", st)
+	}
+	for _, r := range svc.buffer {
+		want := 0.0
+		if r.Endpoint == "/home" {
+			want = 0.1
+		}
+		if r.SampleRate != want {
+			t.Errorf("Expected sample rate %v for %s, got %v", want, r.Endpoint, r.SampleRate)
+		}
+	}
+}
+
+func TestLoggerService_Redaction(t *testing.T) {
+	svc := NewLoggerService(&config.Config{
+		UpstreamBaseURL: "http://127.0.0.1:0",
+		LogBatchSize:    100,
+		LogRedact:       map[string]string{"ip_address": "mask", "username": "hash", "user_agent": "drop"},
+		LogRedactKey:    "redact-key",
+	}, nil, nil)
+	svc.QueueLog(models.LogRequest{IPAddress: "203.0.113.7", Username: "alice", UserAgent: "curl/8.0"})
+	svc.QueueLog(models.LogRequest{IPAddress: "2001:db8:1:2::7", Username: "alice"})
+
+	got := svc.buffer
+	if got[0].IPAddress != "203.0.113.0" || got[1].IPAddress != "2001:db8:1::" {
+		t.Errorf("Expected truncated addresses, got %q and %q", got[0].IPAddress, got[1].IPAddress)
+	}
+	if got[0].Username == "alice" || len(got[0].Username) != 32 || got[0].Username != got[1].Username {
+		t.Errorf("Expected a stable keyed hash of the username, got %q and %q", got[0].Username, got[1].Username)
+	}
+	if got[0].UserAgent != "" {
+		t.Errorf("Expected the user agent dropped, got %q", got[0].UserAgent)
+	}
+
+	// Regions limit redaction to records located there, or nowhere known
+	r := newLogRedactor(&config.Config{LogRedact: map[string]string{"ip_address": "mask"}, LogRedactRegions: []string{"EU"}})
+	for _, tc := range []struct {
+		country, continent, want string
+	}{
+		{"DE", "EU", "198.51.100.0"},
+		{"US", "NA", "198.51.100.9"},
+		{"", "", "198.51.100.0"},
+	} {
+		req := models.LogRequest{IPAddress: "198.51.100.9", Country: tc.country, Continent: tc.continent}
+		r.redact(&req)
+		if req.IPAddress != tc.want {
+			t.Errorf("%s/%s: got %q, want %q", tc.country, tc.continent, req.IPAddress, tc.want)
+		}
+	}
+}
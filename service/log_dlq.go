@@ -0,0 +1,181 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+var (
+	// ErrDLQDisabled is returned by dead-letter operations when LOG_DLQ_DIR is unset.
+	ErrDLQDisabled = errors.New("log dead-letter queue is disabled")
+	// ErrDeadLetterNotFound is returned when no dead letter has the requested ID.
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+// DeadLetter describes a batch of log records that could not be delivered to
+// a sink after its retries were exhausted.
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Sink     string    `json:"sink"`
+	Records  int       `json:"records"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+const (
+	dlqMetaPrefix    = "logdlq/meta/"
+	dlqRecordsPrefix = "logdlq/records/"
+)
+
+// deadLetterQueue keeps undeliverable batches in a Storage: the records as a
+// spool segment under "logdlq/records/<id>" and a DeadLetter describing the
+// failure under "logdlq/meta/<id>". The metadata is written last, so only
+// complete entries are listed.
+type deadLetterQueue struct {
+	store storage.Storage
+	mu    sync.Mutex // Serializes re-drives against writes and removals
+}
+
+func newDeadLetterQueue(store storage.Storage) *deadLetterQueue {
+	return &deadLetterQueue{store: store}
+}
+
+// put stores records that sink failed to accept after attempts tries.
+func (q *deadLetterQueue) put(sink string, records []models.LogRequest, attempts int, cause error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d := DeadLetter{
+		ID:       fmt.Sprintf("%020d-%s", time.Now().UnixNano(), sink),
+		Sink:     sink,
+		Records:  len(records),
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	}
+	if cause != nil {
+		d.Error = cause.Error()
+	}
+	if err := q.store.Set(dlqRecordsPrefix+d.ID, encodeSegment(records), 0); err != nil {
+		return err
+	}
+	return q.writeMeta(d)
+}
+
+// list returns all dead letters, oldest first.
+func (q *deadLetterQueue) list() ([]DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var out []DeadLetter
+	err := q.store.Scan(dlqMetaPrefix, func(_ string, value []byte) bool {
+		var d DeadLetter
+		if json.Unmarshal(value, &d) == nil {
+			out = append(out, d)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// redrive sends a dead letter's records through send in batches of batchSize
+// and removes it once all were accepted. On failure the delivered prefix is
+// dropped from the entry and its attempt count and error are updated.
+func (q *deadLetterQueue) redrive(id string, batchSize int, send func(sink string, records []models.LogRequest) error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if id == "" || strings.Contains(id, "/") {
+		return ErrDeadLetterNotFound
+	}
+	meta, ok, err := q.store.Get(dlqMetaPrefix + id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+	var d DeadLetter
+	if err := json.Unmarshal(meta, &d); err != nil {
+		return err
+	}
+	data, _, err := q.store.Get(dlqRecordsPrefix + id)
+	if err != nil {
+		return err
+	}
+	records, err := decodeSegment(data)
+	if err != nil {
+		return err
+	}
+
+	if batchSize <= 0 {
+		batchSize = 50
+	}
+	for i := 0; i < len(records); i += batchSize {
+		end := min(i+batchSize, len(records))
+		if err := send(d.Sink, records[i:end]); err != nil {
+			d.Records = len(records) - i
+			d.Attempts++
+			d.Error = err.Error()
+			d.FailedAt = time.Now().UTC()
+			if werr := q.store.Set(dlqRecordsPrefix+id, encodeSegment(records[i:]), 0); werr != nil {
+				return werr
+			}
+			if werr := q.writeMeta(d); werr != nil {
+				return werr
+			}
+			return err
+		}
+	}
+	q.store.Delete(dlqMetaPrefix + id)
+	return q.store.Delete(dlqRecordsPrefix + id)
+}
+
+func (q *deadLetterQueue) writeMeta(d DeadLetter) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return q.store.Set(dlqMetaPrefix+d.ID, data, 0)
+}
+
+// importDir moves the entries older builds wrote to dir ("<id>.ndjson" and
+// "<id>.json") into the queue.
+func (q *deadLetterQueue) importDir(dir string) {
+	names, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, name := range names {
+		id := strings.TrimSuffix(filepath.Base(name), ".json")
+		meta, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, id+spoolSuffix))
+		if err != nil {
+			continue
+		}
+		if err := q.store.Set(dlqRecordsPrefix+id, data, 0); err != nil {
+			logFor(componentLogger).Error("error importing dead letter", "id", id, "error", err)
+			continue
+		}
+		if err := q.store.Set(dlqMetaPrefix+id, meta, 0); err != nil {
+			logFor(componentLogger).Error("error importing dead letter", "id", id, "error", err)
+			continue
+		}
+		os.Remove(name)
+		os.Remove(filepath.Join(dir, id+spoolSuffix))
+	}
+}
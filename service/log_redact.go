@@ -0,0 +1,108 @@
+package service
+
+import (
+	"net/netip"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/utils"
+)
+
+// Prefix lengths IP addresses are truncated to by LOG_REDACT ip_address=mask.
+const (
+	redactIPv4Bits = 24
+	redactIPv6Bits = 48
+)
+
+// logRedactor hashes, masks or drops personal data in log records before
+// they are buffered (LOG_REDACT), optionally only for records located in
+// LOG_REDACT_REGIONS. Decisions never see redacted values: redaction runs
+// after the record's keys have been enriched.
+type logRedactor struct {
+	fields  map[string]string // Field -> "hash", "mask" or "drop"
+	regions map[string]bool   // Country and continent codes (empty = all)
+	key     []byte            // LOG_REDACT_KEY
+	cfg     *config.Config    // Without key: hash under the identity key's subkey
+}
+
+func newLogRedactor(cfg *config.Config) *logRedactor {
+	if len(cfg.LogRedact) == 0 {
+		return nil
+	}
+	r := &logRedactor{fields: cfg.LogRedact, regions: make(map[string]bool), key: []byte(cfg.LogRedactKey), cfg: cfg}
+	for _, code := range cfg.LogRedactRegions {
+		r.regions[code] = true
+	}
+	return r
+}
+
+// redact rewrites the configured fields of req. Records whose location is
+// unknown are redacted too, so a GeoIP miss never leaks data.
+func (r *logRedactor) redact(req *models.LogRequest) {
+	if r == nil {
+		return
+	}
+	if len(r.regions) > 0 && req.Country != "" && !r.regions[req.Country] && !r.regions[req.Continent] {
+		return
+	}
+	for field, action := range r.fields {
+		switch field {
+		case "ip_address":
+			req.IPAddress = r.apply(action, req.IPAddress, maskIP)
+		case "username":
+			req.Username = r.apply(action, req.Username, maskString)
+		case "user_agent":
+			req.UserAgent = r.apply(action, req.UserAgent, maskString)
+		case "email":
+			req.Email = r.apply(action, req.Email, maskString)
+		}
+	}
+}
+
+func (r *logRedactor) apply(action, v string, mask func(string) string) string {
+	if v == "" {
+		return ""
+	}
+	switch action {
+	case "hash":
+		return r.hash(v)
+	case "mask":
+		return mask(v)
+	}
+	return ""
+}
+
+// hash hashes v under LOG_REDACT_KEY or, without it, under the log subkey of
+// EMAIL_ENCRYPTION_KEY, prefixed with EMAIL_ENCRYPTION_KEY_ID.
+func (r *logRedactor) hash(v string) string {
+	if len(r.key) > 0 {
+		return utils.OneWayKeyedHash(r.key, v)
+	}
+	subkey := utils.DeriveSubkey([]byte(r.cfg.CurrentEmailKey()), utils.SubkeyLogHash)
+	return utils.WithKeyID(r.cfg.EmailKeyID, utils.OneWayKeyedHash(subkey, v))
+}
+
+// maskIP zeroes the host part of an address: 203.0.113.7 becomes 203.0.113.0
+// and 2001:db8:1:2::7 becomes 2001:db8:1::. Values that are not addresses
+// are dropped.
+func maskIP(v string) string {
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := redactIPv6Bits
+	if addr.Is4() {
+		bits = redactIPv4Bits
+	}
+	prefix, _ := addr.WithZone("").Prefix(bits)
+	return prefix.Addr().String()
+}
+
+// maskString keeps the first character of v and replaces the rest.
+func maskString(v string) string {
+	for _, c := range v {
+		return string(c) + "***"
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// logSampler keeps a share of successful log records, by HTTP method
+// (LOG_SAMPLE_RATES). Records of failed requests (4xx and 5xx responses) and
+// of LOG_RAW_EVENT_TYPES are always kept, so blocks and attacks are never
+// sampled away.
+type logSampler struct {
+	rates map[string]float64 // By upper-case method, "*" for the rest
+	raw   map[string]bool
+}
+
+func newLogSampler(cfg *config.Config) *logSampler {
+	if len(cfg.LogSampleRates) == 0 {
+		return nil
+	}
+	l := &logSampler{rates: cfg.LogSampleRates, raw: make(map[string]bool)}
+	for _, t := range cfg.LogRawEventTypes {
+		l.raw[t] = true
+	}
+	return l
+}
+
+// rate returns the share of records like req that are kept (1 = all).
+func (l *logSampler) rate(req models.LogRequest) float64 {
+	if l == nil || req.ResponseCode >= http.StatusBadRequest || l.raw[req.EventType] {
+		return 1
+	}
+	if r, ok := l.rates[strings.ToUpper(req.HTTPMethod)]; ok {
+		return r
+	}
+	if r, ok := l.rates["*"]; ok {
+		return r
+	}
+	return 1
+}
+
+// sample decides whether req is kept, recording the rate it was kept at.
+func (s *LoggerService) sample(req *models.LogRequest) bool {
+	r := s.sampler.rate(*req)
+	if r >= 1 {
+		return true
+	}
+	if rand.Float64() >= r {
+		atomic.AddInt64(&s.sampledOut, 1)
+		return false
+	}
+	req.SampleRate = r
+	return true
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+const (
+	spoolSuffix = ".ndjson"
+	spoolPrefix = "logspool/"
+)
+
+// logSpool is a write-ahead log, kept in a Storage, for log records that
+// could not be delivered or held in memory. Each spill is one segment under
+// "logspool/<sink>/<ts>"; replay delivers segments oldest first, deleting
+// each one only after the sink accepted it. Segments left over from a
+// previous run are replayed too.
+type logSpool struct {
+	store  storage.Storage
+	prefix string
+
+	mu   sync.Mutex // Keeps segment names unique and ordered
+	last int64
+
+	replayMu sync.Mutex // Serializes replays
+}
+
+func newLogSpool(store storage.Storage, sink string) *logSpool {
+	return &logSpool{store: store, prefix: spoolPrefix + sink + "/"}
+}
+
+// logStorage returns the store LOG_SPILL_DIR or LOG_DLQ_DIR records are kept
+// in: the STORAGE_BACKEND store, unless that is process memory, in which case
+// a file store named name in dir keeps them across restarts. owned is true
+// for the file store, which the caller closes.
+func logStorage(cfg *config.Config, shared storage.Storage, dir, name string) (st storage.Storage, owned bool, err error) {
+	if b := strings.ToLower(cfg.StorageBackend); b != "" && b != "memory" {
+		return shared, false, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, false, err
+	}
+	f, err := storage.OpenFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+// append stores records as a new segment.
+func (l *logSpool) append(records []models.LogRequest) error {
+	return l.store.Set(l.prefix+l.nextName(), encodeSegment(records), 0)
+}
+
+// nextName returns a segment name sorting after every earlier one.
+func (l *logSpool) nextName() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last = max(time.Now().UnixNano(), l.last+1)
+	return fmt.Sprintf("%020d", l.last)
+}
+
+// segments lists the keys of the spooled segments, oldest first.
+func (l *logSpool) segments() ([]string, error) {
+	var keys []string
+	err := l.store.Scan(l.prefix, func(key string, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// replay delivers spooled segments in batches of batchSize via send, stopping
+// at the first failure. It returns the number of records delivered. A replay
+// already in progress makes this call a no-op.
+//
+// Each failed replay counts an attempt against the oldest segment (recorded in
+// its name). When giveUp is non-nil it is offered the undelivered records
+// with that count; if it takes them (e.g. into the dead-letter queue) the
+// segment is deleted and replay moves on to the next one.
+func (l *logSpool) replay(batchSize int, send func([]models.LogRequest) error, giveUp func(records []models.LogRequest, attempts int, err error) bool) (int, error) {
+	if !l.replayMu.TryLock() {
+		return 0, nil
+	}
+	defer l.replayMu.Unlock()
+
+	keys, err := l.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	if batchSize <= 0 {
+		batchSize = 50
+	}
+	delivered := 0
+segments:
+	for _, key := range keys {
+		data, ok, err := l.store.Get(key)
+		if err != nil {
+			return delivered, err
+		}
+		if !ok {
+			continue
+		}
+		records, err := decodeSegment(data)
+		if err != nil {
+			return delivered, fmt.Errorf("%s: %w", strings.TrimPrefix(key, l.prefix), err)
+		}
+		for i := 0; i < len(records); i += batchSize {
+			end := min(i+batchSize, len(records))
+			if err := send(records[i:end]); err != nil {
+				attempts := segmentAttempts(key) + 1
+				if giveUp != nil && giveUp(records[i:], attempts, err) {
+					if derr := l.store.Delete(key); derr != nil {
+						return delivered, derr
+					}
+					continue segments
+				}
+				// Keep only what is left so delivered records are not resent.
+				next := withAttempts(key, attempts)
+				if werr := l.store.Set(next, encodeSegment(records[i:]), 0); werr != nil {
+					return delivered, werr
+				}
+				if next != key {
+					l.store.Delete(key)
+				}
+				return delivered, err
+			}
+			delivered += end - i
+		}
+		if err := l.store.Delete(key); err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// importDir moves the segment files older builds wrote to dir into the spool.
+func (l *logSpool) importDir(dir string) {
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	sort.Strings(names)
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if _, err := decodeSegment(data); err != nil {
+			logFor(componentLogger).Warn("leaving unreadable spool segment", "file", name, "error", err)
+			continue
+		}
+		base := strings.TrimSuffix(filepath.Base(name), spoolSuffix)
+		if err := l.store.Set(l.prefix+base, data, 0); err != nil {
+			logFor(componentLogger).Error("error importing spool segment", "file", name, "error", err)
+			continue
+		}
+		os.Remove(name)
+	}
+}
+
+// segmentAttempts returns the failed replay count encoded in a segment name
+// ("<ts>.<attempts>"); fresh segments ("<ts>") have none.
+func segmentAttempts(key string) int {
+	base := key[strings.LastIndexByte(key, '/')+1:]
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		n, _ := strconv.Atoi(base[i+1:])
+		return n
+	}
+	return 0
+}
+
+func withAttempts(key string, attempts int) string {
+	dir, base := "", key
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		dir, base = key[:i+1], key[i+1:]
+	}
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	return fmt.Sprintf("%s%s.%d", dir, base, attempts)
+}
+
+// encodeSegment writes records as NDJSON after a log spool header.
+func encodeSegment(records []models.LogRequest) []byte {
+	var buf bytes.Buffer
+	storage.WriteHeader(&buf, storage.KindLogSpool, "")
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		enc.Encode(r)
+	}
+	return buf.Bytes()
+}
+
+func decodeSegment(data []byte) ([]models.LogRequest, error) {
+	// Segments from a newer build are left for it rather than misread
+	br := bufio.NewReader(bytes.NewReader(data))
+	if _, err := storage.ReadHeader(br, storage.KindLogSpool); err != nil {
+		return nil, err
+	}
+	var records []models.LogRequest
+	sc := bufio.NewScanner(br)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		var r models.LogRequest
+		// A torn final line from a crash mid-append is skipped, not fatal.
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, sc.Err()
+}
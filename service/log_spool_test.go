@@ -0,0 +1,147 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+func TestLoggerService_SpillAndReplay(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	var mu sync.Mutex
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []models.LogRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+		mu.Lock()
+		for _, l := range batch {
+			received = append(received, l.IPAddress)
+		}
+		mu.Unlock()
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	svc := NewLoggerService(&config.Config{
+		UpstreamBaseURL: upstream.URL,
+		LogBatchSize:    2,
+		LogSpillDir:     dir,
+	}, nil, nil)
+
+	// Upstream outage: the failed batch is spilled instead of lost
+	svc.QueueLog(models.LogRequest{IPAddress: "10.0.0.1"})
+	svc.QueueLog(models.LogRequest{IPAddress: "10.0.0.2"})
+	deadline := time.Now().Add(2 * time.Second)
+	for svc.Stats().InFlight != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := svc.Stats(); st.Spilled != 2 || st.Dropped != 0 {
+		t.Fatalf("got %+v", st)
+	}
+
+	// Still down: replay keeps the segment
+	svc.replaySpool()
+	if names, _ := svc.sinks[0].spool.segments(); len(names) != 1 {
+		t.Fatalf("expected 1 spooled segment, got %v", names)
+	}
+
+	// A fresh service (e.g. after a restart) replays what the previous one spilled
+	down.Store(false)
+	restarted := NewLoggerService(&config.Config{UpstreamBaseURL: upstream.URL, LogBatchSize: 2, LogSpillDir: dir}, nil, nil)
+	restarted.replaySpool()
+
+	if st := restarted.Stats(); st.Replayed != 2 {
+		t.Errorf("got %+v", st)
+	}
+	if len(received) != 2 || received[0] != "10.0.0.1" || received[1] != "10.0.0.2" {
+		t.Errorf("received %v", received)
+	}
+	if names, _ := restarted.sinks[0].spool.segments(); len(names) != 0 {
+		t.Errorf("expected spool to be empty, got %v", names)
+	}
+}
+
+func TestLoggerService_DeadLetterAndRedrive(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	var received atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []models.LogRequest
+		json.NewDecoder(r.Body).Decode(&batch)
+		received.Add(int64(len(batch)))
+	}))
+	defer upstream.Close()
+
+	svc := NewLoggerService(&config.Config{
+		UpstreamBaseURL: upstream.URL,
+		LogBatchSize:    2,
+		LogSpillDir:     t.TempDir(),
+		LogDLQDir:       t.TempDir(),
+		LogMaxAttempts:  2,
+	}, nil, nil)
+	svc.overflow(models.LogRequest{IPAddress: "10.0.0.1"}, models.LogRequest{IPAddress: "10.0.0.2"})
+
+	// The first failed replay only counts an attempt
+	svc.replaySpool()
+	if letters, _ := svc.DeadLetters(); len(letters) != 0 {
+		t.Fatalf("dead-lettered too early: %+v", letters)
+	}
+	names, _ := svc.sinks[0].spool.segments()
+	if len(names) != 1 || segmentAttempts(names[0]) != 1 {
+		t.Fatalf("expected one segment with 1 attempt, got %v", names)
+	}
+
+	// The second exhausts LOG_MAX_ATTEMPTS and moves it to the DLQ
+	svc.replaySpool()
+	letters, err := svc.DeadLetters()
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("got %+v, %v", letters, err)
+	}
+	if d := letters[0]; d.Sink != "upstream" || d.Records != 2 || d.Attempts != 2 || d.Error == "" {
+		t.Errorf("got %+v", d)
+	}
+	if names, _ := svc.sinks[0].spool.segments(); len(names) != 0 {
+		t.Errorf("expected spool to be empty, got %v", names)
+	}
+	if st := svc.Stats(); st.DeadLettered != 2 {
+		t.Errorf("got %+v", st)
+	}
+
+	// Re-driving while the upstream is still down keeps the entry
+	if err := svc.Redrive(letters[0].ID); err == nil {
+		t.Fatal("expected redrive to fail")
+	}
+	if letters, _ := svc.DeadLetters(); len(letters) != 1 || letters[0].Attempts != 3 {
+		t.Fatalf("got %+v", letters)
+	}
+
+	down.Store(false)
+	if n, err := svc.RedriveAll(); n != 1 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if received.Load() != 2 {
+		t.Errorf("received %d records", received.Load())
+	}
+	if letters, _ := svc.DeadLetters(); len(letters) != 0 {
+		t.Errorf("expected empty DLQ, got %+v", letters)
+	}
+	if err := svc.Redrive(letters[0].ID); err != ErrDeadLetterNotFound {
+		t.Errorf("got %v", err)
+	}
+}
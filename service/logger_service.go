@@ -1,41 +1,133 @@
 package service
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"apigate-proxy/config"
 	"apigate-proxy/models"
+	"apigate-proxy/storage"
 	"apigate-proxy/utils"
 )
 
 type LoggerService struct {
-	config *config.Config
-	client *http.Client
+	config    *config.Config
+	client    *http.Client
+	upstream  *UpstreamPool
+	transport UpstreamTransport
+	geo       *GeoIP
 
 	mu        sync.Mutex
 	buffer    []models.LogRequest
 	flushChan chan []models.LogRequest // To handle flush trigger
+
+	// One token per record buffered or in flight, bounding memory when the
+	// upstream is slow (nil when LOG_MAX_BUFFER is 0)
+	slots       chan struct{}
+	inFlight    int64
+	dropped     int64
+	recentDrops int64 // Since the last periodic warning
+
+	// Log destinations, each with an optional spool for records that
+	// fail to send or overflow
+	sinks    []*sinkRoute
+	spilled  int64
+	replayed int64
+
+	// Roll-ups of repeated events for the current flush interval (nil when
+	// LOG_AGGREGATE_EVENT_TYPES is unset)
+	agg        *logAggregator
+	aggregated int64
+
+	// Keeps a share of successful records (nil when LOG_SAMPLE_RATES is unset)
+	sampler    *logSampler
+	sampledOut int64
+	// Redacts personal data (nil when LOG_REDACT is unset)
+	redactor *logRedactor
+
+	// Batches that exhausted their retries (nil when LOG_DLQ_DIR is unset)
+	dlq          *deadLetterQueue
+	deadLettered int64
+	// File stores opened for the spool and DLQ, closed by Stop
+	owned []storage.Storage
+
+	// Upstream labels for a record's keys (nil until EnrichFrom)
+	labelsFor func(models.LogRequest) []string
+
+	// Closed by Stop; workers are the flush loop, sends and spool replays
+	done     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
 }
 
-func NewLoggerService(cfg *config.Config) *LoggerService {
+// NewLoggerService builds the log buffer for cfg. Upstream calls go through
+// client, normally the ProxyService's, or a client of its own when client is
+// nil. The spool and dead-letter queue are kept in store, normally the
+// ProxyService's, unless that is process memory (see logStorage).
+func NewLoggerService(cfg *config.Config, client *http.Client, store storage.Storage) *LoggerService {
+	if client == nil {
+		client = newUpstreamClient(cfg)
+	}
+	pool := NewUpstreamPool(cfg, client)
+	var slots chan struct{}
+	if cfg.LogMaxBuffer > 0 {
+		slots = make(chan struct{}, cfg.LogMaxBuffer)
+	}
+	transport := newUpstreamTransport(cfg, pool)
+	var owned []storage.Storage
+	var spools storage.Storage
+	if cfg.LogSpillDir != "" {
+		st, own, err := logStorage(cfg, store, cfg.LogSpillDir, "spool.db")
+		if err != nil {
+			logFor(componentLogger).Warn("log spill disabled", "error", err)
+		} else if spools = st; own {
+			owned = append(owned, st)
+		}
+	}
+	var dlq *deadLetterQueue
+	if cfg.LogDLQDir != "" {
+		st, own, err := logStorage(cfg, store, cfg.LogDLQDir, "dlq.db")
+		if err != nil {
+			logFor(componentLogger).Warn("log dead-letter queue disabled", "error", err)
+		} else {
+			if own {
+				owned = append(owned, st)
+			}
+			dlq = newDeadLetterQueue(st)
+			dlq.importDir(cfg.LogDLQDir)
+		}
+	}
 	return &LoggerService{
 		config:    cfg,
-		client:    &http.Client{Timeout: 10 * time.Second},
+		client:    client,
+		upstream:  pool,
+		transport: transport,
+		geo:       openGeoIP(cfg),
 		buffer:    make([]models.LogRequest, 0, cfg.LogBatchSize),
 		flushChan: make(chan []models.LogRequest, 10), // Buffered chan
+		slots:     slots,
+		sinks:     newSinkRoutes(cfg, transport, spools),
+		agg:       newLogAggregator(cfg),
+		sampler:   newLogSampler(cfg),
+		redactor:  newLogRedactor(cfg),
+		dlq:       dlq,
+		owned:     owned,
+		done:      make(chan struct{}),
 	}
 }
 
 func (s *LoggerService) Start() {
+	// The proxy's probes report upstream health; these only order failover
+	if usesHTTPUpstream(s.config) && len(s.upstream.endpoints) > 1 {
+		s.upstream.StartHealthChecks(s.done)
+	}
 
 	// Start ticker
-	go func() {
+	s.goWorker(func() {
 		interval := time.Duration(s.config.LogFlushInterval) * time.Second
 		if interval < 1*time.Second {
 			interval = 10 * time.Second
@@ -43,21 +135,85 @@ func (s *LoggerService) Start() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
-		for range ticker.C {
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			s.flushAggregates()
 			s.triggerFlush()
+			s.goWorker(s.replaySpool)
+			if n := atomic.SwapInt64(&s.recentDrops, 0); n > 0 {
+				logFor(componentLogger).Warn("dropped log records: buffer full",
+					"dropped", n, "max_buffer", s.config.LogMaxBuffer, "policy", s.config.LogOverflowPolicy)
+			}
 		}
+	})
+}
+
+// goWorker runs fn in a goroutine Stop waits for. It reports false, starting
+// nothing, once Stop was called.
+func (s *LoggerService) goWorker(fn func()) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn()
 	}()
+	return true
+}
+
+// Config returns the configuration the service was created with.
+func (s *LoggerService) Config() *config.Config {
+	return s.config
+}
+
+// EnrichFrom attaches the upstream labels p has cached for a record's keys
+// to every record queued afterwards. Call it before Start.
+func (s *LoggerService) EnrichFrom(p *ProxyService) {
+	s.labelsFor = p.recordLabels
 }
 
 func (s *LoggerService) QueueLog(req models.LogRequest) {
-	// Encrypt email immediately if configured
-	// Encrypt email immediately if configured and enabled
-	if s.config.EmailEncryptionEnabled && s.config.EmailEncryptionKey != "" && req.Email != "" {
-		if s.config.EmailEncryptionFormat == "numeric" {
-			req.Email = utils.OneWayKeyedHashNumeric([]byte(s.config.EmailEncryptionKey), req.Email)
-		} else {
-			req.Email = utils.OneWayKeyedHash([]byte(s.config.EmailEncryptionKey), req.Email)
-		}
+	// Read replicas have no route to the upstream; don't buffer what can never be sent
+	if s.config.ReadReplica {
+		return
+	}
+	if !s.sample(&req) {
+		return
+	}
+
+	// Normalize and encrypt email/user ID immediately if configured and enabled,
+	// producing the same key ProxyService uses for decisions
+	req.Email, req.IdentityType = identityKey(s.config, req.Email, req.IdentityType)
+
+	if req.ClientCertFingerprint != "" {
+		req.ClientCertFingerprint = utils.NormalizeFingerprint(req.ClientCertFingerprint)
+	}
+	req.JA3 = strings.ToLower(req.JA3)
+	if ip, ok := utils.NormalizeIP(req.IPAddress); ok {
+		req.IPAddress = ip
+	}
+	req.UAClass, req.UAClient = utils.ClassifyUserAgent(req.UserAgent)
+	if s.geo != nil {
+		req.Country, req.Continent = s.geo.Lookup(req.IPAddress)
+	}
+	if s.labelsFor != nil {
+		req.Labels = s.labelsFor(req)
+	}
+	s.redactor.redact(&req)
+
+	if s.aggregate(req) {
+		return
+	}
+	if !s.reserve() {
+		s.overflow(req)
+		return
 	}
 
 	s.mu.Lock()
@@ -86,60 +242,113 @@ func (s *LoggerService) triggerFlush() {
 
 	// Reset buffer
 	s.buffer = s.buffer[:0]
+	atomic.AddInt64(&s.inFlight, int64(len(batch)))
 	s.mu.Unlock()
 
-	// Send to worker
 	// Send to worker asynchronously
-	go s.sendBatch(batch)
+	if !s.goWorker(func() { s.sendBatch(batch) }) {
+		// Stopping: leave the records to Stop's final flush
+		s.mu.Lock()
+		s.buffer = append(s.buffer, batch...)
+		atomic.AddInt64(&s.inFlight, -int64(len(batch)))
+		s.mu.Unlock()
+	}
 }
 
 func (s *LoggerService) sendBatch(batch []models.LogRequest) {
 	if len(batch) == 0 {
 		return
 	}
+	defer func() {
+		atomic.AddInt64(&s.inFlight, -int64(len(batch)))
+		s.release(len(batch))
+	}()
 
-	url := fmt.Sprintf("%s/api/logs", s.config.UpstreamBaseURL)
 	// Emails are already encrypted in QueueLog
+	for _, r := range s.sinks {
+		if err := r.sink.Send(batch); err != nil {
+			logFor(componentLogger).Error("error sending batch logs", "sink", r.sink.Name(), "batch_size", len(batch), "error", err)
+			// Replayed from the spool once the sink recovers; without a spool
+			// there are no retries left
+			if !s.spill(r, batch) {
+				s.deadLetter(r, batch, 1, err)
+			}
+			continue
+		}
+		logFor(componentLogger).Info("flushed batch", "sink", r.sink.Name(), "batch_size", len(batch))
+	}
+}
 
-	body, _ := json.Marshal(batch)
-
-	r, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		log.Printf("[Logger] Error creating request: %v", err)
-		return
+// DeadLetters lists the log batches in the dead-letter queue, oldest first.
+func (s *LoggerService) DeadLetters() ([]DeadLetter, error) {
+	if s.dlq == nil {
+		return nil, ErrDLQDisabled
 	}
-	r.Header.Set("Content-Type", "application/json")
-	if s.config.UpstreamAPIKey != "" {
-		r.Header.Set("X-API-Key", s.config.UpstreamAPIKey)
+	return s.dlq.list()
+}
+
+// Redrive sends a dead-lettered batch to its sink again, removing it from the
+// queue once delivered.
+func (s *LoggerService) Redrive(id string) error {
+	if s.dlq == nil {
+		return ErrDLQDisabled
 	}
+	return s.dlq.redrive(id, s.config.LogBatchSize, func(sink string, records []models.LogRequest) error {
+		for _, r := range s.sinks {
+			if r.sink.Name() == sink {
+				return r.sink.Send(records)
+			}
+		}
+		return fmt.Errorf("sink %q is not configured", sink)
+	})
+}
 
-	resp, err := s.client.Do(r)
+// RedriveAll re-drives every dead letter, returning how many were delivered
+// and the first error encountered.
+func (s *LoggerService) RedriveAll() (int, error) {
+	letters, err := s.DeadLetters()
 	if err != nil {
-		log.Printf("[Logger] Error sending batch logs: %v", err)
-		// Retry logic could go here (e.g. put back in buffer), but simpler to drop/log for now.
-		return
+		return 0, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 300 {
-		log.Printf("[Logger] Upstream returned error: %d", resp.StatusCode)
-	} else {
-		log.Printf("[Logger] Flushed batch of %d data points to server.", len(batch))
+	redriven := 0
+	var firstErr error
+	for _, d := range letters {
+		if err := s.Redrive(d.ID); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", d.ID, err)
+			}
+			continue
+		}
+		redriven++
 	}
+	return redriven, firstErr
 }
 
-// Stop flushes any remaining logs synchronously before shutdown
+// Stop ends the flush loop and waits for the sends and spool replays in
+// flight, then flushes any remaining logs synchronously and closes the sinks.
+// Records queued afterwards are not delivered. Stop may be called more than
+// once, and before Start.
 func (s *LoggerService) Stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+	s.workers.Wait()
+	s.flushAggregates()
 	s.mu.Lock()
-	if len(s.buffer) == 0 {
-		s.mu.Unlock()
-		return
-	}
 	batch := make([]models.LogRequest, len(s.buffer))
 	copy(batch, s.buffer)
 	s.buffer = s.buffer[:0]
+	atomic.AddInt64(&s.inFlight, int64(len(batch)))
 	s.mu.Unlock()
 
-	log.Println("[LoggerService] Flushing remaining logs on shutdown...")
-	s.sendBatch(batch)
+	if len(batch) > 0 {
+		logFor(componentLogger).Info("flushing remaining logs on shutdown")
+		s.sendBatch(batch)
+	}
+	for _, r := range s.sinks {
+		if err := r.sink.Close(); err != nil {
+			logFor(componentLogger).Error("error closing sink", "sink", r.sink.Name(), "error", err)
+		}
+	}
+	for _, st := range s.owned {
+		CloseStorage(st)
+	}
 }
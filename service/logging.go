@@ -0,0 +1,20 @@
+package service
+
+import "log/slog"
+
+// Components named in the "component" field of every log record.
+const (
+	componentProxy     = "proxy"
+	componentLogger    = "logger"
+	componentScheduler = "scheduler"
+	componentUpstream  = "upstream"
+	componentStorage   = "storage"
+	componentReporter  = "reporter"
+	componentGeoIP     = "geoip"
+)
+
+// logFor returns the logger of a component. It is looked up on every use, so
+// it follows the handler config.LoadConfig installs.
+func logFor(component string) *slog.Logger {
+	return slog.With("component", component)
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+
+	"apigate-proxy/models"
+)
+
+// decisionMemo remembers the response for an exact AllowRequest for a very short
+// TTL, so client retries and duplicate submissions skip encryption and the main
+// cache lock entirely. It is backed by a sync.Map, which is optimized for this
+// read-mostly, disjoint-key access pattern.
+type decisionMemo struct {
+	ttl     time.Duration
+	entries sync.Map // memoID -> memoEntry
+}
+
+type memoEntry struct {
+	resp    models.AllowResponse
+	trace   decisionTrace // Keys, winner and tracked keys of the memoized decision
+	expires time.Time
+}
+
+func newDecisionMemo(ttl time.Duration) *decisionMemo {
+	if ttl <= 0 {
+		return nil
+	}
+	return &decisionMemo{ttl: ttl}
+}
+
+// memoID identifies an exact request: every field that can change its
+// decision. The memo is keyed by it in full, so two requests never share an
+// entry.
+func memoID(req models.AllowRequest) string {
+	return strings.Join([]string{
+		req.IPAddress,
+		req.Email,
+		req.IdentityType,
+		req.UserAgent,
+		req.ClientCertFingerprint,
+		req.JA3,
+		req.RequestFingerprint,
+		req.Endpoint,
+	}, "\x00")
+}
+
+// memoKey is a compact fingerprint of memoID, for comparing a request with
+// one seen before.
+func memoKey(req models.AllowRequest) uint64 {
+	return xxhash.Sum64String(memoID(req))
+}
+
+// get returns the memoized response for key and the trace of a memo hit:
+// source "memo" with the keys and winner of the original decision.
+func (m *decisionMemo) get(key string) (models.AllowResponse, decisionTrace, bool) {
+	if m == nil {
+		return models.AllowResponse{}, decisionTrace{}, false
+	}
+	v, ok := m.entries.Load(key)
+	if !ok {
+		return models.AllowResponse{}, decisionTrace{}, false
+	}
+	entry := v.(memoEntry)
+	if time.Now().After(entry.expires) {
+		m.entries.Delete(key)
+		return models.AllowResponse{}, decisionTrace{}, false
+	}
+	return entry.resp, entry.trace, true
+}
+
+func (m *decisionMemo) put(key string, resp models.AllowResponse, trace decisionTrace) {
+	if m == nil {
+		return
+	}
+	hit := decisionTrace{Source: sourceMemo, Keys: trace.Keys, Winner: trace.Winner, Tracked: trace.Tracked}
+	m.entries.Store(key, memoEntry{resp: resp, trace: hit, expires: time.Now().Add(m.ttl)})
+}
+
+// clear forgets every response, when cached decisions change mid-window.
+func (m *decisionMemo) clear() {
+	if m == nil {
+		return
+	}
+	m.entries.Clear()
+}
+
+// sweep drops expired entries that were never looked up again.
+func (m *decisionMemo) sweep() {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	m.entries.Range(func(k, v any) bool {
+		if now.After(v.(memoEntry).expires) {
+			m.entries.Delete(k)
+		}
+		return true
+	})
+}
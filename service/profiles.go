@@ -0,0 +1,47 @@
+package service
+
+import "apigate-proxy/models"
+
+// Response profiles, bound to client API keys by RESPONSE_PROFILES. They
+// shape what a caller learns about a decision, so less-trusted callers cannot
+// probe which of their keys are blocked or why.
+const (
+	// ProfileFull returns every field.
+	ProfileFull = "full"
+	// ProfileDecision drops the per-key explanation: blocked_by, would_block
+	// and over_quota.
+	ProfileDecision = "decision"
+	// ProfileMinimal returns allow, status and the deferred decision ID only,
+	// plus error details on failures so the caller can still tell a bad
+	// request from a block.
+	ProfileMinimal = "minimal"
+)
+
+// ResponseProfile returns the profile of the caller authenticated with
+// clientKey ("" for unauthenticated callers).
+func (s *ProxyService) ResponseProfile(clientKey string) string {
+	if p, ok := s.config.ResponseProfiles[clientKey]; ok && clientKey != "" {
+		return p
+	}
+	if s.config.DefaultResponseProfile != "" {
+		return s.config.DefaultResponseProfile
+	}
+	return ProfileFull
+}
+
+// Redact strips the fields of resp the caller's profile does not entitle it to.
+func (s *ProxyService) Redact(clientKey string, resp models.AllowResponse) models.AllowResponse {
+	switch s.ResponseProfile(clientKey) {
+	case ProfileDecision:
+		resp.BlockedBy = nil
+		resp.WouldBlock = false
+		resp.OverQuota = false
+	case ProfileMinimal:
+		out := models.AllowResponse{Allow: resp.Allow, Status: resp.Status, DecisionID: resp.DecisionID}
+		if resp.Status != "success" {
+			out.Error, out.ErrorCode = resp.Error, resp.ErrorCode
+		}
+		return out
+	}
+	return resp
+}
@@ -1,276 +1,765 @@
 package service
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"log"
+	"context"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/sync/errgroup"
+
 	"apigate-proxy/config"
 	"apigate-proxy/models"
+	"apigate-proxy/storage"
 	"apigate-proxy/utils"
 )
 
 type ProxyService struct {
-	config *config.Config
-	client *http.Client
-
+	config    *config.Config
+	client    *http.Client
+	upstream  *UpstreamPool
+	transport UpstreamTransport
+	// STORAGE_BACKEND, shared by the stateful subsystems under their prefixes
+	store storage.Storage
+
+	// Guards the window state below. Lookups and live writes do not take it
+	// for writing: they go to the current cache's shards, and live writes
+	// hold it for reading so no swap replaces the cache under them.
 	mu sync.RWMutex
-	// Cache for current window
-	currentCache map[string]bool
-	// Cache being built for next window
-	pendingCache map[string]bool
-	// Keys collected for the next batch
-	batchedKeys map[string]struct{}
-	// Warmup flag
-	warmUp bool
+	// Cache for current window, replaced whole at each swap
+	current atomic.Pointer[decisionCache]
+	// Cache being built for next window (nil until a prefetch lands)
+	pending *decisionCache
+	// Upstream change-feed versions of the current and pending caches
+	// (PREFETCH_DELTA; empty when unknown)
+	currentVersion string
+	pendingVersion string
+	// Keys collected for the next batch, outside mu (see keyBatch)
+	batchedKeys *keyBatch
+	// Warmup flag, read without mu and set under it
+	warmUp     atomic.Bool
+	warmupEnds atomic.Int64 // Unix nanoseconds, set when WARMUP_SECONDS times warmup
+	// When current was last replaced by a prefetch, and whether it has
+	// since been kept past a window without one (CACHE_STALE_POLICY)
+	freshAt time.Time
+	stale   bool
+	// Refresh window length and when the next swap is due, in Unix
+	// nanoseconds (zero before Start). nextSwap is read without mu.
+	window   time.Duration
+	nextSwap atomic.Int64
+	// Independently refreshed caches for key types in WINDOW_SECONDS_BY_TYPE
+	typed map[string]*typeWindow
+	// Set on shutdown to fail readiness (see Drain)
+	draining atomic.Bool
+
+	// Static allow/deny entries evaluated before the cache
+	rules *Rules
+	// Optional country/continent resolution for IP addresses
+	geo *GeoIP
+
+	// Upstream reason codes of cached blocks
+	reasons *blockReasons
+	// Upstream metadata labels of cached keys
+	labels *keyLabels
+	// Combines per-key decisions (DECISION_COMBINE)
+	combiner *decisionCombiner
+	// Fetch times for per-decision TTLs (nil when disabled)
+	ttls *decisionTTLs
+
+	// Sub-second memo of exact-duplicate requests (nil when disabled)
+	memo *decisionMemo
+	// Combined decisions per full request key tuple (nil when disabled)
+	tuples *tupleCache
+	// Decisions by Idempotency-Key (nil when disabled)
+	idempotency *idempotencyStore
+	// Cumulative counters for usage reports
+	usage *usageStats
+	// Keys sent upstream and the daily key budget
+	cost *costMeter
+	// Availability-driven FAIL_MODE override (nil when disabled)
+	failSwitch *failSwitch
+	breaker    *circuitBreaker
+	// Recent decisions for audit queries (nil when disabled)
+	audit *decisionAudit
+	// Sampled full decision context by request ID (nil when disabled)
+	debug *debugStore
+	// Background encrypt batches (/api/jobs)
+	jobs *encryptJobs
+	// Shares live-check results with peer instances (nil when disabled)
+	gossip *gossip
+	// Prefetch leader election (nil when disabled)
+	leader *prefetchLeader
+	// Decision and swap event subscribers (GET /api/events)
+	events eventHub
+	// Delays answers to blocked requests (nil when disabled)
+	tarpit *tarpit
+	// Local velocity limits (nil when disabled)
+	quotas *quotas
+	// Outcome of recent prefetches (GET /api/upstream/status)
+	prefetches prefetchHealth
+
+	// Coalesces concurrent live checks for the same key set into one upstream call
+	live liveGroup
+
+	// Closed by Stop to end the background work started by Start
+	done     chan struct{}
+	stopOnce sync.Once
+	// Schedulers and in-flight prefetches, awaited by Stop
+	workers sync.WaitGroup
 
 	// Metrics
-	totalReqs       int64
-	individualCalls int64
-	lastBatchSize   int64
+	efficiency    *efficiency
+	lastBatchSize int64
+	keyOverflows  int64
+	clockJumps    int64
+	shadowBlocks  int64
+	invalidations int64
 }
 
-func NewProxyService(cfg *config.Config) *ProxyService {
-	return &ProxyService{
-		config:       cfg,
-		client:       &http.Client{Timeout: 10 * time.Second},
-		currentCache: make(map[string]bool),
-		pendingCache: nil,
-		batchedKeys:  make(map[string]struct{}),
-		warmUp:       true,
+// NewProxyService builds the decision service for cfg. Upstream calls go
+// through client, or a client of its own when client is nil; see
+// UpstreamClient. State kept between requests goes to store (see
+// OpenStorage), or to process memory when store is nil. The caller closes
+// store once the service has stopped.
+func NewProxyService(cfg *config.Config, client *http.Client, store storage.Storage) *ProxyService {
+	if client == nil {
+		client = newUpstreamClient(cfg)
+	}
+	if store == nil {
+		store = storage.NewMemory()
 	}
+	pool := NewUpstreamPool(cfg, client)
+	labels := newKeyLabels()
+	s := &ProxyService{
+		config:      cfg,
+		client:      client,
+		store:       store,
+		upstream:    pool,
+		transport:   newUpstreamTransport(cfg, pool),
+		batchedKeys: newKeyBatch(cfg.MaxWindowKeys),
+		typed:       newTypeWindows(cfg),
+		reasons:     newBlockReasons(),
+		labels:      labels,
+		ttls:        newDecisionTTLs(cfg),
+		combiner:    newDecisionCombiner(cfg),
+		memo:        newDecisionMemo(time.Duration(cfg.DecisionMemoTTLMs) * time.Millisecond),
+		tuples:      newTupleCache(time.Duration(cfg.TupleCacheTTLMs) * time.Millisecond),
+		idempotency: newIdempotencyStore(time.Duration(cfg.IdempotencyTTLSeconds)*time.Second, store),
+		usage:       newUsageStats(),
+		efficiency:  newEfficiency(),
+		cost:        newCostMeter(cfg),
+		failSwitch:  newFailSwitch(cfg),
+		breaker:     newCircuitBreaker(cfg),
+		audit:       newDecisionAudit(cfg.AuditStoreSize, cfg.AuditMaxResults, store),
+		debug:       newDebugStore(cfg, store, labels),
+		jobs:        newEncryptJobs(cfg),
+		gossip:      newGossip(cfg),
+		tarpit:      newTarpit(cfg),
+		quotas:      newQuotas(cfg),
+		done:        make(chan struct{}),
+	}
+	s.current.Store(newDecisionCache())
+	s.warmUp.Store(cfg.WarmupAction != WarmupLive)
+	s.rules = loadRules(s)
+	s.geo = openGeoIP(cfg)
+	return s
 }
 
-func (s *ProxyService) Start() {
+// windowDuration returns the default window: WINDOW_SECONDS, or 20s when
+// that is under 5s.
+func (s *ProxyService) windowDuration() time.Duration {
 	winSec := s.config.WindowSeconds
 	if winSec < 5 {
 		winSec = 20
 	}
-	windowDuration := time.Duration(winSec) * time.Second
-	// Calculate durations
-	fetchOffset := 5 * time.Second
-	fetchDuration := windowDuration - fetchOffset
-	if fetchDuration <= 0 {
-		fetchDuration = 1 * time.Second
-	}
+	return time.Duration(winSec) * time.Second
+}
 
-	go func() {
-		log.Printf("[ProxyService] Starting background worker. Window: %v, FetchOffset: %v", windowDuration, fetchOffset)
+func (s *ProxyService) Start() {
+	windowDuration := s.windowDuration()
+	s.gossip.start(s.done, s.applyGossip)
+	if s.debug != nil {
+		s.goWorker(func() { s.debug.run(s.done) })
+	}
+	s.subscribeInvalidations()
+	s.refreshSecrets()
 
-		start := time.Now()
-		nextFetch := start.Add(fetchDuration)
-		nextSwap := start.Add(windowDuration)
+	if s.config.ReadReplica {
+		s.startReplica(windowDuration)
+		return
+	}
 
-		for {
-			now := time.Now()
+	if usesHTTPUpstream(s.config) {
+		s.upstream.StartHealthChecks(s.done)
+	}
+	s.leader = newPrefetchLeader(s.config, s.store, windowDuration)
 
-			// 1. Wait for prefetch time
-			if wait := nextFetch.Sub(now); wait > 0 {
-				time.Sleep(wait)
+	s.goWorker(func() {
+		logFor(componentProxy).Info("starting background worker", "window", "default", "window_duration", windowDuration, "fetch_offset", 5*time.Second)
+		runSchedule(s.done, windowDuration, s.prefetch, func() {
+			s.swapCache()
+			s.publishLeaderCache()
+			if s.config.WarmupPersist {
+				s.persistSnapshot()
 			}
-			s.prefetch()
-			nextFetch = nextFetch.Add(windowDuration)
+			s.memo.sweep()
+			s.tuples.sweep()
+			s.idempotency.sweep()
+			s.debug.sweep()
+			s.jobs.sweep()
+			s.audit.flush()
+		}, func(next time.Time) {
+			s.setNextSwap(windowDuration, next)
+		}, &s.clockJumps, s.cost.stretch)
+	})
+	s.startTypeWindows()
+
+	switch {
+	case s.config.WarmupPersist && s.loadPersisted():
+	case s.config.WarmStart:
+		s.warmStart()
+	}
+	s.startWarmupTimer()
+}
 
-			// 2. Wait for window swap time
-			now = time.Now()
-			if wait := nextSwap.Sub(now); wait > 0 {
-				time.Sleep(wait)
-			}
-			s.swapCache()
-			nextSwap = nextSwap.Add(windowDuration)
-		}
+// Stop ends the background work started by Start: the window schedulers stop,
+// so no further prefetch or swap happens, and the gossip, invalidation and
+// health-check loops exit, and the decision history is written to the store.
+// Queued encrypt jobs are dropped. Prefetches and encrypt jobs in flight are
+// awaited until ctx is done, then abandoned to finish on their own; Stop then
+// returns ctx's error. The caches stay as they are
+// and keep answering checks. Stop may be called more
+// than once, and before Start.
+func (s *ProxyService) Stop(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.done) })
+	s.audit.flush()
+	finished := make(chan struct{})
+	go func() {
+		s.jobs.stop()
+		s.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// goWorker runs fn in a goroutine Stop waits for. Nothing is started once
+// Stop was called.
+func (s *ProxyService) goWorker(fn func()) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn()
 	}()
 }
 
+// Config returns the configuration the service was created with.
+func (s *ProxyService) Config() *config.Config {
+	return s.config
+}
+
+// UpstreamClient returns the HTTP client of the service's upstream calls, for
+// the services that should share its connection pool.
+func (s *ProxyService) UpstreamClient() *http.Client {
+	return s.client
+}
+
 // EncryptEmail encrypts the email if encryption is enabled and key is configured.
+// The value is hashed as given; use IdentityKey for the normalized lookup key.
 func (s *ProxyService) EncryptEmail(email string) string {
-	if email == "" || !s.config.EmailEncryptionEnabled || s.config.EmailEncryptionKey == "" {
-		return email
+	return pseudonymize(s.config, email)
+}
+
+// Locate returns the country and continent codes for ip, or empty strings
+// when no GeoIP database is configured.
+func (s *ProxyService) Locate(ip string) (string, string) {
+	return s.geo.Lookup(ip)
+}
+
+// ASN returns the autonomous system of ip as "AS<number>", or an empty
+// string without ASN_DB_PATH or when it is unknown.
+func (s *ProxyService) ASN(ip string) string {
+	return s.geo.LookupASN(ip)
+}
+
+// IdentityKey returns the cache/upstream key for an email or user ID and its
+// resolved identity type. declared may be empty to auto-detect.
+func (s *ProxyService) IdentityKey(value, declared string) (string, string) {
+	return identityKey(s.config, value, declared)
+}
+
+// Check decides req. Its IP address is canonicalized first; one that does not
+// parse fails with ErrInvalidIP. A live check it needs is canceled when ctx ends and no
+// other request waits for it, and carries ctx's deadline and values.
+func (s *ProxyService) Check(ctx context.Context, req models.AllowRequest) (models.AllowResponse, error) {
+	if err := canonicalIP(&req); err != nil {
+		return models.AllowResponse{}, err
+	}
+	resp, err := s.check(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	return s.shadow(resp), nil
+}
+
+// check decides a request. Caches, metrics and stores see the real decision;
+// SHADOW_MODE is applied on the way out by Check.
+func (s *ProxyService) check(ctx context.Context, req models.AllowRequest) (models.AllowResponse, error) {
+	// Every request counts against the local velocity limits, memoized or not
+	over := s.quotas.count(s.config, req)
+
+	// 0. Fast path for an exact repeat of a recent request
+	var mk string
+	if s.memo != nil {
+		mk = memoID(req)
+		if resp, trace, ok := s.memo.get(mk); ok {
+			// Keep the keys in the next prefetch, as a full evaluation would
+			s.trackKeys(trace.Tracked)
+			s.efficiency.record(trace)
+			resp = s.applyQuota(req, resp, over, &trace)
+			s.usage.recordDecision(resp, trace)
+			s.audit.record(resp, trace)
+			s.debug.record(req, resp, trace)
+			s.publishDecision(resp, trace)
+			return resp, nil
+		}
+	}
+
+	resp, trace, err := s.evaluate(ctx, req)
+	s.efficiency.record(trace)
+	if err != nil {
+		return resp, err
 	}
-	if s.config.EmailEncryptionFormat == "numeric" {
-		return utils.OneWayKeyedHashNumeric([]byte(s.config.EmailEncryptionKey), email)
+	resp.UAClass, resp.UAClient = utils.ClassifyUserAgent(req.UserAgent)
+	if trace.cacheable() {
+		s.memo.put(mk, resp, trace)
 	}
-	return utils.OneWayKeyedHash([]byte(s.config.EmailEncryptionKey), email)
+	resp = s.applyQuota(req, resp, over, &trace)
+	s.usage.recordDecision(resp, trace)
+	s.audit.record(resp, trace)
+	s.debug.record(req, resp, trace)
+	s.publishDecision(resp, trace)
+	return resp, nil
+}
+
+// shadow turns a block into an allow flagged WouldBlock in SHADOW_MODE, so a
+// ruleset can be trialled on production traffic before it is enforced.
+func (s *ProxyService) shadow(resp models.AllowResponse) models.AllowResponse {
+	if !s.config.ShadowMode || resp.Allow || resp.Status != "success" {
+		return resp
+	}
+	atomic.AddInt64(&s.shadowBlocks, 1)
+	s.usage.recordShadow()
+	resp.Allow = true
+	resp.WouldBlock = true
+	resp.Message = "Shadow: " + resp.Message
+	return resp
+}
+
+// Decision sources reported in decisionTrace.
+const (
+	sourceMemo       = "memo" // Exact repeat of a recent request
+	sourceRule       = "rule"
+	sourceWarmup     = "warmup"
+	sourceCache      = "cache"
+	sourceLive       = "live"
+	sourceFailOpen   = "fail_open"
+	sourceFailClosed = "fail_closed"
+	sourceUnknown    = "unknown"
+	sourceDeferred   = "deferred" // Live check over LIVE_CHECK_BUDGET_MS, answered provisionally
+	sourceInvalid    = "invalid"
+	sourceQuota      = "quota" // Over a local velocity limit (QUOTA_RULES)
+	// Read replica cache miss, answered with REPLICA_UNKNOWN_ACTION
+	sourceReplicaMiss = "replica_miss"
+)
+
+// Cache states reported in decisionTrace, when the cache was consulted.
+const (
+	cacheTupleHit = "tuple_hit" // The whole key tuple was cached
+	cacheHit      = "hit"
+	cacheMiss     = "miss"
+)
+
+// decisionTrace records how evaluate reached a decision, for metrics,
+// reporting and the debug store.
+type decisionTrace struct {
+	Source   string
+	Keys     []requestKey
+	Cache    string
+	Upstream *DebugUpstream // Set when the decision needed a live check
+	Winner   requestKey     // Key that decided a cache or live decision, if one did
+	Tracked  []requestKey   // Keys added to the next prefetch
 }
 
-func (s *ProxyService) Check(req models.AllowRequest) (models.AllowResponse, error) {
-	atomic.AddInt64(&s.totalReqs, 1)
+// cacheable is false for provisional answers (warmup, upstream failure, deferred) that must not be memoized.
+func (t decisionTrace) cacheable() bool {
+	return t.Source == sourceRule || t.Source == sourceCache || t.Source == sourceLive
+}
 
+// evaluate runs the full decision pipeline.
+func (s *ProxyService) evaluate(ctx context.Context, req models.AllowRequest) (models.AllowResponse, decisionTrace, error) {
 	// 1. Encrypt email (if configured) and track keys for next window
-	reqFor := req // copy
-	if req.Email != "" {
-		// Encrypt the Identifier (Email OR User-ID)
-		reqFor.Email = s.EncryptEmail(req.Email)
+	reqKeys := resolvedKeys(s.config, s.geo, req)
+	trace := decisionTrace{Keys: reqKeys}
+	// During key rotation the identity is also looked up under its
+	// secondary-key hash, which is what older cached/upstream data uses
+	lookupKeys := reqKeys
+	alt, rotating := s.secondaryKey(req)
+	if rotating {
+		lookupKeys = append(slices.Clip(reqKeys), alt)
 	}
-	s.trackKeys(reqFor)
 
-	s.mu.RLock()
-	warmUp := s.warmUp
-	s.mu.RUnlock()
+	// Local rules win over everything else, including warmup. They also see
+	// the location and User-Agent class, which are never cached or sent upstream
+	ruleKeys := append(slices.Clip(reqKeys), localKeys(s.geo, req)...)
+	if action, matched := s.rules.Evaluate(ruleKeys, req.Endpoint); matched {
+		trace.Source = sourceRule
+		if action == RuleAllow {
+			return models.AllowResponse{Allow: true, Status: "success", Message: "Allowed (Local Rule)"}, trace, nil
+		}
+		return models.AllowResponse{Allow: false, Status: "success", Message: "Blocked (Local Rule)", BlockedBy: s.explainRule(ruleKeys, req.Endpoint)}, trace, nil
+	}
 
-	// 2. Warmup Phase
-	if warmUp {
-		return models.AllowResponse{Allow: true, Status: "success", Message: "Warmup: Allowed"}, nil
+	if !s.config.ReadReplica {
+		s.trackKeys(lookupKeys)
+		trace.Tracked = lookupKeys
 	}
 
-	// 3. Check Cache
-	s.mu.RLock()
-	decision, found := s.getFromCache(reqFor)
-	s.mu.RUnlock()
+	// 2. Warmup Phase (read replicas treat a missing snapshot as all-unknown instead)
+	if !s.config.ReadReplica && s.warmingUp() {
+		trace.Source = sourceWarmup
+		if s.config.WarmupAction == WarmupBlock {
+			return models.AllowResponse{Allow: false, Status: "success", Message: "Warmup: Blocked"}, trace, nil
+		}
+		return models.AllowResponse{Allow: true, Status: "success", Message: "Warmup: Allowed"}, trace, nil
+	}
+
+	// 3. Check Cache, the whole key tuple first
+	var tk string
+	gen := s.tuples.generation()
+	if s.tuples != nil {
+		tk = tupleKey(reqKeys)
+	}
+	decision, found := s.tuples.get(tk)
+	trace.Cache = cacheTupleHit
+	if !found {
+		decision, found, trace.Winner = s.getFromCache(reqKeys, alt)
+		trace.Cache = cacheHit
+		if found {
+			s.tuples.put(tk, decision, gen)
+		} else {
+			trace.Cache = cacheMiss
+		}
+	}
 
 	if found {
-		msg := "Cache Hit"
+		resp := models.AllowResponse{Allow: decision, Status: "success", Message: "Cache Hit"}
 		if !decision {
-			msg = "Cache Hit: Blocked"
+			resp.Message = "Cache Hit: Blocked"
+			resp.BlockedBy = s.combiner.explain(s.explainCached(lookupKeys), trace.Winner)
 		}
-		return models.AllowResponse{Allow: decision, Status: "success", Message: msg}, nil
+		trace.Source = sourceCache
+		return resp, trace, nil
+	}
+
+	if s.config.ReadReplica {
+		trace.Source = sourceReplicaMiss
+		if s.config.ReplicaUnknownAction == "block" {
+			return models.AllowResponse{Allow: false, Status: "success", Message: "Blocked (Replica: Unknown Key)"}, trace, nil
+		}
+		return models.AllowResponse{Allow: true, Status: "success", Message: "Allowed (Replica: Unknown Key)"}, trace, nil
 	}
 
 	// 4. Cache Miss -> Fallback to Batch Upstream
 	// We use the batch endpoint even for a single request context to get status for each key separately.
 	// This allows us to cache both ALLOW and BLOCK statuses for specific keys.
 
-	atomic.AddInt64(&s.individualCalls, 1)
-
 	// Collect keys from this request
-	keys := make([]string, 0, 3)
-	if reqFor.IPAddress != "" {
-		keys = append(keys, reqFor.IPAddress)
-	}
-	if reqFor.Email != "" {
-		// reqFor.Email is a one-way hash when key configured
-		keys = append(keys, reqFor.Email)
-	}
-	if reqFor.UserAgent != "" {
-		keys = append(keys, utils.CompressUserAgent(reqFor.UserAgent))
-	}
+	// reqFor.Email is a one-way hash when key configured
+	keys := keyValues(lookupKeys)
 
 	if len(keys) == 0 {
-		return models.AllowResponse{Allow: false, Status: "error", Message: "No keys provided"}, nil
+		trace.Source = sourceInvalid
+		return models.AllowResponse{Allow: false, Status: "error", Message: "No keys provided"}, trace, ErrNoKeys
 	}
 
-	// Call Upstream Batch
-	results, err := s.callUpstreamBatch(keys)
+	// Call Upstream Batch (deduplicated across concurrent misses on the same keys)
+	started := time.Now()
+	call := s.live.join(ctx, strings.Join(keys, "\x00"), func(ctx context.Context) ([]models.BatchAllowResponseItem, error) {
+		return s.callUpstreamBatch(ctx, keys)
+	})
+	ok, err := s.awaitLive(ctx, call)
 	if err != nil {
+		// The caller is gone or out of time; nobody reads this answer
+		return models.AllowResponse{}, trace, err
+	}
+	trace.Upstream = &DebugUpstream{Keys: keys, LatencyMs: time.Since(started).Milliseconds()}
+	if !ok {
+		// Over LIVE_CHECK_BUDGET_MS: answer now, reconcile via callback later
+		trace.Source = sourceDeferred
+		trace.Upstream.Deferred = true
+		return s.deferLive(call, lookupKeys, req.CallbackURL), trace, nil
+	}
+	trace.Upstream.Shared = call.shared
+	if call.err != nil {
+		trace.Upstream.Error = call.err.Error()
+		var resp models.AllowResponse
+		resp, trace.Source = s.failResponse(call.err)
+		return resp, trace, nil
+	}
+
+	trace.Source = sourceLive
+	trace.Upstream.Results = call.items
+	var resp models.AllowResponse
+	resp, trace.Winner = s.applyLive(lookupKeys, trace.Upstream.Results)
+	return resp, trace, nil
+}
+
+// Answers to a failed live check (FAIL_MODE).
+const (
+	FailOpen    = "open"
+	FailClosed  = "closed"
+	FailUnknown = "unknown"
+)
+
+// StatusUnknown is the AllowResponse status with FAIL_MODE=unknown: no
+// decision could be made and the caller applies its own policy.
+const StatusUnknown = "unknown"
+
+// failResponse answers a request whose live check failed or timed out,
+// according to FAIL_MODE (or FAIL_SWITCH_TO while upstream availability is
+// low), and returns the decision source to report.
+func (s *ProxyService) failResponse(err error) (models.AllowResponse, string) {
+	switch s.failMode() {
+	case FailClosed:
+		logFor(componentProxy).Warn("upstream check failed", "fail_mode", FailClosed, "error", err)
+		return models.AllowResponse{Allow: false, Status: "success", Message: "Blocked (Fail Closed)"}, sourceFailClosed
+	case FailUnknown:
+		logFor(componentProxy).Warn("upstream check failed", "fail_mode", FailUnknown, "error", err)
+		return models.AllowResponse{Allow: false, Status: StatusUnknown, Message: "Unknown (Upstream Unavailable)", Error: err.Error()}, sourceUnknown
+	default:
 		// FAIL OPEN STRATEGY: If upstream is down, allow traffic to proceed.
-		log.Printf("[ProxyService] Upstream check failed (Fail Open triggering): %v", err)
-		return models.AllowResponse{
-			Allow:   true,
-			Status:  "success",
-			Message: "Allowed (Fail Open)",
-		}, nil
+		logFor(componentProxy).Warn("upstream check failed", "fail_mode", FailOpen, "error", err)
+		return models.AllowResponse{Allow: true, Status: "success", Message: "Allowed (Fail Open)"}, sourceFailOpen
 	}
+}
 
-	// Process Results & Update Cache
-	s.mu.Lock()
-	allowed := true
+// applyLive caches live check results and combines them into the decision,
+// returned with the key that decided it.
+func (s *ProxyService) applyLive(reqKeys []requestKey, results []models.BatchAllowResponseItem) (models.AllowResponse, requestKey) {
+	// Process Results & Update Cache. Held for reading only: writes go to
+	// the cache's shards, and a swap must not replace it meanwhile.
+	s.mu.RLock()
+	now := time.Now()
+	decisions := make([]keyDecision, 0, len(results))
 	for _, item := range results {
-		// Update cache for this specific key
-		s.currentCache[item.Key] = item.Allow
-		// If any part of the request is blocked, the whole request is blocked
-		if !item.Allow {
-			allowed = false
+		// Update cache for this specific key, in the window owning its type
+		keyType := keyTypeOf(reqKeys, item)
+		if prev, ok := s.cacheFor(keyType).put(item); ok && prev != item.Allow {
+			// Combined decisions involving this key are now stale
+			s.tuples.invalidate()
 		}
+		s.reasons.note(item)
+		s.labels.note(item)
+		s.ttls.note(item, now)
+		item.Type = keyType
+		s.gossip.publish(item)
+		decisions = append(decisions, keyDecision{key: requestKey{keyType, item.Key}, allow: item.Allow, known: true})
 	}
-	s.mu.Unlock()
+	s.mu.RUnlock()
 
-	msg := "Allowed (Live Check)"
-	if !allowed {
-		msg = "Blocked (Live Check)"
+	// An empty result allows, as no key was blocked
+	allowed, _, winner := s.combiner.combine(decisions)
+	if allowed || len(decisions) == 0 {
+		return models.AllowResponse{Allow: true, Status: "success", Message: "Allowed (Live Check)"}, winner
 	}
+	blockedBy := s.combiner.explain(explainLive(reqKeys, results), winner)
+	return models.AllowResponse{Allow: false, Status: "success", Message: "Blocked (Live Check)", BlockedBy: blockedBy}, winner
+}
 
-	return models.AllowResponse{Allow: allowed, Status: "success", Message: msg}, nil
+// trackKeys batches keys for their window's next prefetch. It runs on every
+// request without taking s.mu.
+func (s *ProxyService) trackKeys(keys []requestKey) {
+	for _, k := range keys {
+		// Past the cap (e.g. during a scan) new keys are only live-checked
+		if !s.batchFor(k.Type).add(k.Value) {
+			atomic.AddInt64(&s.keyOverflows, 1)
+		}
+	}
 }
 
-func (s *ProxyService) trackKeys(req models.AllowRequest) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// reportOverflow raises the cardinality alert for a window whose batch
+// overflowed, once per window.
+func (s *ProxyService) reportOverflow(window string, overflow int) {
+	if overflow == 0 {
+		return
+	}
+	logFor(componentProxy).Warn("key cardinality overflow: new keys beyond MAX_KEYS_PER_WINDOW were live-checked only",
+		"alert", true, "window", window, "overflow", overflow, "max_keys", s.config.MaxWindowKeys)
+}
+
+// requestKey is a single cacheable identity extracted from an AllowRequest.
+type requestKey struct {
+	Type  string
+	Value string
+}
+
+// canonicalIP rewrites req's IP address in its canonical form, so an IPv6
+// address written two ways is cached and sent upstream as one key.
+func canonicalIP(req *models.AllowRequest) error {
+	if req.IPAddress == "" {
+		return nil
+	}
+	ip, ok := utils.NormalizeIP(req.IPAddress)
+	if !ok {
+		return ErrInvalidIP
+	}
+	req.IPAddress = ip
+	return nil
+}
+
+// resolvedKeys returns the lookup keys of req: the identity normalized and
+// encrypted (if configured) and the IP resolved to its ASN.
+func resolvedKeys(cfg *config.Config, geo *GeoIP, req models.AllowRequest) []requestKey {
+	if req.Email != "" {
+		// Normalize and encrypt the Identifier (Email OR User-ID)
+		req.Email, req.IdentityType = identityKey(cfg, req.Email, req.IdentityType)
+	}
+	if geo != nil {
+		req.ASN = geo.LookupASN(req.IPAddress)
+	}
+	return requestKeys(cfg, req)
+}
 
+// requestKeys returns the cache/upstream keys for a request in a fixed order.
+// The identity is expected to be normalized and encrypted already (see
+// IdentityKey); the UA is hashed here.
+func requestKeys(cfg *config.Config, req models.AllowRequest) []requestKey {
+	keys := make([]requestKey, 0, 8)
 	if req.IPAddress != "" {
-		s.batchedKeys[req.IPAddress] = struct{}{}
+		keys = append(keys, requestKey{models.KeyTypeIP, req.IPAddress})
 	}
 	if req.Email != "" {
-		s.batchedKeys[req.Email] = struct{}{}
+		keyType := models.KeyTypeEmail
+		if req.IdentityType == utils.IdentityUserID {
+			keyType = models.KeyTypeUserID
+		}
+		keys = append(keys, requestKey{keyType, req.Email})
 	}
 	if req.UserAgent != "" {
-		// Hash the UA before tracking
-		hashedUA := utils.CompressUserAgent(req.UserAgent)
-		s.batchedKeys[hashedUA] = struct{}{}
+		keys = append(keys, requestKey{models.KeyTypeUserAgent, userAgentKey(cfg, req.UserAgent)})
+	}
+	if req.ClientCertFingerprint != "" {
+		keys = append(keys, requestKey{models.KeyTypeClientCert, utils.NormalizeFingerprint(req.ClientCertFingerprint)})
+	}
+	if req.JA3 != "" {
+		keys = append(keys, requestKey{models.KeyTypeJA3, strings.ToLower(req.JA3)})
 	}
+	if req.RequestFingerprint != "" {
+		keys = append(keys, requestKey{models.KeyTypeRequestFP, req.RequestFingerprint})
+	}
+	if req.ASN != "" {
+		keys = append(keys, requestKey{models.KeyTypeASN, req.ASN})
+	}
+	return keys
 }
 
-func (s *ProxyService) getFromCache(req models.AllowRequest) (bool, bool) {
-	// Default to true (allow) only if ALL keys are present and true.
-	// If ANY key is present and false (block), then BLOCK.
-	// If keys are missing, then return found=false (Cache Miss).
-
-	ipStatus, ipKnown := s.currentCache[req.IPAddress]
-	emailStatus, emailKnown := s.currentCache[req.Email]
+// keyTypeOf returns the type of the request key an upstream result answers,
+// falling back to the type reported by the upstream.
+func keyTypeOf(keys []requestKey, item models.BatchAllowResponseItem) string {
+	for _, k := range keys {
+		if k.Value == item.Key {
+			return k.Type
+		}
+	}
+	return item.Type
+}
 
-	// Logic:
-	// If IP is known and blocked -> Block
-	if req.IPAddress != "" && ipKnown && !ipStatus {
-		return false, true
+func keyValues(keys []requestKey) []string {
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = k.Value
 	}
-	// If Email is known and blocked -> Block
-	if req.Email != "" && emailKnown && !emailStatus {
-		return false, true
+	return values
+}
+
+// getFromCache combines the cached decisions for keys (see decisionCombiner)
+// and returns the deciding key. alt, when set, is the identity hashed under
+// the secondary encryption key: it stands in for the primary identity key
+// when that is not cached yet, and blocks like any key.
+func (s *ProxyService) getFromCache(keys []requestKey, alt requestKey) (bool, bool, requestKey) {
+	// By default, allow only if ALL keys are present and true.
+	// If ANY key is present and false (block), then BLOCK.
+	// If keys are missing, then return found=false (Cache Miss).
+	if len(keys) == 0 {
+		return false, false, requestKey{} // Nothing to check
 	}
 
-	// Check UA
-	var uaStatus, uaKnown bool
-	if req.UserAgent != "" {
-		hashedUA := utils.CompressUserAgent(req.UserAgent)
-		uaStatus, uaKnown = s.currentCache[hashedUA]
-		if uaKnown && !uaStatus {
-			return false, true
+	now := time.Now()
+	var altDecision keyDecision
+	if alt.Value != "" {
+		status, known := s.cacheFor(alt.Type).get(alt.Value)
+		if known && s.ttls.expired(alt.Value, status, now) {
+			known = false
 		}
+		altDecision = keyDecision{key: alt, allow: status, known: known}
 	}
 
-	// If both are required and known and allowed -> Allow
-	// What if only one is provided?
-	ipOk := (req.IPAddress == "") || (ipKnown && ipStatus)
-	emailOk := (req.Email == "") || (emailKnown && emailStatus)
-	uaOk := (req.UserAgent == "") || (uaKnown && uaStatus)
-
-	if ipOk && emailOk && uaOk {
-		// Both are "OK" (either empty or known-allow).
-		// But we must ensure at least one was actually checked?
-		// If input is empty, that's an error elsewhere, but here:
-		if req.IPAddress == "" && req.Email == "" && req.UserAgent == "" {
-			return false, false // Nothing to check
+	decisions := make([]keyDecision, 0, len(keys)+1)
+	for _, k := range keys {
+		cache := s.cacheFor(k.Type)
+		status, known := cache.get(k.Value)
+		if known && s.ttls.expired(k.Value, status, now) {
+			known = false // Past CACHE_ALLOW_TTL_SECONDS or CACHE_BLOCK_TTL_SECONDS
 		}
-
-		// If we have a partial miss (e.g. IP known allow, Email unknown), we treat as MISS.
-		if (req.IPAddress != "" && !ipKnown) || (req.Email != "" && !emailKnown) || (req.UserAgent != "" && !uaKnown) {
-			return false, false
+		if !known && k.Type == models.KeyTypeIP {
+			// Fall back to the most specific cached range covering the address
+			if addr, err := netip.ParseAddr(k.Value); err == nil {
+				status, known = cache.lookupRange(addr)
+			}
 		}
-
-		return true, true
+		d := keyDecision{key: k, allow: status, known: known}
+		if !known && altDecision.known && k.Type == alt.Type {
+			d = altDecision // Known under the secondary key
+		}
+		decisions = append(decisions, d)
 	}
-
-	// Fallback (should be covered by miss logic)
-	return false, false
+	if altDecision.known && !altDecision.allow {
+		decisions = append(decisions, altDecision)
+	}
+	return s.combiner.combine(decisions)
 }
 
 func (s *ProxyService) prefetch() {
-	s.mu.Lock()
-	// Collect keys to fetch
-	keys := make([]string, 0, len(s.batchedKeys))
-	for k := range s.batchedKeys {
-		keys = append(keys, k)
-	}
-
-	// Reset collected keys for the next window tracking.
+	// Collect keys to fetch and reset them for the next window tracking.
 	// We reset here so that any new requests coming in during the 'fetch gap'
 	// start populating the batch for the subsequent window.
-	s.batchedKeys = make(map[string]struct{})
-	s.mu.Unlock()
+	batched, overflow := s.batchedKeys.drain()
+	s.reportOverflow("default", overflow)
+	if s.leader != nil {
+		// Election and the shared cache live in storage; keep that I/O off the scheduler
+		s.goWorker(func() { s.prefetchClustered(batched) })
+		return
+	}
+	s.prefetchKeys(batched)
+}
+
+// prefetchKeys starts fetching the default window's next cache for batched.
+func (s *ProxyService) prefetchKeys(batched map[string]int) {
+	keys := prefetchOrder(batched, s.current.Load())
 
 	if len(keys) == 0 {
 		return
@@ -279,78 +768,190 @@ func (s *ProxyService) prefetch() {
 	// Call Upstream
 	// Note: Doing this outside lock
 	atomic.StoreInt64(&s.lastBatchSize, int64(len(keys)))
-	go func(batchKeys []string) {
-		log.Printf("Prefetching %d keys for next window...", len(batchKeys))
-		results, err := s.callUpstreamBatch(batchKeys)
-		if err != nil {
-			log.Printf("[ProxyService] Error prefetching batch: %v", err)
-			return
-		}
+	logFor(componentProxy).Info("prefetching keys for next window", "window", "default", "batch_size", len(keys))
+	if s.config.PrefetchDelta {
+		s.goWorker(func() { s.fetchDelta(keys) })
+		return
+	}
+	s.goWorker(func() { s.fetchPending(keys, s.storePending("")) })
+}
 
-		newCache := make(map[string]bool)
-		for _, cx := range results {
-			newCache[cx.Key] = cx.Allow
-		}
+// storePending returns a store func for fetchPending that makes the fetched
+// cache, at change-feed version, the default window's next cache.
+func (s *ProxyService) storePending(version string) func(*decisionCache) {
+	return func(cache *decisionCache) {
+		s.pending = cache
+		s.pendingVersion = version
+	}
+}
+
+// fetchPending fetches decisions for keys, chunk by chunk, and hands the
+// resulting cache to store, which runs under s.mu. Nothing is stored when no
+// chunk succeeds.
+func (s *ProxyService) fetchPending(keys []string, store func(*decisionCache)) {
+	// Built outside the lock, so the swap is a single pointer assignment.
+	newCache := newDecisionCache()
+	if s.fetchInto(newCache, keys) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	store(newCache)
+	s.mu.Unlock()
+	logFor(componentProxy).Info("prefetch complete, pending cache updated", "batch_size", newCache.len())
+}
 
-		s.mu.Lock()
-		s.pendingCache = newCache
-		s.mu.Unlock()
-		log.Println("Prefetch complete. Pending cache updated.")
-	}(keys)
+// fetchInto fetches decisions for keys into cache, chunk by chunk, and
+// returns how many keys the completed chunks covered. Streaming (NDJSON)
+// responses are inserted item by item as they arrive.
+func (s *ProxyService) fetchInto(cache *decisionCache, keys []string) int {
+	fetched, err := s.fetchChunks(keys, func(cx models.BatchAllowResponseItem) {
+		cache.put(cx)
+		s.reasons.note(cx)
+		s.labels.note(cx)
+		s.ttls.note(cx, time.Now())
+	})
+	s.prefetches.record(err)
+	if err != nil {
+		logFor(componentProxy).Error("error prefetching batch", "batch_size", len(keys), "error", err)
+		if fetched > 0 {
+			// Earlier chunks hold the highest-priority keys (see prefetchOrder);
+			// keep them and leave the rest to live checks.
+			logFor(componentProxy).Info("keeping prefetched keys from completed chunks", "fetched", fetched, "batch_size", len(keys))
+		}
+	}
+	return fetched
 }
 
 func (s *ProxyService) swapCache() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.warmUp = false
+	if s.config.WarmupSeconds <= 0 {
+		s.warmUp.Store(false)
+	}
 
 	// Swap the cache
-	if s.pendingCache != nil {
-		s.currentCache = s.pendingCache
-		s.pendingCache = nil
+	prev := s.current.Load()
+	next := prev
+	if s.pending != nil {
+		next = s.pending
+		s.pending = nil
+		s.currentVersion, s.pendingVersion = s.pendingVersion, ""
+		s.freshAt, s.stale = time.Now(), false
+	} else if s.keepStale("default", s.freshAt, prev) {
+		s.stale = true
 	} else {
 		// If fetch failed or no keys were pending, ensure we have a valid empty cache
-		s.currentCache = make(map[string]bool)
+		next = newDecisionCache()
+		s.currentVersion = ""
+		s.stale = false
 	}
+	if !s.stale {
+		// Carried before the swap, so no lookup sees the new cache without them
+		if n := s.ttls.carry(prev, next, time.Now()); n > 0 {
+			logFor(componentProxy).Info("carried decisions within their TTL into the new window", "window", "default", "carried", n)
+		}
+	}
+	s.current.Store(next)
+	// After the store: a tuple combined from the old cache is refused by
+	// its generation
+	s.tuples.invalidate()
+	s.reasons.prune(s.cachedBlock)
+	s.labels.prune(s.cachedAnywhere)
+	s.ttls.prune(s.cachedAnywhere)
 
 	// Logging Efficiency Stats
-	total := atomic.SwapInt64(&s.totalReqs, 0)
-	individual := atomic.SwapInt64(&s.individualCalls, 0)
-	batchSize := atomic.SwapInt64(&s.lastBatchSize, 0)
+	win := s.efficiency.endWindow(atomic.SwapInt64(&s.lastBatchSize, 0))
+	upstreamKeys := s.cost.endWindow()
 
-	log.Printf("[Window Stats] Total Requests: %d, Individual Upstream Calls: %d, Batch Keys Prefetched: %d",
-		total, individual, batchSize)
+	s.publishSwap("default", next.len(), s.stale)
+	logFor(componentProxy).Info("window stats", "window", "default", "total_requests", win.Requests,
+		"individual_upstream_calls", win.UpstreamCalls, "batch_size", win.BatchSize, "upstream_keys", upstreamKeys,
+		"hit_ratio", win.HitRatio)
 }
 
-// Http Utils
-
-func (s *ProxyService) callUpstreamBatch(keys []string) ([]models.BatchAllowResponseItem, error) {
-	url := fmt.Sprintf("%s/api/allow/batch", s.config.UpstreamBaseURL)
-	body, _ := json.Marshal(keys)
-
-	r, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
+// fetchChunks fetches keys in PREFETCH_CHUNK_SIZE requests, up to
+// PREFETCH_CHUNK_CONCURRENCY at a time and started PREFETCH_CHUNK_DELAY_MS
+// apart, in key order. Results are handed to visit as they arrive, one at a
+// time. No further chunks are started once one fails; the error is returned
+// with how many keys the completed chunks covered.
+func (s *ProxyService) fetchChunks(keys []string, visit func(models.BatchAllowResponseItem)) (int, error) {
+	size := s.config.PrefetchChunkSize
+	if size <= 0 {
+		size = len(keys)
 	}
-	r.Header.Set("Content-Type", "application/json")
-	if s.config.UpstreamAPIKey != "" {
-		r.Header.Set("X-API-Key", s.config.UpstreamAPIKey)
+	delay := time.Duration(s.config.PrefetchChunkDelayMs) * time.Millisecond
+
+	var (
+		mu      sync.Mutex
+		fetched int
+		failed  atomic.Bool
+	)
+	var g errgroup.Group
+	g.SetLimit(max(s.config.PrefetchConcurrency, 1))
+	for start := 0; start < len(keys); start += size {
+		if start > 0 && delay > 0 {
+			time.Sleep(delay)
+		}
+		chunk := keys[start:min(start+size, len(keys))]
+		g.Go(func() error {
+			if failed.Load() {
+				return nil // An earlier chunk failed; leave the rest to live checks
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout(s.config))
+			defer cancel()
+			err := s.fetchUpstreamBatch(ctx, chunk, func(item models.BatchAllowResponseItem) {
+				mu.Lock()
+				visit(item)
+				mu.Unlock()
+			})
+			if err != nil {
+				failed.Store(true)
+				return err
+			}
+			mu.Lock()
+			fetched += len(chunk)
+			mu.Unlock()
+			return nil
+		})
 	}
+	err := g.Wait()
+	return fetched, err
+}
 
-	resp, err := s.client.Do(r)
+// Http Utils
+
+func (s *ProxyService) callUpstreamBatch(ctx context.Context, keys []string) ([]models.BatchAllowResponseItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, liveCheckTimeout(s.config))
+	defer cancel()
+	results := make([]models.BatchAllowResponseItem, 0, len(keys))
+	err := s.fetchUpstreamBatch(ctx, keys, func(item models.BatchAllowResponseItem) {
+		results = append(results, item)
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return results, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("upstream returned status: %d", resp.StatusCode)
+// fetchUpstreamBatch requests decisions for keys over the configured transport
+// and calls visit for every decision. Streaming responses (NDJSON or gRPC) are
+// consumed incrementally instead of buffered as a whole.
+func (s *ProxyService) fetchUpstreamBatch(ctx context.Context, keys []string, visit func(models.BatchAllowResponseItem)) error {
+	if !s.breaker.allow(time.Now()) {
+		return ErrCircuitOpen
 	}
-
-	var result []models.BatchAllowResponseItem
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	s.cost.record(len(keys))
+	s.usage.recordKeys(len(keys))
+	err := s.transport.AllowBatch(ctx, keys, visit)
+	if err != nil && ctx.Err() == context.Canceled {
+		// Abandoned by the requests waiting for it, not an upstream failure
+		s.breaker.release()
+		return err
 	}
-	return result, nil
+	s.usage.recordUpstream(err)
+	s.failSwitch.record(err, time.Now())
+	s.breaker.record(err, time.Now())
+	return err
 }
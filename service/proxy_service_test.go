@@ -1,14 +1,23 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
 	"apigate-proxy/models"
+	"apigate-proxy/storage"
 	"apigate-proxy/utils"
 )
 
@@ -61,7 +70,7 @@ func TestProxyService_Flow(t *testing.T) {
 		EmailEncryptionEnabled: true,
 	}
 
-	svc := NewProxyService(cfg)
+	svc := NewProxyService(cfg, nil, nil)
 	// We do NOT call svc.Start() because we want to manually control prefetch/swap for deterministic testing.
 	// But `Start` uses internal goroutine.
 	// Let's modify `Start` or just call methods manually.
@@ -69,18 +78,18 @@ func TestProxyService_Flow(t *testing.T) {
 
 	// A. Warmup Phase
 	req1 := models.AllowRequest{IPAddress: "1.2.3.4"}
-	resp1, _ := svc.Check(req1)
+	resp1, _ := svc.Check(context.Background(), req1)
 	if !resp1.Allow || resp1.Message != "Warmup: Allowed" {
 		t.Errorf("Expected Warmup Allowed, got %v", resp1)
 	}
 
 	// Track some keys
-	svc.Check(models.AllowRequest{IPAddress: "5.6.7.8"}) // Safe IP
-	svc.Check(models.AllowRequest{Email: "blocked@test.com"})
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "5.6.7.8"}) // Safe IP
+	svc.Check(context.Background(), models.AllowRequest{Email: "blocked@test.com"})
 
 	// Verify tracked keys
 	svc.mu.RLock()
-	if _, ok := svc.batchedKeys["1.2.3.4"]; !ok {
+	if !svc.batchedKeys.has("1.2.3.4") {
 		t.Error("1.2.3.4 not tracked")
 	}
 	svc.mu.RUnlock()
@@ -91,14 +100,14 @@ func TestProxyService_Flow(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	svc.mu.RLock()
-	if svc.pendingCache == nil {
+	if svc.pending == nil {
 		t.Error("Pending cache not built")
 	}
 	// Check content of pending cache
-	if allow, ok := svc.pendingCache["1.2.3.4"]; !ok || allow {
+	if allow, ok := svc.pending.get("1.2.3.4"); !ok || allow {
 		t.Errorf("1.2.3.4 should be in pending cache and blocked (false), got %v", allow)
 	}
-	if allow, ok := svc.pendingCache["5.6.7.8"]; !ok || !allow {
+	if allow, ok := svc.pending.get("5.6.7.8"); !ok || !allow {
 		t.Errorf("5.6.7.8 should be in pending cache and allowed (true), got %v", allow)
 	}
 	svc.mu.RUnlock()
@@ -106,18 +115,16 @@ func TestProxyService_Flow(t *testing.T) {
 	// C. Trigger Swap (Simulate Window End)
 	svc.swapCache()
 
-	svc.mu.RLock()
-	if svc.warmUp {
+	if svc.warmUp.Load() {
 		t.Error("Warmup should be off")
 	}
-	if len(svc.currentCache) == 0 {
+	if svc.current.Load().len() == 0 {
 		t.Error("Current cache empty after swap")
 	}
-	svc.mu.RUnlock()
 
 	// D. Verify Cache Hit (Window 2)
 	// 1.2.3.4 is blocked in cache
-	resp2, _ := svc.Check(req1)
+	resp2, _ := svc.Check(context.Background(), req1)
 	if resp2.Allow {
 		t.Error("Expected 1.2.3.4 to be blocked from cache")
 	}
@@ -126,31 +133,1154 @@ func TestProxyService_Flow(t *testing.T) {
 	}
 
 	// 5.6.7.8 is allowed in cache
-	resp3, _ := svc.Check(models.AllowRequest{IPAddress: "5.6.7.8"})
+	resp3, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "5.6.7.8"})
 	if !resp3.Allow {
 		t.Error("Expected 5.6.7.8 to be allowed from cache")
 	}
 
 	// E. Unknown Key (Cache Miss -> Individual)
 	// 9.9.9.9 is new. Should be miss -> upstream (Allow).
-	resp4, _ := svc.Check(models.AllowRequest{IPAddress: "9.9.9.9"})
+	resp4, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "9.9.9.9"})
 	if !resp4.Allow {
 		t.Error("Expected 9.9.9.9 to be allowed (upstream)")
 	}
 
 	// F. Verify Individual Caching Optimization
-	// Since 9.9.9.9 was allowed, it should be added to currentCache immediately.
-	svc.mu.RLock()
-	cached, ok := svc.currentCache["9.9.9.9"]
-	svc.mu.RUnlock()
+	// Since 9.9.9.9 was allowed, it should be added to the current cache immediately.
+	cached, ok := svc.current.Load().get("9.9.9.9")
 
 	if !ok || !cached {
-		t.Error("Optimization failed: 9.9.9.9 should be added to currentCache after individual block check success")
+		t.Error("Optimization failed: 9.9.9.9 should be added to the current cache after individual block check success")
 	}
 
 	// Verify subsequent hit
-	resp5, _ := svc.Check(models.AllowRequest{IPAddress: "9.9.9.9"})
+	resp5, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "9.9.9.9"})
 	if resp5.Message != "Cache Hit" {
 		t.Errorf("Expected immediate Cache Hit for 9.9.9.9, got %s", resp5.Message)
 	}
 }
+
+func TestProxyService_CoalescesConcurrentMisses(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll, upstreamtest.Delay(100*time.Millisecond))
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL}, nil, nil)
+	svc.swapCache() // leave warmup
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			svc.Check(context.Background(), models.AllowRequest{IPAddress: "7.7.7.7"})
+		}()
+	}
+	wg.Wait()
+
+	if n := upstream.Calls(); n != 1 {
+		t.Errorf("Expected 1 upstream call for concurrent misses, got %d", n)
+	}
+}
+
+func TestProxyService_CheckCanceled(t *testing.T) {
+	received := make(chan struct{}, 2)
+	canceled := make(chan struct{}, 2)
+	release := make(chan struct{})
+	upstream := upstreamtest.New(t, upstreamtest.BlockAll, func(w http.ResponseWriter, r *http.Request) bool {
+		received <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+			return false
+		case <-release:
+			return true
+		}
+	})
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL}, nil, nil)
+	svc.swapCache() // leave warmup
+	waiters := func(key string) int {
+		svc.live.mu.Lock()
+		defer svc.live.mu.Unlock()
+		if c, ok := svc.live.calls[key]; ok {
+			return c.waiters
+		}
+		return 0
+	}
+
+	// The live check of a caller that went away is canceled upstream
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	if _, err := svc.Check(ctx, models.AllowRequest{IPAddress: "6.6.6.6"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the upstream call to be canceled")
+	}
+	if !svc.upstream.endpoints[0].healthy {
+		t.Error("Expected a canceled call not to mark the upstream unhealthy")
+	}
+
+	// A caller leaving a shared live check does not cancel it for the others
+	ctx, cancel = context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := svc.Check(ctx, models.AllowRequest{IPAddress: "7.7.7.7"})
+		first <- err
+	}()
+	<-received
+	second := make(chan models.AllowResponse, 1)
+	go func() {
+		resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "7.7.7.7"})
+		second <- resp
+	}()
+	for waiters("7.7.7.7") != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the canceled caller to get context.Canceled, got %v", err)
+	}
+	close(release)
+	if resp := <-second; resp.Message != "Blocked (Live Check)" {
+		t.Errorf("Expected the remaining caller to get the live decision, got %+v", resp)
+	}
+	if len(canceled) != 0 {
+		t.Error("Expected the shared upstream call not to be canceled")
+	}
+}
+
+func TestProxyService_UpstreamTimeouts(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.BlockAll, upstreamtest.Delay(200*time.Millisecond))
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, LiveCheckTimeoutMs: 50}, nil, nil)
+	svc.swapCache() // leave warmup
+
+	// A live check gives up after LIVE_CHECK_TIMEOUT_MS and fails open
+	started := time.Now()
+	resp, err := svc.Check(context.Background(), models.AllowRequest{IPAddress: "5.5.5.5"})
+	if err != nil || resp.Message != "Allowed (Fail Open)" {
+		t.Fatalf("Expected the live check to time out, got %+v, %v", resp, err)
+	}
+	if elapsed := time.Since(started); elapsed >= 200*time.Millisecond {
+		t.Errorf("Expected the live check to give up early, took %v", elapsed)
+	}
+
+	// A prefetch of the same speed is within PREFETCH_TIMEOUT_SECONDS
+	svc.trackKeys([]requestKey{{models.KeyTypeIP, "5.5.5.5"}})
+	svc.prefetch()
+	if err := svc.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	if allow, ok := svc.pending.get("5.5.5.5"); !ok || allow {
+		t.Errorf("Expected the prefetch to complete, got %v, %v", allow, ok)
+	}
+}
+
+func TestProxyService_DecisionMemo(t *testing.T) {
+	var calls int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		json.NewEncoder(w).Encode([]models.BatchAllowResponseItem{{Key: "8.8.8.8", Allow: false}})
+	}))
+	defer upstream.Close()
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, DecisionMemoTTLMs: 500, AuditStoreSize: 10}, nil, nil)
+
+	// Warmup answers are provisional and must not be memoized
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "8.8.8.8"})
+	svc.swapCache()
+
+	first, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "8.8.8.8"})
+	if first.Allow || first.Message != "Blocked (Live Check)" {
+		t.Fatalf("Expected live block, got %v", first)
+	}
+
+	// Clearing the cache proves the repeat is served from the memo
+	svc.current.Store(newDecisionCache())
+	svc.batchedKeys.drain()
+
+	second, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "8.8.8.8"})
+	if second.Allow != first.Allow || second.Message != first.Message {
+		t.Errorf("Expected memoized response %v, got %v", first, second)
+	}
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", n)
+	}
+
+	// The memoized key stays in the next prefetch
+	if !svc.batchedKeys.has("8.8.8.8") {
+		t.Error("Expected a memo hit to track its keys for the next prefetch")
+	}
+	// A request differing in any field is not served from the memo
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "8.8.8.8", Endpoint: "/login"})
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Errorf("Expected a different request to miss the memo and go upstream, got %d calls", n)
+	}
+
+	// Memo hits are audited and counted like any other decision
+	page, _ := svc.QueryDecisions(AuditQuery{})
+	if len(page.Records) != 4 || page.Records[1].Source != sourceMemo || len(page.Records[1].Keys) != 1 {
+		t.Errorf("Expected the memo hit in the audit store with its key, got %+v", page.Records)
+	}
+	if r := svc.UsageReport(10); r.TotalRequests != 4 || r.BlockedRequests != 3 || r.CacheHits != 1 {
+		t.Errorf("Expected both decisions in the usage stats, got %+v", r)
+	}
+}
+
+func TestProxyService_Stats(t *testing.T) {
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: "http://127.0.0.1:0", UpstreamBaseURLs: []string{"http://127.0.0.1:0"}}, nil, nil)
+
+	if st := svc.Stats(); !st.WarmUp || st.NextSwapSeconds != 0 {
+		t.Fatalf("before Start: got %+v", st)
+	}
+
+	svc.setNextSwap(20*time.Second, time.Now().Add(10*time.Second))
+	st := svc.Stats()
+	if st.WindowSeconds != 20 || st.NextSwapSeconds <= 9 || st.NextSwapSeconds > 10 {
+		t.Fatalf("unexpected countdown: %+v", st)
+	}
+	if st.WarmupRemainingSeconds != st.NextSwapSeconds {
+		t.Errorf("warmup remaining %v, want %v", st.WarmupRemainingSeconds, st.NextSwapSeconds)
+	}
+	if warmup, next := svc.Freshness(); next <= 9 || next > 10 || warmup != next {
+		t.Errorf("Freshness: got warmup %v, next swap %v", warmup, next)
+	}
+
+	svc.swapCache()
+	if st := svc.Stats(); st.WarmUp || st.WarmupRemainingSeconds != 0 {
+		t.Errorf("after swap: got %+v", st)
+	}
+	if warmup, _ := svc.Freshness(); warmup != 0 {
+		t.Errorf("Freshness after swap: got warmup %v", warmup)
+	}
+}
+
+func TestProxyService_EfficiencyStats(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll)
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL}, nil, nil)
+	svc.swapCache() // leave warmup
+	svc.current.Store(cacheOf(map[string]bool{"8.8.8.8": true}))
+
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "8.8.8.8"})
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "8.8.8.8", UserAgent: "curl/8.0"})
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "9.9.9.9"})
+
+	win := svc.Stats().Efficiency.Window
+	if win.Requests != 3 || win.CacheHits != 1 || win.UpstreamCalls != 2 || win.HitRatio != 0.333 {
+		t.Errorf("Unexpected window counters: %+v", win.EfficiencyCounters)
+	}
+	if ip := win.KeyTypes[models.KeyTypeIP]; ip.Requests != 3 || ip.CacheHits != 1 {
+		t.Errorf("Unexpected ip counters: %+v", ip)
+	}
+	if ua := win.KeyTypes[models.KeyTypeUserAgent]; ua.Requests != 1 || ua.UpstreamCalls != 1 {
+		t.Errorf("Unexpected user_agent counters: %+v", ua)
+	}
+
+	// The window resets at the swap; the totals carry on
+	atomic.StoreInt64(&svc.lastBatchSize, 2)
+	svc.swapCache()
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "9.9.9.9"})
+	st := svc.Stats().Efficiency
+	if st.LastWindow == nil || st.LastWindow.Requests != 3 || st.LastWindow.BatchSize != 2 {
+		t.Errorf("Unexpected last window: %+v", st.LastWindow)
+	}
+	if st.Window.Requests != 1 || st.Total.Requests != 4 || st.Total.KeyTypes[models.KeyTypeIP].Requests != 4 {
+		t.Errorf("Unexpected window %+v and total %+v", st.Window, st.Total)
+	}
+}
+
+func TestProxyService_TypedErrors(t *testing.T) {
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: "http://127.0.0.1:0"}, nil, nil)
+	svc.swapCache() // leave warmup
+	if _, err := svc.Check(context.Background(), models.AllowRequest{}); !errors.Is(err, ErrNoKeys) {
+		t.Errorf("empty request: got %v", err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	visit := func(models.BatchAllowResponseItem) {}
+	cfg := &config.Config{UpstreamBaseURL: upstream.URL, UpstreamAPIKey: "bad"}
+	transport := newUpstreamTransport(cfg, NewUpstreamPool(cfg, &http.Client{Timeout: 50 * time.Millisecond}))
+	if err := transport.AllowBatch(context.Background(), []string{"1.1.1.1"}, visit); !errors.Is(err, ErrUpstreamUnauthorized) {
+		t.Errorf("bad key: got %v", err)
+	}
+	if err := transport.SendLogs(context.Background(), []models.LogRequest{{IPAddress: "1.1.1.1"}}); !errors.Is(err, ErrUpstreamUnauthorized) {
+		t.Errorf("bad key logs: got %v", err)
+	}
+
+	cfg.UpstreamAPIKey = "good"
+	if err := transport.AllowBatch(context.Background(), []string{"1.1.1.1"}, visit); !errors.Is(err, ErrUpstreamTimeout) {
+		t.Errorf("slow upstream: got %v", err)
+	}
+}
+
+func TestProxyService_Idempotency(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.BlockAll)
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, IdempotencyTTLSeconds: 60}, nil, nil)
+	svc.swapCache() // leave warmup
+
+	req := models.AllowRequest{IPAddress: "8.8.8.8"}
+	first, replayed, err := svc.CheckIdempotent(context.Background(), "k1", req)
+	if err != nil || replayed || first.Allow {
+		t.Fatalf("first submission: %+v, replayed=%v, err=%v", first, replayed, err)
+	}
+
+	// The retry returns the original answer without evaluating or counting it
+	svc.current.Store(newDecisionCache())
+	again, replayed, err := svc.CheckIdempotent(context.Background(), "k1", req)
+	if err != nil || !replayed || again.Allow != first.Allow || again.Message != first.Message {
+		t.Errorf("retry: %+v, replayed=%v, err=%v", again, replayed, err)
+	}
+	if n := upstream.Calls(); n != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", n)
+	}
+	if n := svc.Stats().Efficiency.Total.Requests; n != 1 {
+		t.Errorf("Expected the retry not to be counted, got %d requests", n)
+	}
+
+	if _, _, err := svc.CheckIdempotent(context.Background(), "k1", models.AllowRequest{IPAddress: "9.9.9.9"}); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("reused key: got %v", err)
+	}
+}
+
+func TestProxyService_DeferredDecision(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.BlockAll, upstreamtest.Delay(100*time.Millisecond))
+
+	got := make(chan DeferredDecision, 1)
+	var signature string
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(callbackSignatureHeader)
+		var d DeferredDecision
+		json.NewDecoder(r.Body).Decode(&d)
+		got <- d
+	}))
+	defer callback.Close()
+
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:      upstream.URL,
+		LiveCheckBudgetMs:    10,
+		CallbackAllowedHosts: []string{"127.0.0.1"},
+		CallbackSecret:       "s3cret",
+	}, nil, nil)
+	svc.swapCache() // leave warmup
+
+	if svc.CallbackAllowed("http://example.com/hook") || svc.CallbackAllowed("file:///etc/passwd") {
+		t.Error("Callbacks outside CALLBACK_ALLOWED_HOSTS must be refused")
+	}
+
+	resp, err := svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6", CallbackURL: callback.URL + "/hook"})
+	if err != nil || !resp.Allow || resp.Message != "Allowed (Deferred)" || resp.DecisionID == "" {
+		t.Fatalf("Expected a provisional allow, got %+v, %v", resp, err)
+	}
+
+	select {
+	case d := <-got:
+		if d.DecisionID != resp.DecisionID || d.Allow || d.Message != "Blocked (Live Check)" {
+			t.Errorf("Unexpected callback %+v", d)
+		}
+		if !strings.HasPrefix(signature, "sha256=") {
+			t.Errorf("Expected a signed callback, got %q", signature)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Callback not delivered")
+	}
+
+	// The completed check was cached for later requests
+	if resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"}); resp.Allow {
+		t.Errorf("Expected the deferred block to be cached, got %+v", resp)
+	}
+}
+
+func TestProxyService_TupleCache(t *testing.T) {
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: "http://127.0.0.1:0", TupleCacheTTLMs: 60000}, nil, nil)
+	svc.pending = cacheOf(map[string]bool{"1.1.1.1": true, "bad@example.com": false})
+	svc.swapCache()
+
+	req := models.AllowRequest{IPAddress: "1.1.1.1", Email: "bad@example.com"}
+	if resp, _ := svc.Check(context.Background(), req); resp.Allow || resp.Message != "Cache Hit: Blocked" {
+		t.Fatalf("Expected a cached block, got %+v", resp)
+	}
+
+	// Served from the tuple cache without consulting the per-key caches
+	svc.current.Store(newDecisionCache())
+	if resp, _ := svc.Check(context.Background(), req); resp.Allow || resp.Message != "Cache Hit: Blocked" {
+		t.Errorf("Expected the tuple cache to answer, got %+v", resp)
+	}
+	// Only the exact tuple matches
+	other := models.AllowRequest{IPAddress: "1.1.1.1", Email: "good@example.com"}
+	if resp, _ := svc.Check(context.Background(), other); resp.Message == "Cache Hit: Blocked" {
+		t.Errorf("Expected another tuple to miss the tuple cache, got %+v", resp)
+	}
+
+	// A window swap invalidates every tuple
+	svc.pending = cacheOf(map[string]bool{"1.1.1.1": true, "bad@example.com": true})
+	svc.swapCache()
+	if resp, _ := svc.Check(context.Background(), req); !resp.Allow || resp.Message != "Cache Hit" {
+		t.Errorf("Expected the new window's decision, got %+v", resp)
+	}
+}
+
+func TestProxyService_KeyBudget(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll)
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, UpstreamDailyKeyBudget: 4, BudgetAlertPercent: 50, BudgetDegradeFactor: 3}, nil, nil)
+	svc.swapCache() // leave warmup
+
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1"})
+	if st := svc.Stats().UpstreamKeys; st.Today != 1 || st.Window != 1 || st.Degraded || svc.cost.stretch() != 1 {
+		t.Fatalf("below the alert threshold: %+v", st)
+	}
+
+	// Two keys reach 50% of the budget: windows stretch by the degrade factor
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "2.2.2.2"})
+	st := svc.Stats().UpstreamKeys
+	if st.Today != 2 || st.BudgetUsed != 0.5 || !st.Degraded || svc.cost.stretch() != 3 {
+		t.Errorf("at the alert threshold: %+v", st)
+	}
+
+	svc.swapCache()
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "3.3.3.3", Email: "a@example.com"})
+	st = svc.Stats().UpstreamKeys
+	if st.Window != 2 || st.Today != 4 || st.Total != 4 || st.DailyBudget != 4 {
+		t.Errorf("after a swap: %+v", st)
+	}
+	if r := svc.UsageReport(10); r.UpstreamKeys != 4 {
+		t.Errorf("Expected 4 upstream keys in the usage report, got %d", r.UpstreamKeys)
+	}
+}
+
+func TestProxyService_DebugStore(t *testing.T) {
+	upstream := upstreamtest.New(t, func(k string) models.BatchAllowResponseItem {
+		return models.BatchAllowResponseItem{Key: k, Type: models.KeyTypeIP, Allow: k != "6.6.6.6"}
+	})
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, DebugStoreTTLSeconds: 60}, nil, nil)
+	svc.swapCache() // leave warmup
+
+	// With a zero sample rate only blocks are kept
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1", RequestID: "allowed"})
+	svc.debug.drain()
+	if _, found, enabled := svc.DebugDecision("allowed"); found || !enabled {
+		t.Errorf("Expected allow not to be sampled: found=%v enabled=%v", found, enabled)
+	}
+
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6", RequestID: "live"})
+	svc.debug.drain()
+	rec, found, _ := svc.DebugDecision("live")
+	if !found || rec.Response.Allow || rec.Source != sourceLive || rec.Cache != cacheMiss || rec.Request.IPAddress != "6.6.6.6" {
+		t.Fatalf("Unexpected live block record: found=%v %+v", found, rec)
+	}
+	if rec.Upstream == nil || len(rec.Upstream.Keys) != 1 || len(rec.Upstream.Results) != 1 || rec.Upstream.Results[0].Allow {
+		t.Errorf("Expected the upstream interaction to be captured, got %+v", rec.Upstream)
+	}
+
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6", RequestID: "cached"})
+	svc.debug.drain()
+	if rec, found, _ := svc.DebugDecision("cached"); !found || rec.Source != sourceCache || rec.Cache != cacheHit || rec.Upstream != nil {
+		t.Errorf("Unexpected cached block record: found=%v %+v", found, rec)
+	}
+
+	// A caller quoting a generated request ID does not replace its record
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6", Email: "Bob@Example.com", RequestID: "gen", RequestIDGenerated: true})
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1", RequestID: "gen"})
+	svc.debug.drain()
+	rec, found, _ = svc.DebugDecision("gen")
+	if !found || rec.Supplied || rec.Request.IPAddress != "6.6.6.6" {
+		t.Errorf("Expected the generated request ID's record, got found=%v %+v", found, rec)
+	}
+	if hashed, _ := svc.IdentityKey("Bob@Example.com", ""); rec.Request.Email != hashed || hashed == "Bob@Example.com" {
+		t.Errorf("Expected only the hashed identity to be stored, got %q", rec.Request.Email)
+	}
+
+	// A full queue drops decisions instead of blocking the check
+	for i := 0; i < debugQueue+5; i++ {
+		svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6", RequestID: "flood"})
+	}
+	if d := svc.Stats().DebugDropped; d != 5 {
+		t.Errorf("Expected 5 dropped records, got %d", d)
+	}
+
+	disabled := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL}, nil, nil)
+	if _, _, enabled := disabled.DebugDecision("live"); enabled {
+		t.Error("Expected the debug store to be disabled by default")
+	}
+}
+
+func TestProxyService_ShadowMode(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.Block("6.6.6.6"))
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, ShadowMode: true}, nil, nil)
+	svc.swapCache() // leave warmup
+
+	// Live, then cached: the block is never enforced
+	for i := 0; i < 2; i++ {
+		resp, err := svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"})
+		if err != nil || !resp.Allow || !resp.WouldBlock || !strings.HasPrefix(resp.Message, "Shadow: ") {
+			t.Errorf("check %d: expected a shadow block, got %+v, err=%v", i, resp, err)
+		}
+	}
+	if resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1"}); !resp.Allow || resp.WouldBlock {
+		t.Errorf("Expected a plain allow, got %+v", resp)
+	}
+
+	if n := svc.Stats().ShadowBlocks; n != 2 {
+		t.Errorf("Expected 2 shadow blocks in stats, got %d", n)
+	}
+	if r := svc.UsageReport(10); r.BlockedRequests != 2 || r.ShadowBlocks != 2 {
+		t.Errorf("Expected would-be blocks in the usage report, got %+v", r)
+	}
+}
+
+func TestProxyService_BlockReasons(t *testing.T) {
+	upstream := upstreamtest.New(t, func(k string) models.BatchAllowResponseItem {
+		if k == "6.6.6.6" {
+			return models.BatchAllowResponseItem{Key: k, Type: models.KeyTypeIP, Allow: false, Reason: "abuse_report"}
+		}
+		return models.BatchAllowResponseItem{Key: k, Allow: true}
+	})
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, RulesDeny: []string{"ip:7.7.7.7"}}, nil, nil)
+	svc.swapCache() // leave warmup
+
+	want := []models.BlockReason{{Key: "6.6.6.6", Type: models.KeyTypeIP, Reason: "abuse_report"}}
+	req := models.AllowRequest{IPAddress: "6.6.6.6", UserAgent: "curl/8.0"}
+	for _, source := range []string{"live", "cache"} {
+		resp, _ := svc.Check(context.Background(), req)
+		if resp.Allow || !reflect.DeepEqual(resp.BlockedBy, want) {
+			t.Errorf("%s: expected blocked_by %+v, got %+v", source, want, resp)
+		}
+	}
+	if resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1"}); resp.BlockedBy != nil {
+		t.Errorf("Expected no blocked_by on an allow, got %+v", resp.BlockedBy)
+	}
+
+	resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "7.7.7.7"})
+	if len(resp.BlockedBy) != 1 || resp.BlockedBy[0].Reason != ReasonLocalRule {
+		t.Errorf("Expected a local rule reason, got %+v", resp.BlockedBy)
+	}
+
+	// Reasons go with the cache entries they explain
+	svc.swapCache()
+	if r := svc.reasons.get("6.6.6.6"); r != "" {
+		t.Errorf("Expected the reason to be pruned with its cache entry, got %q", r)
+	}
+}
+
+func TestProxyService_Labels(t *testing.T) {
+	upstream := upstreamtest.New(t, func(k string) models.BatchAllowResponseItem {
+		item := models.BatchAllowResponseItem{Key: k, Allow: true}
+		if k == "5.5.5.5" {
+			item.Labels = []string{"datacenter_ip", "vpn"}
+		} else if strings.Contains(k, "mailinator") {
+			item.Labels = []string{"disposable_email", "vpn"}
+		}
+		return item
+	})
+
+	cfg := &config.Config{UpstreamBaseURL: upstream.URL, DebugStoreTTLSeconds: 60, DebugSampleRate: 1, LogBatchSize: 100}
+	svc := NewProxyService(cfg, nil, nil)
+	svc.swapCache() // leave warmup
+	logger := NewLoggerService(cfg, nil, nil)
+	logger.EnrichFrom(svc)
+
+	req := models.AllowRequest{IPAddress: "5.5.5.5", Email: "bob@mailinator.com", RequestID: "labelled"}
+	if resp, _ := svc.Check(context.Background(), req); !resp.Allow {
+		t.Fatalf("Expected labels not to affect the decision, got %+v", resp)
+	}
+	svc.debug.drain()
+	rec, found, _ := svc.DebugDecision("labelled")
+	if !found || len(rec.Keys) != 2 || !reflect.DeepEqual(rec.Keys[0].Labels, []string{"datacenter_ip", "vpn"}) {
+		t.Fatalf("Expected labels on the debug record's keys, got %+v", rec.Keys)
+	}
+
+	logger.QueueLog(models.LogRequest{IPAddress: "5.5.5.5", Email: "bob@mailinator.com", EventType: "login"})
+	logger.QueueLog(models.LogRequest{IPAddress: "1.1.1.1", EventType: "login"})
+	want := []string{"datacenter_ip", "disposable_email", "vpn"}
+	if got := logger.buffer[0].Labels; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the log record to carry %v, got %v", want, got)
+	}
+	if got := logger.buffer[1].Labels; got != nil {
+		t.Errorf("Expected no labels for an unlabelled identity, got %v", got)
+	}
+
+	// Labels go with the cache entries they describe
+	svc.swapCache()
+	if l := svc.Labels("5.5.5.5"); l != nil {
+		t.Errorf("Expected the labels to be pruned with their cache entry, got %v", l)
+	}
+}
+
+func TestProxyService_StaleCache(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll)
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, CacheStalePolicy: StaleRetain, CacheMaxStaleSeconds: 60}, nil, nil)
+	svc.swapCache() // leave warmup
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1"})
+
+	// No pending cache (as after a failed prefetch): the current one is kept
+	svc.mu.Lock()
+	svc.freshAt = time.Now()
+	svc.mu.Unlock()
+	svc.swapCache()
+	if resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1"}); resp.Message != "Cache Hit" {
+		t.Errorf("Expected the retained cache to answer, got %+v", resp)
+	}
+	if !svc.Stats().Stale {
+		t.Error("Expected stats to report a stale cache")
+	}
+
+	// Past CACHE_MAX_STALE_SECONDS it is dropped after all
+	svc.mu.Lock()
+	svc.freshAt = time.Now().Add(-2 * time.Minute)
+	svc.mu.Unlock()
+	svc.swapCache()
+	if st := svc.Stats(); st.Stale || st.CachedKeys != 0 {
+		t.Errorf("Expected the stale cache to be dropped, got %+v", st)
+	}
+}
+
+func TestProxyService_DecisionTTLs(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.Block("6.6.6.6"))
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, CacheAllowTTLSeconds: 30, CacheBlockTTLSeconds: 600}, nil, nil)
+	svc.swapCache() // leave warmup
+	allowReq := models.AllowRequest{IPAddress: "1.1.1.1"}
+	blockReq := models.AllowRequest{IPAddress: "6.6.6.6"}
+	svc.Check(context.Background(), allowReq)
+	svc.Check(context.Background(), blockReq)
+	backdate := func(key string, age time.Duration) {
+		svc.ttls.mu.Lock()
+		svc.ttls.fetched[key] = time.Now().Add(-age)
+		svc.ttls.mu.Unlock()
+	}
+
+	// An allow older than its TTL is re-checked within the window
+	if resp, _ := svc.Check(context.Background(), allowReq); resp.Message != "Cache Hit" {
+		t.Fatalf("Expected a cache hit, got %+v", resp)
+	}
+	backdate("1.1.1.1", 31*time.Second)
+	if resp, _ := svc.Check(context.Background(), allowReq); resp.Message != "Allowed (Live Check)" {
+		t.Errorf("Expected the expired allow to be live-checked, got %+v", resp)
+	}
+
+	// At a swap without a prefetch, the block outlives the window; the expired allow does not
+	backdate("1.1.1.1", 31*time.Second)
+	svc.swapCache()
+	if resp, _ := svc.Check(context.Background(), blockReq); resp.Message != "Cache Hit: Blocked" {
+		t.Errorf("Expected the block carried into the new window, got %+v", resp)
+	}
+	if resp, _ := svc.Check(context.Background(), allowReq); resp.Message != "Allowed (Live Check)" {
+		t.Errorf("Expected the expired allow dropped at the swap, got %+v", resp)
+	}
+
+	backdate("6.6.6.6", 11*time.Minute)
+	if resp, _ := svc.Check(context.Background(), blockReq); resp.Message != "Blocked (Live Check)" {
+		t.Errorf("Expected the expired block to be live-checked, got %+v", resp)
+	}
+}
+
+func TestProxyService_FailMode(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		mode   string
+		allow  bool
+		status string
+	}{
+		{FailOpen, true, "success"},
+		{FailClosed, false, "success"},
+		{FailUnknown, false, StatusUnknown},
+	}
+	for _, tt := range tests {
+		svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, FailMode: tt.mode}, nil, nil)
+		svc.swapCache() // leave warmup
+		resp, err := svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1"})
+		if err != nil || resp.Allow != tt.allow || resp.Status != tt.status {
+			t.Errorf("%s: got %+v, err=%v", tt.mode, resp, err)
+		}
+		r := svc.UsageReport(10)
+		if r.FailOpenDecisions+r.FailClosedDecisions+r.UnknownDecisions != 1 || r.BlockedRequests != 0 {
+			t.Errorf("%s: unexpected usage report %+v", tt.mode, r)
+		}
+	}
+}
+
+func TestFailSwitch(t *testing.T) {
+	f := newFailSwitch(&config.Config{
+		FailMode:             FailClosed,
+		FailSwitchBelow:      0.9,
+		FailSwitchTo:         FailOpen,
+		FailSwitchSeconds:    30,
+		FailSwitchWindowSecs: 10,
+	})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fail := errors.New("upstream down")
+
+	// Too few calls to judge, then enough errors to drop below 90%
+	for i := 0; i < failSwitchMinCalls-1; i++ {
+		f.record(fail, now)
+	}
+	if m := f.mode(now); m != FailClosed {
+		t.Fatalf("Expected no switch before %d calls, got %s", failSwitchMinCalls, m)
+	}
+	f.record(fail, now)
+	if m := f.mode(now); m != FailOpen {
+		t.Fatalf("Expected a switch to fail open, got %s", m)
+	}
+
+	// The switch is bounded, and measuring restarts afterwards
+	if m := f.mode(now.Add(29 * time.Second)); m != FailOpen {
+		t.Errorf("Expected the switch to hold, got %s", m)
+	}
+	later := now.Add(31 * time.Second)
+	if m := f.mode(later); m != FailClosed {
+		t.Errorf("Expected the switch to expire, got %s", m)
+	}
+	for i := 0; i < failSwitchMinCalls; i++ {
+		f.record(nil, later)
+	}
+	f.record(fail, later)
+	if m := f.mode(later); m != FailClosed {
+		t.Errorf("Expected a healthy window not to switch, got %s", m)
+	}
+
+	// Calls older than the window no longer count
+	f = newFailSwitch(&config.Config{FailMode: FailOpen, FailSwitchBelow: 0.5, FailSwitchTo: FailClosed, FailSwitchSeconds: 30, FailSwitchWindowSecs: 10})
+	for i := 0; i < failSwitchMinCalls; i++ {
+		f.record(nil, now)
+	}
+	for i := 0; i < failSwitchMinCalls; i++ {
+		f.record(fail, now.Add(15*time.Second))
+	}
+	if m := f.mode(now.Add(15 * time.Second)); m != FailClosed {
+		t.Errorf("Expected old successes to age out of the window, got %s", m)
+	}
+
+	if newFailSwitch(&config.Config{FailMode: FailOpen}) != nil {
+		t.Error("Expected no switch without FAIL_SWITCH_BELOW")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(&config.Config{BreakerFailures: 3, BreakerOpenSeconds: 30})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fail := errors.New("upstream down")
+
+	// A success resets the count of consecutive failures
+	b.record(fail, now)
+	b.record(fail, now)
+	b.record(nil, now)
+	b.record(fail, now)
+	b.record(fail, now)
+	if !b.allow(now) {
+		t.Fatal("Expected the breaker to stay closed below 3 consecutive failures")
+	}
+	b.record(fail, now)
+	if b.allow(now.Add(29 * time.Second)) {
+		t.Fatal("Expected the breaker to open after 3 consecutive failures")
+	}
+
+	// Half-open lets one trial through; its failure reopens the breaker
+	later := now.Add(30 * time.Second)
+	if !b.allow(later) {
+		t.Fatal("Expected a trial call once the breaker went half-open")
+	}
+	if b.allow(later) {
+		t.Error("Expected a single trial call while half-open")
+	}
+	b.record(fail, later)
+	if b.allow(later.Add(time.Second)) {
+		t.Error("Expected a failed trial to reopen the breaker")
+	}
+
+	// An abandoned trial frees the slot, and a successful one closes it
+	later = later.Add(30 * time.Second)
+	if !b.allow(later) {
+		t.Fatal("Expected another trial call")
+	}
+	b.release()
+	if !b.allow(later) {
+		t.Fatal("Expected a released trial to allow another")
+	}
+	b.record(nil, later)
+	if st := b.stats(); st.State != breakerClosed || st.Opened != 2 || st.Rejected != 3 {
+		t.Errorf("Expected a closed breaker opened twice with 3 rejections, got %+v", st)
+	}
+
+	if newCircuitBreaker(&config.Config{}) != nil {
+		t.Error("Expected no breaker without CIRCUIT_BREAKER_FAILURES")
+	}
+}
+
+func TestProxyService_Redact(t *testing.T) {
+	svc := NewProxyService(&config.Config{
+		ResponseProfiles:       map[string]string{"partner": ProfileMinimal, "internal": ProfileFull},
+		DefaultResponseProfile: ProfileDecision,
+	}, nil, nil)
+	resp := models.AllowResponse{
+		Allow:     false,
+		Status:    "success",
+		Message:   "Cache Hit: Blocked",
+		BlockedBy: []models.BlockReason{{Key: "1.1.1.1", Type: models.KeyTypeIP, Reason: "abuse"}},
+	}
+
+	if got := svc.Redact("internal", resp); len(got.BlockedBy) != 1 || got.Message == "" {
+		t.Errorf("full profile redacted fields: %+v", got)
+	}
+	if got := svc.Redact("", resp); got.BlockedBy != nil || got.Message == "" {
+		t.Errorf("decision profile: got %+v", got)
+	}
+	if got := svc.Redact("partner", resp); !reflect.DeepEqual(got, models.AllowResponse{Allow: false, Status: "success"}) {
+		t.Errorf("minimal profile: got %+v", got)
+	}
+	failed := models.AllowResponse{Status: StatusUnknown, Message: "Unknown (Upstream Unavailable)", Error: "upstream timeout"}
+	if got := svc.Redact("partner", failed); got.Error == "" || got.Message != "" {
+		t.Errorf("minimal profile should keep error details: got %+v", got)
+	}
+}
+
+func TestProxyService_State(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL:    "http://127.0.0.1:0",
+		UpstreamAPIKey:     "upstream-secret",
+		EmailEncryptionKey: "email-secret",
+		ClientAPIKeys:      []string{"client-key-0001", "short"},
+		ResponseProfiles:   map[string]string{"client-key-0001": ProfileMinimal},
+		ShadowMode:         true,
+	}
+	svc := NewProxyService(cfg, nil, nil)
+
+	st := svc.State()
+	data, err := json.Marshal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"upstream-secret", "email-secret", "client-key-0001", "short"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("State leaks %q: %s", secret, data)
+		}
+	}
+	if got := st.Config.ClientAPIKeys; !reflect.DeepEqual(got, []string{"********0001", "********"}) {
+		t.Errorf("Unexpected masked client keys %v", got)
+	}
+	if cfg.UpstreamAPIKey != "upstream-secret" {
+		t.Error("Masking must not modify the running configuration")
+	}
+	if !st.Features["shadow_mode"] || !st.Features["client_auth"] || st.Features["read_replica"] {
+		t.Errorf("Unexpected features %v", st.Features)
+	}
+}
+
+func TestProxyService_Gossip(t *testing.T) {
+	upstream := upstreamtest.New(t, func(k string) models.BatchAllowResponseItem {
+		return models.BatchAllowResponseItem{Key: k, Allow: k != "6.6.6.6", Reason: "abuse_report"}
+	})
+
+	cfg := &config.Config{UpstreamBaseURL: upstream.URL, GossipBind: "127.0.0.1:0", GossipSecret: "s3cret"}
+	a, b := NewProxyService(cfg, nil, nil), NewProxyService(cfg, nil, nil)
+	a.gossip.peers = []*net.UDPAddr{b.gossip.conn.LocalAddr().(*net.UDPAddr)}
+	a.gossip.start(a.done, a.applyGossip)
+	b.gossip.start(b.done, b.applyGossip)
+	a.swapCache() // leave warmup
+
+	if resp, _ := a.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"}); resp.Allow {
+		t.Fatalf("Expected a live block, got %+v", resp)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		allow, ok := b.current.Load().get("6.6.6.6")
+		if ok {
+			if allow || b.reasons.get("6.6.6.6") != "abuse_report" {
+				t.Errorf("Expected the peer's block with its reason, got allow=%v reason=%q", allow, b.reasons.get("6.6.6.6"))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the live-check result to reach the peer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := a.Stats().Gossip; st == nil || st.Sent != 1 || st.Peers != 1 {
+		t.Errorf("Unexpected sender stats: %+v", st)
+	}
+
+	// Messages signed with another secret are rejected
+	forged := &gossip{id: "forged", secret: []byte("wrong")}
+	payload, _ := json.Marshal(gossipMessage{From: "forged", Sent: time.Now(), Items: []models.BatchAllowResponseItem{{Key: "1.1.1.1", Allow: false}}})
+	if _, ok := b.gossip.open(append(forged.sign(payload), payload...)); ok {
+		t.Error("Expected a message with a bad MAC to be rejected")
+	}
+	stale, _ := json.Marshal(gossipMessage{From: "peer", Sent: time.Now().Add(-time.Minute)})
+	if _, ok := b.gossip.open(append(b.gossip.sign(stale), stale...)); ok {
+		t.Error("Expected a stale message to be rejected")
+	}
+	fresh, _ := json.Marshal(gossipMessage{From: "peer", Sent: time.Now(), Items: []models.BatchAllowResponseItem{{Key: "1.1.1.1", Allow: false}}})
+	packet := append(b.gossip.sign(fresh), fresh...)
+	if _, ok := b.gossip.open(packet); !ok {
+		t.Fatal("Expected a fresh message to be accepted")
+	}
+	if _, ok := b.gossip.open(packet); ok {
+		t.Error("Expected a replayed message to be rejected")
+	}
+}
+
+func TestProxyService_GossipClearsMemo(t *testing.T) {
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: "http://127.0.0.1:0", DecisionMemoTTLMs: 60000}, nil, nil)
+	svc.pending = cacheOf(map[string]bool{"1.1.1.1": true})
+	svc.swapCache()
+	req := models.AllowRequest{IPAddress: "1.1.1.1"}
+	if resp, _ := svc.Check(context.Background(), req); !resp.Allow {
+		t.Fatalf("Expected a cached allow, got %+v", resp)
+	}
+
+	// A peer's flipped decision is served at once, not the memoized allow
+	svc.applyGossip([]models.BatchAllowResponseItem{{Key: "1.1.1.1", Type: models.KeyTypeIP, Allow: false}})
+	if resp, _ := svc.Check(context.Background(), req); resp.Allow {
+		t.Errorf("Expected the gossiped block, got %+v", resp)
+	}
+}
+
+func TestProxyService_Invalidate(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll)
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, DecisionMemoTTLMs: 60000}, nil, nil)
+	svc.swapCache() // leave warmup
+	req := models.AllowRequest{IPAddress: "6.6.6.6"}
+	if resp, _ := svc.Check(context.Background(), req); !resp.Allow {
+		t.Fatalf("Expected a live allow, got %+v", resp)
+	}
+	svc.mu.Lock()
+	svc.pending = cacheOf(map[string]bool{"6.6.6.6": true})
+	svc.mu.Unlock()
+
+	n := svc.Invalidate([]models.BatchAllowResponseItem{{Key: "6.6.6.6", Allow: false, Reason: "abuse_report"}, {Allow: false}})
+	if n != 1 {
+		t.Errorf("Expected 1 decision applied, got %d", n)
+	}
+	// Neither the memoized response nor the prefetched cache brings the allow back
+	if resp, _ := svc.Check(context.Background(), req); resp.Allow {
+		t.Errorf("Expected the pushed block at once, got %+v", resp)
+	}
+	svc.swapCache()
+	if resp, _ := svc.Check(context.Background(), req); resp.Allow {
+		t.Errorf("Expected the pushed block after the swap, got %+v", resp)
+	}
+	if r := svc.reasons.get("6.6.6.6"); r != "abuse_report" {
+		t.Errorf("Expected the pushed reason, got %q", r)
+	}
+	if st := svc.Stats(); st.Invalidations != 1 {
+		t.Errorf("Expected 1 invalidation counted, got %d", st.Invalidations)
+	}
+}
+
+func TestProxyService_InvalidatePersisted(t *testing.T) {
+	store := storage.NewMemory()
+	cfg := &config.Config{UpstreamBaseURL: "http://127.0.0.1:0"}
+	svc := NewProxyService(cfg, nil, store)
+	svc.Invalidate([]models.BatchAllowResponseItem{{Key: "6.6.6.6", Allow: false}})
+
+	// A restarted instance loading an older snapshot keeps the pushed block
+	restarted := NewProxyService(cfg, nil, store)
+	err := restarted.loadDecisions("test", func(visit func(models.BatchAllowResponseItem)) (time.Time, error) {
+		visit(models.BatchAllowResponseItem{Key: "6.6.6.6", Allow: true})
+		visit(models.BatchAllowResponseItem{Key: "7.7.7.7", Allow: true})
+		return time.Now(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := restarted.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"}); resp.Allow {
+		t.Errorf("Expected the stored override over the snapshot, got %+v", resp)
+	}
+	if resp, _ := restarted.Check(context.Background(), models.AllowRequest{IPAddress: "7.7.7.7"}); !resp.Allow {
+		t.Errorf("Expected the snapshot decision for other keys, got %+v", resp)
+	}
+	if ttl, ok, _ := store.TTL(overridePrefix + "/6.6.6.6"); !ok || ttl <= 20*time.Second || ttl > 40*time.Second {
+		t.Errorf("Expected the override kept for two windows, got %v %v", ttl, ok)
+	}
+}
+
+func TestProxyService_Stop(t *testing.T) {
+	release := make(chan struct{})
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/health" {
+			return false
+		}
+		<-release
+		return true
+	})
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, UpstreamHealthPath: "/health"}, nil, nil)
+	svc.Start()
+	svc.trackKeys([]requestKey{{models.KeyTypeIP, "1.1.1.1"}})
+	svc.prefetch()
+
+	// A prefetch in flight is waited for until the context ends, then abandoned
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := svc.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected Stop to give up on the prefetch in flight, got %v", err)
+	}
+	close(release)
+	if err := svc.Stop(context.Background()); err != nil {
+		t.Fatalf("Expected Stop to return once the prefetch completed, got %v", err)
+	}
+	svc.mu.RLock()
+	if _, ok := svc.pending.get("1.1.1.1"); !ok {
+		t.Error("Expected the awaited prefetch to complete")
+	}
+	svc.mu.RUnlock()
+
+	// Nothing is started once stopped
+	svc.trackKeys([]requestKey{{models.KeyTypeIP, "2.2.2.2"}})
+	svc.prefetch()
+	time.Sleep(50 * time.Millisecond)
+	if n := upstream.Calls(); n != 1 {
+		t.Errorf("Expected no upstream call after Stop, got %d calls", n)
+	}
+}
+
+func TestProxyService_Tarpit(t *testing.T) {
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL: "http://127.0.0.1:0", // never reached
+		RulesDeny:       []string{"ip:6.6.6.6"},
+		TarpitMinMs:     50,
+		TarpitMaxMs:     80,
+		TarpitMaxHeld:   1,
+	}, nil, nil)
+	ctx := context.Background()
+	blocked, _ := svc.Check(ctx, models.AllowRequest{IPAddress: "6.6.6.6"})
+	allowed, _ := svc.Check(ctx, models.AllowRequest{IPAddress: "1.1.1.1"})
+
+	start := time.Now()
+	svc.Tarpit(ctx, allowed)
+	svc.Tarpit(ctx, models.AllowResponse{Allow: false, Status: StatusUnknown})
+	if d := time.Since(start); d > 20*time.Millisecond {
+		t.Errorf("Expected allows and unknown decisions to be answered at once, took %v", d)
+	}
+
+	start = time.Now()
+	svc.Tarpit(ctx, blocked)
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("Expected a block to be delayed 50-80ms, took %v", d)
+	}
+
+	// Over TARPIT_MAX_HELD, blocks are answered at once
+	held := make(chan struct{})
+	go func() {
+		svc.Tarpit(ctx, blocked)
+		close(held)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	start = time.Now()
+	svc.Tarpit(ctx, blocked)
+	if d := time.Since(start); d > 20*time.Millisecond {
+		t.Errorf("Expected a block over TARPIT_MAX_HELD to be answered at once, took %v", d)
+	}
+	<-held
+
+	// A caller that goes away is released
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	svc.Tarpit(canceled, blocked)
+
+	if st := svc.Stats().Tarpit; st == nil || st.Delayed != 2 || st.Skipped != 1 || st.Held != 0 {
+		t.Errorf("Unexpected tarpit stats: %+v", st)
+	}
+}
+
+func TestProxyService_Quota(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL: "http://127.0.0.1:0", // never reached
+		RulesAllow:      []string{"ip:9.9.9.9"},
+		QuotaRules: []config.QuotaRule{
+			{KeyType: models.KeyTypeIP, Limit: 3, Window: time.Minute},
+			{KeyType: models.KeyTypeEmail, Limit: 5, Window: time.Minute},
+		},
+		QuotaAction:       "block",
+		QuotaMaxKeys:      100,
+		DecisionMemoTTLMs: 60000,
+	}
+	svc := NewProxyService(cfg, nil, nil)
+	svc.pending = cacheOf(map[string]bool{"1.1.1.1": true, "2.2.2.2": true, "bob@example.com": true, "10.0.0.0/24": true})
+	svc.swapCache()
+	now := time.Unix(1_800_000_000, 0) // At the start of a window
+	svc.quotas.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// Memoized repeats count too
+	for i := 1; i <= 3; i++ {
+		if resp, _ := svc.Check(ctx, models.AllowRequest{IPAddress: "1.1.1.1"}); !resp.Allow || resp.OverQuota {
+			t.Fatalf("request %d: expected an allow within the limit, got %+v", i, resp)
+		}
+	}
+	resp, _ := svc.Check(ctx, models.AllowRequest{IPAddress: "1.1.1.1"})
+	if resp.Allow || !resp.OverQuota || resp.Message != "Blocked (Quota)" || len(resp.BlockedBy) != 1 || resp.BlockedBy[0].Reason != ReasonQuota {
+		t.Errorf("Expected the 4th request to be blocked by the quota, got %+v", resp)
+	}
+	if resp, _ := svc.Check(ctx, models.AllowRequest{IPAddress: "2.2.2.2"}); !resp.Allow {
+		t.Errorf("Expected other keys to be unaffected, got %+v", resp)
+	}
+
+	// The previous window still weighs in, fading out over the next one
+	now = now.Add(time.Minute + 15*time.Second)
+	if resp, _ := svc.Check(ctx, models.AllowRequest{IPAddress: "1.1.1.1"}); resp.Allow {
+		t.Errorf("Expected 3/4 of the last window's 4 requests plus this one to be over 3, got %+v", resp)
+	}
+	now = now.Add(time.Minute)
+	if resp, _ := svc.Check(ctx, models.AllowRequest{IPAddress: "1.1.1.1"}); !resp.Allow {
+		t.Errorf("Expected the key to recover once idle, got %+v", resp)
+	}
+
+	// Emails are counted by their identity key, IPs shared or not
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		resp, _ = svc.Check(ctx, models.AllowRequest{IPAddress: ip, Email: "Bob@Example.com"})
+	}
+	if resp.Allow || resp.BlockedBy[0].Type != models.KeyTypeEmail {
+		t.Errorf("Expected the 6th request of the email to be blocked, got %+v", resp)
+	}
+
+	// Allowlisted keys are exempt
+	for range 5 {
+		resp, _ = svc.Check(ctx, models.AllowRequest{IPAddress: "9.9.9.9"})
+	}
+	if !resp.Allow || resp.OverQuota {
+		t.Errorf("Expected an allowlisted IP to be exempt, got %+v", resp)
+	}
+	// Exempt requests over a limit are counted as exceeded all the same
+	if st := svc.Stats().Quota; st == nil || st.Exceeded != 5 || st.Keys != 10 {
+		t.Errorf("Unexpected quota stats %+v", st)
+	}
+
+	// QUOTA_ACTION=flag reports without blocking
+	flagged := *cfg
+	flagged.QuotaAction = "flag"
+	svc = NewProxyService(&flagged, nil, nil)
+	svc.pending = cacheOf(map[string]bool{"1.1.1.1": true})
+	svc.swapCache()
+	for range 4 {
+		resp, _ = svc.Check(ctx, models.AllowRequest{IPAddress: "1.1.1.1"})
+	}
+	if !resp.Allow || !resp.OverQuota {
+		t.Errorf("Expected an allow flagged over_quota, got %+v", resp)
+	}
+}
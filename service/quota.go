@@ -0,0 +1,198 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/utils"
+)
+
+// ReasonQuota explains blocks by a local velocity limit (QUOTA_RULES).
+const ReasonQuota = "quota"
+
+// QuotaStats counts requests over the local velocity limits, since start.
+type QuotaStats struct {
+	Keys      int   `json:"keys"`      // Keys being counted now, over all rules
+	Exceeded  int64 `json:"exceeded"`  // Requests of a key over a limit
+	Untracked int64 `json:"untracked"` // Requests not counted because QUOTA_MAX_KEYS keys were
+}
+
+// quotas enforces QUOTA_RULES. Every request is counted, including those
+// answered from the memo or blocked, so a key stays over its limit while it
+// keeps sending. Counts are local to the instance and lost on restart.
+type quotas struct {
+	limiters []*quotaLimiter
+	flag     bool // QUOTA_ACTION=flag: report keys over a limit, do not block
+	identity bool // Some rule counts emails or user IDs
+	maxKeys  int
+	now      func() time.Time
+
+	exceeded  atomic.Int64
+	untracked atomic.Int64
+}
+
+// quotaLimiter counts the requests of each key of one rule.
+type quotaLimiter struct {
+	rule   config.QuotaRule
+	mu     sync.Mutex
+	counts map[string]*quotaCounter
+}
+
+// quotaCounter holds a key's requests in the current and previous fixed
+// window. The sliding count weights the previous window by the share of it
+// still inside a window ending now, which approximates a true sliding window
+// in constant space.
+type quotaCounter struct {
+	window    int64 // Index of the current window since the Unix epoch
+	cur, prev int
+}
+
+func newQuotas(cfg *config.Config) *quotas {
+	if len(cfg.QuotaRules) == 0 {
+		return nil
+	}
+	q := &quotas{flag: cfg.QuotaAction == "flag", maxKeys: max(cfg.QuotaMaxKeys, 1), now: time.Now}
+	for _, rule := range cfg.QuotaRules {
+		q.limiters = append(q.limiters, &quotaLimiter{rule: rule, counts: make(map[string]*quotaCounter)})
+		q.identity = q.identity || rule.KeyType != models.KeyTypeIP
+	}
+	return q
+}
+
+// count counts req against every rule and returns its keys that are over a
+// limit.
+func (q *quotas) count(cfg *config.Config, req models.AllowRequest) []models.BlockReason {
+	if q == nil {
+		return nil
+	}
+	var identity, identityType string
+	if q.identity && req.Email != "" {
+		var kind string
+		identity, kind = identityKey(cfg, req.Email, req.IdentityType)
+		identityType = models.KeyTypeEmail
+		if kind == utils.IdentityUserID {
+			identityType = models.KeyTypeUserID
+		}
+	}
+
+	now := q.now()
+	var over []models.BlockReason
+	for _, l := range q.limiters {
+		key := req.IPAddress
+		if l.rule.KeyType != models.KeyTypeIP {
+			if l.rule.KeyType != identityType {
+				continue
+			}
+			key = identity
+		}
+		if key == "" {
+			continue
+		}
+		exceeded, tracked := l.count(key, now, q.maxKeys)
+		if !tracked {
+			q.untracked.Add(1)
+		}
+		if exceeded && !hasReason(over, key) {
+			over = append(over, models.BlockReason{Key: key, Type: l.rule.KeyType, Reason: ReasonQuota})
+		}
+	}
+	if len(over) > 0 {
+		q.exceeded.Add(1)
+	}
+	return over
+}
+
+// count adds a request of key and reports whether its sliding count is over
+// the limit. Once maxKeys keys are counted, keys idle for a whole window are
+// dropped; if none are, the request is not counted.
+func (l *quotaLimiter) count(key string, now time.Time, maxKeys int) (over, tracked bool) {
+	window := int64(l.rule.Window)
+	idx := now.UnixNano() / window
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.counts[key]
+	if c == nil {
+		if len(l.counts) >= maxKeys {
+			l.prune(idx)
+			if len(l.counts) >= maxKeys {
+				return false, false
+			}
+		}
+		c = &quotaCounter{window: idx}
+		l.counts[key] = c
+	}
+	switch c.window {
+	case idx:
+	case idx - 1:
+		c.prev, c.cur = c.cur, 0
+	default:
+		c.prev, c.cur = 0, 0
+	}
+	c.window = idx
+	c.cur++
+
+	elapsed := float64(now.UnixNano()%window) / float64(window)
+	return float64(c.prev)*(1-elapsed)+float64(c.cur) > float64(l.rule.Limit), true
+}
+
+// prune drops the counters that no longer reach into a window ending now.
+func (l *quotaLimiter) prune(idx int64) {
+	for key, c := range l.counts {
+		if c.window < idx-1 {
+			delete(l.counts, key)
+		}
+	}
+}
+
+func (q *quotas) stats() *QuotaStats {
+	if q == nil {
+		return nil
+	}
+	st := &QuotaStats{Exceeded: q.exceeded.Load(), Untracked: q.untracked.Load()}
+	for _, l := range q.limiters {
+		l.mu.Lock()
+		st.Keys += len(l.counts)
+		l.mu.Unlock()
+	}
+	return st
+}
+
+func hasReason(reasons []models.BlockReason, key string) bool {
+	for _, r := range reasons {
+		if r.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// applyQuota marks resp as over quota when keys in over exceeded a limit
+// and, unless QUOTA_ACTION=flag, turns it into a block. Keys on a local
+// allow rule are exempt.
+func (s *ProxyService) applyQuota(req models.AllowRequest, resp models.AllowResponse, over []models.BlockReason, trace *decisionTrace) models.AllowResponse {
+	if len(over) == 0 || s.allowedByRule(req) {
+		return resp
+	}
+	resp.OverQuota = true
+	if s.quotas.flag || (!resp.Allow && resp.Status == "success") {
+		return resp
+	}
+	trace.Source = sourceQuota
+	resp.Allow = false
+	resp.Status = "success"
+	resp.Message = "Blocked (Quota)"
+	resp.Error, resp.ErrorCode = "", ""
+	resp.BlockedBy = over
+	return resp
+}
+
+// allowedByRule reports whether a local allow rule matches req.
+func (s *ProxyService) allowedByRule(req models.AllowRequest) bool {
+	keys := append(resolvedKeys(s.config, s.geo, req), localKeys(s.geo, req)...)
+	action, matched := s.rules.Evaluate(keys, req.Endpoint)
+	return matched && action == RuleAllow
+}
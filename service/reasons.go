@@ -0,0 +1,114 @@
+package service
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"apigate-proxy/models"
+)
+
+// Reason codes set by the proxy itself; all others come from the upstream.
+const (
+	ReasonLocalRule = "local_rule"
+)
+
+// maxBlockReasons bounds the reason table; once full, further reasons are
+// not remembered and their cached blocks are explained without one.
+const maxBlockReasons = 100000
+
+// blockReasons remembers the upstream reason code of blocked keys, so blocks
+// answered from the cache are explained like live ones. The caches only hold
+// a decision per key; reasons live here, keyed by cache key, and are pruned
+// at each swap to the keys still cached as blocked.
+type blockReasons struct {
+	mu sync.RWMutex
+	m  map[string]string
+}
+
+func newBlockReasons() *blockReasons {
+	return &blockReasons{m: make(map[string]string)}
+}
+
+func (r *blockReasons) note(item models.BatchAllowResponseItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if item.Allow || item.Reason == "" {
+		delete(r.m, item.Key)
+		return
+	}
+	if _, ok := r.m[item.Key]; ok || len(r.m) < maxBlockReasons {
+		r.m[item.Key] = item.Reason
+	}
+}
+
+func (r *blockReasons) get(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.m[key]
+}
+
+// prune drops reasons whose key is no longer blocked.
+func (r *blockReasons) prune(blocked func(key string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k := range r.m {
+		if !blocked(k) {
+			delete(r.m, k)
+		}
+	}
+}
+
+// cachedBlock reports whether key is cached as blocked in any current or
+// pending window. Callers hold s.mu.
+func (s *ProxyService) cachedBlock(key string) bool {
+	for _, c := range s.windowCaches() {
+		if allow, ok := c.get(key); ok && !allow {
+			return true
+		}
+	}
+	return false
+}
+
+// explainCached lists the keys of a request cached as blocked.
+func (s *ProxyService) explainCached(keys []requestKey) []models.BlockReason {
+	var out []models.BlockReason
+	for _, k := range keys {
+		cache := s.cacheFor(k.Type)
+		allow, known := cache.get(k.Value)
+		if known && s.ttls.expired(k.Value, allow, time.Now()) {
+			known = false
+		}
+		if !known && k.Type == models.KeyTypeIP {
+			if addr, err := netip.ParseAddr(k.Value); err == nil {
+				allow, known = cache.lookupRange(addr)
+			}
+		}
+		if known && !allow {
+			out = append(out, models.BlockReason{Key: k.Value, Type: k.Type, Reason: s.reasons.get(k.Value)})
+		}
+	}
+	return out
+}
+
+// explainLive lists the keys a live check blocked.
+func explainLive(keys []requestKey, results []models.BatchAllowResponseItem) []models.BlockReason {
+	var out []models.BlockReason
+	for _, item := range results {
+		if !item.Allow {
+			out = append(out, models.BlockReason{Key: item.Key, Type: keyTypeOf(keys, item), Reason: item.Reason})
+		}
+	}
+	return out
+}
+
+// explainRule lists the keys matching deny rules for endpoint.
+func (s *ProxyService) explainRule(keys []requestKey, endpoint string) []models.BlockReason {
+	var out []models.BlockReason
+	for _, k := range keys {
+		if s.rules.denies(k, endpoint) {
+			out = append(out, models.BlockReason{Key: k.Value, Type: k.Type, Reason: ReasonLocalRule})
+		}
+	}
+	return out
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+)
+
+// Reporter periodically turns the ProxyService usage counters into a report and
+// delivers it to a webhook and/or by email.
+type Reporter struct {
+	config *config.Config
+	proxy  *ProxyService
+	client *http.Client
+
+	done     chan struct{}
+	stopOnce sync.Once
+	worker   sync.WaitGroup
+}
+
+func NewReporter(cfg *config.Config, proxy *ProxyService) *Reporter {
+	return &Reporter{
+		config: cfg,
+		proxy:  proxy,
+		client: &http.Client{Timeout: 10 * time.Second},
+		done:   make(chan struct{}),
+	}
+}
+
+// ParseReportInterval accepts "daily", "weekly" or a Go duration such as "12h".
+func ParseReportInterval(v string) (time.Duration, error) {
+	switch strings.ToLower(v) {
+	case "":
+		return 0, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// Start schedules report delivery. It does nothing when no interval or
+// destination is configured.
+func (r *Reporter) Start() {
+	interval, err := ParseReportInterval(r.config.ReportInterval)
+	if err != nil {
+		logFor(componentReporter).Warn("invalid REPORT_INTERVAL", "value", r.config.ReportInterval, "error", err)
+		return
+	}
+	if interval <= 0 || (r.config.ReportWebhookURL == "" && r.config.ReportSMTPAddr == "") {
+		return
+	}
+
+	r.worker.Add(1)
+	go func() {
+		defer r.worker.Done()
+		logFor(componentReporter).Info("sending usage reports", "interval", interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+			}
+			r.send(r.proxy.usage.snapshot(r.config.ReportTopN, true))
+		}
+	}()
+}
+
+// Stop ends report delivery, waiting for a report being sent. It may be
+// called more than once, and before Start.
+func (r *Reporter) Stop() {
+	r.stopOnce.Do(func() { close(r.done) })
+	r.worker.Wait()
+}
+
+func (r *Reporter) send(report UsageReport) {
+	body, contentType, err := RenderReport(report, r.config.ReportFormat)
+	if err != nil {
+		logFor(componentReporter).Error("error rendering report", "error", err)
+		return
+	}
+
+	if r.config.ReportWebhookURL != "" {
+		if err := r.postWebhook(body, contentType); err != nil {
+			logFor(componentReporter).Error("error delivering report to webhook", "error", err)
+		} else {
+			logFor(componentReporter).Info("usage report delivered to webhook")
+		}
+	}
+	if r.config.ReportSMTPAddr != "" {
+		if err := r.sendMail(report, body, contentType); err != nil {
+			logFor(componentReporter).Error("error emailing report", "error", err)
+		} else {
+			logFor(componentReporter).Info("usage report emailed", "recipients", len(r.config.ReportSMTPTo))
+		}
+	}
+}
+
+func (r *Reporter) postWebhook(body []byte, contentType string) error {
+	resp, err := r.client.Post(r.config.ReportWebhookURL, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *Reporter) sendMail(report UsageReport, body []byte, contentType string) error {
+	if len(r.config.ReportSMTPTo) == 0 {
+		return fmt.Errorf("REPORT_SMTP_TO is empty")
+	}
+
+	var auth smtp.Auth
+	if r.config.ReportSMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(r.config.ReportSMTPAddr)
+		auth = smtp.PlainAuth("", r.config.ReportSMTPUsername, r.config.ReportSMTPPassword, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", r.config.ReportSMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(r.config.ReportSMTPTo, ", "))
+	fmt.Fprintf(&msg, "Subject: APIGate Proxy usage report %s - %s\r\n",
+		report.PeriodStart.Format("2006-01-02"), report.PeriodEnd.Format("2006-01-02"))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\nContent-Type: %s; charset=utf-8\r\n\r\n", contentType)
+	msg.Write(body)
+
+	return smtp.SendMail(r.config.ReportSMTPAddr, auth, r.config.ReportSMTPFrom, r.config.ReportSMTPTo, msg.Bytes())
+}
+
+// RenderReport encodes a report as "json" (default) or "html".
+func RenderReport(report UsageReport, format string) ([]byte, string, error) {
+	if format == "html" {
+		var buf bytes.Buffer
+		if err := reportTemplate.Execute(&buf, report); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "text/html", nil
+	}
+	body, err := json.MarshalIndent(report, "", "  ")
+	return body, "application/json", err
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"pct": func(f float64) string { return fmt.Sprintf("%.2f%%", f*100) },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>APIGate Proxy Usage Report</title></head>
+<body style="font-family: sans-serif">
+<h2>APIGate Proxy Usage Report</h2>
+<p>{{.PeriodStart.Format "2006-01-02 15:04 MST"}} &ndash; {{.PeriodEnd.Format "2006-01-02 15:04 MST"}}</p>
+<table cellpadding="4">
+<tr><td>Total requests</td><td>{{.TotalRequests}}</td></tr>
+<tr><td>Blocked requests</td><td>{{.BlockedRequests}} ({{pct .BlockRate}}){{if .ShadowBlocks}}, {{.ShadowBlocks}} not enforced (shadow mode){{end}}</td></tr>
+<tr><td>Cache hit ratio</td><td>{{pct .CacheHitRatio}} ({{.CacheHits}} hits / {{.LiveChecks}} live checks)</td></tr>
+<tr><td>Fail-open decisions</td><td>{{.FailOpenDecisions}}</td></tr>
+{{if .FailClosedDecisions}}<tr><td>Fail-closed decisions</td><td>{{.FailClosedDecisions}}</td></tr>
+{{end}}{{if .UnknownDecisions}}<tr><td>Unknown decisions</td><td>{{.UnknownDecisions}}</td></tr>
+{{end}}<tr><td>Upstream availability</td><td>{{pct .UpstreamAvailability}} ({{.UpstreamErrors}} errors / {{.UpstreamCalls}} calls)</td></tr>
+<tr><td>Keys sent upstream</td><td>{{.UpstreamKeys}}</td></tr>
+</table>
+<h3>Top offenders</h3>
+<table cellpadding="4" border="1" style="border-collapse: collapse">
+<tr><th>Type</th><th>Key</th><th>Blocks</th></tr>
+{{range .TopOffenders}}<tr><td>{{.Type}}</td><td>{{.Key}}</td><td>{{.Blocks}}</td></tr>
+{{else}}<tr><td colspan="3">None</td></tr>
+{{end}}</table>
+</body></html>
+`))
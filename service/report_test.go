@@ -0,0 +1,63 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+func TestReporter_UsageReport(t *testing.T) {
+	var received UsageReport
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer webhook.Close()
+
+	cfg := &config.Config{
+		UpstreamBaseURL:  "http://127.0.0.1:0",
+		RulesDeny:        []string{"ip:6.6.6.6"},
+		ReportWebhookURL: webhook.URL,
+		ReportTopN:       5,
+	}
+	svc := NewProxyService(cfg, nil, nil)
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"})
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"})
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1"})
+
+	NewReporter(cfg, svc).send(svc.usage.snapshot(cfg.ReportTopN, true))
+
+	if received.TotalRequests != 3 || received.BlockedRequests != 2 {
+		t.Errorf("Unexpected totals: %+v", received)
+	}
+	if len(received.TopOffenders) != 1 || received.TopOffenders[0].Key != "6.6.6.6" || received.TopOffenders[0].Blocks != 2 {
+		t.Errorf("Unexpected offenders: %+v", received.TopOffenders)
+	}
+	if after := svc.UsageReport(5); after.TotalRequests != 0 {
+		t.Errorf("Expected counters reset after report, got %d", after.TotalRequests)
+	}
+
+	html, contentType, err := RenderReport(received, "html")
+	if err != nil || contentType != "text/html" || !strings.Contains(string(html), "6.6.6.6") {
+		t.Errorf("HTML rendering failed: %v", err)
+	}
+}
+
+func TestUsageStats_Offenders(t *testing.T) {
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: "http://127.0.0.1:0", RulesDeny: []string{"ip:6.6.6.6"}}, nil, nil)
+	svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6", Email: "good@example.com", UserAgent: "curl/8.0"})
+
+	// Only the denied IP caused the block, not the identity or User-Agent
+	r := svc.UsageReport(10)
+	if len(r.TopOffenders) != 1 || r.TopOffenders[0].Key != "6.6.6.6" {
+		t.Errorf("Expected only the blocking key as offender, got %+v", r.TopOffenders)
+	}
+	if r := svc.UsageReport(-1); len(r.TopOffenders) != 0 || r.BlockedRequests != 1 {
+		t.Errorf("Expected no offenders for a negative topN, got %+v", r)
+	}
+}
@@ -0,0 +1,256 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"apigate-proxy/models"
+	"apigate-proxy/utils"
+)
+
+// Rule actions
+const (
+	RuleAllow = "allow"
+	RuleDeny  = "deny"
+)
+
+// Rules holds operator-defined static allow/deny entries. They are evaluated
+// before the cache and upstream, including during warmup.
+type Rules struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+	// CIDR entries such as "ip:10.0.0.0/8"
+	allowRanges *prefixTree
+	denyRanges  *prefixTree
+	// Entries scoped to a path with "@/path", such as "ua_client:curl@/signup"
+	scoped []scopedRule
+}
+
+// scopedRule is an entry that only applies to requests for path and the
+// paths below it.
+type scopedRule struct {
+	path   string
+	key    string       // "type:value", empty for IP ranges
+	prefix netip.Prefix // IP range entries
+	allow  bool
+}
+
+// NewRules parses "type:value" entries. Email and user ID values are given in
+// plaintext and converted with identityKey so they match the keys used for lookups.
+// An entry ending in "@/path" only applies to requests whose endpoint is that
+// path or below it. Invalid entries are skipped and reported in the returned
+// error; the valid ones are still loaded.
+func NewRules(allow, deny []string, identityKey func(value, declared string) (string, string)) (*Rules, error) {
+	r := &Rules{
+		allow:       make(map[string]struct{}),
+		deny:        make(map[string]struct{}),
+		allowRanges: newPrefixTree(),
+		denyRanges:  newPrefixTree(),
+	}
+	var errs []error
+	add := func(entries []string, exact map[string]struct{}, ranges *prefixTree, isAllow bool) {
+		for _, entry := range entries {
+			key, path, err := parseRuleEntry(entry, identityKey)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			prefix, isRange := parseCIDRKey(strings.TrimPrefix(key, models.KeyTypeIP+":"))
+			switch {
+			case path != "" && isRange:
+				r.scoped = append(r.scoped, scopedRule{path: path, prefix: prefix, allow: isAllow})
+			case path != "":
+				r.scoped = append(r.scoped, scopedRule{path: path, key: key, allow: isAllow})
+			case isRange:
+				ranges.Insert(prefix, true)
+			default:
+				exact[key] = struct{}{}
+			}
+		}
+	}
+	add(allow, r.allow, r.allowRanges, true)
+	add(deny, r.deny, r.denyRanges, false)
+	return r, errors.Join(errs...)
+}
+
+// parseRuleEntry returns the "type:value" key of a rule entry and the path it
+// is scoped to, if any.
+func parseRuleEntry(entry string, identityKey func(value, declared string) (string, string)) (string, string, error) {
+	rule := strings.TrimSpace(entry)
+	path := ""
+	// Values such as emails may contain "@", but never right before a "/"
+	if i := strings.LastIndex(rule, "@/"); i >= 0 {
+		rule, path = rule[:i], rule[i+1:]
+	}
+	keyType, value, ok := strings.Cut(rule, ":")
+	if !ok || value == "" {
+		return "", "", fmt.Errorf("invalid rule %q: expected type:value", entry)
+	}
+
+	switch keyType {
+	case models.KeyTypeIP:
+		if strings.Contains(value, "/") {
+			if _, ok := parseCIDRKey(value); !ok {
+				return "", "", fmt.Errorf("invalid rule %q: bad CIDR range", entry)
+			}
+		} else if value, ok = utils.NormalizeIP(value); !ok {
+			return "", "", fmt.Errorf("invalid rule %q: bad IP address", entry)
+		}
+	case models.KeyTypeEmail, models.KeyTypeUserID:
+		value, _ = identityKey(value, keyType)
+	case models.KeyTypeUserAgent, "ua":
+		// Rules reference the compressed UA hash as seen upstream
+		keyType = models.KeyTypeUserAgent
+	case models.KeyTypeClientCert:
+		value = utils.NormalizeFingerprint(value)
+	case models.KeyTypeJA3:
+		value = strings.ToLower(value)
+	case models.KeyTypeRequestFP:
+	case models.KeyTypeCountry, models.KeyTypeContinent:
+		value = strings.ToUpper(value)
+	case models.KeyTypeASN:
+		if value, ok = normalizeASN(value); !ok {
+			return "", "", fmt.Errorf("invalid rule %q: bad AS number", entry)
+		}
+	case models.KeyTypeUAClass:
+		value = strings.ToLower(value)
+		switch value {
+		case utils.UAClassBrowser, utils.UAClassBot, utils.UAClassHeadless, utils.UAClassLibrary, utils.UAClassUnknown:
+		default:
+			return "", "", fmt.Errorf("invalid rule %q: unknown User-Agent class", entry)
+		}
+	case models.KeyTypeUAClient:
+		value = strings.ToLower(value)
+	default:
+		return "", "", fmt.Errorf("invalid rule %q: unknown key type %q", entry, keyType)
+	}
+	return keyType + ":" + value, path, nil
+}
+
+// Evaluate returns the rule action matching any of the keys of a request for
+// endpoint. Allow entries take precedence so that explicitly trusted
+// identities are never blocked.
+func (r *Rules) Evaluate(keys []requestKey, endpoint string) (string, bool) {
+	if r.Len() == 0 {
+		return "", false
+	}
+
+	denied := false
+	for _, k := range keys {
+		ruleKey := k.Type + ":" + k.Value
+		if _, ok := r.allow[ruleKey]; ok {
+			return RuleAllow, true
+		}
+		if k.Type == models.KeyTypeIP {
+			if addr, err := netip.ParseAddr(k.Value); err == nil {
+				if _, ok := r.allowRanges.Lookup(addr); ok {
+					return RuleAllow, true
+				}
+			}
+		}
+		if r.matchesScoped(k, endpoint, true) {
+			return RuleAllow, true
+		}
+		if r.denies(k, endpoint) {
+			denied = true
+		}
+	}
+	if denied {
+		return RuleDeny, true
+	}
+	return "", false
+}
+
+// denies reports whether a deny entry matches k in a request for endpoint.
+func (r *Rules) denies(k requestKey, endpoint string) bool {
+	if r.Len() == 0 {
+		return false
+	}
+	if _, ok := r.deny[k.Type+":"+k.Value]; ok {
+		return true
+	}
+	if k.Type == models.KeyTypeIP {
+		if addr, err := netip.ParseAddr(k.Value); err == nil {
+			if _, ok := r.denyRanges.Lookup(addr); ok {
+				return true
+			}
+		}
+	}
+	return r.matchesScoped(k, endpoint, false)
+}
+
+// matchesScoped reports whether an allow (or deny) entry scoped to endpoint
+// matches k.
+func (r *Rules) matchesScoped(k requestKey, endpoint string, allow bool) bool {
+	if len(r.scoped) == 0 || endpoint == "" {
+		return false
+	}
+	ruleKey := k.Type + ":" + k.Value
+	for _, rule := range r.scoped {
+		if rule.allow != allow || !pathWithin(endpoint, rule.path) {
+			continue
+		}
+		if rule.key == ruleKey {
+			return true
+		}
+		if rule.key == "" && k.Type == models.KeyTypeIP {
+			if addr, err := netip.ParseAddr(k.Value); err == nil && rule.prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pathWithin reports whether endpoint is path or below it. A query string on
+// endpoint is ignored.
+func pathWithin(endpoint, path string) bool {
+	endpoint, _, _ = strings.Cut(endpoint, "?")
+	path = strings.TrimSuffix(path, "/")
+	return endpoint == path || path == "" || strings.HasPrefix(endpoint, path+"/")
+}
+
+// localKeys returns the keys of req only local rules see: the country and
+// continent of the IP and the User-Agent class.
+func localKeys(geo *GeoIP, req models.AllowRequest) []requestKey {
+	var keys []requestKey
+	country, continent := geo.Lookup(req.IPAddress)
+	if country != "" {
+		keys = append(keys, requestKey{models.KeyTypeCountry, country})
+	}
+	if continent != "" {
+		keys = append(keys, requestKey{models.KeyTypeContinent, continent})
+	}
+	return append(keys, uaKeys(req.UserAgent)...)
+}
+
+// uaKeys returns the User-Agent class and client name of a request as keys
+// for local rules.
+func uaKeys(ua string) []requestKey {
+	class, client := utils.ClassifyUserAgent(ua)
+	if class == "" {
+		return nil
+	}
+	return []requestKey{{models.KeyTypeUAClass, class}, {models.KeyTypeUAClient, client}}
+}
+
+// Len returns the number of configured entries.
+func (r *Rules) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.allow) + len(r.deny) + r.allowRanges.Len() + r.denyRanges.Len() + len(r.scoped)
+}
+
+func loadRules(s *ProxyService) *Rules {
+	rules, err := NewRules(s.config.RulesAllow, s.config.RulesDeny, s.IdentityKey)
+	if err != nil {
+		logFor(componentProxy).Warn("skipping invalid local rules", "error", err)
+	}
+	if rules.Len() > 0 {
+		logFor(componentProxy).Info("loaded local rules", "rules", rules.Len())
+	}
+	return rules
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// RuleNoMatch is the outcome of a request no rule matches; it goes on to the
+// cache and upstream.
+const RuleNoMatch = "none"
+
+// RuleTestCase is an example request and the rule outcome expected for it:
+// "allow", "deny" or "none".
+type RuleTestCase struct {
+	Name    string              `json:"name"`
+	Request models.AllowRequest `json:"request"`
+	Expect  string              `json:"expect"`
+}
+
+// RuleTestsFileContent is the JSON layout of a rules test file.
+type RuleTestsFileContent struct {
+	Tests []RuleTestCase `json:"tests"`
+}
+
+// RuleTestResult is the outcome of one test case.
+type RuleTestResult struct {
+	Name   string `json:"name"`
+	Expect string `json:"expect"`
+	Got    string `json:"got"`
+	Pass   bool   `json:"pass"`
+}
+
+// RuleTestReport is the outcome of a rules test run. Invalid lists rule
+// entries that failed to parse; they fail the run like a failed case.
+type RuleTestReport struct {
+	Passed  bool             `json:"passed"`
+	Invalid []string         `json:"invalid,omitempty"`
+	Failed  int              `json:"failed"`
+	Results []RuleTestResult `json:"results"`
+}
+
+// LoadRuleTestsFile reads a JSON rules test file.
+func LoadRuleTestsFile(path string) ([]RuleTestCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var content RuleTestsFileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	return content.Tests, nil
+}
+
+// RunRuleTests evaluates rules against each case the way Check would, with
+// identities keyed and IPs geolocated per cfg. It needs no running service,
+// so policy changes can be verified in CI before deployment.
+func RunRuleTests(cfg *config.Config, rules config.RulesFileContent, cases []RuleTestCase) RuleTestReport {
+	geo := openGeoIP(cfg)
+	defer geo.Close()
+	return runRuleTests(cfg, geo, rules, cases)
+}
+
+// ValidateRules is RunRuleTests with the service's configuration. A nil
+// rules tests the rules currently loaded.
+func (s *ProxyService) ValidateRules(rules *config.RulesFileContent, cases []RuleTestCase) RuleTestReport {
+	if rules == nil {
+		rules = &config.RulesFileContent{Allow: s.config.RulesAllow, Deny: s.config.RulesDeny}
+	}
+	return runRuleTests(s.config, s.geo, *rules, cases)
+}
+
+func runRuleTests(cfg *config.Config, geo *GeoIP, content config.RulesFileContent, cases []RuleTestCase) RuleTestReport {
+	report := RuleTestReport{Results: make([]RuleTestResult, 0, len(cases))}
+	rules, err := NewRules(content.Allow, content.Deny, func(value, declared string) (string, string) {
+		return identityKey(cfg, value, declared)
+	})
+	if err != nil {
+		for _, e := range unwrapJoined(err) {
+			report.Invalid = append(report.Invalid, e.Error())
+		}
+	}
+
+	for _, c := range cases {
+		canonicalIP(&c.Request) // An invalid address is evaluated as given
+		keys := append(resolvedKeys(cfg, geo, c.Request), localKeys(geo, c.Request)...)
+		got, matched := rules.Evaluate(keys, c.Request.Endpoint)
+		if !matched {
+			got = RuleNoMatch
+		}
+		res := RuleTestResult{Name: c.Name, Expect: c.Expect, Got: got, Pass: got == c.Expect}
+		if !res.Pass {
+			report.Failed++
+		}
+		report.Results = append(report.Results, res)
+	}
+	report.Passed = report.Failed == 0 && len(report.Invalid) == 0
+	return report
+}
+
+// unwrapJoined splits an errors.Join error into its parts.
+func unwrapJoined(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
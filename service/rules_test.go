@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+func TestProxyService_LocalRules(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL:        "http://127.0.0.1:0", // never reached
+		EmailEncryptionKey:     "0123456789abcdef0123456789abcdef",
+		EmailEncryptionEnabled: true,
+		RulesAllow:             []string{"ip:10.0.0.1"},
+		RulesDeny:              []string{"email:bad@test.com", "ip:6.6.6.6", "bogus"},
+	}
+	svc := NewProxyService(cfg, nil, nil)
+
+	// Deny applies even during warmup
+	resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1", Email: "bad@test.com"})
+	if resp.Allow || resp.Message != "Blocked (Local Rule)" {
+		t.Errorf("Expected rule block for email, got %v", resp)
+	}
+
+	// Allow wins over deny
+	resp, _ = svc.Check(context.Background(), models.AllowRequest{IPAddress: "10.0.0.1", Email: "bad@test.com"})
+	if !resp.Allow || resp.Message != "Allowed (Local Rule)" {
+		t.Errorf("Expected rule allow for internal IP, got %v", resp)
+	}
+
+	// Matched requests are not tracked for prefetch
+	svc.mu.RLock()
+	if svc.batchedKeys.has("10.0.0.1") {
+		t.Error("Rule-matched key should not be tracked")
+	}
+	svc.mu.RUnlock()
+
+	if svc.rules.Len() != 3 {
+		t.Errorf("Expected invalid entry to be skipped, got %d rules", svc.rules.Len())
+	}
+}
+
+func TestRunRuleTests(t *testing.T) {
+	cfg := &config.Config{EmailEncryptionKey: "0123456789abcdef0123456789abcdef", EmailEncryptionEnabled: true}
+	rules := config.RulesFileContent{
+		Allow: []string{"email:vip@example.com"},
+		Deny:  []string{"ip:6.6.6.0/24", "bogus"},
+	}
+	cases := []RuleTestCase{
+		{Name: "range", Request: models.AllowRequest{IPAddress: "6.6.6.9"}, Expect: RuleDeny},
+		// Identities are normalized and hashed as Check would
+		{Name: "vip", Request: models.AllowRequest{IPAddress: "6.6.6.9", Email: " VIP@example.com"}, Expect: RuleAllow},
+		{Name: "clean", Request: models.AllowRequest{IPAddress: "1.1.1.1"}, Expect: RuleNoMatch},
+		{Name: "wrong", Request: models.AllowRequest{IPAddress: "1.1.1.1"}, Expect: RuleDeny},
+	}
+
+	report := RunRuleTests(cfg, rules, cases)
+	if report.Passed || report.Failed != 1 || len(report.Invalid) != 1 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	for i, res := range report.Results {
+		if res.Pass != (i != 3) {
+			t.Errorf("case %s: pass=%v, got %s", res.Name, res.Pass, res.Got)
+		}
+	}
+
+	// The service tests its running rules by default
+	svc := NewProxyService(&config.Config{RulesDeny: []string{"ip:6.6.6.6"}}, nil, nil)
+	if r := svc.ValidateRules(nil, cases[:1]); r.Passed {
+		t.Errorf("Expected 6.6.6.9 not to match the running rules, got %+v", r)
+	}
+}
+
+func TestRules_ASN(t *testing.T) {
+	rules, err := NewRules([]string{"asn:as64500"}, []string{"asn:64496", "asn:AS0", "asn:hosting"}, nil)
+	if err == nil {
+		t.Error("Expected invalid AS numbers to be reported")
+	}
+	if rules.Len() != 2 {
+		t.Fatalf("Expected 2 ASN rules, got %d", rules.Len())
+	}
+
+	// Rules written as "64496" or "as64500" match keys resolved as "AS<number>"
+	for asn, want := range map[string]string{"AS64496": RuleDeny, "AS64500": RuleAllow} {
+		got, ok := rules.Evaluate(requestKeys(&config.Config{}, models.AllowRequest{IPAddress: "203.0.113.7", ASN: asn}), "")
+		if !ok || got != want {
+			t.Errorf("%s: got %q (matched %v), want %q", asn, got, ok, want)
+		}
+	}
+	if _, ok := rules.Evaluate(requestKeys(&config.Config{}, models.AllowRequest{IPAddress: "203.0.113.7"}), ""); ok {
+		t.Error("Expected no match without a resolved ASN")
+	}
+}
+
+func TestRequestKeys_LocationIsLocal(t *testing.T) {
+	// Location only feeds local rules; it is never cached or sent upstream
+	keys := requestKeys(&config.Config{}, models.AllowRequest{IPAddress: "203.0.113.7", Country: "KP", Continent: "AS"})
+	for _, k := range keys {
+		if k.Type == models.KeyTypeCountry || k.Type == models.KeyTypeContinent {
+			t.Errorf("Expected no location keys, got %+v", keys)
+		}
+	}
+}
+
+func TestProxyService_UserAgentRules(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL: "http://127.0.0.1:0", // never reached
+		RulesAllow:      []string{"ua_client:googlebot"},
+		RulesDeny:       []string{"ua_client:curl@/signup", "ua_class:headless@/signup/", "ua_class:robot", "email:a@b.com@/admin"},
+	}
+	svc := NewProxyService(cfg, nil, nil)
+	if svc.rules.Len() != 4 {
+		t.Fatalf("Expected the unknown class to be skipped, got %d rules", svc.rules.Len())
+	}
+
+	const (
+		curl     = "curl/8.4.0"
+		headless = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36"
+		chrome   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+		google   = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	)
+	cases := []struct {
+		ua, endpoint, email string
+		rule                bool // Decided by a local rule
+		allow               bool
+		class, client       string
+	}{
+		{curl, "/signup", "", true, false, "library", "curl"},
+		{curl, "/signup/confirm?x=1", "", true, false, "library", "curl"},
+		{curl, "/signups", "", false, true, "library", "curl"},
+		{curl, "", "", false, true, "library", "curl"},
+		{headless, "/signup", "", true, false, "headless", "headlesschrome"},
+		{chrome, "/signup", "", false, true, "browser", "chrome"},
+		{google, "/signup", "", true, true, "bot", "googlebot"},
+		{chrome, "/admin/users", "a@b.com", true, false, "browser", "chrome"},
+		{"", "/signup", "", false, true, "", ""},
+	}
+	for _, tc := range cases {
+		resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "198.51.100.1", UserAgent: tc.ua, Endpoint: tc.endpoint, Email: tc.email})
+		rule := strings.HasSuffix(resp.Message, "(Local Rule)")
+		if rule != tc.rule || resp.Allow != tc.allow || resp.UAClass != tc.class || resp.UAClient != tc.client {
+			t.Errorf("%q on %q: got %+v", tc.ua, tc.endpoint, resp)
+		}
+	}
+
+	resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "198.51.100.1", UserAgent: curl, Endpoint: "/signup"})
+	if len(resp.BlockedBy) != 1 || resp.BlockedBy[0].Type != models.KeyTypeUAClient || resp.BlockedBy[0].Key != "curl" {
+		t.Errorf("Expected the curl rule in blocked_by, got %+v", resp.BlockedBy)
+	}
+}
+
+func TestProxyService_CanonicalIP(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamBaseURL: "http://127.0.0.1:0", // never reached
+		RulesDeny:       []string{"ip:2001:DB8:0:0::1", "ip:6.6.6.6", "ip:not-an-ip"},
+	}
+	svc := NewProxyService(cfg, nil, nil)
+	if svc.rules.Len() != 2 {
+		t.Fatalf("Expected the invalid IP rule to be skipped, got %d rules", svc.rules.Len())
+	}
+
+	// Every spelling of an address is looked up as its canonical form
+	for ip, want := range map[string]string{
+		"2001:db8::1": "2001:db8::1",
+		"2001:0db8:0000:0000:0000:0000:0000:0001": "2001:db8::1",
+		" 2001:DB8::1%eth0":                       "2001:db8::1",
+		"::ffff:6.6.6.6":                          "6.6.6.6",
+	} {
+		resp, err := svc.Check(context.Background(), models.AllowRequest{IPAddress: ip})
+		if err != nil || resp.Allow || len(resp.BlockedBy) != 1 || resp.BlockedBy[0].Key != want {
+			t.Errorf("%q: expected a rule block of %s, got %+v (%v)", ip, want, resp, err)
+		}
+	}
+
+	for _, ip := range []string{"999.1.1.1", "2001:db8::g", "example.com"} {
+		if _, err := svc.Check(context.Background(), models.AllowRequest{IPAddress: ip}); !errors.Is(err, ErrInvalidIP) {
+			t.Errorf("%q: expected ErrInvalidIP, got %v", ip, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// scheduleTick is how often the scheduler checks the monotonic clock.
+	scheduleTick = 100 * time.Millisecond
+	// clockJumpTolerance is how far the wall clock may drift from the
+	// monotonic clock, or a tick may be late, before it counts as a jump.
+	clockJumpTolerance = time.Second
+)
+
+// scheduler drives one window: prefetch shortly before every boundary and
+// swap at the boundary. Boundaries are measured on the monotonic clock from
+// the start, so wall clock corrections (NTP steps, manual changes) do not move
+// them. A stall (VM pause, host suspend, starved process) that skips over
+// boundaries is healed by re-planning to the next future boundary: the window
+// is prefetched and swapped once, rather than once per missed window back to
+// back. Both kinds of jump are logged and counted.
+//
+// With a stretch function, a swap only happens every stretch() windows (see
+// costMeter.stretch); the boundaries in between are passed without a prefetch
+// or swap, so the current cache stays in use.
+type scheduler struct {
+	window  time.Duration
+	fetchAt time.Duration // Offset into each window at which to prefetch
+
+	prefetch, swap func()
+	next           func(time.Time)
+	jumps          *int64
+	stretch        func() int // nil = swap every window
+
+	epoch     int64 // Current window; it ends at (epoch+1)*window
+	fetched   bool  // The current window's prefetch point has passed
+	swapDue   bool  // A swap happens at the end of the current window
+	sinceSwap int   // Boundaries passed without a swap
+
+	lastMono time.Duration // Monotonic elapsed time at the end of the last tick
+	lastWall time.Time     // Wall clock (monotonic reading stripped) at the same instant
+}
+
+func newScheduler(windowDuration time.Duration, prefetch, swap func(), next func(time.Time), jumps *int64, stretch func() int) *scheduler {
+	fetchOffset := 5 * time.Second
+	fetchAt := windowDuration - fetchOffset
+	if fetchAt <= 0 {
+		fetchAt = 1 * time.Second
+	}
+	return &scheduler{window: windowDuration, fetchAt: fetchAt, prefetch: prefetch, swap: swap, next: next, jumps: jumps, stretch: stretch}
+}
+
+// runSchedule prefetches shortly before every window boundary and swaps at the
+// boundary. next is told each upcoming swap; jumps counts detected clock
+// jumps; stretch, if not nil, lengthens windows (see scheduler). It returns
+// once done is closed.
+func runSchedule(done <-chan struct{}, windowDuration time.Duration, prefetch, swap func(), next func(time.Time), jumps *int64, stretch func() int) {
+	sc := newScheduler(windowDuration, prefetch, swap, next, jumps, stretch)
+	start := time.Now()
+	sc.mark(0, start.Round(0))
+	next(start.Add(windowDuration))
+
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		sc.tick(time.Since(start), time.Now().Round(0))
+		sc.mark(time.Since(start), time.Now().Round(0))
+	}
+}
+
+// tick advances the schedule to mono, the monotonic time since the start;
+// wall is the current wall clock with its monotonic reading stripped.
+func (sc *scheduler) tick(mono time.Duration, wall time.Time) {
+	gap := mono - sc.lastMono
+	if drift := wall.Sub(sc.lastWall) - gap; drift > clockJumpTolerance || drift < -clockJumpTolerance {
+		atomic.AddInt64(sc.jumps, 1)
+		logFor(componentScheduler).Warn("wall clock jumped, schedule follows the monotonic clock", "drift", drift.Round(time.Millisecond))
+	}
+	if gap > scheduleTick+clockJumpTolerance {
+		atomic.AddInt64(sc.jumps, 1)
+		logFor(componentScheduler).Warn("scheduler stalled", "gap", gap.Round(time.Millisecond))
+	}
+
+	windowStart := time.Duration(sc.epoch) * sc.window
+	if !sc.fetched && mono >= windowStart+sc.fetchAt {
+		sc.fetched = true
+		sc.swapDue = sc.sinceSwap+1 >= sc.windowsPerSwap()
+		if sc.swapDue {
+			sc.prefetch()
+		}
+	}
+
+	if boundary := windowStart + sc.window; mono >= boundary {
+		if sc.swapDue {
+			sc.swap()
+			sc.sinceSwap = 0
+		} else {
+			sc.sinceSwap++
+		}
+		missed := int64((mono - boundary) / sc.window)
+		if missed > 0 {
+			logFor(componentScheduler).Warn("skipped missed windows, re-planned to the next boundary", "missed", missed)
+		}
+		// If the stall also passed the new window's prefetch point, the
+		// next tick prefetches late instead of swapping in an empty cache
+		sc.epoch += 1 + missed
+		sc.fetched = false
+		ahead := int64(max(sc.windowsPerSwap()-1-sc.sinceSwap, 0))
+		sc.next(time.Now().Add(time.Duration(sc.epoch+1+ahead)*sc.window - mono))
+	}
+}
+
+func (sc *scheduler) windowsPerSwap() int {
+	if sc.stretch == nil {
+		return 1
+	}
+	return max(sc.stretch(), 1)
+}
+
+// mark records the clocks once a tick's callbacks have returned, so time
+// spent prefetching is not mistaken for a stall.
+func (sc *scheduler) mark(mono time.Duration, wall time.Time) {
+	sc.lastMono = mono
+	sc.lastWall = wall
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// secretReadTimeout bounds each refresh of a secret.
+const secretReadTimeout = 10 * time.Second
+
+// refreshSecrets reads the vault:// and awssm:// secrets of the configuration
+// again every SECRET_REFRESH_SECONDS, so rotated keys are used without a
+// restart. A failed read keeps the previous value.
+func (s *ProxyService) refreshSecrets() {
+	secrets := s.config.Secrets()
+	if len(secrets) == 0 || s.config.SecretRefreshSecs <= 0 {
+		return
+	}
+	interval := time.Duration(s.config.SecretRefreshSecs) * time.Second
+	s.goWorker(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			for _, secret := range secrets {
+				ctx, cancel := context.WithTimeout(context.Background(), secretReadTimeout)
+				if err := secret.Refresh(ctx); err != nil {
+					logFor(componentProxy).Warn("secret refresh failed, keeping the previous value", "error", err)
+				}
+				cancel()
+			}
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"apigate-proxy/config"
+)
+
+func TestProxyService_SecretRefresh(t *testing.T) {
+	var current atomic.Value
+	current.Store("key-1")
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/apigate" || r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+			"data":     map[string]any{"upstream": current.Load()},
+			"metadata": map[string]any{"version": 1},
+		}})
+	}))
+	defer vault.Close()
+
+	var mu sync.Mutex
+	var sent []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent = append(sent, r.Header.Get("X-API-Key"))
+		mu.Unlock()
+		w.Write([]byte(`[{"key":"1.2.3.4","allow":true}]`))
+	}))
+	defer upstream.Close()
+
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+	secret, err := config.ParseSecret("vault://secret/data/apigate#upstream")
+	if err != nil || secret == nil {
+		t.Fatalf("ParseSecret = %v, %v", secret, err)
+	}
+	if err := secret.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		UpstreamBaseURLs:     []string{upstream.URL},
+		UpstreamAPIKey:       secret.Value(),
+		UpstreamAPIKeySecret: secret,
+	}
+	svc := NewProxyService(cfg, nil, nil)
+
+	svc.callUpstreamBatch(context.Background(), []string{"1.2.3.4"})
+	current.Store("key-2")
+	if err := secret.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	svc.callUpstreamBatch(context.Background(), []string{"1.2.3.4"})
+
+	// A failed read keeps the rotated key
+	vault.Close()
+	if err := secret.Refresh(context.Background()); err == nil {
+		t.Error("Expected an error once the secrets backend is gone")
+	}
+	svc.callUpstreamBatch(context.Background(), []string{"1.2.3.4"})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 3 || sent[0] != "key-1" || sent[1] != "key-2" || sent[2] != "key-2" {
+		t.Errorf("Expected the upstream to see key-1 then key-2, got %v", sent)
+	}
+
+	// Tenants with a key of their own never use the shared secret
+	tc := cfg.ForTenant("acme", config.Tenant{UpstreamAPIKey: "acme-key"})
+	if got := tc.CurrentUpstreamAPIKey(); got != "acme-key" {
+		t.Errorf("Expected the tenant's key, got %q", got)
+	}
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+// LogSink is a destination for batches of log records. LOG_SINKS selects one
+// or more of "upstream", "kafka", "syslog" and "archive"; each receives every
+// batch.
+type LogSink interface {
+	Name() string
+	Send(batch []models.LogRequest) error
+	Close() error
+}
+
+// upstreamSink delivers logs to the APIGate upstream over the configured
+// transport, giving each batch LOG_FLUSH_TIMEOUT_SECONDS.
+type upstreamSink struct {
+	transport UpstreamTransport
+	timeout   time.Duration
+}
+
+func (u *upstreamSink) Name() string { return "upstream" }
+func (u *upstreamSink) Close() error { return nil }
+
+func (u *upstreamSink) Send(batch []models.LogRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+	return u.transport.SendLogs(ctx, batch)
+}
+
+// sinkRoute pairs a sink with its own spool, so a failure of one sink never
+// causes records to be delivered twice to another.
+type sinkRoute struct {
+	sink  LogSink
+	spool *logSpool // nil when LOG_SPILL_DIR is unset
+}
+
+// newSinkRoutes builds the sinks named in LOG_SINKS. Unknown or misconfigured
+// sinks are logged and skipped; the upstream sink is used when none remain.
+// Each sink spools into spools (nil when LOG_SPILL_DIR is unset) under its
+// own name.
+func newSinkRoutes(cfg *config.Config, transport UpstreamTransport, spools storage.Storage) []*sinkRoute {
+	names := cfg.LogSinks
+	if len(names) == 0 {
+		names = []string{"upstream"}
+	}
+
+	var routes []*sinkRoute
+	for _, name := range names {
+		var sink LogSink
+		switch strings.ToLower(name) {
+		case "upstream":
+			sink = &upstreamSink{transport: transport, timeout: logFlushTimeout(cfg)}
+		case "kafka":
+			k, err := newKafkaSink(cfg)
+			if err != nil {
+				logFor(componentLogger).Warn("kafka sink disabled", "error", err)
+				continue
+			}
+			sink = k
+		case "syslog":
+			sl, err := newSyslogSink(cfg)
+			if err != nil {
+				logFor(componentLogger).Warn("syslog sink disabled", "error", err)
+				continue
+			}
+			sink = sl
+		case "archive":
+			ar, err := newArchiveSink(cfg)
+			if err != nil {
+				logFor(componentLogger).Warn("archive sink disabled", "error", err)
+				continue
+			}
+			sink = ar
+		default:
+			logFor(componentLogger).Warn("ignoring unknown log sink", "sink", name)
+			continue
+		}
+		routes = append(routes, &sinkRoute{sink: sink, spool: sinkSpool(cfg, spools, sink.Name())})
+	}
+	if len(routes) == 0 {
+		sink := &upstreamSink{transport: transport, timeout: logFlushTimeout(cfg)}
+		routes = append(routes, &sinkRoute{sink: sink, spool: sinkSpool(cfg, spools, sink.Name())})
+	}
+	return routes
+}
+
+// sinkSpool returns the spool of a sink in store, nil without one, after
+// moving in the segments older builds wrote to its LOG_SPILL_DIR directory.
+func sinkSpool(cfg *config.Config, store storage.Storage, name string) *logSpool {
+	if store == nil {
+		return nil
+	}
+	spool := newLogSpool(store, name)
+	dir := cfg.LogSpillDir
+	if name != "upstream" {
+		dir = filepath.Join(dir, name)
+	}
+	spool.importDir(dir)
+	return spool
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// kafkaSink produces each log record as a JSON message to KAFKA_TOPIC. Records
+// are keyed by identity (falling back to IP) so one user's events stay ordered
+// within a partition.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func newKafkaSink(cfg *config.Config) (*kafkaSink, error) {
+	if len(cfg.KafkaBrokers) == 0 || cfg.KafkaTopic == "" {
+		return nil, errors.New("KAFKA_BROKERS and KAFKA_TOPIC are required")
+	}
+	return &kafkaSink{writer: &kafka.Writer{
+		Addr:         kafka.TCP(cfg.KafkaBrokers...),
+		Topic:        cfg.KafkaTopic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    cfg.KafkaBatchSize,
+		BatchTimeout: time.Duration(cfg.KafkaBatchTimeoutMs) * time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+	}}, nil
+}
+
+func (k *kafkaSink) Name() string { return "kafka" }
+
+func (k *kafkaSink) Send(batch []models.LogRequest) error {
+	msgs := make([]kafka.Message, len(batch))
+	for i, r := range batch {
+		value, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		key := r.Email
+		if key == "" {
+			key = r.IPAddress
+		}
+		msgs[i] = kafka.Message{Key: []byte(key), Value: value}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return k.writer.WriteMessages(ctx, msgs...)
+}
+
+func (k *kafkaSink) Close() error {
+	return k.writer.Close()
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+const (
+	syslogFacilityLocal0 = 16
+	syslogSeverityInfo   = 6
+)
+
+// syslogSink forwards each log record as an RFC 5424 message whose body is the
+// JSON record. UDP sends one datagram per message; TCP and TLS (RFC 5425) use
+// octet-counting framing.
+type syslogSink struct {
+	network  string // "udp", "tcp" or "tls"
+	addr     string
+	appName  string
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogSink(cfg *config.Config) (*syslogSink, error) {
+	if cfg.SyslogAddr == "" {
+		return nil, errors.New("SYSLOG_ADDR is required")
+	}
+	switch cfg.SyslogNetwork {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unsupported SYSLOG_NETWORK %q", cfg.SyslogNetwork)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &syslogSink{
+		network:  cfg.SyslogNetwork,
+		addr:     cfg.SyslogAddr,
+		appName:  cfg.SyslogAppName,
+		hostname: hostname,
+	}, nil
+}
+
+func (s *syslogSink) Name() string { return "syslog" }
+
+func (s *syslogSink) Send(batch []models.LogRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range batch {
+		msg, err := s.format(r, time.Now())
+		if err != nil {
+			return err
+		}
+		if err := s.write(msg); err != nil {
+			// One reconnect attempt covers servers that closed an idle stream.
+			s.close()
+			if err := s.write(msg); err != nil {
+				s.close()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// format renders an RFC 5424 message: <PRI>1 TIMESTAMP HOST APP PROCID MSGID SD MSG.
+func (s *syslogSink) format(r models.LogRequest, now time.Time) ([]byte, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %d log - ",
+		syslogFacilityLocal0*8+syslogSeverityInfo,
+		now.UTC().Format(time.RFC3339Nano), s.hostname, s.appName, os.Getpid())
+	return append([]byte(header), body...), nil
+}
+
+func (s *syslogSink) write(msg []byte) error {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if s.network == "udp" {
+		_, err := s.conn.Write(msg)
+		return err
+	}
+	_, err := fmt.Fprintf(s.conn, "%d %s", len(msg), msg)
+	return err
+}
+
+func (s *syslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if s.network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	return dialer.Dial(s.network, s.addr)
+}
+
+func (s *syslogSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+	return nil
+}
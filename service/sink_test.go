@@ -0,0 +1,185 @@
+package service
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+	"apigate-proxy/utils"
+)
+
+type failingSink struct{ sent int64 }
+
+func (f *failingSink) Name() string { return "failing" }
+func (f *failingSink) Send(batch []models.LogRequest) error {
+	atomic.AddInt64(&f.sent, int64(len(batch)))
+	return errors.New("unavailable")
+}
+func (f *failingSink) Close() error { return nil }
+
+func TestNewSinkRoutes(t *testing.T) {
+	routes := newSinkRoutes(&config.Config{LogSinks: []string{"bogus", "kafka"}}, nil, nil)
+	if len(routes) != 1 || routes[0].sink.Name() != "upstream" {
+		t.Fatalf("Expected fallback to the upstream sink, got %d routes", len(routes))
+	}
+
+	cfg := &config.Config{
+		LogSinks:     []string{"upstream", "kafka"},
+		KafkaBrokers: []string{"127.0.0.1:9092"},
+		KafkaTopic:   "apigate-logs",
+		LogSpillDir:  t.TempDir(),
+	}
+	routes = newSinkRoutes(cfg, nil, storage.NewMemory())
+	if len(routes) != 2 || routes[1].sink.Name() != "kafka" {
+		t.Fatalf("Expected upstream and kafka sinks, got %d routes", len(routes))
+	}
+	if routes[0].spool.prefix != "logspool/upstream/" || routes[1].spool.prefix != "logspool/kafka/" {
+		t.Errorf("unexpected spool prefixes %q, %q", routes[0].spool.prefix, routes[1].spool.prefix)
+	}
+}
+
+func TestLoggerService_SinkFailureIsolated(t *testing.T) {
+	var upstreamRecords int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&upstreamRecords, 1)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{UpstreamBaseURL: upstream.URL, LogBatchSize: 10, LogSpillDir: t.TempDir()}
+	svc := NewLoggerService(cfg, nil, nil)
+	failing := &failingSink{}
+	svc.sinks = append(svc.sinks, &sinkRoute{sink: failing, spool: newLogSpool(storage.NewMemory(), "failing")})
+
+	svc.QueueLog(models.LogRequest{IPAddress: "10.0.0.1"})
+	svc.Stop()
+
+	if n := atomic.LoadInt64(&upstreamRecords); n != 1 {
+		t.Fatalf("Expected 1 upstream delivery, got %d", n)
+	}
+	if st := svc.Stats(); st.Spilled != 1 {
+		t.Fatalf("Expected the failing sink's batch to be spilled, got %+v", st)
+	}
+
+	// Replay retries only the failing sink
+	svc.replaySpool()
+	if n := atomic.LoadInt64(&upstreamRecords); n != 1 {
+		t.Errorf("Upstream received a duplicate delivery (%d)", n)
+	}
+	if n := atomic.LoadInt64(&failing.sent); n != 2 {
+		t.Errorf("Expected the failing sink to be retried, got %d sends", n)
+	}
+}
+
+func TestSyslogSink_TCPFraming(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var n int
+		fmt.Fscanf(r, "%d ", &n)
+		msg := make([]byte, n)
+		io.ReadFull(r, msg)
+		got <- string(msg)
+	}()
+
+	sink, err := newSyslogSink(&config.Config{SyslogAddr: ln.Addr().String(), SyslogNetwork: "tcp", SyslogAppName: "apigate-proxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Send([]models.LogRequest{{IPAddress: "10.0.0.1", Endpoint: "/login"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-got
+	if !strings.HasPrefix(msg, "<134>1 ") || !strings.Contains(msg, " apigate-proxy ") {
+		t.Errorf("unexpected header: %q", msg)
+	}
+	if !strings.HasSuffix(msg, ` log - {"ip_address":"10.0.0.1","email":"","user_agent":"","http_method":"","endpoint":"/login","track_request":false}`) {
+		t.Errorf("unexpected body: %q", msg)
+	}
+}
+
+func TestArchiveSink_PutsPartitionedGzip(t *testing.T) {
+	type put struct {
+		path, auth, encoding string
+		records              []models.LogRequest
+	}
+	got := make(chan put, 1)
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("body is not gzip: %v", err)
+			return
+		}
+		var records []models.LogRequest
+		dec := json.NewDecoder(zr)
+		for dec.More() {
+			var rec models.LogRequest
+			dec.Decode(&rec)
+			records = append(records, rec)
+		}
+		got <- put{r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("Content-Encoding"), records}
+	}))
+	defer store.Close()
+
+	sink, err := newArchiveSink(&config.Config{
+		ArchiveEndpoint:  store.URL,
+		ArchiveBucket:    "logs",
+		ArchiveRegion:    "us-east-1",
+		ArchivePrefix:    "/apigate/",
+		ArchivePartition: "hour",
+		ArchiveAccessKey: "AKIDEXAMPLE",
+		ArchiveSecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.now = func() time.Time { return time.Date(2024, 5, 1, 13, 4, 5, 0, time.UTC) }
+
+	if err := sink.Send([]models.LogRequest{{IPAddress: "10.0.0.1"}, {IPAddress: "10.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	p := <-got
+	if !strings.HasPrefix(p.path, "/logs/apigate/dt=2024-05-01/hr=13/") || !strings.HasSuffix(p.path, ".ndjson.gz") {
+		t.Errorf("unexpected object path %q", p.path)
+	}
+	if !strings.HasPrefix(p.auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240501/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Errorf("unexpected Authorization %q", p.auth)
+	}
+	if p.encoding != "gzip" || len(p.records) != 2 || p.records[1].IPAddress != "10.0.0.2" {
+		t.Errorf("unexpected object: %+v", p)
+	}
+}
+
+func TestSigningKeyV4(t *testing.T) {
+	// Example from the AWS Signature Version 4 documentation
+	key := utils.SigningKeyV4("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	if got := hex.EncodeToString(key); got != "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d" {
+		t.Errorf("signing key = %s", got)
+	}
+}
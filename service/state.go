@@ -0,0 +1,54 @@
+package service
+
+import (
+	"time"
+
+	"apigate-proxy/config"
+)
+
+// AdminState is a point-in-time snapshot of a proxy for support tickets: the
+// effective configuration with secrets masked, which optional features are
+// on, and the scheduler and cache state from Stats.
+type AdminState struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	Config      *config.Config  `json:"config"`
+	Features    map[string]bool `json:"features"`
+	Cache       CacheStats      `json:"cache"`
+}
+
+// State returns the proxy's AdminState.
+func (s *ProxyService) State() AdminState {
+	return AdminState{
+		GeneratedAt: time.Now().UTC(),
+		Config:      s.config.Masked(),
+		Features:    s.features(),
+		Cache:       s.Stats(),
+	}
+}
+
+// features reports the optional features enabled by the configuration.
+func (s *ProxyService) features() map[string]bool {
+	c := s.config
+	return map[string]bool{
+		"read_replica":       c.ReadReplica,
+		"shadow_mode":        c.ShadowMode,
+		"warm_start":         c.WarmStart,
+		"warmup_persist":     c.WarmupPersist,
+		"warmup":             c.WarmupAction != WarmupLive,
+		"decision_memo":      c.DecisionMemoTTLMs > 0,
+		"idempotency":        c.IdempotencyTTLSeconds > 0,
+		"tuple_cache":        c.TupleCacheTTLMs > 0,
+		"latency_budget":     c.LiveCheckBudgetMs > 0,
+		"upstream_budget":    c.UpstreamDailyKeyBudget > 0,
+		"upstream_streaming": c.UpstreamStreaming,
+		"debug_store":        s.DebugEnabled(),
+		"decision_headers":   c.DecisionHeaders,
+		"email_encryption":   c.EmailEncryptionEnabled,
+		"geoip":              c.GeoIPDBPath != "",
+		"asn":                c.ASNDBPath != "",
+		"local_rules":        len(c.RulesAllow)+len(c.RulesDeny) > 0,
+		"per_type_windows":   len(s.typed) > 0,
+		"client_auth":        len(c.ClientAPIKeys) > 0,
+		"tenants":            len(c.Tenants) > 0,
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats describes how fresh the proxy's decisions are. Test automation can
+// wait WarmupRemainingSeconds before expecting cached (non-warmup) answers, and
+// NextSwapSeconds before expecting a newly prefetched window.
+type CacheStats struct {
+	WarmUp                 bool    `json:"warm_up"`
+	WarmupRemainingSeconds float64 `json:"warmup_remaining_seconds"`
+	NextSwapSeconds        float64 `json:"next_swap_seconds"`
+	WindowSeconds          float64 `json:"window_seconds"`
+	CachedKeys             int     `json:"cached_keys"`
+	CachedRanges           int     `json:"cached_ranges"`
+	PendingKeys            int     `json:"pending_keys"`
+	// The cache was kept past a window without a prefetch (CACHE_STALE_POLICY=retain)
+	Stale bool `json:"stale"`
+	// New keys left out of prefetch batches by MAX_KEYS_PER_WINDOW, since start
+	KeyOverflows int64 `json:"key_overflows"`
+	// Wall clock steps and scheduler stalls detected, since start
+	ClockJumps int64 `json:"clock_jumps"`
+	// Blocks answered as allows by SHADOW_MODE, since start
+	ShadowBlocks int64 `json:"shadow_blocks"`
+	// Decisions replaced by pushed invalidations, since start
+	Invalidations int64 `json:"invalidations"`
+	// Events dropped for GET /api/events subscribers that fell behind, since start
+	EventsDropped int64 `json:"events_dropped"`
+	// Decisions not kept in the debug store because its write queue was full, since start
+	DebugDropped int64 `json:"debug_dropped,omitempty"`
+	// Answer to failed live checks now; differs from FAIL_MODE while FAIL_SWITCH_BELOW applies
+	FailMode string `json:"fail_mode"`
+	// Keys sent to the upstream (billed per key) and the daily budget
+	UpstreamKeys UpstreamKeyStats `json:"upstream_keys"`
+	// Cache hits and upstream calls per window and since start
+	Efficiency EfficiencyStats `json:"efficiency"`
+	// Independently refreshed key types (WINDOW_SECONDS_BY_TYPE)
+	TypeWindows []TypeWindowStats `json:"type_windows,omitempty"`
+	// Decisions shared with peer instances (GOSSIP_BIND)
+	Gossip *GossipStats `json:"gossip,omitempty"`
+	// Prefetch leader election (LEADER_ELECTION)
+	Leader *LeaderStats `json:"leader,omitempty"`
+	// Blocked requests delayed before their answer (TARPIT_MAX_MS)
+	Tarpit *TarpitStats `json:"tarpit,omitempty"`
+	// Local velocity limits (QUOTA_RULES)
+	Quota *QuotaStats `json:"quota,omitempty"`
+	// Upstream circuit breaker (CIRCUIT_BREAKER_FAILURES)
+	CircuitBreaker *BreakerStats `json:"circuit_breaker,omitempty"`
+}
+
+// TypeWindowStats is the freshness of one per-type window.
+type TypeWindowStats struct {
+	Type            string  `json:"type"`
+	WindowSeconds   float64 `json:"window_seconds"`
+	NextSwapSeconds float64 `json:"next_swap_seconds"`
+	CachedKeys      int     `json:"cached_keys"`
+	PendingKeys     int     `json:"pending_keys"`
+	Stale           bool    `json:"stale"`
+}
+
+func (s *ProxyService) setNextSwap(window time.Duration, next time.Time) {
+	s.mu.Lock()
+	s.window = window
+	s.nextSwap.Store(next.UnixNano())
+	s.mu.Unlock()
+}
+
+// Freshness returns the seconds left in warmup and until the next cache swap,
+// as in Stats. It takes no locks, so it can run on every request.
+func (s *ProxyService) Freshness() (warmupRemaining, nextSwap float64) {
+	if ns := s.nextSwap.Load(); ns != 0 {
+		nextSwap = roundSeconds(max(time.Until(time.Unix(0, ns)), 0))
+	}
+	if s.warmUp.Load() {
+		warmupRemaining = nextSwap
+		if ns := s.warmupEnds.Load(); ns != 0 {
+			warmupRemaining = roundSeconds(max(time.Until(time.Unix(0, ns)), 0))
+		}
+	}
+	return warmupRemaining, nextSwap
+}
+
+// Stats reports the warmup state and the time until the next cache swap.
+// Warmup ends at the first swap unless WARMUP_SECONDS sets its own length, so
+// by default both countdowns are equal during warmup.
+func (s *ProxyService) Stats() CacheStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st := CacheStats{
+		WarmUp:         s.warmUp.Load(),
+		WindowSeconds:  s.window.Seconds(),
+		CachedKeys:     s.current.Load().len(),
+		CachedRanges:   s.current.Load().rangeLen(),
+		PendingKeys:    s.batchedKeys.len(),
+		Stale:          s.stale,
+		KeyOverflows:   atomic.LoadInt64(&s.keyOverflows),
+		ClockJumps:     atomic.LoadInt64(&s.clockJumps),
+		ShadowBlocks:   atomic.LoadInt64(&s.shadowBlocks),
+		Invalidations:  atomic.LoadInt64(&s.invalidations),
+		EventsDropped:  s.events.dropped.Load(),
+		DebugDropped:   s.debug.droppedCount(),
+		FailMode:       s.failMode(),
+		UpstreamKeys:   s.cost.stats(),
+		Efficiency:     s.efficiency.stats(atomic.LoadInt64(&s.lastBatchSize)),
+		Gossip:         s.gossip.stats(),
+		Leader:         s.leader.stats(),
+		Tarpit:         s.tarpit.stats(),
+		Quota:          s.quotas.stats(),
+		CircuitBreaker: s.breaker.stats(),
+	}
+	st.WarmupRemainingSeconds, st.NextSwapSeconds = s.Freshness()
+	for _, w := range s.typed {
+		ws := TypeWindowStats{
+			Type:          w.keyType,
+			WindowSeconds: w.window.Seconds(),
+			CachedKeys:    w.current.Load().len(),
+			PendingKeys:   w.batched.len(),
+			Stale:         w.stale,
+		}
+		if !w.nextSwap.IsZero() {
+			ws.NextSwapSeconds = roundSeconds(max(time.Until(w.nextSwap), 0))
+		}
+		st.TypeWindows = append(st.TypeWindows, ws)
+	}
+	sort.Slice(st.TypeWindows, func(i, j int) bool { return st.TypeWindows[i].Type < st.TypeWindows[j].Type })
+	return st
+}
+
+func roundSeconds(d time.Duration) float64 {
+	return math.Round(d.Seconds()*1000) / 1000
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"apigate-proxy/config"
+	"apigate-proxy/storage"
+)
+
+// OpenStorage opens the STORAGE_BACKEND store of cfg, to be handed to
+// NewProxyService and NewLoggerService. Every subsystem keeps its state in it
+// under its own key prefix such as "idempotency/". A backend that fails to
+// open is logged and replaced by process memory, so persistence problems
+// degrade to the pre-storage behaviour rather than failing startup.
+func OpenStorage(cfg *config.Config) storage.Storage {
+	st, err := storage.Open(storage.Options{
+		Backend:       cfg.StorageBackend,
+		Path:          cfg.StoragePath,
+		RedisAddr:     cfg.StorageRedisAddr,
+		RedisPassword: cfg.StorageRedisPassword,
+		RedisDB:       cfg.StorageRedisDB,
+		RedisPrefix:   cfg.StorageRedisPrefix,
+	})
+	if err != nil {
+		logFor(componentStorage).Error("failed to open backend, using memory", "backend", cfg.StorageBackend, "error", err)
+		st = storage.NewMemory()
+	}
+	return st
+}
+
+// sweepStorage reclaims expired entries on backends that do not expire them
+// on their own (Redis does).
+func sweepStorage(st storage.Storage) {
+	if sw, ok := st.(interface{ Sweep() }); ok {
+		sw.Sweep()
+	}
+}
+
+// CloseStorage flushes and closes st. Call it once the services using it
+// have stopped.
+func CloseStorage(st storage.Storage) {
+	if err := st.Close(); err != nil {
+		logFor(componentStorage).Error("error closing backend", "error", err)
+	}
+}
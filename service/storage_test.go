@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+func TestStorage_FileBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	st, err := storage.Open(storage.Options{Backend: "file", Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Set("a/1", []byte("one"), 0)
+	st.Set("a/2", []byte("two"), time.Hour)
+	st.Set("b/1", []byte("other"), 0)
+	st.Set("a/gone", []byte("x"), time.Millisecond)
+	st.Set("a/deleted", []byte("x"), 0)
+	st.Delete("a/deleted")
+	time.Sleep(5 * time.Millisecond)
+
+	if v, ok, _ := st.Get("a/1"); !ok || string(v) != "one" {
+		t.Errorf("Get a/1: %q %v", v, ok)
+	}
+	if _, ok, _ := st.Get("a/gone"); ok {
+		t.Error("Expected expired key to be missing")
+	}
+	if ttl, ok, _ := st.TTL("a/2"); !ok || ttl <= 59*time.Minute {
+		t.Errorf("TTL a/2: %v %v", ttl, ok)
+	}
+	if ttl, ok, _ := st.TTL("a/1"); !ok || ttl != 0 {
+		t.Errorf("TTL a/1: %v %v", ttl, ok)
+	}
+	scanned := map[string]string{}
+	st.Scan("a/", func(k string, v []byte) bool {
+		scanned[k] = string(v)
+		return true
+	})
+	if len(scanned) != 2 || scanned["a/2"] != "two" {
+		t.Errorf("Scan a/: %v", scanned)
+	}
+	st.Close()
+
+	// Reopening replays the file
+	st, err = storage.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	var buf bytes.Buffer
+	if err := st.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]storage.Entry{}
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var e storage.Entry
+		json.Unmarshal(sc.Bytes(), &e)
+		entries[e.Key] = e
+	}
+	if len(entries) != 3 || string(entries["b/1"].Value) != "other" || entries["a/2"].TTLMs <= 0 || entries["a/1"].TTLMs != 0 {
+		t.Errorf("Snapshot after reopen: %+v", entries)
+	}
+}
+
+func TestStorage_Envelope(t *testing.T) {
+	sealed := storage.Seal(storage.KindWarmupSnapshot, "kd", []byte(`{"a":1}`))
+	if h, payload, err := storage.Unseal(sealed, storage.KindWarmupSnapshot); err != nil || string(payload) != `{"a":1}` || h.Version != storage.FormatVersion || h.KeyDerivation != "kd" {
+		t.Fatalf("Unseal: %+v %q %v", h, payload, err)
+	}
+	if _, _, err := storage.Unseal(append(sealed, ' '), storage.KindWarmupSnapshot); !errors.Is(err, storage.ErrChecksum) {
+		t.Errorf("Expected a checksum error for a modified payload, got %v", err)
+	}
+	if _, payload, err := storage.Unseal([]byte(`{"a":1}`), storage.KindWarmupSnapshot); err != nil || string(payload) != `{"a":1}` {
+		t.Errorf("Expected state without a header read as version 0, got %q %v", payload, err)
+	}
+
+	// Files written before envelopes load, and are rewritten with a header
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.db")
+	os.WriteFile(path, []byte(`{"k":"a","v":"b25l"}`+"\n"), 0o600)
+	st, err := storage.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, _ := st.Get("a"); !ok || string(v) != "one" {
+		t.Errorf("Expected the legacy file to load, got %q %v", v, ok)
+	}
+	st.Close()
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), `{"magic":"APIGATE","version":1,"kind":"state"`) {
+		t.Errorf("Expected the file rewritten with a header, got %s", data)
+	}
+
+	// State from a newer build is refused, not misread
+	newer := filepath.Join(dir, "newer.db")
+	os.WriteFile(newer, []byte(`{"magic":"APIGATE","version":99,"kind":"state"}`+"\n"+`{"k":"a"}`+"\n"), 0o600)
+	if _, err := storage.OpenFile(newer); !errors.Is(err, storage.ErrNewerFormat) {
+		t.Errorf("Expected ErrNewerFormat, got %v", err)
+	}
+	spool := []byte(`{"magic":"APIGATE","version":99,"kind":"log_spool"}` + "\n" + `{"ip_address":"1.1.1.1"}` + "\n")
+	if _, err := decodeSegment(spool); !errors.Is(err, storage.ErrNewerFormat) {
+		t.Errorf("Expected a newer spool segment to be refused, got %v", err)
+	}
+}
+
+func TestProxyService_IdempotencySurvivesRestart(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.BlockAll)
+
+	path := filepath.Join(t.TempDir(), "state.db")
+	newService := func() (*ProxyService, storage.Storage) {
+		cfg := &config.Config{UpstreamBaseURL: upstream.URL, IdempotencyTTLSeconds: 60, StorageBackend: "file", StoragePath: path}
+		st := OpenStorage(cfg)
+		svc := NewProxyService(cfg, nil, st)
+		svc.swapCache() // leave warmup
+		return svc, st
+	}
+
+	req := models.AllowRequest{IPAddress: "8.8.8.8"}
+	svc, st := newService()
+	first, _, err := svc.CheckIdempotent(context.Background(), "k1", req)
+	if err != nil || first.Allow {
+		t.Fatalf("first submission: %+v, err=%v", first, err)
+	}
+	CloseStorage(st)
+
+	svc, st = newService()
+	defer CloseStorage(st)
+	again, replayed, err := svc.CheckIdempotent(context.Background(), "k1", req)
+	if err != nil || !replayed || again.Allow != first.Allow || again.Message != first.Message {
+		t.Errorf("retry after restart: %+v, replayed=%v, err=%v", again, replayed, err)
+	}
+	if n := upstream.Calls(); n != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", n)
+	}
+}
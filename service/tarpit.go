@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// TarpitStats counts the blocked requests held back by the tarpit, since start.
+type TarpitStats struct {
+	Held    int   `json:"held"`    // Being delayed now
+	Delayed int64 `json:"delayed"` // Answered after a delay
+	Skipped int64 `json:"skipped"` // Answered at once because TARPIT_MAX_HELD were held
+}
+
+// tarpit delays answers to blocked requests by a random time between min and
+// min+spread. Bots retrying credentials then get far fewer tries per
+// connection, while allowed requests are never slowed. Waiting costs a timer
+// per held request; held bounds how many wait at once.
+type tarpit struct {
+	min, spread time.Duration
+	held        chan struct{} // One slot per request being delayed
+
+	delayed atomic.Int64
+	skipped atomic.Int64
+}
+
+func newTarpit(cfg *config.Config) *tarpit {
+	if cfg.TarpitMaxMs <= 0 {
+		return nil
+	}
+	return &tarpit{
+		min:    time.Duration(cfg.TarpitMinMs) * time.Millisecond,
+		spread: time.Duration(cfg.TarpitMaxMs-cfg.TarpitMinMs) * time.Millisecond,
+		held:   make(chan struct{}, max(cfg.TarpitMaxHeld, 1)),
+	}
+}
+
+// Tarpit waits before resp is answered when it blocks the request
+// (TARPIT_MIN_MS..TARPIT_MAX_MS). It returns at once for allows, unknown or
+// failed decisions and shadowed blocks, when TARPIT_MAX_HELD requests are
+// already waiting, and when ctx ends.
+func (s *ProxyService) Tarpit(ctx context.Context, resp models.AllowResponse) {
+	t := s.tarpit
+	if t == nil || resp.Allow || resp.Status != "success" {
+		return
+	}
+	select {
+	case t.held <- struct{}{}:
+	default:
+		t.skipped.Add(1)
+		return
+	}
+	defer func() { <-t.held }()
+
+	delay := t.min
+	if t.spread > 0 {
+		delay += rand.N(t.spread + 1)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		t.delayed.Add(1)
+	case <-ctx.Done():
+	}
+}
+
+func (t *tarpit) stats() *TarpitStats {
+	if t == nil {
+		return nil
+	}
+	return &TarpitStats{
+		Held:    len(t.held),
+		Delayed: t.delayed.Load(),
+		Skipped: t.skipped.Load(),
+	}
+}
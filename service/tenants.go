@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"sort"
+
+	"apigate-proxy/config"
+	"apigate-proxy/storage"
+)
+
+// Tenants routes requests to per-tenant services. Each tenant in TENANTS_FILE
+// gets its own ProxyService and LoggerService built from its derived config,
+// so caches, prefetch batches, encryption keys, upstream API keys and log
+// buffers are never shared. Tenants share the upstream connection pool and the
+// storage backend (under a "tenant/<id>/" key prefix). Requests without a
+// tenant go to the default services.
+type Tenants struct {
+	proxy   *ProxyService
+	logger  *LoggerService
+	proxies map[string]*ProxyService
+	loggers map[string]*LoggerService
+	keys    map[string]string // Client API key -> tenant it is bound to
+}
+
+// NewTenants builds the services of every configured tenant around the
+// default services built from cfg.
+func NewTenants(cfg *config.Config, proxy *ProxyService, logger *LoggerService) *Tenants {
+	t := &Tenants{
+		proxy:   proxy,
+		logger:  logger,
+		proxies: make(map[string]*ProxyService, len(cfg.Tenants)),
+		loggers: make(map[string]*LoggerService, len(cfg.Tenants)),
+		keys:    make(map[string]string),
+	}
+	for id, tenant := range cfg.Tenants {
+		tc := cfg.ForTenant(id, tenant)
+		store := storage.WithPrefix(proxy.store, "tenant/"+id+"/")
+		t.proxies[id] = NewProxyService(tc, proxy.client, store)
+		t.loggers[id] = NewLoggerService(tc, proxy.client, store)
+		t.loggers[id].EnrichFrom(t.proxies[id])
+		for _, k := range tenant.ClientAPIKeys {
+			t.keys[k] = id
+		}
+	}
+	return t
+}
+
+// Start starts the tenants' services; the default ones are started by their owner.
+func (t *Tenants) Start() {
+	for _, id := range t.IDs() {
+		t.proxies[id].Start()
+		t.loggers[id].Start()
+	}
+}
+
+// Stop ends the tenants' background work, waiting for prefetches in flight
+// until ctx is done (see ProxyService.Stop), and flushes their log buffers.
+func (t *Tenants) Stop(ctx context.Context) error {
+	var err error
+	for _, id := range t.IDs() {
+		if perr := t.proxies[id].Stop(ctx); perr != nil && err == nil {
+			err = perr
+		}
+		t.loggers[id].Stop()
+	}
+	return err
+}
+
+// IDs returns the configured tenant IDs in order.
+func (t *Tenants) IDs() []string {
+	ids := make([]string, 0, len(t.proxies))
+	for id := range t.proxies {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ClientAPIKeys returns every key accepted by some tenant, including the
+// deployment-wide CLIENT_API_KEYS.
+func (t *Tenants) ClientAPIKeys(cfg *config.Config) []string {
+	keys := append([]string(nil), cfg.ClientAPIKeys...)
+	for k := range t.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Resolve returns the tenant a request belongs to. requested is the tenant ID
+// the request named (header or body, may be empty); clientKey is the API key
+// it authenticated with. A key bound to a tenant always resolves to that
+// tenant and may not name another one; other keys may name any tenant without
+// bound keys. "" is the default tenant.
+func (t *Tenants) Resolve(requested, clientKey string) (string, error) {
+	bound, isBound := t.keyTenant(clientKey)
+	switch {
+	case requested == "" && isBound:
+		return bound, nil
+	case requested == "":
+		return "", nil
+	}
+	if _, ok := t.proxies[requested]; !ok {
+		return "", ErrUnknownTenant
+	}
+	if isBound && bound != requested {
+		return "", ErrTenantForbidden
+	}
+	if !isBound && t.hasBoundKeys(requested) {
+		return "", ErrTenantForbidden
+	}
+	return requested, nil
+}
+
+// Lookup checks that id names a configured tenant ("" is the default one),
+// without the API key binding Resolve enforces. It is meant for admin
+// endpoints, whose keys are not bound to tenants.
+func (t *Tenants) Lookup(id string) (string, error) {
+	if _, ok := t.proxies[id]; !ok && id != "" {
+		return "", ErrUnknownTenant
+	}
+	return id, nil
+}
+
+// Proxy returns the ProxyService of a tenant returned by Resolve.
+func (t *Tenants) Proxy(id string) *ProxyService {
+	if p, ok := t.proxies[id]; ok {
+		return p
+	}
+	return t.proxy
+}
+
+// Logger returns the LoggerService of a tenant returned by Resolve.
+func (t *Tenants) Logger(id string) *LoggerService {
+	if l, ok := t.loggers[id]; ok {
+		return l
+	}
+	return t.logger
+}
+
+func (t *Tenants) keyTenant(clientKey string) (string, bool) {
+	if clientKey == "" {
+		return "", false
+	}
+	for k, id := range t.keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(clientKey)) == 1 {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func (t *Tenants) hasBoundKeys(id string) bool {
+	return len(t.proxies[id].Config().ClientAPIKeys) > 0
+}
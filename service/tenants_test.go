@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
+	"apigate-proxy/models"
+)
+
+func TestTenants(t *testing.T) {
+	// The upstream blocks 6.6.6.6, but only for tenant acme's API key
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get("X-API-Key")
+		mu.Lock()
+		seen[apiKey] = true
+		mu.Unlock()
+		var keys []string
+		json.NewDecoder(r.Body).Decode(&keys)
+		var res []models.BatchAllowResponseItem
+		for _, k := range keys {
+			res = append(res, models.BatchAllowResponseItem{Key: k, Allow: !(apiKey == "acme-upstream" && k == "6.6.6.6")})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		UpstreamBaseURL:        upstream.URL,
+		UpstreamAPIKey:         "default-upstream",
+		EmailEncryptionKey:     "default-email-key",
+		EmailEncryptionEnabled: true,
+		Tenants: map[string]config.Tenant{
+			"acme":   {UpstreamAPIKey: "acme-upstream", EmailEncryptionKey: "acme-email-key", ClientAPIKeys: []string{"acme-client"}},
+			"globex": {UpstreamAPIKey: "globex-upstream"},
+		},
+	}
+	proxy := NewProxyService(cfg, nil, nil)
+	tenants := NewTenants(cfg, proxy, NewLoggerService(cfg, nil, nil))
+
+	resolveCases := []struct {
+		requested, clientKey, want string
+		err                        error
+	}{
+		{"", "", "", nil},
+		// Bound keys imply their tenant and cannot name another
+		{"", "acme-client", "acme", nil},
+		{"acme", "acme-client", "acme", nil},
+		{"globex", "acme-client", "", ErrTenantForbidden},
+		// Tenants with bound keys only accept those
+		{"acme", "other-client", "", ErrTenantForbidden},
+		{"globex", "other-client", "globex", nil},
+		{"initech", "", "", ErrUnknownTenant},
+	}
+	for _, c := range resolveCases {
+		got, err := tenants.Resolve(c.requested, c.clientKey)
+		if got != c.want || !errors.Is(err, c.err) {
+			t.Errorf("Resolve(%q, %q) = %q, %v; want %q, %v", c.requested, c.clientKey, got, err, c.want, c.err)
+		}
+	}
+
+	acme, globex := tenants.Proxy("acme"), tenants.Proxy("globex")
+	if acme.client != proxy.client || tenants.Logger("acme").client != proxy.client {
+		t.Error("Expected the tenants to share the default upstream client")
+	}
+	for _, svc := range []*ProxyService{proxy, acme, globex} {
+		svc.swapCache() // leave warmup
+	}
+	req := models.AllowRequest{IPAddress: "6.6.6.6"}
+	if resp, _ := acme.Check(context.Background(), req); resp.Allow {
+		t.Errorf("Expected acme to block 6.6.6.6, got %+v", resp)
+	}
+	for name, svc := range map[string]*ProxyService{"default": proxy, "globex": globex} {
+		if resp, _ := svc.Check(context.Background(), req); !resp.Allow {
+			t.Errorf("Expected %s not to see acme's decision, got %+v", name, resp)
+		}
+	}
+	if !seen["acme-upstream"] || !seen["globex-upstream"] || !seen["default-upstream"] {
+		t.Errorf("Expected each tenant's upstream API key to be used, saw %v", seen)
+	}
+
+	// Emails are pseudonymized with each tenant's key; globex inherits the default
+	acmeKey, _ := acme.IdentityKey("alice@example.com", "")
+	globexKey, _ := globex.IdentityKey("alice@example.com", "")
+	defaultKey, _ := proxy.IdentityKey("alice@example.com", "")
+	if acmeKey == defaultKey || globexKey != defaultKey {
+		t.Errorf("Unexpected identity keys: acme=%s globex=%s default=%s", acmeKey, globexKey, defaultKey)
+	}
+}
+
+func TestTenants_CircuitBreaker(t *testing.T) {
+	// acme's upstream key is rejected; globex's works
+	var acmeCalls atomic.Int32
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-API-Key") != "acme-upstream" {
+			return true
+		}
+		acmeCalls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	})
+
+	cfg := &config.Config{
+		UpstreamBaseURL: upstream.URL,
+		UpstreamAPIKey:  "default-upstream",
+		FailMode:        FailClosed,
+		Tenants: map[string]config.Tenant{
+			"acme":   {UpstreamAPIKey: "acme-upstream", BreakerFailures: 2, BreakerOpenSeconds: 60},
+			"globex": {UpstreamAPIKey: "globex-upstream", BreakerFailures: 2},
+		},
+	}
+	proxy := NewProxyService(cfg, nil, nil)
+	tenants := NewTenants(cfg, proxy, NewLoggerService(cfg, nil, nil))
+	acme, globex := tenants.Proxy("acme"), tenants.Proxy("globex")
+	for _, svc := range []*ProxyService{proxy, acme, globex} {
+		svc.swapCache() // leave warmup
+	}
+	if proxy.breaker != nil {
+		t.Error("Expected no breaker for the default tenant")
+	}
+
+	for i, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		resp, err := acme.Check(context.Background(), models.AllowRequest{IPAddress: ip})
+		if err != nil || resp.Allow {
+			t.Fatalf("check %d: expected a fail-closed block, got %+v, %v", i, resp, err)
+		}
+	}
+	if n := acmeCalls.Load(); n != 2 {
+		t.Errorf("Expected acme's breaker to open after 2 failed calls, got %d calls", n)
+	}
+	if st := acme.Stats().CircuitBreaker; st == nil || st.State != breakerOpen || st.Rejected != 1 {
+		t.Errorf("Expected acme's breaker open with one rejected call, got %+v", st)
+	}
+
+	// Other tenants keep calling the upstream
+	if resp, _ := globex.Check(context.Background(), models.AllowRequest{IPAddress: "4.4.4.4"}); !resp.Allow {
+		t.Errorf("Expected globex to reach the upstream, got %+v", resp)
+	}
+	if st := globex.Stats().CircuitBreaker; st == nil || st.State != breakerClosed {
+		t.Errorf("Expected globex's breaker closed, got %+v", st)
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// UpstreamTransport carries batch decision lookups and log batches to the
+// upstream. The default speaks JSON over HTTP; UPSTREAM_PROTOCOL=grpc selects
+// the binary gRPC protocol instead, and READ_REPLICA disables upstream calls.
+type UpstreamTransport interface {
+	// AllowBatch requests decisions for keys and calls visit for each result,
+	// giving up when ctx ends.
+	AllowBatch(ctx context.Context, keys []string, visit func(models.BatchAllowResponseItem)) error
+	// Snapshot streams up to limit current decisions (0 = all) for warm starts.
+	Snapshot(ctx context.Context, limit int, visit func(models.BatchAllowResponseItem)) error
+	// Changes returns the decisions changed since a version (PREFETCH_DELTA),
+	// or errDeltaUnsupported.
+	Changes(ctx context.Context, since string) (models.ChangesResponse, error)
+	// SendLogs delivers a batch of log records.
+	SendLogs(ctx context.Context, batch []models.LogRequest) error
+}
+
+func newUpstreamTransport(cfg *config.Config, pool *UpstreamPool) UpstreamTransport {
+	if cfg.ReadReplica {
+		return newReplicaTransport(cfg)
+	}
+	if cfg.UpstreamProtocol == "grpc" {
+		return newGRPCTransport(cfg)
+	}
+	return &httpTransport{config: cfg, pool: pool}
+}
+
+// usesHTTPUpstream reports whether the HTTP endpoints (and their health checks) are in use.
+func usesHTTPUpstream(cfg *config.Config) bool {
+	return !cfg.ReadReplica && cfg.UpstreamProtocol != "grpc"
+}
+
+// httpTransport implements the JSON/HTTP protocol with multi-endpoint failover.
+type httpTransport struct {
+	config *config.Config
+	pool   *UpstreamPool
+}
+
+func (t *httpTransport) AllowBatch(ctx context.Context, keys []string, visit func(models.BatchAllowResponseItem)) error {
+	body, _ := json.Marshal(keys)
+
+	resp, err := t.pool.Do(func(baseURL string) (*http.Request, error) {
+		url := fmt.Sprintf("%s/api/allow/batch", baseURL)
+		r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		if t.config.UpstreamStreaming {
+			r.Header.Set("Accept", ndjsonContentType+", application/json")
+		}
+		if key := t.config.CurrentUpstreamAPIKey(); key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		return r, nil
+	})
+	if err != nil {
+		return err
+	}
+	return t.decodeItems(resp, visit)
+}
+
+func (t *httpTransport) Snapshot(ctx context.Context, limit int, visit func(models.BatchAllowResponseItem)) error {
+	resp, err := t.pool.Do(func(baseURL string) (*http.Request, error) {
+		url := fmt.Sprintf("%s/api/allow/snapshot?limit=%d", baseURL, limit)
+		r, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if t.config.UpstreamStreaming {
+			r.Header.Set("Accept", ndjsonContentType+", application/json")
+		}
+		if key := t.config.CurrentUpstreamAPIKey(); key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		return r, nil
+	})
+	if err != nil {
+		return err
+	}
+	return t.decodeItems(resp, visit)
+}
+
+func (t *httpTransport) Changes(ctx context.Context, since string) (models.ChangesResponse, error) {
+	query := url.Values{"since": {since}}.Encode()
+	resp, err := t.pool.Do(func(baseURL string) (*http.Request, error) {
+		url := fmt.Sprintf("%s/api/allow/changes?%s", baseURL, query)
+		r, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if key := t.config.CurrentUpstreamAPIKey(); key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		return r, nil
+	})
+	if err != nil {
+		return models.ChangesResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return models.ChangesResponse{}, statusError(resp.StatusCode)
+	}
+	var changes models.ChangesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+		return models.ChangesResponse{}, err
+	}
+	return changes, nil
+}
+
+// decodeItems consumes a JSON array or NDJSON decision response.
+func (t *httpTransport) decodeItems(resp *http.Response, visit func(models.BatchAllowResponseItem)) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+
+	if isNDJSON(resp.Header.Get("Content-Type")) {
+		return decodeNDJSONItems(resp.Body, visit)
+	}
+
+	items, err := decodeBatchItems(resp.Body, t.config.PrefetchWorkers)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		visit(item)
+	}
+	return nil
+}
+
+func (t *httpTransport) SendLogs(ctx context.Context, batch []models.LogRequest) error {
+	body, _ := json.Marshal(batch)
+
+	resp, err := t.pool.Do(func(baseURL string) (*http.Request, error) {
+		url := fmt.Sprintf("%s/api/logs", baseURL)
+		r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		if key := t.config.CurrentUpstreamAPIKey(); key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		return r, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return statusError(resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	apigatev1 "apigate-proxy/proto/apigate/v1"
+)
+
+// grpcTransport implements UpstreamTransport over apigate.v1.UpstreamService.
+// Decisions are streamed back item by item, so large prefetches never hold the
+// full response in memory.
+type grpcTransport struct {
+	config *config.Config
+	client apigatev1.UpstreamServiceClient
+	err    error // connection setup error, reported on every call
+}
+
+// newGRPCTransport connects to UPSTREAM_GRPC_ADDR; opts are added to the
+// connection's dial options.
+func newGRPCTransport(cfg *config.Config, opts ...grpc.DialOption) *grpcTransport {
+	creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if cfg.UpstreamGRPCInsecure {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(cfg.UpstreamGRPCAddr, append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, opts...)...)
+	if err != nil {
+		return &grpcTransport{config: cfg, err: fmt.Errorf("grpc upstream %q: %w", cfg.UpstreamGRPCAddr, err)}
+	}
+	return &grpcTransport{config: cfg, client: apigatev1.NewUpstreamServiceClient(conn)}
+}
+
+// withAPIKey adds UPSTREAM_API_KEY to the metadata of calls made with ctx.
+func (t *grpcTransport) withAPIKey(ctx context.Context) context.Context {
+	if key := t.config.CurrentUpstreamAPIKey(); key != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", key)
+	}
+	return ctx
+}
+
+func (t *grpcTransport) AllowBatch(ctx context.Context, keys []string, visit func(models.BatchAllowResponseItem)) error {
+	if t.err != nil {
+		return t.err
+	}
+	stream, err := t.client.AllowBatch(t.withAPIKey(ctx), &apigatev1.AllowBatchRequest{Keys: keys})
+	if err != nil {
+		return upstreamError(err)
+	}
+	return upstreamError(recvItems(stream, visit))
+}
+
+func (t *grpcTransport) Snapshot(ctx context.Context, limit int, visit func(models.BatchAllowResponseItem)) error {
+	if t.err != nil {
+		return t.err
+	}
+	stream, err := t.client.Snapshot(t.withAPIKey(ctx), &apigatev1.SnapshotRequest{Limit: uint32(limit)})
+	if err != nil {
+		return upstreamError(err)
+	}
+	return upstreamError(recvItems(stream, visit))
+}
+
+// Changes is not part of apigate.v1.UpstreamService yet.
+func (t *grpcTransport) Changes(ctx context.Context, since string) (models.ChangesResponse, error) {
+	return models.ChangesResponse{}, errDeltaUnsupported
+}
+
+func recvItems(stream grpc.ServerStreamingClient[apigatev1.AllowBatchItem], visit func(models.BatchAllowResponseItem)) error {
+	for {
+		item, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		visit(models.BatchAllowResponseItem{Key: item.GetKey(), Type: item.GetType(), Allow: item.GetAllow(), Reason: item.GetReason(), Labels: item.GetLabels()})
+	}
+}
+
+func (t *grpcTransport) SendLogs(ctx context.Context, batch []models.LogRequest) error {
+	if t.err != nil {
+		return t.err
+	}
+	records := make([]*apigatev1.LogRecord, len(batch))
+	for i, l := range batch {
+		records[i] = &apigatev1.LogRecord{
+			IpAddress:             l.IPAddress,
+			Email:                 l.Email,
+			IdentityType:          l.IdentityType,
+			UserAgent:             l.UserAgent,
+			ClientCertFingerprint: l.ClientCertFingerprint,
+			Ja3:                   l.JA3,
+			RequestFingerprint:    l.RequestFingerprint,
+			Country:               l.Country,
+			Continent:             l.Continent,
+			HttpMethod:            l.HTTPMethod,
+			Endpoint:              l.Endpoint,
+			EventType:             l.EventType,
+			Username:              l.Username,
+			ResponseCode:          int32(l.ResponseCode),
+			TrackRequest:          l.TrackRequest,
+			Count:                 uint32(l.Count),
+			Labels:                l.Labels,
+			SampleRate:            l.SampleRate,
+			UaClass:               l.UAClass,
+			UaClient:              l.UAClient,
+		}
+	}
+
+	_, err := t.client.SubmitLogs(t.withAPIKey(ctx), &apigatev1.SubmitLogsRequest{Records: records})
+	return upstreamError(err)
+}
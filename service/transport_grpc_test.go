@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+	apigatev1 "apigate-proxy/proto/apigate/v1"
+)
+
+// fakeGRPCUpstream blocks the keys in blocked, or fails every call with fail.
+type fakeGRPCUpstream struct {
+	apigatev1.UnimplementedUpstreamServiceServer
+
+	blocked map[string]bool
+	fail    codes.Code
+
+	mu      sync.Mutex
+	apiKeys []string
+	records int
+}
+
+func (f *fakeGRPCUpstream) seen(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.mu.Lock()
+	f.apiKeys = append(f.apiKeys, md.Get("x-api-key")...)
+	f.mu.Unlock()
+}
+
+func (f *fakeGRPCUpstream) AllowBatch(in *apigatev1.AllowBatchRequest, stream grpc.ServerStreamingServer[apigatev1.AllowBatchItem]) error {
+	f.seen(stream.Context())
+	if f.fail != codes.OK {
+		return status.Error(f.fail, "upstream failure")
+	}
+	for _, key := range in.GetKeys() {
+		item := &apigatev1.AllowBatchItem{Key: key, Type: "ip", Allow: !f.blocked[key]}
+		if f.blocked[key] {
+			item.Reason, item.Labels = "abuse", []string{"botnet"}
+		}
+		if err := stream.Send(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeGRPCUpstream) SubmitLogs(ctx context.Context, in *apigatev1.SubmitLogsRequest) (*apigatev1.SubmitLogsResponse, error) {
+	f.seen(ctx)
+	f.mu.Lock()
+	f.records += len(in.GetRecords())
+	f.mu.Unlock()
+	return &apigatev1.SubmitLogsResponse{Accepted: uint32(len(in.GetRecords()))}, nil
+}
+
+// grpcUpstream serves f over an in-memory connection and returns a transport
+// connected to it.
+func grpcUpstream(t *testing.T, cfg *config.Config, f *fakeGRPCUpstream) *grpcTransport {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	apigatev1.RegisterUpstreamServiceServer(srv, f)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	cfg.UpstreamGRPCAddr = "passthrough:///bufnet"
+	cfg.UpstreamGRPCInsecure = true
+	tr := newGRPCTransport(cfg, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	if tr.err != nil {
+		t.Fatal(tr.err)
+	}
+	return tr
+}
+
+func TestGRPCTransport_AllowBatch(t *testing.T) {
+	f := &fakeGRPCUpstream{blocked: map[string]bool{"6.6.6.6": true}}
+	tr := grpcUpstream(t, &config.Config{UpstreamAPIKey: "up-secret"}, f)
+
+	var items []models.BatchAllowResponseItem
+	err := tr.AllowBatch(context.Background(), []string{"1.1.1.1", "6.6.6.6"}, func(item models.BatchAllowResponseItem) {
+		items = append(items, item)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || !items[0].Allow || items[0].Key != "1.1.1.1" ||
+		items[1].Allow || items[1].Reason != "abuse" || len(items[1].Labels) != 1 || items[1].Type != "ip" {
+		t.Errorf("Expected one decision per key in order, got %+v", items)
+	}
+
+	if err := tr.SendLogs(context.Background(), []models.LogRequest{{IPAddress: "1.1.1.1"}, {IPAddress: "6.6.6.6"}}); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.records != 2 {
+		t.Errorf("Expected 2 log records delivered, got %d", f.records)
+	}
+	if len(f.apiKeys) != 2 || f.apiKeys[0] != "up-secret" || f.apiKeys[1] != "up-secret" {
+		t.Errorf("Expected UPSTREAM_API_KEY sent with every call, got %v", f.apiKeys)
+	}
+}
+
+func TestGRPCTransport_Errors(t *testing.T) {
+	for _, c := range []struct {
+		code codes.Code
+		want error
+	}{
+		{codes.DeadlineExceeded, ErrUpstreamTimeout},
+		{codes.Unauthenticated, ErrUpstreamUnauthorized},
+		{codes.PermissionDenied, ErrUpstreamUnauthorized},
+	} {
+		tr := grpcUpstream(t, &config.Config{}, &fakeGRPCUpstream{fail: c.code})
+		err := tr.AllowBatch(context.Background(), []string{"1.1.1.1"}, func(models.BatchAllowResponseItem) {})
+		if !errors.Is(err, c.want) {
+			t.Errorf("%v: got %v, want %v", c.code, err, c.want)
+		}
+	}
+}
+
+func TestGRPCTransport_FailMode(t *testing.T) {
+	for _, c := range []struct {
+		mode  string
+		allow bool
+	}{
+		{FailOpen, true},
+		{FailClosed, false},
+	} {
+		cfg := &config.Config{UpstreamProtocol: "grpc", WarmupAction: WarmupLive, FailMode: c.mode}
+		f := &fakeGRPCUpstream{blocked: map[string]bool{"6.6.6.6": true}}
+		tr := grpcUpstream(t, cfg, f)
+		svc := NewProxyService(cfg, nil, nil)
+		svc.transport = tr
+
+		resp, err := svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"})
+		if err != nil || resp.Allow {
+			t.Errorf("%s: expected a block from the upstream, got %+v, %v", c.mode, resp, err)
+		}
+
+		// The upstream goes away: the fail mode decides
+		f.fail = codes.Unavailable
+		resp, err = svc.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1"})
+		if err != nil || resp.Allow != c.allow {
+			t.Errorf("%s: expected allow=%v on a transport error, got %+v, %v", c.mode, c.allow, resp, err)
+		}
+		r := svc.UsageReport(10)
+		if r.FailOpenDecisions+r.FailClosedDecisions != 1 {
+			t.Errorf("%s: expected one failed decision, got %+v", c.mode, r)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+var errReadReplica = errors.New("read replica: upstream calls are disabled")
+
+// replicaTransport backs READ_REPLICA mode. Decisions only ever come from a
+// published snapshot (a local file or an http(s) URL, e.g. a CDN object);
+// batch lookups and log delivery are refused so nothing reaches the decision
+// service.
+type replicaTransport struct {
+	config *config.Config
+	client *http.Client
+}
+
+func newReplicaTransport(cfg *config.Config) *replicaTransport {
+	return &replicaTransport{config: cfg, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (t *replicaTransport) AllowBatch(ctx context.Context, keys []string, visit func(models.BatchAllowResponseItem)) error {
+	return errReadReplica
+}
+
+func (t *replicaTransport) SendLogs(ctx context.Context, batch []models.LogRequest) error {
+	return errReadReplica
+}
+
+func (t *replicaTransport) Changes(ctx context.Context, since string) (models.ChangesResponse, error) {
+	return models.ChangesResponse{}, errReadReplica
+}
+
+// Snapshot reads the published snapshot, either a JSON array or NDJSON of
+// batch items.
+func (t *replicaTransport) Snapshot(ctx context.Context, limit int, visit func(models.BatchAllowResponseItem)) error {
+	src := t.config.ReplicaSnapshot
+	if src == "" {
+		return errors.New("read replica: REPLICA_SNAPSHOT is not set")
+	}
+
+	var body io.ReadCloser
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		req, err := http.NewRequestWithContext(ctx, "GET", src, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("snapshot returned status: %d", resp.StatusCode)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		body = f
+	}
+	defer body.Close()
+
+	n := 0
+	limited := func(item models.BatchAllowResponseItem) {
+		if limit > 0 && n >= limit {
+			return
+		}
+		n++
+		visit(item)
+	}
+
+	// A JSON array starts with '['; anything else is treated as NDJSON.
+	r := bufio.NewReader(body)
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		r.ReadByte()
+	}
+	if b, _ := r.Peek(1); b[0] != '[' {
+		return decodeNDJSONItems(r, limited)
+	}
+
+	items, err := decodeBatchItems(r, t.config.PrefetchWorkers)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		limited(item)
+	}
+	return nil
+}
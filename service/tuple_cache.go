@@ -0,0 +1,100 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tupleCache remembers the combined decision for a request's full key tuple
+// (ip, identity, user agent, ...) so repeat visitors skip the per-key cache
+// composition in getFromCache. Entries are tagged with a generation that is
+// bumped whenever the per-key caches change wholesale (window swaps, warm
+// start loads), which invalidates them all at once.
+type tupleCache struct {
+	ttl     time.Duration
+	gen     atomic.Uint64
+	entries sync.Map // tupleKey -> tupleEntry
+}
+
+type tupleEntry struct {
+	allow   bool
+	gen     uint64
+	expires time.Time
+}
+
+func newTupleCache(ttl time.Duration) *tupleCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &tupleCache{ttl: ttl}
+}
+
+// tupleKey spells out the whole key tuple; entries are keyed by it in full,
+// so two tuples never share a decision.
+func tupleKey(keys []requestKey) string {
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k.Type)
+		b.WriteString("\x00")
+		b.WriteString(k.Value)
+		b.WriteString("\x00")
+	}
+	return b.String()
+}
+
+// generation returns the current generation. Read it before consulting the
+// per-key caches and pass it to put, so a decision computed from caches that
+// were swapped in the meantime is never stored as current.
+func (c *tupleCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.gen.Load()
+}
+
+func (c *tupleCache) get(key string) (allow bool, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	v, found := c.entries.Load(key)
+	if !found {
+		return false, false
+	}
+	entry := v.(tupleEntry)
+	if entry.gen != c.gen.Load() || time.Now().After(entry.expires) {
+		c.entries.Delete(key)
+		return false, false
+	}
+	return entry.allow, true
+}
+
+func (c *tupleCache) put(key string, allow bool, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.entries.Store(key, tupleEntry{allow: allow, gen: gen, expires: time.Now().Add(c.ttl)})
+}
+
+// invalidate drops every entry.
+func (c *tupleCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.gen.Add(1)
+}
+
+// sweep drops expired and invalidated entries that were never looked up again.
+func (c *tupleCache) sweep() {
+	if c == nil {
+		return
+	}
+	now, gen := time.Now(), c.gen.Load()
+	c.entries.Range(func(k, v any) bool {
+		if e := v.(tupleEntry); e.gen != gen || now.After(e.expires) {
+			c.entries.Delete(k)
+		}
+		return true
+	})
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"apigate-proxy/config"
+)
+
+// UpstreamPool tracks the health of every configured upstream base URL and
+// routes requests to healthy endpoints first, failing over to the next one
+// when a call errors out or the upstream answers with a 5xx.
+type UpstreamPool struct {
+	config    *config.Config
+	client    *http.Client
+	endpoints []*upstreamEndpoint
+}
+
+type upstreamEndpoint struct {
+	baseURL string
+
+	mu        sync.RWMutex
+	healthy   bool
+	lastCheck time.Time
+	lastError string
+	failures  int // Consecutive failed probes and calls
+}
+
+func NewUpstreamPool(cfg *config.Config, client *http.Client) *UpstreamPool {
+	urls := cfg.UpstreamBaseURLs
+	if len(urls) == 0 {
+		urls = []string{cfg.UpstreamBaseURL}
+	}
+	p := &UpstreamPool{config: cfg, client: client}
+	for _, u := range urls {
+		// Assume healthy until the first probe says otherwise
+		p.endpoints = append(p.endpoints, &upstreamEndpoint{baseURL: u, healthy: true})
+	}
+	return p
+}
+
+// StartHealthChecks probes every endpoint periodically in the background,
+// until done is closed (never, if done is nil). A single endpoint is probed
+// too, so its health shows in Status.
+func (p *UpstreamPool) StartHealthChecks(done <-chan struct{}) {
+	interval := time.Duration(p.config.UpstreamHealthInterval) * time.Second
+	if interval < 1*time.Second {
+		interval = 10 * time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		p.checkAll()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			p.checkAll()
+		}
+	}()
+}
+
+func (p *UpstreamPool) checkAll() {
+	for _, ep := range p.endpoints {
+		p.probe(ep)
+	}
+}
+
+func (p *UpstreamPool) probe(ep *upstreamEndpoint) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ep.baseURL+p.config.UpstreamHealthPath, nil)
+	if err != nil {
+		p.markFailed(ep, err.Error())
+		return
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.markFailed(ep, err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		p.markFailed(ep, fmt.Sprintf("health check returned status: %d", resp.StatusCode))
+		return
+	}
+	p.markHealthy(ep)
+}
+
+func (p *UpstreamPool) markHealthy(ep *upstreamEndpoint) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if !ep.healthy {
+		logFor(componentUpstream).Info("upstream is healthy again", "upstream", ep.baseURL)
+	}
+	ep.healthy = true
+	ep.lastCheck = time.Now()
+	ep.lastError = ""
+	ep.failures = 0
+}
+
+func (p *UpstreamPool) markFailed(ep *upstreamEndpoint, reason string) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.healthy {
+		logFor(componentUpstream).Warn("upstream marked unhealthy", "upstream", ep.baseURL, "reason", reason)
+	}
+	ep.healthy = false
+	ep.lastCheck = time.Now()
+	ep.lastError = reason
+	ep.failures++
+}
+
+// EndpointStatus is the health of one upstream base URL.
+type EndpointStatus struct {
+	URL                 string     `json:"url"`
+	Healthy             bool       `json:"healthy"`
+	LastCheck           *time.Time `json:"last_check,omitempty"` // Last probe or failed call
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// Status reports the health of every endpoint, in configured order.
+func (p *UpstreamPool) Status() []EndpointStatus {
+	out := make([]EndpointStatus, len(p.endpoints))
+	for i, ep := range p.endpoints {
+		ep.mu.RLock()
+		out[i] = EndpointStatus{
+			URL:                 ep.baseURL,
+			Healthy:             ep.healthy,
+			LastError:           ep.lastError,
+			ConsecutiveFailures: ep.failures,
+		}
+		if !ep.lastCheck.IsZero() {
+			t := ep.lastCheck
+			out[i].LastCheck = &t
+		}
+		ep.mu.RUnlock()
+	}
+	return out
+}
+
+// anyHealthy reports whether at least one endpoint is healthy.
+func (p *UpstreamPool) anyHealthy() bool {
+	for _, ep := range p.endpoints {
+		ep.mu.RLock()
+		ok := ep.healthy
+		ep.mu.RUnlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ordered returns healthy endpoints first (in configured order), followed by
+// unhealthy ones as a last resort.
+func (p *UpstreamPool) ordered() []*upstreamEndpoint {
+	healthy := make([]*upstreamEndpoint, 0, len(p.endpoints))
+	var unhealthy []*upstreamEndpoint
+	for _, ep := range p.endpoints {
+		ep.mu.RLock()
+		ok := ep.healthy
+		ep.mu.RUnlock()
+		if ok {
+			healthy = append(healthy, ep)
+		} else {
+			unhealthy = append(unhealthy, ep)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// Do builds a request against each endpoint in turn until one answers with a
+// non-5xx status. The caller owns the returned response body. The deadline of
+// the requests' context spans every attempt.
+func (p *UpstreamPool) Do(build func(baseURL string) (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	for _, ep := range p.ordered() {
+		r, err := build(ep.baseURL)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := p.client.Do(r)
+		if err != nil && r.Context().Err() != nil {
+			// Given up by the caller, which says nothing about the endpoint,
+			// or out of time, which leaves none to fail over to
+			if r.Context().Err() == context.DeadlineExceeded {
+				p.markFailed(ep, err.Error())
+			}
+			return nil, upstreamError(err)
+		}
+		if err != nil {
+			p.markFailed(ep, err.Error())
+			lastErr = upstreamError(err)
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("upstream %s returned status: %d", ep.baseURL, resp.StatusCode)
+			p.markFailed(ep, lastErr.Error())
+			continue
+		}
+		return resp, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream endpoints configured")
+	}
+	return nil, lastErr
+}
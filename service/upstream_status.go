@@ -0,0 +1,65 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// UpstreamStatus is the upstream's health as seen by the proxy
+// (GET /api/upstream/status).
+type UpstreamStatus struct {
+	// At least one endpoint passes its health check (always true without
+	// HTTP endpoints to probe, e.g. with UPSTREAM_PROTOCOL=grpc)
+	Healthy   bool             `json:"healthy"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+	// When a prefetch last fetched every key it asked for (nil = never)
+	LastPrefetch *time.Time `json:"last_successful_prefetch,omitempty"`
+	// Prefetches failed since then, and the latest error
+	PrefetchFailures  int    `json:"consecutive_prefetch_failures"`
+	LastPrefetchError string `json:"last_prefetch_error,omitempty"`
+}
+
+// prefetchHealth tracks the outcome of recent prefetches.
+type prefetchHealth struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	failures    int
+	lastError   string
+}
+
+func (p *prefetchHealth) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failures++
+		p.lastError = err.Error()
+		return
+	}
+	p.lastSuccess = time.Now()
+	p.failures = 0
+	p.lastError = ""
+}
+
+// UpstreamStatus reports endpoint health checks and prefetch outcomes.
+func (s *ProxyService) UpstreamStatus() UpstreamStatus {
+	st := UpstreamStatus{Healthy: true, Endpoints: []EndpointStatus{}}
+	if usesHTTPUpstream(s.config) {
+		st.Endpoints = s.upstream.Status()
+		st.Healthy = s.upstream.anyHealthy()
+	}
+	s.prefetches.mu.Lock()
+	defer s.prefetches.mu.Unlock()
+	if !s.prefetches.lastSuccess.IsZero() {
+		t := s.prefetches.lastSuccess
+		st.LastPrefetch = &t
+	}
+	st.PrefetchFailures = s.prefetches.failures
+	st.LastPrefetchError = s.prefetches.lastError
+	return st
+}
+
+// upstreamReady reports whether UPSTREAM_HEALTH_BLOCK_READINESS lets the
+// proxy receive traffic: false while every probed endpoint is unhealthy.
+func (s *ProxyService) upstreamReady() bool {
+	return !s.config.ReadyWhenUpstream || !usesHTTPUpstream(s.config) || s.upstream.anyHealthy()
+}
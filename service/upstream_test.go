@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+func TestUpstreamPool_Failover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"key":"1.2.3.4","allow":false}]`))
+	}))
+	defer up.Close()
+
+	cfg := &config.Config{
+		UpstreamBaseURLs:   []string{down.URL, up.URL},
+		UpstreamHealthPath: "/health",
+	}
+	svc := NewProxyService(cfg, nil, nil)
+
+	results, err := svc.callUpstreamBatch(context.Background(), []string{"1.2.3.4"})
+	if err != nil {
+		t.Fatalf("Expected failover to second upstream, got error: %v", err)
+	}
+	if len(results) != 1 || !reflect.DeepEqual(results[0], models.BatchAllowResponseItem{Key: "1.2.3.4", Allow: false}) {
+		t.Errorf("Unexpected results: %v", results)
+	}
+
+	// The failing endpoint should now be tried last
+	if order := svc.upstream.ordered(); order[0].baseURL != up.URL {
+		t.Errorf("Expected healthy upstream first, got %s", order[0].baseURL)
+	}
+}
+
+func TestUpstreamClient_SharedTunedTransport(t *testing.T) {
+	cfg := &config.Config{UpstreamBaseURL: "http://127.0.0.1:0", UpstreamMaxIdlePerHost: 32}
+	proxy := NewProxyService(cfg, nil, nil)
+	logger := NewLoggerService(cfg, proxy.UpstreamClient(), nil)
+	if proxy.client != logger.client {
+		t.Fatal("Expected ProxyService and LoggerService to share one client")
+	}
+	tr, ok := proxy.client.Transport.(*http.Transport)
+	if !ok || tr.MaxIdleConnsPerHost != 32 || tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil {
+		t.Errorf("Unexpected transport settings: %+v", tr)
+	}
+	if other := NewProxyService(cfg, nil, nil); other.client == proxy.client {
+		t.Error("Expected a separate client for a service built without one")
+	}
+}
+
+func TestProxyService_UpstreamStatus(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/health" {
+			return
+		}
+		w.Write([]byte(`[{"key":"1.2.3.4","allow":true}]`))
+	}))
+	defer upstream.Close()
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, UpstreamHealthPath: "/health", ReadyWhenUpstream: true}, nil, nil)
+	if !svc.Ready() {
+		t.Fatal("Expected readiness before the first probe")
+	}
+
+	svc.upstream.checkAll()
+	svc.fetchInto(newDecisionCache(), []string{"1.2.3.4"})
+	st := svc.UpstreamStatus()
+	if st.Healthy || len(st.Endpoints) != 1 || st.Endpoints[0].ConsecutiveFailures < 2 || st.Endpoints[0].LastCheck == nil {
+		t.Errorf("Expected an unhealthy endpoint with failures counted, got %+v", st)
+	}
+	if st.LastPrefetch != nil || st.PrefetchFailures != 1 || st.LastPrefetchError == "" {
+		t.Errorf("Expected one failed prefetch, got %+v", st)
+	}
+	if svc.Ready() {
+		t.Error("Expected readiness to fail with UPSTREAM_HEALTH_BLOCK_READINESS while the upstream is down")
+	}
+
+	down.Store(false)
+	svc.upstream.checkAll()
+	svc.fetchInto(newDecisionCache(), []string{"1.2.3.4"})
+	st = svc.UpstreamStatus()
+	if !st.Healthy || st.Endpoints[0].ConsecutiveFailures != 0 || st.Endpoints[0].LastError != "" {
+		t.Errorf("Expected the endpoint to recover, got %+v", st.Endpoints)
+	}
+	if st.LastPrefetch == nil || st.PrefetchFailures != 0 {
+		t.Errorf("Expected a successful prefetch to reset failures, got %+v", st)
+	}
+	if !svc.Ready() {
+		t.Error("Expected readiness once the upstream recovers")
+	}
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+
+	"apigate-proxy/models"
+)
+
+// maxTrackedOffenders bounds the offender table; once full, only keys already
+// present keep counting.
+const maxTrackedOffenders = 10000
+
+// offenderShards splits the offender table so concurrent blocks of different
+// keys do not contend on one lock.
+const offenderShards = 16
+
+// usageStats accumulates decision and upstream counters between usage reports.
+// Unlike the per-window stats logged in swapCache, these are only reset when a
+// report is taken. Counters are atomic so recording a decision takes no lock
+// unless it blocked.
+type usageStats struct {
+	mu    sync.Mutex // Serializes snapshots
+	since time.Time
+
+	requests       atomic.Int64
+	blocked        atomic.Int64
+	cacheHits      atomic.Int64
+	liveChecks     atomic.Int64
+	failOpen       atomic.Int64
+	failClosed     atomic.Int64
+	unknown        atomic.Int64
+	upstreamCalls  atomic.Int64
+	upstreamErrors atomic.Int64
+	upstreamKeys   atomic.Int64
+	shadowBlocks   atomic.Int64
+	offenders      [offenderShards]offenderShard
+}
+
+type offenderShard struct {
+	mu     sync.Mutex
+	counts map[requestKey]int64
+}
+
+func newUsageStats() *usageStats {
+	u := &usageStats{since: time.Now()}
+	for i := range u.offenders {
+		u.offenders[i].counts = make(map[requestKey]int64)
+	}
+	return u
+}
+
+func (u *usageStats) recordDecision(resp models.AllowResponse, trace decisionTrace) {
+	u.requests.Add(1)
+	switch trace.Source {
+	case sourceCache, sourceMemo:
+		u.cacheHits.Add(1)
+	case sourceLive:
+		u.liveChecks.Add(1)
+	case sourceFailOpen:
+		u.failOpen.Add(1)
+	case sourceFailClosed:
+		u.failClosed.Add(1)
+	case sourceUnknown:
+		u.unknown.Add(1)
+	}
+
+	// Fail-closed and warmup blocks say nothing about the keys involved
+	if resp.Allow || resp.Status != "success" || trace.Source == sourceFailClosed || trace.Source == sourceWarmup {
+		return
+	}
+	u.blocked.Add(1)
+
+	// Only the keys that caused the block are offenders, not the other keys
+	// of the request: BlockedBy lists them (just the winner under
+	// precedence), else the winner alone
+	if len(resp.BlockedBy) > 0 {
+		for _, b := range resp.BlockedBy {
+			u.offend(requestKey{Type: b.Type, Value: b.Key})
+		}
+	} else if trace.Winner.Value != "" {
+		u.offend(trace.Winner)
+	}
+}
+
+func (u *usageStats) offend(k requestKey) {
+	sh := &u.offenders[xxhash.Sum64String(k.Value)%offenderShards]
+	sh.mu.Lock()
+	if _, ok := sh.counts[k]; ok || len(sh.counts) < maxTrackedOffenders/offenderShards {
+		sh.counts[k]++
+	}
+	sh.mu.Unlock()
+}
+
+func (u *usageStats) recordUpstream(err error) {
+	u.upstreamCalls.Add(1)
+	if err != nil {
+		u.upstreamErrors.Add(1)
+	}
+}
+
+func (u *usageStats) recordKeys(n int) {
+	u.upstreamKeys.Add(int64(n))
+}
+
+func (u *usageStats) recordShadow() {
+	u.shadowBlocks.Add(1)
+}
+
+// UsageReport summarizes proxy activity over a reporting period.
+type UsageReport struct {
+	PeriodStart          time.Time  `json:"period_start"`
+	PeriodEnd            time.Time  `json:"period_end"`
+	TotalRequests        int64      `json:"total_requests"`
+	BlockedRequests      int64      `json:"blocked_requests"`
+	BlockRate            float64    `json:"block_rate"`
+	CacheHits            int64      `json:"cache_hits"`
+	LiveChecks           int64      `json:"live_checks"`
+	CacheHitRatio        float64    `json:"cache_hit_ratio"`
+	FailOpenDecisions    int64      `json:"fail_open_decisions"`
+	FailClosedDecisions  int64      `json:"fail_closed_decisions"`
+	UnknownDecisions     int64      `json:"unknown_decisions"`
+	UpstreamCalls        int64      `json:"upstream_calls"`
+	UpstreamErrors       int64      `json:"upstream_errors"`
+	UpstreamAvailability float64    `json:"upstream_availability"`
+	UpstreamKeys         int64      `json:"upstream_keys"` // Keys sent upstream (billed per key)
+	ShadowBlocks         int64      `json:"shadow_blocks"` // Blocked requests answered as allows (SHADOW_MODE)
+	TopOffenders         []Offender `json:"top_offenders"`
+}
+
+// Offender is a key that appeared in blocked requests.
+type Offender struct {
+	Key    string `json:"key"`
+	Type   string `json:"type"`
+	Blocks int64  `json:"blocks"`
+}
+
+// snapshot builds a report for the period so far; reset starts a new period.
+// A negative topN is treated as zero.
+func (u *usageStats) snapshot(topN int, reset bool) UsageReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// Counters are read (and reset) one by one, so decisions recorded
+	// meanwhile may land in either period but are never lost
+	load := func(c *atomic.Int64) int64 {
+		if reset {
+			return c.Swap(0)
+		}
+		return c.Load()
+	}
+	now := time.Now()
+	r := UsageReport{
+		PeriodStart:          u.since,
+		PeriodEnd:            now,
+		TotalRequests:        load(&u.requests),
+		BlockedRequests:      load(&u.blocked),
+		CacheHits:            load(&u.cacheHits),
+		LiveChecks:           load(&u.liveChecks),
+		FailOpenDecisions:    load(&u.failOpen),
+		FailClosedDecisions:  load(&u.failClosed),
+		UnknownDecisions:     load(&u.unknown),
+		UpstreamCalls:        load(&u.upstreamCalls),
+		UpstreamErrors:       load(&u.upstreamErrors),
+		UpstreamKeys:         load(&u.upstreamKeys),
+		ShadowBlocks:         load(&u.shadowBlocks),
+		UpstreamAvailability: 1,
+	}
+	if r.TotalRequests > 0 {
+		r.BlockRate = float64(r.BlockedRequests) / float64(r.TotalRequests)
+	}
+	if lookups := r.CacheHits + r.LiveChecks; lookups > 0 {
+		r.CacheHitRatio = float64(r.CacheHits) / float64(lookups)
+	}
+	if r.UpstreamCalls > 0 {
+		r.UpstreamAvailability = float64(r.UpstreamCalls-r.UpstreamErrors) / float64(r.UpstreamCalls)
+	}
+
+	r.TopOffenders = []Offender{}
+	for i := range u.offenders {
+		sh := &u.offenders[i]
+		sh.mu.Lock()
+		for k, n := range sh.counts {
+			r.TopOffenders = append(r.TopOffenders, Offender{Key: k.Value, Type: k.Type, Blocks: n})
+		}
+		if reset {
+			sh.counts = make(map[requestKey]int64)
+		}
+		sh.mu.Unlock()
+	}
+	sort.Slice(r.TopOffenders, func(i, j int) bool {
+		if r.TopOffenders[i].Blocks != r.TopOffenders[j].Blocks {
+			return r.TopOffenders[i].Blocks > r.TopOffenders[j].Blocks
+		}
+		return r.TopOffenders[i].Key < r.TopOffenders[j].Key
+	})
+	if topN = max(topN, 0); len(r.TopOffenders) > topN {
+		r.TopOffenders = r.TopOffenders[:topN]
+	}
+
+	if reset {
+		u.since = now
+	}
+	return r
+}
+
+// UsageReport returns the report for the current period without resetting it.
+func (s *ProxyService) UsageReport(topN int) UsageReport {
+	return s.usage.snapshot(topN, false)
+}
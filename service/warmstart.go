@@ -0,0 +1,272 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+// warmStartRetry is how long to wait before retrying a failed snapshot load.
+const warmStartRetry = 5 * time.Second
+
+// Answers during warmup (WARMUP_ACTION). With WarmupLive there is no warmup:
+// unknown keys are checked live from the first request.
+const (
+	WarmupAllow = "allow"
+	WarmupBlock = "block"
+	WarmupLive  = "live"
+)
+
+// warmStart loads an upstream decision snapshot into the current caches and
+// ends warmup, so the proxy does not answer with warmup allows. The first
+// attempt runs before Start returns, i.e. before the server listens; failures
+// are retried in the background until a snapshot loads or the first regular
+// window swap ends warmup anyway.
+func (s *ProxyService) warmStart() {
+	err := s.loadSnapshot()
+	if err == nil {
+		return
+	}
+	s.goWorker(func() {
+		for err != nil {
+			logFor(componentProxy).Warn("warm start failed, retrying", "retry_in", warmStartRetry, "error", err)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(warmStartRetry):
+			}
+			if s.warmingUp() {
+				err = s.loadSnapshot()
+			} else {
+				err = nil
+			}
+		}
+	})
+}
+
+func (s *ProxyService) loadSnapshot() error {
+	return s.loadDecisions("Warm start", func(visit func(models.BatchAllowResponseItem)) (time.Time, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout(s.config))
+		defer cancel()
+		err := s.transport.Snapshot(ctx, s.config.WarmStartLimit, visit)
+		s.usage.recordUpstream(err)
+		s.failSwitch.record(err, time.Now())
+		return time.Now(), err
+	})
+}
+
+// loadDecisions replaces the current caches with the decisions read by source,
+// which returns when they were fetched, batches their keys for the next
+// prefetch and ends warmup.
+func (s *ProxyService) loadDecisions(name string, source func(visit func(models.BatchAllowResponseItem)) (time.Time, error)) error {
+	start := time.Now()
+	// Built outside the lock like a prefetch; items are routed to the window owning their type.
+	cache := newDecisionCache()
+	typed := make(map[string]*decisionCache, len(s.typed))
+	for keyType := range s.typed {
+		typed[keyType] = newDecisionCache()
+	}
+
+	n := 0
+	visit := func(item models.BatchAllowResponseItem) {
+		n++
+		// Batched like requested keys, so the next prefetch refreshes them
+		// instead of dropping them at the first swap. Read replicas never
+		// prefetch.
+		if !s.config.ReadReplica {
+			s.batchFor(item.Type).add(item.Key)
+		}
+		if c, ok := typed[item.Type]; ok {
+			c.put(item)
+			return
+		}
+		cache.put(item)
+	}
+	freshAt, err := source(visit)
+	if err != nil {
+		return err
+	}
+	// Decisions pushed since the snapshot was taken replace its own
+	s.scanOverrides(visit)
+
+	s.mu.Lock()
+	// Live checks may have landed while the snapshot streamed; keep them.
+	// Read replicas make no live checks, and each snapshot fully replaces the last.
+	merge := !s.config.ReadReplica
+	if merge {
+		mergeInto(cache, s.current.Load())
+	}
+	s.current.Store(cache)
+	s.freshAt = freshAt
+	for keyType, w := range s.typed {
+		if merge {
+			mergeInto(typed[keyType], w.current.Load())
+		}
+		w.current.Store(typed[keyType])
+		w.freshAt = freshAt
+	}
+	s.warmUp.Store(false)
+	s.tuples.invalidate()
+	s.mu.Unlock()
+
+	logFor(componentProxy).Info("decisions loaded", "source", name, "decisions", n, "duration", time.Since(start))
+	return nil
+}
+
+// mergeInto copies every decision of from into to.
+func mergeInto(to, from *decisionCache) {
+	from.each(func(k string, allow bool) bool {
+		to.put(models.BatchAllowResponseItem{Key: k, Allow: allow})
+		return true
+	})
+}
+
+func (s *ProxyService) warmingUp() bool {
+	return s.warmUp.Load()
+}
+
+// Ready reports whether the proxy should receive traffic. It turns false for
+// good once Drain is called. Otherwise it is always ready unless
+// WARM_START_BLOCK_READINESS is set, in which case it waits for the warm start
+// snapshot (or the first window swap, whichever ends warmup first), or
+// UPSTREAM_HEALTH_BLOCK_READINESS is set and no upstream is healthy.
+func (s *ProxyService) Ready() bool {
+	if s.draining.Load() || !s.upstreamReady() {
+		return false
+	}
+	return !s.config.ReadyWhenWarm || !s.warmingUp()
+}
+
+// Drain fails readiness so load balancers stop routing new traffic here
+// before shutdown. Requests keep being served normally; event streams end,
+// so their clients reconnect elsewhere.
+func (s *ProxyService) Drain() {
+	s.draining.Store(true)
+	s.events.close()
+}
+
+// startReplica loads the published snapshot and reloads it every window in
+// place of the prefetch/swap cycle. Per-type windows are refreshed with it.
+func (s *ProxyService) startReplica(windowDuration time.Duration) {
+	logFor(componentProxy).Info("read replica: reloading snapshot every window", "snapshot", s.config.ReplicaSnapshot, "window_duration", windowDuration)
+	s.warmStart()
+
+	s.goWorker(func() {
+		runSchedule(s.done, windowDuration, func() {}, func() {
+			if err := s.loadSnapshot(); err != nil {
+				logFor(componentProxy).Error("read replica snapshot reload failed, keeping previous", "error", err)
+			}
+			s.memo.sweep()
+			s.audit.flush()
+		}, func(next time.Time) {
+			s.setNextSwap(windowDuration, next)
+		}, &s.clockJumps, nil)
+	})
+}
+
+// warmupSnapshotKey holds the decisions persisted for WARMUP_PERSIST.
+const warmupSnapshotKey = "warmup/snapshot"
+
+type persistedSnapshot struct {
+	SavedAt   time.Time                       `json:"saved_at"`
+	Version   string                          `json:"version,omitempty"` // Change feed version, for leader caches
+	Decisions []models.BatchAllowResponseItem `json:"decisions"`
+}
+
+// persistSnapshot saves the current caches to STORAGE_BACKEND, so the next
+// process to start from the same storage can skip warmup. Entries expire after
+// CACHE_MAX_STALE_SECONDS, when set, like a retained stale cache would.
+func (s *ProxyService) persistSnapshot() {
+	s.mu.RLock()
+	snap := persistedSnapshot{SavedAt: s.freshAt}
+	s.current.Load().each(func(k string, allow bool) bool {
+		snap.Decisions = append(snap.Decisions, models.BatchAllowResponseItem{Key: k, Allow: allow})
+		return true
+	})
+	for keyType, w := range s.typed {
+		w.current.Load().each(func(k string, allow bool) bool {
+			snap.Decisions = append(snap.Decisions, models.BatchAllowResponseItem{Key: k, Type: keyType, Allow: allow})
+			return true
+		})
+	}
+	s.mu.RUnlock()
+	// An idle window would otherwise overwrite the last useful snapshot
+	if len(snap.Decisions) == 0 {
+		return
+	}
+
+	data, _ := json.Marshal(snap)
+	data = storage.Seal(storage.KindWarmupSnapshot, keyDerivation(s.config), data)
+	ttl := time.Duration(s.config.CacheMaxStaleSeconds) * time.Second
+	if err := s.store.Set(warmupSnapshotKey, data, ttl); err != nil {
+		logFor(componentProxy).Error("error persisting warmup snapshot", "error", err)
+	}
+}
+
+// loadPersisted loads the snapshot saved by persistSnapshot, reporting
+// whether there was one.
+func (s *ProxyService) loadPersisted() bool {
+	err := s.loadDecisions("Persisted snapshot", func(visit func(models.BatchAllowResponseItem)) (time.Time, error) {
+		data, ok, err := s.store.Get(warmupSnapshotKey)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !ok {
+			return time.Time{}, errNoSnapshot
+		}
+		h, payload, err := storage.Unseal(data, storage.KindWarmupSnapshot)
+		if err != nil {
+			return time.Time{}, err
+		}
+		// Keys derived under another EMAIL_ENCRYPTION_* setup would never match
+		if h.Version > 0 && h.KeyDerivation != keyDerivation(s.config) {
+			return time.Time{}, errKeyDerivationChanged
+		}
+		var snap persistedSnapshot
+		if err := json.Unmarshal(payload, &snap); err != nil {
+			return time.Time{}, err
+		}
+		for _, item := range snap.Decisions {
+			visit(item)
+		}
+		return snap.SavedAt, nil
+	})
+	if err != nil {
+		logFor(componentProxy).Info("no persisted snapshot to skip warmup with", "reason", err)
+		return false
+	}
+	return true
+}
+
+var (
+	errNoSnapshot           = errors.New("none saved")
+	errKeyDerivationChanged = errors.New("saved under a different identity key derivation")
+)
+
+// startWarmupTimer ends warmup after WARMUP_SECONDS, independently of the
+// window swaps, unless a snapshot ended it already.
+func (s *ProxyService) startWarmupTimer() {
+	d := time.Duration(s.config.WarmupSeconds) * time.Second
+	if d <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.warmUp.Load() {
+		return
+	}
+	s.warmupEnds.Store(time.Now().Add(d).UnixNano())
+	time.AfterFunc(d, s.endWarmup)
+}
+
+func (s *ProxyService) endWarmup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.warmUp.Swap(false) {
+		logFor(componentProxy).Info("warmup ended", "warmup_seconds", s.config.WarmupSeconds)
+	}
+}
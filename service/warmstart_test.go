@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+func TestProxyService_WarmStart(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/allow/snapshot" || r.URL.Query().Get("limit") != "100" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		json.NewEncoder(w).Encode([]models.BatchAllowResponseItem{
+			{Key: "6.6.6.6", Type: models.KeyTypeIP, Allow: false},
+			{Key: "203.0.113.0/24", Type: models.KeyTypeIP, Allow: false},
+			{Key: "bad@example.com", Type: models.KeyTypeEmail, Allow: false},
+		})
+	}))
+	defer upstream.Close()
+
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:     upstream.URL,
+		WindowSecondsByType: map[string]int{"email": 30},
+		WarmStartLimit:      100,
+		ReadyWhenWarm:       true,
+	}, nil, nil)
+	if svc.Ready() {
+		t.Fatal("Expected not ready before warm start")
+	}
+
+	svc.warmStart()
+
+	if !svc.Ready() {
+		t.Fatal("Expected ready after warm start")
+	}
+	if _, ok := svc.typed["email"].current.Load().get("bad@example.com"); !ok {
+		t.Error("Email decision should be loaded into the email window")
+	}
+	// Loaded keys are refreshed by the next prefetch like requested ones
+	if !svc.batchedKeys.has("6.6.6.6") || !svc.batchedKeys.has("203.0.113.0/24") {
+		t.Error("Loaded keys should be batched for the next prefetch")
+	}
+	if !svc.typed["email"].batched.has("bad@example.com") || svc.batchedKeys.has("bad@example.com") {
+		t.Error("Loaded email keys should be batched for the email window")
+	}
+
+	for _, req := range []models.AllowRequest{
+		{IPAddress: "6.6.6.6"},
+		{IPAddress: "203.0.113.9"},
+		{Email: "bad@example.com"},
+	} {
+		resp, _ := svc.Check(context.Background(), req)
+		if resp.Allow || resp.Message != "Cache Hit: Blocked" {
+			t.Errorf("%+v: expected cached block without warmup, got %v", req, resp)
+		}
+	}
+}
+
+func TestProxyService_ReadReplica(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "snapshot.ndjson")
+	os.WriteFile(snapshot, []byte("{\"key\":\"6.6.6.6\",\"type\":\"ip\",\"allow\":false}\n{\"key\":\"1.1.1.1\",\"type\":\"ip\",\"allow\":true}\n"), 0o644)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("read replica called the upstream: %s", r.URL)
+	}))
+	defer upstream.Close()
+
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:      upstream.URL,
+		ReadReplica:          true,
+		ReplicaSnapshot:      snapshot,
+		ReplicaUnknownAction: "block",
+	}, nil, nil)
+	svc.warmStart()
+
+	tests := []struct {
+		ip      string
+		allow   bool
+		message string
+	}{
+		{"6.6.6.6", false, "Cache Hit: Blocked"},
+		{"1.1.1.1", true, "Cache Hit"},
+		{"9.9.9.9", false, "Blocked (Replica: Unknown Key)"},
+	}
+	for _, tt := range tests {
+		resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: tt.ip})
+		if resp.Allow != tt.allow || resp.Message != tt.message {
+			t.Errorf("%s: got %v", tt.ip, resp)
+		}
+	}
+
+	// Reloads replace the previous snapshot entirely
+	os.WriteFile(snapshot, []byte(`[{"key":"1.1.1.1","type":"ip","allow":true}]`), 0o644)
+	if err := svc.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := svc.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"}); resp.Message != "Blocked (Replica: Unknown Key)" {
+		t.Errorf("Expected removed key to be unknown, got %v", resp)
+	}
+	if svc.batchedKeys.len() != 0 {
+		t.Errorf("Read replica should not track keys, got %d", svc.batchedKeys.len())
+	}
+}
+
+func TestProxyService_DrainFailsReadiness(t *testing.T) {
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: "http://127.0.0.1:0"}, nil, nil)
+	if !svc.Ready() {
+		t.Fatal("Expected ready without WARM_START_BLOCK_READINESS")
+	}
+	svc.Drain()
+	if svc.Ready() {
+		t.Error("Expected not ready while draining")
+	}
+}
+
+func TestProxyService_WarmupPolicy(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.Block("6.6.6.6"))
+
+	blocking := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, WarmupAction: WarmupBlock}, nil, nil)
+	if resp, _ := blocking.Check(context.Background(), models.AllowRequest{IPAddress: "1.1.1.1"}); resp.Allow || resp.Message != "Warmup: Blocked" {
+		t.Errorf("Expected warmup block, got %+v", resp)
+	}
+	if r := blocking.UsageReport(10); r.BlockedRequests != 0 {
+		t.Errorf("Warmup blocks should not count as blocked requests, got %d", r.BlockedRequests)
+	}
+
+	live := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, WarmupAction: WarmupLive}, nil, nil)
+	if resp, _ := live.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"}); resp.Allow {
+		t.Errorf("Expected a live block without warmup, got %+v", resp)
+	}
+
+	// A fixed warmup outlasts window swaps
+	timed := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, WarmupSeconds: 60}, nil, nil)
+	timed.startWarmupTimer()
+	timed.swapCache()
+	if st := timed.Stats(); !st.WarmUp || st.WarmupRemainingSeconds <= 0 {
+		t.Errorf("Expected warmup to continue after a swap, got %+v", st)
+	}
+	timed.endWarmup()
+	if timed.warmingUp() {
+		t.Error("Expected warmup to end with its timer")
+	}
+}
+
+func TestProxyService_WarmupPersist(t *testing.T) {
+	cfg := &config.Config{UpstreamBaseURL: "http://127.0.0.1:0", WarmupPersist: true}
+	st := storage.NewMemory()
+
+	first := NewProxyService(cfg, nil, st)
+	first.current.Store(cacheOf(map[string]bool{"6.6.6.6": false}))
+	first.persistSnapshot()
+
+	second := NewProxyService(cfg, nil, st)
+	if !second.loadPersisted() {
+		t.Fatal("Expected the persisted snapshot to load")
+	}
+	if resp, _ := second.Check(context.Background(), models.AllowRequest{IPAddress: "6.6.6.6"}); resp.Allow || resp.Message != "Cache Hit: Blocked" {
+		t.Errorf("Expected a cached block without warmup, got %+v", resp)
+	}
+
+	// Identity keys derived under another key would never match
+	cfg.EmailEncryptionEnabled, cfg.EmailEncryptionKey = true, "new-key"
+	if NewProxyService(cfg, nil, st).loadPersisted() {
+		t.Error("Expected a snapshot from another key derivation to be discarded")
+	}
+}
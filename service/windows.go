@@ -0,0 +1,199 @@
+package service
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/models"
+)
+
+// typeWindow is an independently scheduled cache for one key type listed in
+// WINDOW_SECONDS_BY_TYPE. Keys of other types stay in the ProxyService's
+// default window. Fields but current and batched are guarded by
+// ProxyService.mu; current is replaced under it.
+type typeWindow struct {
+	keyType string
+	window  time.Duration
+
+	current  atomic.Pointer[decisionCache]
+	pending  *decisionCache
+	batched  *keyBatch
+	nextSwap time.Time
+	freshAt  time.Time // When current was last replaced by a prefetch
+	stale    bool      // current was kept past a window without a prefetch
+}
+
+var windowedKeyTypes = map[string]bool{
+	models.KeyTypeIP:         true,
+	models.KeyTypeEmail:      true,
+	models.KeyTypeUserID:     true,
+	models.KeyTypeUserAgent:  true,
+	models.KeyTypeClientCert: true,
+	models.KeyTypeJA3:        true,
+	models.KeyTypeRequestFP:  true,
+	models.KeyTypeASN:        true,
+}
+
+// newTypeWindows builds the per-type windows, skipping unknown key types.
+func newTypeWindows(cfg *config.Config) map[string]*typeWindow {
+	windows := make(map[string]*typeWindow)
+	for keyType, secs := range cfg.WindowSecondsByType {
+		if !windowedKeyTypes[keyType] {
+			logFor(componentProxy).Warn("ignoring window for unknown key type", "window", keyType)
+			continue
+		}
+		w := &typeWindow{
+			keyType: keyType,
+			window:  time.Duration(secs) * time.Second,
+			batched: newKeyBatch(cfg.MaxWindowKeys),
+		}
+		w.current.Store(newDecisionCache())
+		windows[keyType] = w
+	}
+	return windows
+}
+
+// cacheFor returns the current cache holding keys of keyType. It needs no
+// lock; writers that must not lose their write to a swap hold s.mu.
+func (s *ProxyService) cacheFor(keyType string) *decisionCache {
+	if w := s.typed[keyType]; w != nil {
+		return w.current.Load()
+	}
+	return s.current.Load()
+}
+
+// pendingFor returns the prefetched cache waiting to replace the current
+// cache of keyType, or nil when none is. Callers hold s.mu.
+func (s *ProxyService) pendingFor(keyType string) *decisionCache {
+	if w := s.typed[keyType]; w != nil {
+		return w.pending
+	}
+	return s.pending
+}
+
+// windowCaches returns the current and pending caches of every window;
+// pending ones may be nil. Callers hold s.mu.
+func (s *ProxyService) windowCaches() []*decisionCache {
+	caches := []*decisionCache{s.current.Load(), s.pending}
+	for _, w := range s.typed {
+		caches = append(caches, w.current.Load(), w.pending)
+	}
+	return caches
+}
+
+// batchFor returns the batch collecting keyType keys for the next prefetch.
+// Batches are never replaced, so no lock is needed.
+func (s *ProxyService) batchFor(keyType string) *keyBatch {
+	if w := s.typed[keyType]; w != nil {
+		return w.batched
+	}
+	return s.batchedKeys
+}
+
+func (s *ProxyService) startTypeWindows() {
+	for _, w := range s.typed {
+		s.goWorker(func() {
+			logFor(componentProxy).Info("starting window", "window", w.keyType, "window_duration", w.window)
+			runSchedule(s.done, w.window,
+				func() { s.prefetchWindow(w) },
+				func() { s.swapWindow(w) },
+				func(t time.Time) {
+					s.mu.Lock()
+					w.nextSwap = t
+					s.mu.Unlock()
+				}, &s.clockJumps, s.cost.stretch)
+		})
+	}
+}
+
+// prefetchOrder lists the batched keys in the order they are fetched: keys
+// the current cache blocks first, then by requests this window, so that with
+// PREFETCH_CHUNK_SIZE the keys most worth re-verifying land in the first
+// chunks and survive a later chunk failing.
+func prefetchOrder(batched map[string]int, current *decisionCache) []string {
+	keys := make([]string, 0, len(batched))
+	for k := range batched {
+		keys = append(keys, k)
+	}
+	blocked := func(k string) bool {
+		allow, ok := current.get(k)
+		return ok && !allow
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if bi, bj := blocked(keys[i]), blocked(keys[j]); bi != bj {
+			return bi
+		}
+		if batched[keys[i]] != batched[keys[j]] {
+			return batched[keys[i]] > batched[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// Stale cache policies (CACHE_STALE_POLICY).
+const (
+	StaleDrop   = "drop"
+	StaleRetain = "retain"
+)
+
+// keepStale reports whether a window swapping without a prefetched cache
+// (the prefetch failed, or nothing was requested) keeps serving its current
+// one, last fetched at freshAt, rather than starting empty and sending every
+// lookup to an upstream that may be struggling already. Callers hold s.mu.
+func (s *ProxyService) keepStale(window string, freshAt time.Time, current *decisionCache) bool {
+	if s.config.CacheStalePolicy != StaleRetain || current.len() == 0 {
+		return false
+	}
+	age := time.Since(freshAt)
+	if maxStale := time.Duration(s.config.CacheMaxStaleSeconds) * time.Second; maxStale > 0 && age > maxStale {
+		logFor(componentProxy).Warn("dropping stale cache: no prefetch within CACHE_MAX_STALE_SECONDS",
+			"window", window, "age", age.Round(time.Second), "max_stale_seconds", s.config.CacheMaxStaleSeconds)
+		return false
+	}
+	logFor(componentProxy).Warn("no prefetch for the window, keeping the current cache", "window", window, "cached_keys", current.len())
+	return true
+}
+
+func (s *ProxyService) prefetchWindow(w *typeWindow) {
+	batched, overflow := w.batched.drain()
+	keys := prefetchOrder(batched, w.current.Load())
+	s.reportOverflow(w.keyType, overflow)
+
+	if len(keys) == 0 {
+		return
+	}
+	logFor(componentProxy).Info("prefetching keys for next window", "window", w.keyType, "batch_size", len(keys))
+	s.goWorker(func() {
+		s.fetchPending(keys, func(cache *decisionCache) {
+			w.pending = cache
+		})
+	})
+}
+
+func (s *ProxyService) swapWindow(w *typeWindow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := w.current.Load()
+	next := prev
+	if w.pending != nil {
+		next = w.pending
+		w.pending = nil
+		w.freshAt, w.stale = time.Now(), false
+	} else if s.keepStale(w.keyType, w.freshAt, prev) {
+		w.stale = true
+	} else {
+		next = newDecisionCache()
+		w.stale = false
+	}
+	if !w.stale {
+		s.ttls.carry(prev, next, time.Now())
+	}
+	w.current.Store(next)
+	s.tuples.invalidate()
+	s.publishSwap(w.keyType, next.len(), w.stale)
+	logFor(componentProxy).Info("window swapped", "window", w.keyType, "cached_keys", next.len())
+}
@@ -0,0 +1,410 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"apigate-proxy/config"
+	"apigate-proxy/internal/upstreamtest"
+	"apigate-proxy/models"
+	"apigate-proxy/storage"
+)
+
+func TestProxyService_TypeWindows(t *testing.T) {
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll)
+
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:     upstream.URL,
+		WindowSecondsByType: map[string]int{"email": 30, "bogus": 10},
+	}, nil, nil)
+	if len(svc.typed) != 1 || svc.typed["email"] == nil {
+		t.Fatalf("Expected only an email window, got %v", svc.typed)
+	}
+	svc.swapCache() // leave warmup
+
+	req := models.AllowRequest{IPAddress: "1.1.1.1", Email: "a@example.com"}
+	if resp, _ := svc.Check(context.Background(), req); resp.Message != "Allowed (Live Check)" {
+		t.Fatalf("Expected live check, got %v", resp)
+	}
+
+	email := svc.typed["email"]
+	if _, ok := svc.current.Load().get("1.1.1.1"); !ok {
+		t.Error("IP should be cached in the default window")
+	}
+	if _, ok := svc.current.Load().get("a@example.com"); ok {
+		t.Error("Email should not be cached in the default window")
+	}
+	if _, ok := email.current.Load().get("a@example.com"); !ok {
+		t.Error("Email should be cached in its own window")
+	}
+	if !email.batched.has("a@example.com") {
+		t.Error("Email should be tracked for its own window's prefetch")
+	}
+
+	if resp, _ := svc.Check(context.Background(), req); resp.Message != "Cache Hit" {
+		t.Fatalf("Expected cache hit, got %v", resp)
+	}
+
+	// Swapping only the email window expires the email decision, not the IP one
+	svc.swapWindow(email)
+	if resp, _ := svc.Check(context.Background(), req); resp.Message != "Allowed (Live Check)" {
+		t.Errorf("Expected live check after email window swap, got %v", resp)
+	}
+	if n := upstream.Calls(); n != 2 {
+		t.Errorf("Expected 2 upstream calls, got %d", n)
+	}
+}
+
+func TestProxyService_MaxWindowKeys(t *testing.T) {
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:     "http://127.0.0.1:0",
+		MaxWindowKeys:       2,
+		WindowSecondsByType: map[string]int{"email": 30},
+	}, nil, nil)
+
+	// Warmup: keys are tracked but never live-checked
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "1.1.1.1"} {
+		svc.Check(context.Background(), models.AllowRequest{IPAddress: ip})
+	}
+	svc.Check(context.Background(), models.AllowRequest{Email: "a@example.com"})
+
+	if svc.batchedKeys.len() != 2 {
+		t.Errorf("Expected the default batch capped at 2 keys, got %d", svc.batchedKeys.len())
+	}
+	if svc.batchedKeys.has("3.3.3.3") {
+		t.Error("Keys past the cap should not be tracked")
+	}
+	// Each window has its own cap
+	if svc.typed["email"].batched.len() != 1 {
+		t.Errorf("Expected the email window unaffected, got %d keys", svc.typed["email"].batched.len())
+	}
+	if st := svc.Stats(); st.KeyOverflows != 1 {
+		t.Errorf("Expected 1 key overflow, got %d", st.KeyOverflows)
+	}
+
+	svc.prefetch()
+	if svc.batchedKeys.overflow.Load() != 0 || svc.batchedKeys.len() != 0 {
+		t.Error("Prefetch should reset the window's keys and overflow count")
+	}
+}
+
+func TestScheduler_ClockJumps(t *testing.T) {
+	var prefetches, swaps int
+	var jumps int64
+	var nextSwap time.Time
+	sc := newScheduler(10*time.Second, func() { prefetches++ }, func() { swaps++ }, func(t time.Time) { nextSwap = t }, &jumps, nil)
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	wallOffset := time.Duration(0)
+	mono := time.Duration(0)
+	sc.mark(0, base)
+	step := func(to time.Duration) {
+		for mono < to {
+			mono += scheduleTick
+			sc.tick(mono, base.Add(mono+wallOffset))
+			sc.mark(mono, base.Add(mono+wallOffset))
+		}
+	}
+
+	step(10 * time.Second)
+	if prefetches != 1 || swaps != 1 || jumps != 0 {
+		t.Fatalf("first window: prefetches=%d swaps=%d jumps=%d", prefetches, swaps, jumps)
+	}
+
+	// An NTP step of the wall clock is counted but does not move the schedule
+	wallOffset = time.Hour
+	step(12 * time.Second)
+	if jumps != 1 || prefetches != 1 || swaps != 1 {
+		t.Fatalf("after wall jump: prefetches=%d swaps=%d jumps=%d", prefetches, swaps, jumps)
+	}
+	step(20 * time.Second)
+	if prefetches != 2 || swaps != 2 {
+		t.Fatalf("second window: prefetches=%d swaps=%d", prefetches, swaps)
+	}
+
+	// A 27s pause skips two boundaries: one prefetch and swap, not a burst
+	mono = 47 * time.Second
+	sc.tick(mono, base.Add(mono+wallOffset))
+	sc.mark(mono, base.Add(mono+wallOffset))
+	if jumps != 2 || prefetches != 3 || swaps != 3 {
+		t.Fatalf("after stall: prefetches=%d swaps=%d jumps=%d", prefetches, swaps, jumps)
+	}
+	if remaining := time.Until(nextSwap); remaining < 2*time.Second || remaining > 3*time.Second {
+		t.Errorf("Expected the next swap at the 50s boundary, %v away", remaining)
+	}
+
+	// The window resumed mid-way prefetches late rather than swapping in an empty cache
+	step(50 * time.Second)
+	if prefetches != 4 || swaps != 4 || jumps != 2 {
+		t.Errorf("window after stall: prefetches=%d swaps=%d jumps=%d", prefetches, swaps, jumps)
+	}
+}
+
+func TestScheduler_Stretch(t *testing.T) {
+	var prefetches, swaps int
+	var jumps int64
+	var nextSwap time.Time
+	factor := 1
+	sc := newScheduler(10*time.Second, func() { prefetches++ }, func() { swaps++ }, func(t time.Time) { nextSwap = t }, &jumps, func() int { return factor })
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mono := time.Duration(0)
+	sc.mark(0, base)
+	step := func(to time.Duration) {
+		for mono < to {
+			mono += scheduleTick
+			sc.tick(mono, base.Add(mono))
+			sc.mark(mono, base.Add(mono))
+		}
+	}
+
+	step(10 * time.Second)
+	if prefetches != 1 || swaps != 1 {
+		t.Fatalf("unstretched: prefetches=%d swaps=%d", prefetches, swaps)
+	}
+
+	// Stretched windows pass two boundaries without prefetching or swapping
+	factor = 3
+	step(20 * time.Second)
+	if prefetches != 1 || swaps != 1 {
+		t.Fatalf("stretched: prefetches=%d swaps=%d", prefetches, swaps)
+	}
+	if remaining := time.Until(nextSwap); remaining < 19*time.Second || remaining > 20*time.Second {
+		t.Errorf("Expected the next swap at the 40s boundary, %v away", remaining)
+	}
+	step(40 * time.Second)
+	if prefetches != 2 || swaps != 2 {
+		t.Fatalf("end of stretched window: prefetches=%d swaps=%d", prefetches, swaps)
+	}
+
+	factor = 1
+	step(50 * time.Second)
+	if prefetches != 3 || swaps != 3 {
+		t.Errorf("unstretched again: prefetches=%d swaps=%d", prefetches, swaps)
+	}
+}
+
+func TestProxyService_PrefetchPriority(t *testing.T) {
+	var calls int64
+	upstream := upstreamtest.New(t, upstreamtest.Block("9.9.9.9"), func(w http.ResponseWriter, r *http.Request) bool {
+		// Only the first chunk succeeds
+		if atomic.AddInt64(&calls, 1) > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		return true
+	})
+
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:   upstream.URL,
+		PrefetchChunkSize: 2,
+	}, nil, nil)
+	svc.current.Store(cacheOf(map[string]bool{"9.9.9.9": false, "2.2.2.2": true}))
+	batched := map[string]int{"1.1.1.1": 1, "2.2.2.2": 5, "3.3.3.3": 2, "9.9.9.9": 1}
+
+	keys := prefetchOrder(batched, svc.current.Load())
+	want := []string{"9.9.9.9", "2.2.2.2", "3.3.3.3", "1.1.1.1"}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("Expected blocked keys first, then by traffic: %v, got %v", want, keys)
+		}
+	}
+
+	svc.fetchPending(keys, func(cache *decisionCache) {
+		svc.pending = cache
+	})
+	if svc.pending.len() != 2 {
+		t.Fatalf("Expected the first chunk kept after the second failed, got %v", svc.pending.toMap())
+	}
+	if allow, ok := svc.pending.get("9.9.9.9"); !ok || allow {
+		t.Errorf("Expected the previously blocked key re-verified, got %v", svc.pending.toMap())
+	}
+	if _, ok := svc.pending.get("1.1.1.1"); ok {
+		t.Error("Keys from the failed chunk should be left to live checks")
+	}
+}
+
+func TestProxyService_ConcurrentPrefetchChunks(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, peak int
+	upstream := upstreamtest.New(t, upstreamtest.AllowAll, func(http.ResponseWriter, *http.Request) bool {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return true
+	})
+
+	svc := NewProxyService(&config.Config{
+		UpstreamBaseURL:     upstream.URL,
+		PrefetchChunkSize:   10,
+		PrefetchConcurrency: 3,
+	}, nil, nil)
+	keys := make([]string, 95)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.0.0.%d", i)
+	}
+	svc.fetchPending(keys, func(cache *decisionCache) {
+		svc.pending = cache
+	})
+
+	if svc.pending.len() != len(keys) {
+		t.Errorf("Expected every chunk merged into the pending cache, got %d keys", svc.pending.len())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if n := upstream.Calls(); n != 10 {
+		t.Errorf("Expected 10 chunk requests, got %d", n)
+	}
+	if peak > 3 {
+		t.Errorf("Expected at most 3 chunks in flight, got %d", peak)
+	}
+}
+
+func TestProxyService_DeltaPrefetch(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	var sinces []string
+	reset := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/api/allow/changes" {
+			since := r.URL.Query().Get("since")
+			sinces = append(sinces, since)
+			resp := models.ChangesResponse{Version: "v2", Reset: reset}
+			if since == "v1" && !reset {
+				resp.Changes = []models.BatchAllowResponseItem{
+					{Key: "6.6.6.6", Allow: false, Reason: "abuse_report"},
+					{Key: "7.7.7.7", Allow: false}, // Not tracked
+				}
+			} else if since == "" {
+				resp.Version = "v1"
+			}
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		var keys []string
+		json.NewDecoder(r.Body).Decode(&keys)
+		fetched = append(fetched, keys...)
+		var res []models.BatchAllowResponseItem
+		for _, k := range keys {
+			res = append(res, models.BatchAllowResponseItem{Key: k, Allow: true})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer upstream.Close()
+
+	svc := NewProxyService(&config.Config{UpstreamBaseURL: upstream.URL, PrefetchDelta: true}, nil, nil)
+
+	// Without a version every key is fetched, at the version read first
+	svc.fetchDelta([]string{"1.1.1.1", "6.6.6.6"})
+	svc.swapCache()
+	if svc.currentVersion != "v1" || len(fetched) != 2 {
+		t.Fatalf("Expected a full fetch at v1, got version %q, fetched %v", svc.currentVersion, fetched)
+	}
+
+	// Cached keys are refreshed from the feed; only new keys are fetched
+	fetched = nil
+	svc.fetchDelta([]string{"1.1.1.1", "6.6.6.6", "2.2.2.2"})
+	svc.swapCache()
+	if !reflect.DeepEqual(fetched, []string{"2.2.2.2"}) {
+		t.Errorf("Expected only the new key fetched, got %v", fetched)
+	}
+	want := map[string]bool{"1.1.1.1": true, "6.6.6.6": false, "2.2.2.2": true}
+	if got := svc.current.Load().toMap(); !reflect.DeepEqual(got, want) || svc.currentVersion != "v2" {
+		t.Errorf("Expected %v at v2, got %v at %q", want, got, svc.currentVersion)
+	}
+	if r := svc.reasons.get("6.6.6.6"); r != "abuse_report" {
+		t.Errorf("Expected the changed decision's reason to be kept, got %q", r)
+	}
+
+	// An expired version falls back to a full fetch
+	fetched, reset = nil, true
+	svc.fetchDelta([]string{"1.1.1.1", "2.2.2.2"})
+	if len(fetched) != 2 || svc.pendingVersion != "v2" {
+		t.Errorf("Expected a full fetch after a reset, got %v at %q", fetched, svc.pendingVersion)
+	}
+	if !reflect.DeepEqual(sinces, []string{"", "v1", "v2"}) {
+		t.Errorf("Unexpected change feed requests: %v", sinces)
+	}
+}
+
+func TestProxyService_LeaderElection(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		json.NewDecoder(r.Body).Decode(&keys)
+		mu.Lock()
+		fetched = append(fetched, keys...)
+		mu.Unlock()
+		var res []models.BatchAllowResponseItem
+		for _, k := range keys {
+			res = append(res, models.BatchAllowResponseItem{Key: k, Allow: k != "2.2.2.2", Reason: "abuse_report"})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer upstream.Close()
+
+	// Both instances share one storage, as they would a Redis
+	cfg := &config.Config{UpstreamBaseURL: upstream.URL, LeaderElection: true}
+	st := storage.NewMemory()
+	leader, follower := NewProxyService(cfg, nil, st), NewProxyService(cfg, nil, st)
+	leader.leader = newPrefetchLeader(cfg, st, time.Minute)
+	follower.leader = newPrefetchLeader(cfg, st, time.Minute)
+	if !leader.leader.elect() || follower.leader.elect() {
+		t.Fatal("Expected the first instance to win the lease")
+	}
+
+	// Without a leader cache yet, the follower prefetches on its own
+	follower.prefetchClustered(map[string]int{"2.2.2.2": 1})
+	time.Sleep(100 * time.Millisecond)
+	follower.swapCache()
+	if s := follower.leader.stats(); s.Local != 1 || s.Shared != 0 {
+		t.Errorf("Expected a local prefetch, got %+v", s)
+	}
+
+	// The leader fetches the follower's keys with its own and publishes the result
+	mu.Lock()
+	fetched = nil
+	mu.Unlock()
+	leader.prefetchClustered(map[string]int{"1.1.1.1": 1})
+	time.Sleep(100 * time.Millisecond)
+	leader.swapCache()
+	leader.publishLeaderCache()
+	mu.Lock()
+	slices.Sort(fetched)
+	if !reflect.DeepEqual(fetched, []string{"1.1.1.1", "2.2.2.2"}) {
+		t.Errorf("Expected the leader to fetch every instance's keys, got %v", fetched)
+	}
+	fetched = nil
+	mu.Unlock()
+
+	// The follower's next window is the leader's cache, without upstream calls
+	follower.prefetchClustered(map[string]int{"3.3.3.3": 1})
+	follower.swapCache()
+	want := map[string]bool{"1.1.1.1": true, "2.2.2.2": false}
+	if got := follower.current.Load().toMap(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the leader's cache %v, got %v", want, got)
+	}
+	if r := follower.reasons.get("2.2.2.2"); r != "abuse_report" {
+		t.Errorf("Expected the leader's block reason, got %q", r)
+	}
+	if len(fetched) != 0 || follower.leader.stats().Shared != 1 {
+		t.Errorf("Expected no upstream calls from the follower, got %v", fetched)
+	}
+}
@@ -0,0 +1,207 @@
+//go:build bbolt
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	openBolt = func(path string) (Storage, error) { return OpenBolt(path) }
+}
+
+// Bolt is an embedded single-file backend on bbolt, for one instance whose
+// state outgrows memory or must survive a machine crash: unlike File, entries
+// are read from disk and every change is committed (fsynced) before it
+// returns. Only one process can open the file at a time.
+type Bolt struct {
+	db *bolt.DB
+}
+
+var (
+	boltData = []byte("data")
+	boltMeta = []byte("meta")
+	// boltHeader holds the envelope Header of the file in the meta bucket.
+	boltHeader = []byte("header")
+)
+
+// OpenBolt opens path (created if missing), waiting up to a second for
+// another process to release it.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+		if data := meta.Get(boltHeader); data != nil {
+			var h Header
+			if err := json.Unmarshal(data, &h); err != nil {
+				return err
+			}
+			if err := h.Check(KindState); err != nil {
+				return err
+			}
+		} else {
+			line, _ := json.Marshal(NewHeader(KindState, ""))
+			if err := meta.Put(boltHeader, line); err != nil {
+				return err
+			}
+		}
+		_, err = tx.CreateBucketIfNotExists(boltData)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &Bolt{db: db}, nil
+}
+
+// Values are stored after their expiry: 8 bytes of Unix nanoseconds, 0 = never.
+func encodeBolt(value []byte, ttl time.Duration) []byte {
+	buf := make([]byte, 8+len(value))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(buf, uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	copy(buf[8:], value)
+	return buf
+}
+
+// decodeBolt splits a stored value; ok is false when it has expired. value
+// aliases bbolt's memory and is only valid within the transaction.
+func decodeBolt(data []byte, now time.Time) (value []byte, expires time.Time, ok bool) {
+	if len(data) < 8 {
+		return nil, time.Time{}, false
+	}
+	if ns := binary.BigEndian.Uint64(data); ns != 0 {
+		expires = time.Unix(0, int64(ns))
+		if !now.Before(expires) {
+			return nil, expires, false
+		}
+	}
+	return data[8:], expires, true
+}
+
+func (b *Bolt) Get(key string) ([]byte, bool, error) {
+	var out []byte
+	var ok bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var value []byte
+		value, _, ok = decodeBolt(tx.Bucket(boltData).Get([]byte(key)), time.Now())
+		out = bytes.Clone(value)
+		return nil
+	})
+	return out, ok, err
+}
+
+func (b *Bolt) Set(key string, value []byte, ttl time.Duration) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltData).Put([]byte(key), encodeBolt(value, ttl))
+	})
+}
+
+func (b *Bolt) Acquire(key, owner string, ttl time.Duration) (bool, error) {
+	acquired := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		if value, _, ok := decodeBolt(bucket.Get([]byte(key)), time.Now()); ok && string(value) != owner {
+			return nil
+		}
+		acquired = true
+		return bucket.Put([]byte(key), encodeBolt([]byte(owner), ttl))
+	})
+	return acquired, err
+}
+
+func (b *Bolt) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltData).Delete([]byte(key))
+	})
+}
+
+func (b *Bolt) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	return b.scan(prefix, func(e Entry) bool { return fn(e.Key, e.Value) })
+}
+
+// scan collects the live entries under prefix in key order, then calls fn
+// outside the transaction so it may call back into the store.
+func (b *Bolt) scan(prefix string, fn func(e Entry) bool) error {
+	now := time.Now()
+	var matched []Entry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltData).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			value, expires, ok := decodeBolt(v, now)
+			if !ok {
+				continue
+			}
+			matched = append(matched, Entry{Key: string(k), Value: bytes.Clone(value), TTLMs: remaining(expires, now).Milliseconds()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range matched {
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *Bolt) TTL(key string) (time.Duration, bool, error) {
+	now := time.Now()
+	var ttl time.Duration
+	var ok bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var expires time.Time
+		if _, expires, ok = decodeBolt(tx.Bucket(boltData).Get([]byte(key)), now); ok {
+			ttl = remaining(expires, now)
+		}
+		return nil
+	})
+	return ttl, ok, err
+}
+
+func (b *Bolt) Snapshot(w io.Writer) error {
+	return writeSnapshot(w, func(fn func(e Entry) bool) error { return b.scan("", fn) })
+}
+
+// Sweep deletes expired entries. Expired entries are never returned, but
+// their space is only reclaimed here.
+func (b *Bolt) Sweep() {
+	now := time.Now()
+	b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltData)
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if _, expires, ok := decodeBolt(v, now); !ok && !expires.IsZero() {
+				expired = append(expired, bytes.Clone(k))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// FormatVersion is the envelope version this build writes. Readers accept
+// every version up to it, so state persisted by older builds stays readable
+// after an upgrade, and refuse newer ones with ErrNewerFormat instead of
+// guessing at a layout they do not know.
+const FormatVersion = 1
+
+// envelopeMagic identifies an envelope header; its absence marks state
+// written before envelopes existed (version 0).
+const envelopeMagic = "APIGATE"
+
+// Kinds of persisted state.
+const (
+	KindState          = "state"           // File backend
+	KindWarmupSnapshot = "warmup_snapshot" // WARMUP_PERSIST cache snapshot
+	KindLogSpool       = "log_spool"       // LOG_SPILL_DIR and LOG_DLQ_DIR segments
+	KindLeaderCache    = "leader_cache"    // LEADER_ELECTION cache shared by the leader
+)
+
+var (
+	// ErrNewerFormat means the state was written by a newer proxy build.
+	ErrNewerFormat = errors.New("persisted by a newer proxy version")
+	// ErrChecksum means the payload does not match its header's checksum.
+	ErrChecksum = errors.New("persisted state fails its checksum")
+)
+
+// Header is the first line of every persisted value and file: a JSON object
+// followed by a newline, then the payload. Fields added in later versions
+// are ignored by older readers of the same major layout.
+type Header struct {
+	Magic     string    `json:"magic"`
+	Version   int       `json:"version"`
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"created_at"`
+	// Fingerprint of the identity key derivation (EMAIL_ENCRYPTION_*) the
+	// payload's keys were computed with; empty when it holds no identity keys
+	KeyDerivation string `json:"key_derivation,omitempty"`
+	// "sha256:<hex>" of the payload; empty for append-only files, whose
+	// records are validated one by one
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// NewHeader returns a header for the current format.
+func NewHeader(kind, keyDerivation string) Header {
+	return Header{Magic: envelopeMagic, Version: FormatVersion, Kind: kind, CreatedAt: time.Now().UTC(), KeyDerivation: keyDerivation}
+}
+
+// Check refuses headers this build cannot read: newer versions, and state
+// of another kind.
+func (h Header) Check(kind string) error {
+	if h.Version > FormatVersion {
+		return fmt.Errorf("%w: format %d, this build reads up to %d", ErrNewerFormat, h.Version, FormatVersion)
+	}
+	if h.Magic != "" && h.Kind != kind {
+		return fmt.Errorf("persisted state is %q, not %q", h.Kind, kind)
+	}
+	return nil
+}
+
+// Seal prefixes payload with a header carrying its checksum.
+func Seal(kind, keyDerivation string, payload []byte) []byte {
+	h := NewHeader(kind, keyDerivation)
+	h.Checksum = checksum(payload)
+	line, _ := json.Marshal(h)
+	return append(append(line, '\n'), payload...)
+}
+
+// Unseal splits data sealed as kind into its header and payload, verifying the
+// checksum. Data without a header is returned whole as version 0.
+func Unseal(data []byte, kind string) (Header, []byte, error) {
+	if !bytes.HasPrefix(data, []byte(`{"magic":`)) {
+		return Header{}, data, nil
+	}
+	line, payload, _ := bytes.Cut(data, []byte("\n"))
+	var h Header
+	if err := json.Unmarshal(line, &h); err != nil || h.Magic != envelopeMagic {
+		return Header{}, data, nil
+	}
+	if err := h.Check(kind); err != nil {
+		return h, nil, err
+	}
+	if h.Checksum != "" && h.Checksum != checksum(payload) {
+		return h, nil, ErrChecksum
+	}
+	return h, payload, nil
+}
+
+// WriteHeader starts an append-only file of kind.
+func WriteHeader(w io.Writer, kind, keyDerivation string) error {
+	line, _ := json.Marshal(NewHeader(kind, keyDerivation))
+	_, err := w.Write(append(line, '\n'))
+	return err
+}
+
+// ReadHeader consumes the header line of an append-only file of kind, if it
+// has one, leaving r at the first record. Files without a header are
+// version 0.
+func ReadHeader(r *bufio.Reader, kind string) (Header, error) {
+	prefix, _ := r.Peek(len(`{"magic":`))
+	if !bytes.Equal(prefix, []byte(`{"magic":`)) {
+		return Header{}, nil
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return Header{}, err
+	}
+	var h Header
+	if err := json.Unmarshal(line, &h); err != nil {
+		// Torn by a crash while the file was created; no records follow
+		return Header{}, nil
+	}
+	return h, h.Check(kind)
+}
+
+func checksum(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
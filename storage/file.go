@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// File is an embedded single-file backend for one instance that must keep its
+// state across restarts. Entries are served from memory; every change is
+// appended to the file as an NDJSON record, after an envelope Header, and the
+// file is rewritten with only the live entries when it is opened and whenever
+// superseded records outnumber live ones. Writes are not fsynced
+// individually, so a machine crash (unlike a process restart) can lose the
+// most recent changes.
+type File struct {
+	*Memory // Reads are served from here
+
+	path string
+
+	mu      sync.Mutex // Serializes appends and compaction
+	f       *os.File
+	w       *bufio.Writer
+	records int // Records in the file, live or superseded
+}
+
+type fileRecord struct {
+	Key     string `json:"k"`
+	Value   []byte `json:"v,omitempty"`
+	Expires int64  `json:"e,omitempty"` // Unix ms, 0 = never
+	Deleted bool   `json:"d,omitempty"`
+}
+
+// compactMin keeps small files from being rewritten on every few changes.
+const compactMin = 1024
+
+// OpenFile loads path (created if missing) and opens it for appending.
+func OpenFile(path string) (*File, error) {
+	s := &File{Memory: NewMemory(), path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *File) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if _, err := ReadHeader(br, KindState); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	dec := json.NewDecoder(br)
+	for {
+		var r fileRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			return nil
+		} else if err != nil {
+			// A torn final record from a crash; everything before it is intact
+			return nil
+		}
+		if r.Deleted {
+			delete(s.entries, r.Key)
+			continue
+		}
+		e := memoryEntry{value: r.Value}
+		if r.Expires > 0 {
+			e.expires = time.UnixMilli(r.Expires)
+		}
+		s.entries[r.Key] = e
+	}
+}
+
+func (s *File) Set(key string, value []byte, ttl time.Duration) error {
+	r := fileRecord{Key: key, Value: value}
+	if ttl > 0 {
+		r.Expires = time.Now().Add(ttl).UnixMilli()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(r); err != nil {
+		return err
+	}
+	return s.Memory.Set(key, value, ttl)
+}
+
+func (s *File) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok, _ := s.Memory.Get(key); !ok {
+		return s.Memory.Delete(key)
+	}
+	if err := s.append(fileRecord{Key: key, Deleted: true}); err != nil {
+		return err
+	}
+	return s.Memory.Delete(key)
+}
+
+// append writes one record; the caller holds s.mu.
+func (s *File) append(r fileRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	s.records++
+	if s.records > compactMin && s.records > 2*len(s.entries) {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+func (s *File) Snapshot(w io.Writer) error {
+	return s.Memory.Snapshot(w)
+}
+
+// Sweep drops expired entries from memory; the file sheds them at the next
+// compaction.
+func (s *File) Sweep() {
+	s.Memory.Sweep()
+}
+
+func (s *File) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked rewrites the file with the live entries and reopens it for
+// appending. The rename is atomic, so a crash leaves either file intact.
+func (s *File) compactLocked() error {
+	s.Memory.Sweep()
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = WriteHeader(w, KindState, "")
+	enc := json.NewEncoder(w)
+	n := 0
+	s.Memory.mu.RLock()
+	for k, e := range s.entries {
+		if err != nil {
+			break
+		}
+		r := fileRecord{Key: k, Value: e.value}
+		if !e.expires.IsZero() {
+			r.Expires = e.expires.UnixMilli()
+		}
+		if err = enc.Encode(r); err != nil {
+			break
+		}
+		n++
+	}
+	s.Memory.mu.RUnlock()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.w = bufio.NewWriter(s.f)
+	s.records = n
+	return nil
+}
+
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	return err
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is the default backend: a map in process memory, lost on restart
+// and private to each instance.
+type Memory struct {
+	mu      sync.RWMutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time // Zero = never
+}
+
+func (e memoryEntry) live(now time.Time) bool {
+	return e.expires.IsZero() || now.Before(e.expires)
+}
+
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]memoryEntry)}
+}
+
+func (m *Memory) Get(key string) ([]byte, bool, error) {
+	m.mu.RLock()
+	e, ok := m.entries[key]
+	m.mu.RUnlock()
+	if !ok || !e.live(time.Now()) {
+		return nil, false, nil
+	}
+	return e.value, true, nil
+}
+
+func (m *Memory) Set(key string, value []byte, ttl time.Duration) error {
+	e := memoryEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	m.mu.Lock()
+	m.entries[key] = e
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) Acquire(key, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[key]; ok && e.live(now) && string(e.value) != owner {
+		return false, nil
+	}
+	m.entries[key] = memoryEntry{value: []byte(owner), expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	return m.scan(prefix, func(e Entry) bool { return fn(e.Key, e.Value) })
+}
+
+func (m *Memory) scan(prefix string, fn func(e Entry) bool) error {
+	now := time.Now()
+	m.mu.RLock()
+	var matched []Entry
+	for k, e := range m.entries {
+		if strings.HasPrefix(k, prefix) && e.live(now) {
+			matched = append(matched, Entry{Key: k, Value: e.value, TTLMs: remaining(e.expires, now).Milliseconds()})
+		}
+	}
+	m.mu.RUnlock()
+	// fn runs unlocked so it may call back into the store
+	for _, e := range matched {
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *Memory) TTL(key string) (time.Duration, bool, error) {
+	now := time.Now()
+	m.mu.RLock()
+	e, ok := m.entries[key]
+	m.mu.RUnlock()
+	if !ok || !e.live(now) {
+		return 0, false, nil
+	}
+	return remaining(e.expires, now), true, nil
+}
+
+func (m *Memory) Snapshot(w io.Writer) error {
+	return writeSnapshot(w, func(fn func(e Entry) bool) error { return m.scan("", fn) })
+}
+
+// Sweep drops expired entries. Expired entries are never returned, but are
+// only reclaimed here.
+func (m *Memory) Sweep() {
+	now := time.Now()
+	m.mu.Lock()
+	for k, e := range m.entries {
+		if !e.live(now) {
+			delete(m.entries, k)
+		}
+	}
+	m.mu.Unlock()
+}
+
+func (m *Memory) Close() error { return nil }
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Prefixed is a view of a Storage with every key under prefix, used to give
+// tenants disjoint keyspaces on one backend. Closing it leaves the underlying
+// store open.
+type Prefixed struct {
+	Storage
+	prefix string
+}
+
+func WithPrefix(st Storage, prefix string) *Prefixed {
+	return &Prefixed{Storage: st, prefix: prefix}
+}
+
+func (p *Prefixed) Get(key string) ([]byte, bool, error) {
+	return p.Storage.Get(p.prefix + key)
+}
+
+func (p *Prefixed) Set(key string, value []byte, ttl time.Duration) error {
+	return p.Storage.Set(p.prefix+key, value, ttl)
+}
+
+func (p *Prefixed) Delete(key string) error {
+	return p.Storage.Delete(p.prefix + key)
+}
+
+// Acquire takes the lease in the prefix's keyspace; it fails when the
+// underlying store cannot hold leases.
+func (p *Prefixed) Acquire(key, owner string, ttl time.Duration) (bool, error) {
+	l, ok := p.Storage.(Locker)
+	if !ok {
+		return false, fmt.Errorf("storage backend cannot hold leases")
+	}
+	return l.Acquire(p.prefix+key, owner, ttl)
+}
+
+func (p *Prefixed) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	return p.Storage.Scan(p.prefix+prefix, func(key string, value []byte) bool {
+		return fn(strings.TrimPrefix(key, p.prefix), value)
+	})
+}
+
+func (p *Prefixed) TTL(key string) (time.Duration, bool, error) {
+	return p.Storage.TTL(p.prefix + key)
+}
+
+func (p *Prefixed) Snapshot(w io.Writer) error {
+	return writeSnapshot(w, func(fn func(e Entry) bool) error {
+		return p.Scan("", func(key string, value []byte) bool {
+			ttl, ok, err := p.TTL(key)
+			if err != nil || !ok {
+				return err == nil
+			}
+			return fn(Entry{Key: key, Value: value, TTLMs: ttl.Milliseconds()})
+		})
+	})
+}
+
+func (p *Prefixed) Close() error { return nil }
@@ -0,0 +1,343 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis stores entries in a Redis server, so several proxy instances can share
+// state. It speaks RESP2 over a single connection, redialled after any error;
+// commands are serialized on it.
+type Redis struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// errRedisNil is the RESP null reply (a missing key).
+var errRedisNil = errors.New("redis: nil")
+
+const redisTimeout = 5 * time.Second
+
+func NewRedis(addr, password string, db int, prefix string) *Redis {
+	return &Redis{addr: addr, password: password, db: db, prefix: prefix}
+}
+
+func (s *Redis) Get(key string) ([]byte, bool, error) {
+	v, err := s.do("GET", s.prefix+key)
+	if err == errRedisNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return v.([]byte), true, nil
+}
+
+func (s *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	args := []any{"SET", s.prefix + key, value}
+	if ttl > 0 {
+		// PX rounds down; never let a short TTL become "no expiry"
+		args = append(args, "PX", max(ttl.Milliseconds(), 1))
+	}
+	_, err := s.do(args...)
+	return err
+}
+
+// acquireScript renews the lease KEYS[1] if ARGV[1] holds it, or takes it
+// if it is free, atomically.
+const acquireScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0`
+
+func (s *Redis) Acquire(key, owner string, ttl time.Duration) (bool, error) {
+	v, err := s.do("EVAL", acquireScript, 1, s.prefix+key, owner, max(ttl.Milliseconds(), 1))
+	if err != nil {
+		return false, err
+	}
+	return v == int64(1), nil
+}
+
+func (s *Redis) Delete(key string) error {
+	_, err := s.do("DEL", s.prefix+key)
+	return err
+}
+
+func (s *Redis) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	return s.scan(prefix, func(key string) (bool, error) {
+		v, ok, err := s.Get(key)
+		if err != nil || !ok { // Deleted or expired since SCAN listed it
+			return err == nil, err
+		}
+		return fn(key, v), nil
+	})
+}
+
+// scan iterates the keys matching prefix with SCAN, passing them to fn without
+// s.prefix.
+func (s *Redis) scan(prefix string, fn func(key string) (bool, error)) error {
+	pattern := redisGlobEscape(s.prefix+prefix) + "*"
+	cursor := "0"
+	for {
+		v, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", 500)
+		if err != nil {
+			return err
+		}
+		reply, ok := v.([]any)
+		if !ok || len(reply) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		next, _ := reply[0].([]byte)
+		keys, _ := reply[1].([]any)
+		for _, k := range keys {
+			b, _ := k.([]byte)
+			more, err := fn(strings.TrimPrefix(string(b), s.prefix))
+			if err != nil || !more {
+				return err
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func (s *Redis) TTL(key string) (time.Duration, bool, error) {
+	v, err := s.do("PTTL", s.prefix+key)
+	if err != nil {
+		return 0, false, err
+	}
+	ms, _ := v.(int64)
+	switch {
+	case ms == -2:
+		return 0, false, nil
+	case ms == -1:
+		return 0, true, nil
+	default:
+		return time.Duration(ms) * time.Millisecond, true, nil
+	}
+}
+
+func (s *Redis) Snapshot(w io.Writer) error {
+	return writeSnapshot(w, func(fn func(e Entry) bool) error {
+		return s.scan("", func(key string) (bool, error) {
+			v, ok, err := s.Get(key)
+			if err != nil || !ok {
+				return err == nil, err
+			}
+			ttl, ok, err := s.TTL(key)
+			if err != nil || !ok {
+				return err == nil, err
+			}
+			return fn(Entry{Key: key, Value: v, TTLMs: ttl.Milliseconds()}), nil
+		})
+	})
+}
+
+func (s *Redis) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Subscribe listens on its own connection, since a subscribed connection
+// takes no other commands. The channel is not prefixed with the key prefix.
+func (s *Redis) Subscribe(done <-chan struct{}, channel string, fn func(msg []byte)) error {
+	sub := &Redis{addr: s.addr, password: s.password, db: s.db}
+	if err := sub.dial(); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// Closing the connection ends the blocked read below
+		select {
+		case <-done:
+		case <-stop:
+		}
+		sub.conn.Close()
+	}()
+	if _, err := sub.roundTrip([]any{"SUBSCRIBE", channel}); err != nil {
+		return err
+	}
+	// Messages arrive whenever they are published
+	sub.conn.SetDeadline(time.Time{})
+	for {
+		v, err := readRESP(sub.r)
+		if err != nil {
+			return err
+		}
+		// ["message", channel, payload]
+		if msg, ok := v.([]any); ok && len(msg) == 3 {
+			if kind, _ := msg[0].([]byte); string(kind) == "message" {
+				payload, _ := msg[2].([]byte)
+				fn(payload)
+			}
+		}
+	}
+}
+
+// do sends one command and reads its reply. Any I/O error drops the
+// connection so the next command redials.
+func (s *Redis) do(args ...any) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return nil, err
+		}
+	}
+	v, err := s.roundTrip(args)
+	var rerr redisError
+	if err != nil && err != errRedisNil && !errors.As(err, &rerr) {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return v, err
+}
+
+func (s *Redis) dial() error {
+	conn, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	if s.password != "" {
+		if _, err := s.roundTrip([]any{"AUTH", s.password}); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.roundTrip([]any{"SELECT", s.db}); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Redis) roundTrip(args []any) (any, error) {
+	s.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		var b []byte
+		switch v := a.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		case int:
+			b = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(nil, v, 10)
+		default:
+			return nil, fmt.Errorf("redis: unsupported argument type %T", a)
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(b)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, b...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRESP(s.r)
+}
+
+// redisError is an error reply from the server; the connection stays usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readRESP reads one RESP2 reply: simple strings and bulk strings as []byte,
+// integers as int64, arrays as []any, and null as errRedisNil.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		out := make([]any, n)
+		for i := range out {
+			v, err := readRESP(r)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// redisGlobEscape escapes the glob metacharacters of a SCAN MATCH pattern.
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+// Package storage is the persistence layer shared by the proxy's stateful
+// features. Every backend implements the same small key/value interface, so a
+// subsystem written against Storage runs unchanged in memory, on local disk or
+// against a shared Redis.
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Storage is a byte-oriented key/value store with optional per-key expiry.
+// Keys are namespaced by convention with a "subsystem/" prefix, e.g.
+// "idempotency/<key>", so subsystems can share one backend and Scan their own
+// entries. Implementations are safe for concurrent use.
+type Storage interface {
+	// Get returns the value stored under key; ok is false when the key is
+	// missing or expired.
+	Get(key string) (value []byte, ok bool, err error)
+	// Set stores value under key. A ttl <= 0 keeps it until deleted.
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+	// Scan calls fn for every live entry whose key starts with prefix, in no
+	// particular order, until fn returns false.
+	Scan(prefix string, fn func(key string, value []byte) bool) error
+	// TTL returns the remaining lifetime of key, 0 when it never expires;
+	// ok is false when the key is missing or expired.
+	TTL(key string) (ttl time.Duration, ok bool, err error)
+	// Snapshot writes every live entry to w as NDJSON Entry lines.
+	Snapshot(w io.Writer) error
+	// Close releases connections and files held by the backend.
+	Close() error
+}
+
+// Locker is implemented by backends that can hold leases, so instances
+// sharing the backend can agree on which of them does a job. Every backend in
+// this package implements it; with memory and file backends the lease is
+// only shared by services within one process.
+type Locker interface {
+	// Acquire takes the lease key for owner, or renews it if owner holds it
+	// already, for ttl. It reports false while another owner holds it.
+	Acquire(key, owner string, ttl time.Duration) (bool, error)
+}
+
+// Subscriber is implemented by backends that can deliver messages published
+// on a channel (Redis pub/sub).
+type Subscriber interface {
+	// Subscribe calls fn with every message published on channel until the
+	// subscription breaks or done is closed, and returns why.
+	Subscribe(done <-chan struct{}, channel string, fn func(msg []byte)) error
+}
+
+// Entry is one line of a Snapshot. TTLMs is the remaining lifetime when the
+// snapshot was taken (0 = no expiry).
+type Entry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	TTLMs int64  `json:"ttl_ms,omitempty"`
+}
+
+// Options selects and configures a backend.
+type Options struct {
+	Backend       string // "memory" (default), "file", "bbolt" or "redis"
+	Path          string // Data file for the file and bbolt backends
+	RedisAddr     string // host:port
+	RedisPassword string
+	RedisDB       int
+	RedisPrefix   string // Prepended to every key, so several deployments can share a Redis
+}
+
+// Open returns the backend described by opts.
+func Open(opts Options) (Storage, error) {
+	switch strings.ToLower(opts.Backend) {
+	case "", "memory":
+		return NewMemory(), nil
+	case "file":
+		if opts.Path == "" {
+			return nil, fmt.Errorf("storage backend file requires a path")
+		}
+		return OpenFile(opts.Path)
+	case "bbolt":
+		if openBolt == nil {
+			return nil, fmt.Errorf("storage backend bbolt is not in this build (build with -tags bbolt)")
+		}
+		if opts.Path == "" {
+			return nil, fmt.Errorf("storage backend bbolt requires a path")
+		}
+		return openBolt(opts.Path)
+	case "redis":
+		if opts.RedisAddr == "" {
+			return nil, fmt.Errorf("storage backend redis requires an address")
+		}
+		return NewRedis(opts.RedisAddr, opts.RedisPassword, opts.RedisDB, opts.RedisPrefix), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", opts.Backend)
+}
+
+// openBolt opens the bbolt backend; nil unless built with the bbolt tag.
+var openBolt func(path string) (Storage, error)
+
+// writeSnapshot encodes the entries produced by scan as NDJSON.
+func writeSnapshot(w io.Writer, scan func(fn func(e Entry) bool) error) error {
+	enc := json.NewEncoder(w)
+	var werr error
+	err := scan(func(e Entry) bool {
+		werr = enc.Encode(e)
+		return werr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// remaining converts an absolute expiry into a TTL (0 = no expiry).
+func remaining(expires, now time.Time) time.Duration {
+	if expires.IsZero() {
+		return 0
+	}
+	return expires.Sub(now)
+}
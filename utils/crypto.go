@@ -1,12 +1,18 @@
 package utils
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 
 	"math/big"
+	"strings"
 
 	"github.com/cespare/xxhash/v2"
 )
@@ -46,3 +52,117 @@ func CompressUserAgent(ua string) string {
 	// Return the first 11 characters which is sufficient entropy for this use case
 	return string(encoded[:11])
 }
+
+// KeyedUserAgentHash is CompressUserAgent keyed with key: an 11-character
+// base64url HMAC-SHA256 prefix, so UA keys cannot be matched against a
+// dictionary of known User-Agents without the key.
+func KeyedUserAgentHash(key []byte, ua string) string {
+	return base64.RawURLEncoding.EncodeToString(hmacSHA256(key, ua)[:8])
+}
+
+// CertFingerprint returns the lowercase hex SHA-256 fingerprint of a certificate.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeFingerprint canonicalizes a fingerprint supplied by a TLS terminator,
+// which may be upper-case and colon-separated (e.g. "AB:CD:...").
+func NormalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	fp = strings.ReplaceAll(fp, ":", "")
+	return strings.ToLower(fp)
+}
+
+// ReversiblePrefix marks values produced by EncryptReversible.
+const ReversiblePrefix = "aes-gcm:"
+
+// ErrInvalidCiphertext is returned when a value was not produced by
+// EncryptReversible under the given key.
+var ErrInvalidCiphertext = errors.New("invalid or foreign ciphertext")
+
+// EncryptReversible encrypts data with AES-256-GCM under a key derived from
+// key. The nonce is derived from the plaintext (an HMAC under a separate
+// derived key), so equal inputs encrypt to equal outputs and the result can
+// still serve as a cache and reputation key; the cost is that equality of
+// plaintexts is visible, exactly as with the one-way hash. The output is
+// ReversiblePrefix followed by base64url(nonce || ciphertext).
+func EncryptReversible(key []byte, data string) (string, error) {
+	aead, err := reversibleAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := hmacSHA256(deriveKey(key, "email-nonce"), data)[:aead.NonceSize()]
+	sealed := aead.Seal(nonce, nonce, []byte(data), nil)
+	return ReversiblePrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptReversible reverses EncryptReversible.
+func DecryptReversible(key []byte, value string) (string, error) {
+	aead, err := reversibleAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	encoded, ok := strings.CutPrefix(value, ReversiblePrefix)
+	if !ok {
+		return "", ErrInvalidCiphertext
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrInvalidCiphertext
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	return string(plain), nil
+}
+
+func reversibleAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(key, "email-encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives a 32-byte subkey of key for purpose, so one configured
+// secret never serves two roles.
+func deriveKey(key []byte, purpose string) []byte {
+	return hmacSHA256(key, "apigate/"+purpose)
+}
+
+// Purposes of the subkeys derived with DeriveSubkey.
+const (
+	SubkeyEmailHash = "email-hash" // Identity hashing and encryption
+	SubkeyUAHash    = "ua-hash"    // User-Agent keys
+	SubkeyLogHash   = "log-hash"   // Hashed log fields (LOG_REDACT)
+)
+
+// KeyIDSeparator ends the key-ID prefix of values made under a subkey, as in
+// "k1$3f1c...".
+const KeyIDSeparator = "$"
+
+// DeriveSubkey derives the 32-byte subkey of master for purpose with
+// HKDF-SHA256, so the master key never serves two roles and a leaked subkey
+// reveals nothing of the others.
+func DeriveSubkey(master []byte, purpose string) []byte {
+	// Cannot fail: 32 bytes is well within HKDF-SHA256's output limit
+	key, _ := hkdf.Key(sha256.New, master, nil, "apigate/"+purpose, 32)
+	return key
+}
+
+// WithKeyID prefixes v with the ID of the key it was made with.
+func WithKeyID(id, v string) string {
+	return id + KeyIDSeparator + v
+}
+
+// SplitKeyID splits a value made by WithKeyID into the key ID and the rest.
+// ok is false when v carries no key ID.
+func SplitKeyID(v string) (id, rest string, ok bool) {
+	id, rest, ok = strings.Cut(v, KeyIDSeparator)
+	if !ok || id == "" {
+		return "", v, false
+	}
+	return id, rest, true
+}
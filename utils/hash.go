@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Keyed hash algorithms for pseudonymization (EMAIL_ENCRYPTION_ALGO).
+const (
+	HashHMACSHA256    = "hmac-sha256"
+	HashHMACSHA512256 = "hmac-sha512-256"
+	HashBLAKE2b       = "blake2b"
+	HashSipHash       = "siphash"
+)
+
+// IsHashAlgorithm reports whether algo is a supported keyed hash.
+func IsHashAlgorithm(algo string) bool {
+	switch algo {
+	case HashHMACSHA256, HashHMACSHA512256, HashBLAKE2b, HashSipHash:
+		return true
+	}
+	return false
+}
+
+// Hash output encodings (EMAIL_ENCRYPTION_FORMAT).
+const (
+	HashFormatHex       = "hex"
+	HashFormatBase64URL = "base64url"
+	HashFormatNumeric   = "numeric"
+)
+
+// IsHashFormat reports whether format is a supported hash encoding.
+func IsHashFormat(format string) bool {
+	switch format {
+	case HashFormatHex, HashFormatBase64URL, HashFormatNumeric:
+		return true
+	}
+	return false
+}
+
+// EncodeHash encodes a digest in format, cut to length characters. A length
+// of 0 keeps the first 16 bytes: 32 hex or 22 base64url characters, or the
+// decimal integer they make. Numeric output with a length is the digest
+// modulo 10^length, zero-padded to exactly length digits. The output never
+// exceeds what the digest holds, e.g. 64 hex characters for 32 bytes.
+func EncodeHash(sum []byte, format string, length int) string {
+	if length <= 0 {
+		sum = sum[:min(len(sum), 16)]
+	}
+	var out string
+	switch format {
+	case HashFormatNumeric:
+		n := new(big.Int).SetBytes(sum)
+		if length <= 0 {
+			return n.String()
+		}
+		// Digits of the largest value the digest can hold
+		digits := len(new(big.Int).Lsh(big.NewInt(1), uint(8*len(sum))).String())
+		length = min(length, digits)
+		n.Mod(n, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil))
+		out = n.String()
+		return strings.Repeat("0", length-len(out)) + out
+	case HashFormatBase64URL:
+		out = base64.RawURLEncoding.EncodeToString(sum)
+	default:
+		out = hex.EncodeToString(sum)
+	}
+	if length > 0 && length < len(out) {
+		out = out[:length]
+	}
+	return out
+}
+
+// SipHashKeySize is the key length SipHash takes.
+const SipHashKeySize = 16
+
+// CheckHashKey reports why key cannot key algo: SipHash takes exactly 16
+// bytes and BLAKE2b at most 64. Keys are used as given, never stretched or
+// cut to fit, so hashes match other implementations of the algorithm.
+func CheckHashKey(algo string, key []byte) error {
+	switch algo {
+	case HashBLAKE2b:
+		if len(key) > blake2b.Size {
+			return fmt.Errorf("blake2b takes keys of up to %d bytes, got %d", blake2b.Size, len(key))
+		}
+	case HashSipHash:
+		if len(key) != SipHashKeySize {
+			return fmt.Errorf("siphash takes %d-byte keys, got %d", SipHashKeySize, len(key))
+		}
+	}
+	return nil
+}
+
+// KeyedHash computes the keyed hash of data with algo:
+//   - hmac-sha256, hmac-sha512-256: HMAC over the respective digest
+//   - blake2b: BLAKE2b-256 in keyed (MAC) mode, with a key of up to 64 bytes
+//   - siphash: SipHash-2-4 (64-bit, little-endian as in the reference) with a 16-byte key
+//
+// Keys not fitting the algorithm are an error (see CheckHashKey).
+func KeyedHash(algo string, key []byte, data string) ([]byte, error) {
+	if err := CheckHashKey(algo, key); err != nil {
+		return nil, err
+	}
+	switch algo {
+	case HashHMACSHA256:
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil), nil
+	case HashHMACSHA512256:
+		h := hmac.New(sha512.New512_256, key)
+		h.Write([]byte(data))
+		return h.Sum(nil), nil
+	case HashBLAKE2b:
+		h, err := blake2b.New256(key)
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte(data))
+		return h.Sum(nil), nil
+	case HashSipHash:
+		sum := sipHash24(binary.LittleEndian.Uint64(key[0:8]), binary.LittleEndian.Uint64(key[8:16]), []byte(data))
+		return binary.LittleEndian.AppendUint64(nil, sum), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", algo)
+}
+
+// OneWayKeyedHashAlgo is OneWayKeyedHash for a selectable algorithm, encoded
+// with EncodeHash. The output is prefixed with the algorithm name, e.g.
+// "blake2b:3f1c...", so hashes from different algorithms never collide and
+// consumers can tell them apart.
+func OneWayKeyedHashAlgo(algo string, key []byte, data, format string, length int) (string, error) {
+	sum, err := KeyedHash(algo, key, data)
+	if err != nil {
+		return "", err
+	}
+	return algo + ":" + EncodeHash(sum, format, length), nil
+}
+
+// sipHash24 implements SipHash-2-4 with a 64-bit output.
+func sipHash24(k0, k1 uint64, msg []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(msg)
+	for len(msg) >= 8 {
+		m := binary.LittleEndian.Uint64(msg)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		msg = msg[8:]
+	}
+
+	// Final block: remaining bytes plus the message length in the top byte
+	var last [8]byte
+	copy(last[:], msg)
+	b := binary.LittleEndian.Uint64(last[:]) | uint64(n)<<56
+	v3 ^= b
+	round()
+	round()
+	v0 ^= b
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
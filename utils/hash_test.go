@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func seq(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestKeyedHash_KnownAnswers(t *testing.T) {
+	cases := []struct {
+		algo string
+		key  []byte
+		data string
+		want string
+	}{
+		// The widely published HMAC examples (key "key" over the pangram)
+		{HashHMACSHA256, []byte("key"), "The quick brown fox jumps over the lazy dog", "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{HashHMACSHA512256, []byte("key"), "The quick brown fox jumps over the lazy dog", "7fb65e03577da9151a1016e9c2e514d4d48842857f13927f348588173dca6d89"},
+		// Keyed BLAKE2b-256; keys up to 64 bytes are used as given
+		{HashBLAKE2b, seq(16), "", "037c7d740ea795902b5aebe210fafffff1f627f74010f8dc79c0d5b8a9fb5847"},
+		{HashBLAKE2b, seq(64), "abc", "dff38c978666dff5631db35ca15535520d134f5c8060ea569c6a178ad393719f"},
+		// SipHash-2-4 reference vectors (key 00..0f, message 00..n-1)
+		{HashSipHash, seq(16), "", "310e0edd47db6f72"},
+		{HashSipHash, seq(16), string(seq(15)), "e545be4961ca29a1"},
+	}
+	for _, c := range cases {
+		sum, err := KeyedHash(c.algo, c.key, c.data)
+		if err != nil {
+			t.Errorf("%s: %v", c.algo, err)
+			continue
+		}
+		if got := hex.EncodeToString(sum); got != c.want {
+			t.Errorf("%s with a %d-byte key over %q: got %s, want %s", c.algo, len(c.key), c.data, got, c.want)
+		}
+	}
+}
+
+func TestKeyedHash_KeySizes(t *testing.T) {
+	for _, c := range []struct {
+		algo string
+		size int
+		ok   bool
+	}{
+		{HashSipHash, 16, true},
+		{HashSipHash, 15, false},
+		{HashSipHash, 32, false},
+		{HashBLAKE2b, 0, true},
+		{HashBLAKE2b, 64, true},
+		{HashBLAKE2b, 65, false},
+		{HashHMACSHA256, 200, true},
+	} {
+		_, err := KeyedHash(c.algo, seq(c.size), "alice@example.com")
+		if (err == nil) != c.ok {
+			t.Errorf("%s with a %d-byte key: got error %v", c.algo, c.size, err)
+		}
+	}
+}
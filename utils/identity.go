@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// Identity types for the AllowRequest/LogRequest "email" field, which carries
+// either an email address or an opaque user ID.
+const (
+	IdentityEmail  = "email"
+	IdentityUserID = "user_id"
+)
+
+// ClassifyIdentity normalizes an identifier according to its type. declared may
+// be IdentityEmail, IdentityUserID or empty to auto-detect. Emails are trimmed
+// and lowercased; user IDs are only trimmed, since they are frequently
+// case-sensitive.
+func ClassifyIdentity(value, declared string) (string, string) {
+	value = strings.TrimSpace(value)
+	kind := declared
+	if kind != IdentityEmail && kind != IdentityUserID {
+		kind = IdentityUserID
+		if IsEmail(value) {
+			kind = IdentityEmail
+		}
+	}
+	if kind == IdentityEmail {
+		value = strings.ToLower(value)
+	}
+	return value, kind
+}
+
+// IsEmail reports whether v is a bare addr-spec such as "user@example.com".
+func IsEmail(v string) bool {
+	if !strings.Contains(v, "@") {
+		return false
+	}
+	addr, err := mail.ParseAddress(v)
+	return err == nil && addr.Address == v
+}
@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// NormalizeIP returns the canonical form of an IP address (RFC 5952 for IPv6:
+// lowercase, zeros compressed), so one address written several ways yields one
+// key. Zone IDs such as "%eth0" are dropped and IPv4-mapped IPv6 addresses
+// become plain IPv4. It reports false for anything that is not an address.
+func NormalizeIP(v string) (string, bool) {
+	ip, err := netip.ParseAddr(strings.TrimSpace(v))
+	if err != nil {
+		return "", false
+	}
+	return ip.WithZone("").Unmap().String(), true
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// JA3 builds the JA3 string for a ClientHello and returns it with its MD5 hash.
+// Format: SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+// GREASE values (RFC 8701) are skipped as they are randomized per connection.
+func JA3(hello *tls.ClientHelloInfo) (string, string) {
+	// Go only exposes the negotiated version list; TLS 1.3 clients always send
+	// a legacy version of TLS 1.2 (771) in the record, so clamp to that.
+	version := uint16(0)
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, c := range hello.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+
+	raw := strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinUint16(hello.CipherSuites),
+		joinUint16(hello.Extensions),
+		joinUint16(curves),
+		joinUint16(points),
+	}, ",")
+
+	sum := md5.Sum([]byte(raw))
+	return raw, hex.EncodeToString(sum[:])
+}
+
+func joinUint16(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+// isGREASE reports whether v is one of the reserved 0x?A?A GREASE values.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestJA3_KnownVectors(t *testing.T) {
+	cases := []struct {
+		name  string
+		hello *tls.ClientHelloInfo
+		raw   string
+		hash  string
+	}{
+		// The example from the JA3 README; lists keep the client's order
+		{"reference", &tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS10},
+			CipherSuites:      []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+			Extensions:        []uint16{0, 10, 11},
+			SupportedCurves:   []tls.CurveID{23, 24, 25},
+			SupportedPoints:   []uint8{0},
+		}, "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0", "ada70206e40642a3e4461f35503241d5"},
+
+		// A TLS 1.3 client with GREASE in every list: GREASE is dropped and
+		// the version is the legacy TLS 1.2
+		{"GREASE", &tls.ClientHelloInfo{
+			SupportedVersions: []uint16{0x0a0a, tls.VersionTLS13, tls.VersionTLS12},
+			CipherSuites:      []uint16{0x1a1a, 4865, 4866, 49195},
+			Extensions:        []uint16{0x2a2a, 0, 23, 65281, 10, 11, 0xfafa},
+			SupportedCurves:   []tls.CurveID{0x3a3a, 29, 23, 24},
+			SupportedPoints:   []uint8{0},
+		}, "771,4865-4866-49195,0-23-65281-10-11,29-23-24,0", "d513a2c384da97e772fef72dfe6d8276"},
+
+		// Fields stay in place when empty
+		{"empty lists", &tls.ClientHelloInfo{
+			SupportedVersions: []uint16{tls.VersionTLS12},
+			CipherSuites:      []uint16{49195},
+		}, "771,49195,,,", "8f7412333aecdf6564c6f68c36da511d"},
+	}
+	for _, c := range cases {
+		raw, hash := JA3(c.hello)
+		if raw != c.raw {
+			t.Errorf("%s: got %q, want %q", c.name, raw, c.raw)
+		}
+		if hash != c.hash {
+			t.Errorf("%s: got hash %s, want %s", c.name, hash, c.hash)
+		}
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for v := 0x0a0a; v <= 0xfafa; v += 0x1010 {
+		if !isGREASE(uint16(v)) {
+			t.Errorf("Expected %#04x to be GREASE", v)
+		}
+	}
+	for _, v := range []uint16{0x0a0b, 0x0a1a, 0x1a0a, 0x0000, 0xff01, 4865} {
+		if isGREASE(v) {
+			t.Errorf("Expected %#04x not to be GREASE", v)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// fingerprintHeaders are the headers whose presence (and, for a few, value shape)
+// distinguishes real browsers from scripted clients that only fake the User-Agent.
+var fingerprintHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Cache-Control",
+	"Connection",
+	"Dnt",
+	"Pragma",
+	"Sec-Ch-Ua",
+	"Sec-Ch-Ua-Mobile",
+	"Sec-Ch-Ua-Platform",
+	"Sec-Fetch-Dest",
+	"Sec-Fetch-Mode",
+	"Sec-Fetch-Site",
+	"Sec-Fetch-User",
+	"Te",
+	"Upgrade-Insecure-Requests",
+}
+
+// RequestFingerprint derives a compact identifier from the shape of an HTTP
+// request: protocol, which well-known headers are present, the header count and
+// the Accept-Language / Accept-Encoding patterns (without q-values).
+// net/http does not preserve header order, so only presence and shape are used.
+// The result is hashed the same way as CompressUserAgent.
+func RequestFingerprint(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Proto)
+	b.WriteByte('|')
+	for _, h := range fingerprintHeaders {
+		if _, ok := r.Header[h]; ok {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(len(r.Header)))
+	b.WriteByte('|')
+	b.WriteString(headerPattern(r.Header.Get("Accept-Language")))
+	b.WriteByte('|')
+	b.WriteString(headerPattern(r.Header.Get("Accept-Encoding")))
+
+	return CompressUserAgent(b.String())
+}
+
+// headerPattern lowercases a comma-separated header value and strips parameters
+// such as q-values, e.g. "en-US,en;q=0.9" -> "en-us,en".
+func headerPattern(v string) string {
+	parts := strings.Split(v, ",")
+	for i, p := range parts {
+		p, _, _ = strings.Cut(p, ";")
+		parts[i] = strings.ToLower(strings.TrimSpace(p))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func browserRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Proto = "HTTP/2.0"
+	r.Header.Set("Accept", "text/html,application/xhtml+xml")
+	r.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	r.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	r.Header.Set("Sec-Ch-Ua", `"Chromium";v="124"`)
+	r.Header.Set("Sec-Fetch-Mode", "navigate")
+	r.Header.Set("Upgrade-Insecure-Requests", "1")
+	r.Header.Set("User-Agent", "Mozilla/5.0 Chrome/124.0")
+	return r
+}
+
+func TestRequestFingerprint_Shape(t *testing.T) {
+	base := RequestFingerprint(browserRequest())
+	if len(base) != 11 {
+		t.Fatalf("Expected an 11-character hash like CompressUserAgent, got %q", base)
+	}
+
+	// Header values outside the patterns do not matter, nor do q-values and case
+	same := browserRequest()
+	same.Header.Set("User-Agent", "Mozilla/5.0 Chrome/125.0")
+	same.Header.Set("Accept", "*/*")
+	same.Header.Set("Accept-Language", "EN-US, en;q=0.5")
+	if got := RequestFingerprint(same); got != base {
+		t.Errorf("Expected the same shape to fingerprint alike, got %q and %q", got, base)
+	}
+
+	for name, change := range map[string]func(r *http.Request){
+		"a library faking the UA": func(r *http.Request) {
+			r.Header.Del("Sec-Ch-Ua")
+			r.Header.Del("Sec-Fetch-Mode")
+			r.Header.Del("Upgrade-Insecure-Requests")
+		},
+		"another protocol":         func(r *http.Request) { r.Proto = "HTTP/1.1" },
+		"another header count":     func(r *http.Request) { r.Header.Set("X-Extra", "1") },
+		"other languages":          func(r *http.Request) { r.Header.Set("Accept-Language", "de-DE,de;q=0.9") },
+		"other encodings":          func(r *http.Request) { r.Header.Set("Accept-Encoding", "gzip") },
+		"a missing known header":   func(r *http.Request) { r.Header.Del("Accept") },
+		"an extra known header":    func(r *http.Request) { r.Header.Set("Dnt", "1") },
+		"an empty Accept-Language": func(r *http.Request) { r.Header.Del("Accept-Language") },
+	} {
+		r := browserRequest()
+		change(r)
+		if RequestFingerprint(r) == base {
+			t.Errorf("Expected %s to change the fingerprint", name)
+		}
+	}
+}
+
+func TestHeaderPattern(t *testing.T) {
+	for in, want := range map[string]string{
+		"en-US,en;q=0.9":      "en-us,en",
+		"gzip, deflate;q=1.0": "gzip,deflate",
+		"":                    "",
+	} {
+		if got := headerPattern(in); got != want {
+			t.Errorf("headerPattern(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
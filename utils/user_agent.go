@@ -0,0 +1,85 @@
+package utils
+
+import "strings"
+
+// User-Agent classes returned by ClassifyUserAgent.
+const (
+	UAClassBrowser  = "browser"  // A mainstream browser
+	UAClassBot      = "bot"      // A self-declared crawler or bot
+	UAClassHeadless = "headless" // An automated browser, e.g. headless Chrome
+	UAClassLibrary  = "library"  // An HTTP client library or command-line tool
+	UAClassUnknown  = "unknown"  // Anything else
+)
+
+// headlessClients are substrings of the User-Agent of automated browsers.
+var headlessClients = []string{"headlesschrome", "phantomjs", "slimerjs"}
+
+// botClients are crawlers that do not name themselves "...bot".
+var botClients = []string{"baiduspider", "facebookexternalhit", "bytespider", "ia_archiver"}
+
+// libraryClients are the product names of HTTP client libraries and tools.
+var libraryClients = []string{
+	"curl", "wget", "httpie", "python-requests", "python-urllib", "python-httpx",
+	"aiohttp", "go-http-client", "okhttp", "apache-httpclient", "java", "node-fetch",
+	"axios", "undici", "node", "libwww-perl", "ruby", "php", "guzzlehttp",
+	"postmanruntime", "insomnia", "powershell", "scrapy", "reqwest", "dart",
+}
+
+// browserClients maps the product tokens of browsers to their names, most
+// specific first: Edge and Opera also claim to be Chrome and Safari.
+var browserClients = []struct{ token, name string }{
+	{"edg/", "edge"},
+	{"opr/", "opera"},
+	{"firefox/", "firefox"},
+	{"chrome/", "chrome"},
+	{"crios/", "chrome"},
+	{"safari/", "safari"},
+}
+
+// ClassifyUserAgent returns the class of a User-Agent (UAClassBrowser,
+// UAClassBot, UAClassHeadless, UAClassLibrary or UAClassUnknown) and the
+// lowercase name of the client, e.g. "curl", "googlebot" or
+// "headlesschrome". An empty User-Agent yields empty strings. The
+// classification reads what the client claims, so it identifies honest
+// automation only.
+func ClassifyUserAgent(ua string) (string, string) {
+	ua = strings.ToLower(strings.TrimSpace(ua))
+	if ua == "" {
+		return "", ""
+	}
+	for _, name := range headlessClients {
+		if strings.Contains(ua, name) {
+			return UAClassHeadless, name
+		}
+	}
+	for _, name := range botClients {
+		if strings.Contains(ua, name) {
+			return UAClassBot, name
+		}
+	}
+	for _, token := range strings.FieldsFunc(ua, isUASeparator) {
+		name, _, _ := strings.Cut(token, "/")
+		if strings.Contains(name, "bot") || strings.Contains(name, "crawler") || strings.Contains(name, "spider") {
+			return UAClassBot, name
+		}
+	}
+
+	product, _, _ := strings.Cut(strings.Fields(ua)[0], "/")
+	for _, name := range libraryClients {
+		if product == name {
+			return UAClassLibrary, name
+		}
+	}
+	if product == "mozilla" || product == "opera" {
+		for _, b := range browserClients {
+			if strings.Contains(ua, b.token) {
+				return UAClassBrowser, b.name
+			}
+		}
+	}
+	return UAClassUnknown, product
+}
+
+func isUASeparator(r rune) bool {
+	return r == ' ' || r == ';' || r == '(' || r == ')' || r == ','
+}